@@ -19,4 +19,5 @@ type Partition struct {
 	Activity   string `json:"activity"`
 	Roothash   string `json:"roothash,omitempty"`
 	Usrhash    string `json:"usrhash,omitempty"`
+	SplitPath  string `json:"split_path,omitempty"`
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// loadCertificate reads a PEM or DER encoded X.509 certificate.
+func loadCertificate(path string) (*x509.Certificate, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%s: expected PEM block of type CERTIFICATE, got %s", path, block.Type)
+		}
+		raw = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing certificate: %w", path, err)
+	}
+	return cert, nil
+}
+
+// loadSigner reads a PEM encoded PKCS #8, PKCS #1 or SEC 1 private key.
+func loadSigner(path string) (crypto.Signer, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block type %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing private key: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return signer, nil
+}
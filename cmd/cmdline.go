@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/cmdline"
+	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+var (
+	addonPattern string
+	profile      string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdlineShowCmd, cmdlineSetCmd} {
+		cmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+		cmd.Flags().StringVarP(&ukiPath, "uki-path", "u", "", "path to the uki binary inside the EFI partition (defaults to all discovered UKIs)")
+		cmd.Flags().StringVar(&ukiPattern, "uki", "", "glob selecting the discovered UKIs (matched against the file name, or the full path if it contains a slash)")
+		cmd.Flags().StringVar(&profile, "profile", "", "index or ID of the profile of multi-profile UKIs (defaults to all profiles for show and the base for set)")
+		cmdlineCmd.AddCommand(cmd)
+	}
+	cmdlineSetCmd.Flags().StringVar(&addonPattern, "addon", "", "glob selecting the addons of the UKIs to edit instead of the UKIs")
+	rootCmd.AddCommand(cmdlineCmd)
+}
+
+var cmdlineCmd = &cobra.Command{
+	Use:   "cmdline",
+	Short: "Show and edit the kernel cmdline of UKIs and their addons",
+}
+
+var cmdlineShowCmd = &cobra.Command{
+	Use:   "show [image]",
+	Short: "Show the cmdline of every UKI, its addons and the effective cmdline",
+	Long: `Shows the .cmdline section of every UKI and of the systemd-stub addons applying to it
+(/loader/addons and <uki>.efi.extra.d), followed by the effective cmdline the stub passes to the kernel.
+Multi-profile UKIs show the cmdline of each profile.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image, err := ddi.NewReadOnly(args[0], int64(blocksize), ukiPath)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		ukis, err := image.SelectUKIs(ukiPattern)
+		if err != nil {
+			return err
+		}
+		out := cmd.OutOrStdout()
+		for _, u := range ukis {
+			profiles, err := image.UKIProfiles(u)
+			if err != nil {
+				return err
+			}
+			multiProfile := len(profiles) > 1 || profile != ""
+			if profile != "" {
+				selected, err := uki.FindProfile(profiles, profile)
+				if err != nil {
+					return fmt.Errorf("%s: %w", u, err)
+				}
+				profiles = []uki.Profile{selected}
+			}
+			for _, p := range profiles {
+				c, err := image.ProfileCmdline(u, p)
+				if err != nil {
+					return err
+				}
+				content, err := trimmedCmdline(c)
+				if err != nil {
+					return err
+				}
+				if multiProfile {
+					fmt.Fprintf(out, "%s profile %s: %s\n", u, p, content)
+				} else {
+					fmt.Fprintf(out, "%s: %s\n", u, content)
+				}
+			}
+			addons, err := image.Addons(u)
+			if err != nil {
+				return err
+			}
+			for _, addon := range addons {
+				content, err := cmdlineString(image, addon)
+				if err != nil {
+					content = "(no cmdline)"
+				}
+				fmt.Fprintf(out, "  addon %s: %s\n", addon, content)
+			}
+			for _, p := range profiles {
+				effective, err := image.EffectiveCmdline(u, p)
+				if err != nil {
+					return err
+				}
+				if multiProfile {
+					fmt.Fprintf(out, "  effective for profile %s: %s\n", p, effective)
+				} else {
+					fmt.Fprintf(out, "  effective: %s\n", effective)
+				}
+			}
+		}
+		return nil
+	},
+}
+
+var cmdlineSetCmd = &cobra.Command{
+	Use:   "set [image] [key=value]...",
+	Short: "Set options in the cmdline of UKIs or addons",
+	Long: `Sets options in the .cmdline section of every selected UKI, or with --addon of the selected addons of these UKIs.
+Existing options are replaced in place if the new value fits, otherwise they are moved to the end.
+With --profile, the cmdline of the profile of multi-profile UKIs is edited instead of the base.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image, err := ddi.New(args[0], int64(blocksize), ukiPath)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		targets, err := image.SelectUKIs(ukiPattern)
+		if err != nil {
+			return err
+		}
+		if addonPattern != "" && profile != "" {
+			return fmt.Errorf("--profile cannot be used with --addon")
+		}
+		if addonPattern != "" {
+			var addons []ddi.UKI
+			seen := make(map[ddi.UKI]bool)
+			for _, u := range targets {
+				selected, err := image.SelectAddons(u, addonPattern)
+				if err != nil {
+					return err
+				}
+				for _, addon := range selected {
+					if !seen[addon] {
+						seen[addon] = true
+						addons = append(addons, addon)
+					}
+				}
+			}
+			targets = addons
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("no UKIs or addons selected")
+		}
+		for _, target := range targets {
+			c, err := targetCmdline(image, target)
+			if err != nil {
+				return err
+			}
+			for _, option := range args[1:] {
+				key, value, _ := strings.Cut(option, "=")
+				if err := c.SetOption(key, value); err != nil {
+					return fmt.Errorf("setting %s in %s: %w", key, target, err)
+				}
+			}
+			content, err := trimmedCmdline(c)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", target, content)
+		}
+		return nil
+	},
+}
+
+// targetCmdline returns the cmdline of the UKI or addon to edit: the cmdline of the profile
+// selected with --profile, or the base cmdline.
+func targetCmdline(image *ddi.Image, u ddi.UKI) (*cmdline.Cmdline, error) {
+	if profile == "" {
+		return image.UKICmdline(u)
+	}
+	profiles, err := image.UKIProfiles(u)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := uki.FindProfile(profiles, profile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	return image.ProfileCmdline(u, selected)
+}
+
+func cmdlineString(image *ddi.Image, u ddi.UKI) (string, error) {
+	c, err := image.UKICmdline(u)
+	if err != nil {
+		return "", err
+	}
+	return trimmedCmdline(c)
+}
+
+func trimmedCmdline(c *cmdline.Cmdline) (string, error) {
+	content, err := c.String()
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(content, " \x00"), nil
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/disk"
+	"github.com/spf13/cobra"
+)
+
+var (
+	convertFormat string
+	seekableZstd  bool
+)
+
+func init() {
+	convertCmd.Flags().StringVarP(&convertFormat, "format", "f", "", "format of the destination: "+strings.Join(disk.Formats, ", ")+" (defaults to the file extension, or raw)")
+	convertCmd.Flags().BoolVar(&seekableZstd, "seekable-zstd", false, "write the seekable zstd format, which read-only commands can access without decompressing the whole image (same as --format seekable-zstd)")
+	convertCmd.MarkFlagsMutuallyExclusive("format", "seekable-zstd")
+	rootCmd.AddCommand(convertCmd)
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert [image] [destination]",
+	Short: "Convert a ddi into another image format",
+	Long: `Copies a ddi (raw, qcow2, VHD, VHDX or compressed) into a new image of another format.
+vhd creates a fixed VHD as required by Azure, vhd-dynamic a dynamic VHD and vhdx a dynamic VHDX with 32 MiB blocks.
+VHD and VHDX images are padded to a multiple of 1 MiB. Zero-filled regions are not allocated in the destination.
+zstd, xz and gzip write a compressed raw image. seekable-zstd writes independent zstd frames of 1 MiB
+with a seek table, so that inspect, verify and the other read-only commands only decompress the frames they need.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format := convertFormat
+		if seekableZstd {
+			format = disk.FormatSeekableZstd
+		}
+		if format == "" {
+			format = disk.FormatFromPath(args[1])
+		}
+		src, err := disk.OpenReadOnly(args[0])
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		size, err := disk.Export(cmd.Context(), args[1], format, src)
+		if err != nil {
+			return fmt.Errorf("converting to %s: %w", format, err)
+		}
+		if size != src.Size() {
+			fmt.Fprintf(cmd.ErrOrStderr(), "padded the disk from %d to %d bytes for %s\n", src.Size(), size, format)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/fat"
+	"github.com/spf13/cobra"
+)
+
+var (
+	mkdirParents bool
+	rmRecursive  bool
+	repairESP    bool
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{espLsCmd, espCatCmd, espPutCmd, espRmCmd, espMkdirCmd, espCheckCmd} {
+		cmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+		espCmd.AddCommand(cmd)
+	}
+	espMkdirCmd.Flags().BoolVarP(&mkdirParents, "parents", "p", false, "create missing parent directories")
+	espRmCmd.Flags().BoolVarP(&rmRecursive, "recursive", "r", false, "remove directories and their content")
+	espCheckCmd.Flags().BoolVar(&repairESP, "repair", false, "repair simple problems")
+	rootCmd.AddCommand(espCmd)
+}
+
+var espCmd = &cobra.Command{
+	Use:   "esp",
+	Short: "Work with files in the EFI system partition",
+	Long: `Lists, reads and modifies files in the FAT filesystem of the EFI system partition,
+without mounting the image.`,
+}
+
+var espLsCmd = &cobra.Command{
+	Use:   "ls [image] [path]",
+	Short: "List a directory in the EFI system partition",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := "/"
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		return withESP(args[0], true, func(esp *fat.FileSystem) error {
+			info, err := esp.Stat(dir)
+			if err != nil {
+				return err
+			}
+			infos := []fat.FileInfo{info}
+			if info.IsDir {
+				if infos, err = esp.ReadDir(dir); err != nil {
+					return err
+				}
+			}
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			for _, info := range infos {
+				name := info.Name
+				if info.IsDir {
+					name += "/"
+				}
+				fmt.Fprintf(tw, "%d\t%s\t%s\n", info.Size, info.ModTime.Format("2006-01-02 15:04:05"), name)
+			}
+			return tw.Flush()
+		})
+	},
+}
+
+var espCatCmd = &cobra.Command{
+	Use:   "cat [image] [path]",
+	Short: "Print a file in the EFI system partition",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withESP(args[0], true, func(esp *fat.FileSystem) error {
+			content, err := esp.ReadFile(args[1])
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(content)
+			return err
+		})
+	},
+}
+
+var espPutCmd = &cobra.Command{
+	Use:   "put [image] [source] [destination]",
+	Short: "Copy a local file into the EFI system partition",
+	Long: `Copies a local file into the EFI system partition, replacing existing files.
+If the destination is an existing directory, the file keeps its name.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		content, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		return withESP(args[0], false, func(esp *fat.FileSystem) error {
+			destination := args[2]
+			if info, err := esp.Stat(destination); err == nil && info.IsDir {
+				destination = path.Join(destination, path.Base(args[1]))
+			}
+			return esp.WriteFile(destination, content)
+		})
+	},
+}
+
+var espRmCmd = &cobra.Command{
+	Use:   "rm [image] [path]...",
+	Short: "Remove files from the EFI system partition",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withESP(args[0], false, func(esp *fat.FileSystem) error {
+			for _, p := range args[1:] {
+				remove := esp.Remove
+				if rmRecursive {
+					remove = esp.RemoveAll
+				}
+				if err := remove(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+var espMkdirCmd = &cobra.Command{
+	Use:   "mkdir [image] [path]...",
+	Short: "Create directories in the EFI system partition",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withESP(args[0], false, func(esp *fat.FileSystem) error {
+			for _, p := range args[1:] {
+				mkdir := esp.Mkdir
+				if mkdirParents {
+					mkdir = esp.MkdirAll
+				}
+				if err := mkdir(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+var espCheckCmd = &cobra.Command{
+	Use:   "check [image]",
+	Short: "Check the consistency of the EFI system partition",
+	Long: `Checks the FAT filesystem of the EFI system partition without mounting it:
+both FAT copies, the FSInfo free cluster count, cross-linked and lost cluster chains,
+file sizes and long filename checksums. With --repair, simple problems are fixed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withESP(args[0], !repairESP, func(esp *fat.FileSystem) error {
+			problems, err := esp.Check(repairESP)
+			if err != nil {
+				return err
+			}
+			var unrepaired int
+			for _, problem := range problems {
+				fmt.Fprintln(cmd.OutOrStdout(), problem)
+				if !problem.Repaired {
+					unrepaired++
+				}
+			}
+			if unrepaired > 0 {
+				return fmt.Errorf("EFI system partition has %d problems", unrepaired)
+			}
+			if len(problems) > 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s filesystem repaired\n", esp.Type())
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s filesystem is consistent\n", esp.Type())
+			return nil
+		})
+	},
+}
+
+// withESP opens the EFI system partition of the image, for reading only if readOnly is set.
+func withESP(imagePath string, readOnly bool, fn func(esp *fat.FileSystem) error) error {
+	newImage := ddi.New
+	if readOnly {
+		newImage = ddi.NewReadOnly
+	}
+	image, err := newImage(imagePath, int64(blocksize), "")
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	esp, err := image.ESP()
+	if err != nil {
+		return err
+	}
+	return fn(esp)
+}
@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/malt3/ddi-tool/api/repart"
 	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/disk"
+	"github.com/malt3/ddi-tool/pkg/verity"
 	"github.com/spf13/cobra"
 )
 
@@ -14,65 +20,394 @@ var (
 	repartJSON string
 	blocksize  int
 	ukiPath    string
+	setUUIDs   bool
+	ukiPattern string
+	blsPattern string
+	outputPath string
+	splitJSON  string
 )
 
 func init() {
-	finalizeCmd.Flags().StringVarP(&repartJSON, "repart-json", "r", "", "path systemd-repart json output")
-	finalizeCmd.MarkFlagRequired("repart-json")
+	finalizeCmd.Flags().StringVarP(&repartJSON, "repart-json", "r", "", "path systemd-repart json output (defaults to the hashes of the stored hash trees)")
 	finalizeCmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
-	finalizeCmd.Flags().StringVarP(&ukiPath, "uki-path", "u", "", "path to the uki binary inside the EFI partition")
+	finalizeCmd.Flags().StringVarP(&ukiPath, "uki-path", "u", "", "path to the uki binary inside the EFI partition (defaults to all discovered UKIs)")
+	finalizeCmd.Flags().StringVar(&ukiPattern, "uki", "", "glob selecting the discovered UKIs to patch (matched against the file name, or the full path if it contains a slash)")
+	finalizeCmd.Flags().StringVar(&blsPattern, "entry", "", "glob selecting the boot loader entries (/loader/entries/*.conf) to patch")
+	finalizeCmd.Flags().StringVarP(&outputPath, "output", "o", "", "write the finalized image to a new file and leave the image untouched, in the format of the file extension (like .raw.zst or .vhd); required for compressed (except tar.gz) and remote images")
+	finalizeCmd.Flags().BoolVar(&setUUIDs, "set-uuids", false, "derive the data and verity partition UUIDs from the injected hashes")
+	finalizeCmd.Flags().StringVar(&privateKeyPath, "key", "", "private key used to sign the hashes of images without UKI (.p7s sidecars)")
+	finalizeCmd.Flags().StringVar(&certificatePath, "cert", "", "certificate matching the private key")
+	finalizeCmd.Flags().StringVar(&splitJSON, "split", "", "systemd-repart json output of a --split=yes run: finalize the split partition files (split_path) instead of a whole image; the image argument is optional then and is kept consistent with them")
+	finalizeCmd.MarkFlagsRequiredTogether("key", "cert")
+	finalizeCmd.MarkFlagsMutuallyExclusive("split", "output")
 	rootCmd.AddCommand(finalizeCmd)
 }
 
 var finalizeCmd = &cobra.Command{
 	Use:   "finalize [image]",
 	Short: "Finalize a ddi built with systemd-repart",
-	Long:  `After building a ddi with systemd-repart, this command can be used to finalize the image by injecting dm-verity hashes.`,
-	Args:  cobra.ExactArgs(1),
+	Long: `After building a ddi with systemd-repart, this command can be used to finalize the image by injecting dm-verity hashes.
+The hashes are injected into the cmdline of every UKI found on the ESP and XBOOTLDR partition (/EFI/BOOT and /EFI/Linux)
+and into the options of every Type #1 boot loader entry (/loader/entries/*.conf).
+Images without UKI or boot loader entry (like system extensions) get .roothash/.usrhash sidecar files instead.
+Compressed images (zstd, xz, gzip) are read on demand and written to --output in a single pass,
+with the patches kept in memory. Seekable zstd images stay seekable when written to a .zst output.
+Google Compute Engine archives (disk.raw in a tar.gz) are rewritten in place without --output, through
+a temporary file next to the archive.
+Remote images (http:// or https:// URLs) are read with range requests and also need --output.
+Raw images in S3 (s3://bucket/key) are rewritten in place with a multipart upload that copies the unchanged
+parts within S3, or uploaded to --output (which may be an s3:// URL as well). Credentials, region and endpoint
+(like a MinIO server) are taken from the AWS_* environment variables.
+With --split, the partition files written by systemd-repart --split=yes are patched in place of the image,
+and the image (if given) is patched alongside, so that both stay consistent.`,
+	Args: imageArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		repartFile, err := os.ReadFile(repartJSON)
+		image, overlay, err := openFinalizeImage(args)
 		if err != nil {
 			return err
 		}
-		var repartJSON repart.Output
-		if err := json.Unmarshal(repartFile, &repartJSON); err != nil {
+		defer image.Close()
+		hashes, err := finalizeHashes(image)
+		if err != nil {
+			return err
+		}
+		sidecars, err := image.NeedsSidecars()
+		if err != nil {
 			return err
 		}
-		var roothash, usrhash string
+		if sidecars {
+			if len(args) == 0 {
+				return errors.New("images without UKI or boot loader entry need the image argument to name their sidecars")
+			}
+			if err := writeSidecars(cmd, image, hashes); err != nil {
+				return err
+			}
+		} else if err := patchCmdlines(cmd, image, hashes); err != nil {
+			return err
+		}
+		if setUUIDs {
+			if err := setVerityUUIDs(cmd, image, hashes); err != nil {
+				return err
+			}
+		}
+		if overlay == nil {
+			return nil
+		}
+		target, format := outputPath, disk.FormatFromPath(outputPath)
+		export := disk.Export
+		if target == "" {
+			// raw images in S3 and tar.gz archives are rewritten in place
+			if !overlay.Modified() {
+				return nil
+			}
+			target, format = args[0], disk.FormatRaw
+			if _, archive := overlay.Base().(*disk.Compressed); archive {
+				format, export = disk.FormatTarGz, disk.Replace
+			}
+		}
+		if _, seekable := overlay.Base().(*disk.SeekableZstd); seekable && format == disk.FormatZstd {
+			format = disk.FormatSeekableZstd
+		}
+		if _, err := export(cmd.Context(), target, format, overlay); err != nil {
+			return fmt.Errorf("writing %s: %w", target, err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "wrote %s (%s)\n", target, format)
+		return nil
+	},
+}
+
+// openFinalizeImage opens the image to finalize. With --output, all writes are kept in the returned overlay
+// to be exported once the image is patched. Sidecars are written next to the output then.
+// Raw images in S3 and tar.gz archives are patched in an overlay as well and rewritten in place.
+// With --split, the split partition files (and the image, if given) are patched in place.
+func openFinalizeImage(args []string) (*ddi.Image, *disk.Overlay, error) {
+	if splitJSON != "" {
+		image, err := openSplitImage(args, false)
+		return image, nil, err
+	}
+	path := args[0]
+	d, err := disk.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if outputPath == "" {
+		switch d := d.(type) {
+		case *disk.Compressed:
+			if d.Format() == disk.FormatTarGz {
+				overlay := disk.NewOverlay(d)
+				image, err := ddi.NewFromDisk(overlay, path, int64(blocksize), ukiPath)
+				return image, overlay, err
+			}
+			d.Close()
+			return nil, nil, fmt.Errorf("%s compressed images cannot be patched in place, use --output", d.Format())
+		case *disk.SeekableZstd:
+			d.Close()
+			return nil, nil, fmt.Errorf("seekable zstd images cannot be patched in place, use --output")
+		case *disk.HTTP:
+			d.Close()
+			return nil, nil, fmt.Errorf("remote images cannot be patched in place, use --output")
+		case *disk.S3:
+			overlay := disk.NewOverlay(d)
+			image, err := ddi.NewFromDisk(overlay, path, int64(blocksize), ukiPath)
+			return image, overlay, err
+		}
+		image, err := ddi.NewFromDisk(d, path, int64(blocksize), ukiPath)
+		return image, nil, err
+	}
+	overlay := disk.NewOverlay(d)
+	image, err := ddi.NewFromDisk(overlay, outputPath, int64(blocksize), ukiPath)
+	return image, overlay, err
+}
+
+// imageArgs requires the image argument, which is optional with --split.
+func imageArgs(cmd *cobra.Command, args []string) error {
+	if splitJSON != "" {
+		return cobra.MaximumNArgs(1)(cmd, args)
+	}
+	return cobra.ExactArgs(1)(cmd, args)
+}
+
+func readRepartOutput(path string) (repart.Output, error) {
+	repartFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var output repart.Output
+	if err := json.Unmarshal(repartFile, &output); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return output, nil
+}
+
+// openSplitImage opens the split partition files listed in the repart output given with --split,
+// together with the image if given. Relative split paths that do not exist in the working directory
+// are looked up next to the repart output. With readOnly, the files are opened for reading only.
+func openSplitImage(args []string, readOnly bool) (*ddi.Image, error) {
+	output, err := readRepartOutput(splitJSON)
+	if err != nil {
+		return nil, err
+	}
+	for i, partition := range output {
+		if partition.SplitPath == "" || filepath.IsAbs(partition.SplitPath) {
+			continue
+		}
+		if _, err := os.Stat(partition.SplitPath); errors.Is(err, os.ErrNotExist) {
+			output[i].SplitPath = filepath.Join(filepath.Dir(splitJSON), partition.SplitPath)
+		}
+	}
+	var imagePath string
+	if len(args) > 0 {
+		imagePath = args[0]
+	}
+	return ddi.NewSplit(output, imagePath, int64(blocksize), ukiPath, readOnly)
+}
+
+// finalizeHashes returns the roothash and usrhash to inject, either from the repart json output
+// or from the hash trees stored in the image.
+func finalizeHashes(image *ddi.Image) (map[string]string, error) {
+	hashes := make(map[string]string)
+	if repartJSON != "" {
+		repartJSON, err := readRepartOutput(repartJSON)
+		if err != nil {
+			return nil, err
+		}
 		for _, partition := range repartJSON {
 			if len(partition.Roothash) > 0 {
-				roothash = partition.Roothash
+				hashes["roothash"] = partition.Roothash
 			}
 			if len(partition.Usrhash) > 0 {
-				usrhash = partition.Usrhash
+				hashes["usrhash"] = partition.Usrhash
 			}
 		}
-		image, err := ddi.New(args[0], int64(blocksize), ukiPath)
+		return hashes, nil
+	}
+	sets, err := image.VeritySets()
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		rootHash, err := image.StoredRootHash(set)
 		if err != nil {
+			return nil, fmt.Errorf("reading %s hash tree: %w", set.Designator, err)
+		}
+		hashes[set.CmdlineKey()] = hex.EncodeToString(rootHash)
+	}
+	return hashes, nil
+}
+
+// patchCmdlines injects the hashes into the cmdline of every selected UKI and boot loader entry.
+// In multi-profile UKIs, every profile setting roothash or usrhash is patched.
+// All cmdlines are located before the first one is modified.
+func patchCmdlines(cmd *cobra.Command, image *ddi.Image, hashes map[string]string) error {
+	ukis, err := image.SelectUKIs(ukiPattern)
+	if err != nil {
+		return err
+	}
+	entries, err := image.SelectBootEntries(blsPattern)
+	if err != nil {
+		return err
+	}
+	if len(ukis) == 0 && len(entries) == 0 {
+		return fmt.Errorf("no UKIs or boot loader entries found")
+	}
+	entryCmdlines := make([]*ddi.BootEntryCmdline, len(entries))
+	for i, e := range entries {
+		if entryCmdlines[i], err = image.BootEntryCmdline(e); err != nil {
 			return err
 		}
-		defer image.Close()
-		cmdline, err := image.GetCmdline()
-		if err != nil {
+	}
+	cmdlines := make([][]ddi.SharedCmdline, len(ukis))
+	for i, u := range ukis {
+		if finding := image.CheckUKIArch(u); finding.Severity != ddi.SeverityOK {
+			fmt.Fprintf(cmd.ErrOrStderr(), "%s: %s: %s\n", finding.Severity, finding.Check, finding.Message)
+		}
+		if cmdlines[i], err = image.DistinctCmdlines(u); err != nil {
 			return err
 		}
-		if len(roothash) > 0 {
-			fmt.Fprintf(cmd.OutOrStdout(), "setting roothash=%s\n", roothash)
-			if err := cmdline.SetOne("roothash", roothash, true); err != nil {
-				return fmt.Errorf("setting roothash: %w", err)
+	}
+	for i, u := range ukis {
+		for _, key := range []string{"roothash", "usrhash"} {
+			hash := hashes[key]
+			if len(hash) == 0 {
+				continue
+			}
+			if err := patchProfiles(cmd, u, cmdlines[i], key, hash); err != nil {
+				return err
 			}
 		}
-		if len(usrhash) > 0 {
-			fmt.Fprintf(cmd.OutOrStdout(), "setting usrhash=%s\n", usrhash)
-			if err := cmdline.SetOne("usrhash", usrhash, true); err != nil {
-				return fmt.Errorf("setting usrhash: %w", err)
+		for _, pc := range cmdlines[i] {
+			after, err := pc.Cmdline.String()
+			if err != nil {
+				return err
 			}
+			fmt.Fprintln(cmd.OutOrStdout(), after)
 		}
-		after, err := cmdline.String()
+	}
+	for i, e := range entries {
+		for _, key := range []string{"roothash", "usrhash"} {
+			hash := hashes[key]
+			if len(hash) == 0 {
+				continue
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "setting %s=%s in %s\n", key, hash, e)
+			if err := entryCmdlines[i].SetOption(key, hash); err != nil {
+				return fmt.Errorf("setting %s in %s: %w", key, e, err)
+			}
+		}
+		if err := entryCmdlines[i].Save(); err != nil {
+			return err
+		}
+		after, err := entryCmdlines[i].String()
 		if err != nil {
 			return err
 		}
-		fmt.Println(after)
-		return nil
-	},
+		fmt.Fprintln(cmd.OutOrStdout(), strings.TrimRight(after, " "))
+	}
+	return nil
+}
+
+// patchProfiles sets key in the cmdline of every profile of the UKI that sets it.
+// UKIs with a single cmdline must set the key.
+func patchProfiles(cmd *cobra.Command, u ddi.UKI, cmdlines []ddi.SharedCmdline, key, hash string) error {
+	var patched int
+	for _, pc := range cmdlines {
+		_, ok, err := pc.Cmdline.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok && len(cmdlines) > 1 {
+			continue
+		}
+		target := u.String()
+		if len(cmdlines) > 1 {
+			target += " " + pc.String()
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "setting %s=%s in %s\n", key, hash, target)
+		if err := pc.Cmdline.SetOne(key, hash, true); err != nil {
+			return fmt.Errorf("setting %s in %s: %w", key, target, err)
+		}
+		patched++
+	}
+	if patched == 0 {
+		return fmt.Errorf("setting %s in %s: no profile sets %s", key, u, key)
+	}
+	return nil
+}
+
+func writeSidecars(cmd *cobra.Command, image *ddi.Image, hashes map[string]string) error {
+	if len(hashes) == 0 {
+		return fmt.Errorf("image has no UKI or boot loader entry and no hashes to write")
+	}
+	var sign func(hash string) ([]byte, error)
+	if privateKeyPath != "" {
+		cert, err := loadCertificate(certificatePath)
+		if err != nil {
+			return err
+		}
+		key, err := loadSigner(privateKeyPath)
+		if err != nil {
+			return err
+		}
+		sign = func(hash string) ([]byte, error) {
+			rootHash, err := hex.DecodeString(hash)
+			if err != nil {
+				return nil, err
+			}
+			sig, err := verity.Sign(rootHash, cert, key)
+			if err != nil {
+				return nil, err
+			}
+			return sig.Signature, nil
+		}
+	}
+	for _, key := range []string{"roothash", "usrhash"} {
+		hash, ok := hashes[key]
+		if !ok {
+			continue
+		}
+		path, err := image.WriteHashSidecar(cmd.Context(), key, hash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "writing %s=%s to %s\n", key, hash, path)
+		if sign == nil {
+			continue
+		}
+		signature, err := sign(hash)
+		if err != nil {
+			return fmt.Errorf("signing %s: %w", key, err)
+		}
+		path, err = image.WriteSignatureSidecar(cmd.Context(), key, signature)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "writing %s signature to %s\n", key, path)
+	}
+	return nil
+}
+
+func setVerityUUIDs(cmd *cobra.Command, image *ddi.Image, hashes map[string]string) error {
+	sets, err := image.VeritySets()
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		hash := hashes[set.CmdlineKey()]
+		if len(hash) == 0 {
+			continue
+		}
+		rootHash, err := hex.DecodeString(hash)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", set.CmdlineKey(), err)
+		}
+		dataUUID, hashUUID, err := ddi.VerityUUIDs(rootHash)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "setting %s partition uuids to %s and %s\n", set.Designator, dataUUID, hashUUID)
+		if err := image.SetVerityUUIDs(set, rootHash); err != nil {
+			return fmt.Errorf("setting %s partition uuids: %w", set.Designator, err)
+		}
+	}
+	return nil
 }
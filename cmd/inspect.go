@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/spf13/cobra"
+)
+
+var certificatePath string
+
+func init() {
+	inspectCmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+	inspectCmd.Flags().StringVarP(&ukiPath, "uki-path", "u", "", "path to the uki binary inside the EFI partition")
+	inspectCmd.Flags().StringVar(&certificatePath, "cert", "", "certificate used to verify verity signatures")
+	rootCmd.AddCommand(inspectCmd)
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [image]",
+	Short: "Show the partitions, dm-verity setup and kernel cmdline of a ddi",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := verifyOptions()
+		if err != nil {
+			return err
+		}
+		image, err := ddi.NewReadOnly(args[0], int64(blocksize), ukiPath)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		out := cmd.OutOrStdout()
+
+		table, err := image.Partitions()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "blocksize: %d\n", table.Blocksize)
+		fmt.Fprintf(out, "disk uuid: %s\n", table.Header.DiskGUID)
+		if arch, err := image.Arch(); err == nil {
+			fmt.Fprintf(out, "architecture: %s\n", arch)
+		}
+		fmt.Fprintln(out, "partitions:")
+		printPartitions(out, table)
+
+		sets, err := image.VeritySets()
+		if err != nil {
+			return err
+		}
+		for _, set := range sets {
+			fmt.Fprintf(out, "%s verity (%s):\n", set.Designator, set.Arch)
+			fmt.Fprintf(out, "  data partition: %d\n", set.Data.Index+1)
+			fmt.Fprintf(out, "  hash partition: %d\n", set.Hash.Index+1)
+			printSuperblock(out, image, set)
+			if set.Signature == nil {
+				continue
+			}
+			fmt.Fprintf(out, "  signature partition: %d\n", set.Signature.Index+1)
+			sig, err := image.VeritySignature(set)
+			if err != nil {
+				fmt.Fprintf(out, "  signature: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(out, "  signed root hash: %s\n", sig.RootHash)
+			fmt.Fprintf(out, "  certificate fingerprint: %s\n", sig.CertificateFingerprint)
+		}
+
+		if ukis, err := image.UKIs(); err != nil {
+			fmt.Fprintf(out, "ukis: %v\n", err)
+		} else if len(ukis) > 0 {
+			fmt.Fprintln(out, "ukis:")
+			for _, u := range ukis {
+				printUKI(out, image, u)
+			}
+		}
+
+		if entries, err := image.BootEntries(); err != nil {
+			fmt.Fprintf(out, "boot entries: %v\n", err)
+		} else if len(entries) > 0 {
+			fmt.Fprintln(out, "boot entries:")
+			for _, e := range entries {
+				options, err := image.BootEntryCmdline(e)
+				if err != nil {
+					fmt.Fprintf(out, "  %s: %v\n", e, err)
+					continue
+				}
+				content, err := options.String()
+				if err != nil {
+					fmt.Fprintf(out, "  %s: %v\n", e, err)
+					continue
+				}
+				fmt.Fprintf(out, "  %s: %s\n", e, strings.TrimRight(content, " "))
+			}
+		}
+
+		if cmdline, err := image.GetCmdline(); err != nil {
+			fmt.Fprintf(out, "cmdline: %v\n", err)
+		} else if content, err := cmdline.String(); err != nil {
+			fmt.Fprintf(out, "cmdline: %v\n", err)
+		} else {
+			fmt.Fprintf(out, "cmdline: %s\n", strings.TrimRight(content, " \x00"))
+		}
+
+		findings, err := image.Verify(cmd.Context(), opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "checks:")
+		printFindings(out, findings)
+		return nil
+	},
+}
+
+func printPartitions(w io.Writer, table *gpt.Table) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "  #\ttype\tlabel\tuuid\tstart\tsize")
+	for _, part := range table.Partitions {
+		fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%d\t%d\n", part.Index+1, part.Type, part.Name, part.UUID, part.Start, part.Size)
+	}
+	tw.Flush()
+}
+
+func printSuperblock(w io.Writer, image *ddi.Image, set ddi.VeritySet) {
+	sb, err := image.VeritySuperblock(set)
+	if err != nil {
+		fmt.Fprintf(w, "  superblock: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "  superblock:")
+	fmt.Fprintf(w, "    version: %d\n", sb.Version)
+	fmt.Fprintf(w, "    hash type: %d\n", sb.HashType)
+	fmt.Fprintf(w, "    uuid: %s\n", sb.UUIDString())
+	fmt.Fprintf(w, "    algorithm: %s\n", sb.Algorithm)
+	fmt.Fprintf(w, "    data block size: %d\n", sb.DataBlockSize)
+	fmt.Fprintf(w, "    hash block size: %d\n", sb.HashBlockSize)
+	fmt.Fprintf(w, "    data blocks: %d (%d bytes, data partition has %d bytes)\n", sb.DataBlocks, sb.DataSize(), set.Data.Size)
+	fmt.Fprintf(w, "    salt: %x\n", sb.Salt)
+	if treeSize, err := sb.TreeSize(); err == nil {
+		fmt.Fprintf(w, "    hash tree size: %d bytes (hash partition has %d bytes)\n", treeSize, set.Hash.Size)
+	}
+}
+
+func printFindings(w io.Writer, findings []ddi.Finding) {
+	for _, finding := range findings {
+		fmt.Fprintf(w, "  [%s] %s: %s\n", finding.Severity, finding.Check, finding.Message)
+	}
+}
+
+// printUKI prints the profiles and addons of the UKI and the effective cmdline of each profile.
+func printUKI(out io.Writer, image *ddi.Image, u ddi.UKI) {
+	if arch, err := image.UKIArch(u); err != nil {
+		fmt.Fprintf(out, "  %s (%v)\n", u, err)
+	} else {
+		fmt.Fprintf(out, "  %s (%s)\n", u, arch)
+	}
+	profiles, err := image.UKIProfiles(u)
+	if err != nil {
+		fmt.Fprintf(out, "    profiles: %v\n", err)
+		return
+	}
+	if len(profiles) > 1 {
+		for _, profile := range profiles {
+			fmt.Fprintf(out, "    profile %s\n", profile)
+		}
+	}
+	addons, err := image.Addons(u)
+	if err != nil {
+		fmt.Fprintf(out, "    addons: %v\n", err)
+		return
+	}
+	for _, addon := range addons {
+		fmt.Fprintf(out, "    addon %s\n", addon)
+	}
+	if len(addons) == 0 {
+		return
+	}
+	for _, profile := range profiles {
+		label := "effective cmdline"
+		if len(profiles) > 1 {
+			label += fmt.Sprintf(" for profile %s", profile)
+		}
+		if effective, err := image.EffectiveCmdline(u, profile); err != nil {
+			fmt.Fprintf(out, "    %s: %v\n", label, err)
+		} else {
+			fmt.Fprintf(out, "    %s: %s\n", label, effective)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/verity"
+	"github.com/spf13/cobra"
+)
+
+var rehashData bool
+
+func init() {
+	verifyCmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+	verifyCmd.Flags().StringVarP(&ukiPath, "uki-path", "u", "", "path to the uki binary inside the EFI partition")
+	verifyCmd.Flags().StringVar(&certificatePath, "cert", "", "certificate used to verify verity signatures")
+	verifyCmd.Flags().BoolVar(&rehashData, "rehash", false, "recompute the root hashes from the data partitions")
+	verifyCmd.Flags().StringVar(&splitJSON, "split", "", "systemd-repart json output of a --split=yes run: verify the split partition files (split_path) instead of a whole image; if the image is given as well, the split files of the partitions ddi-tool modifies are compared with it")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [image]",
+	Short: "Verify that hash trees, verity signatures and the kernel cmdlines of a ddi agree",
+	Args:  imageArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := verifyOptions()
+		if err != nil {
+			return err
+		}
+		opts.RehashData = rehashData
+		opts.Progress = func(set ddi.VeritySet) verity.ProgressFunc {
+			return progressPrinter(cmd.ErrOrStderr(), string(set.Designator))
+		}
+		var image *ddi.Image
+		if splitJSON != "" {
+			image, err = openSplitImage(args, true)
+		} else {
+			image, err = ddi.NewReadOnly(args[0], int64(blocksize), ukiPath)
+		}
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		findings, err := image.Verify(cmd.Context(), opts)
+		if err != nil {
+			return err
+		}
+		if len(findings) == 0 {
+			return errors.New("no dm-verity protected partitions found")
+		}
+		printFindings(cmd.OutOrStdout(), findings)
+		var failed int
+		for _, finding := range findings {
+			if finding.Severity == ddi.SeverityError {
+				failed++
+			}
+		}
+		if failed > 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("verification failed: %d errors", failed)
+		}
+		return nil
+	},
+}
+
+func verifyOptions() (ddi.VerifyOptions, error) {
+	var opts ddi.VerifyOptions
+	if certificatePath != "" {
+		cert, err := loadCertificate(certificatePath)
+		if err != nil {
+			return opts, err
+		}
+		opts.Certificate = cert
+	}
+	return opts, nil
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/malt3/ddi-tool/pkg/ddi"
+	"github.com/malt3/ddi-tool/pkg/verity"
+	"github.com/spf13/cobra"
+)
+
+var privateKeyPath string
+
+func init() {
+	verityHashCmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+	veritySignCmd.Flags().IntVarP(&blocksize, "blocksize", "b", 0, "blocksize of the image")
+	veritySignCmd.Flags().StringVar(&privateKeyPath, "key", "", "PEM encoded private key used for signing")
+	veritySignCmd.MarkFlagRequired("key")
+	veritySignCmd.Flags().StringVar(&certificatePath, "cert", "", "certificate matching the private key")
+	veritySignCmd.MarkFlagRequired("cert")
+	verityCmd.AddCommand(verityHashCmd)
+	verityCmd.AddCommand(veritySignCmd)
+	rootCmd.AddCommand(verityCmd)
+}
+
+var verityCmd = &cobra.Command{
+	Use:   "verity",
+	Short: "Work with dm-verity protected partitions",
+}
+
+var verityHashCmd = &cobra.Command{
+	Use:   "hash [image]",
+	Short: "Compute the dm-verity root hashes of a ddi",
+	Long:  `Recomputes the dm-verity root hash of every root and usr partition using the parameters stored in the verity superblock.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image, err := ddi.NewReadOnly(args[0], int64(blocksize), "")
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		sets, err := image.VeritySets()
+		if err != nil {
+			return err
+		}
+		if len(sets) == 0 {
+			return fmt.Errorf("no dm-verity protected partitions found")
+		}
+		for _, set := range sets {
+			rootHash, err := image.ComputeRootHash(cmd.Context(), set, progressPrinter(cmd.ErrOrStderr(), string(set.Designator)))
+			if err != nil {
+				return fmt.Errorf("hashing %s partition: %w", set.Designator, err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%shash=%s\n", set.Designator, hex.EncodeToString(rootHash))
+		}
+		return nil
+	},
+}
+
+var veritySignCmd = &cobra.Command{
+	Use:   "sign [image]",
+	Short: "Sign the dm-verity root hashes of a ddi",
+	Long: `Signs the root hash of every dm-verity hash tree in the image and writes the signature
+into the matching root-verity-sig or usr-verity-sig partition.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cert, err := loadCertificate(certificatePath)
+		if err != nil {
+			return err
+		}
+		key, err := loadSigner(privateKeyPath)
+		if err != nil {
+			return err
+		}
+		image, err := ddi.New(args[0], int64(blocksize), "")
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		sets, err := image.VeritySets()
+		if err != nil {
+			return err
+		}
+		var signed int
+		for _, set := range sets {
+			if set.Signature == nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "%s partition has no verity signature partition, skipping\n", set.Designator)
+				continue
+			}
+			rootHash, err := image.StoredRootHash(set)
+			if err != nil {
+				return fmt.Errorf("reading %s hash tree: %w", set.Designator, err)
+			}
+			sig, err := verity.Sign(rootHash, cert, key)
+			if err != nil {
+				return fmt.Errorf("signing %s: %w", set.CmdlineKey(), err)
+			}
+			if err := image.WriteVeritySignature(set, sig); err != nil {
+				return fmt.Errorf("writing %s verity signature: %w", set.Designator, err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "signed %s=%s\n", set.CmdlineKey(), sig.RootHash)
+			signed++
+		}
+		if signed == 0 {
+			return fmt.Errorf("no verity signature partitions found")
+		}
+		return nil
+	},
+}
+
+func progressPrinter(w io.Writer, name string) verity.ProgressFunc {
+	var lastPercent int64 = -1
+	return func(done, total int64) {
+		percent := done * 100 / total
+		if percent == lastPercent {
+			return
+		}
+		lastPercent = percent
+		fmt.Fprintf(w, "\rhashing %s: %3d%% (%d/%d MiB)", name, percent, done>>20, total>>20)
+		if done == total {
+			fmt.Fprintln(w)
+		}
+	}
+}
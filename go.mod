@@ -4,8 +4,11 @@ go 1.21.5
 
 require (
 	github.com/diskfs/go-diskfs v1.4.0
+	github.com/klauspost/compress v1.17.4
 	github.com/spf13/cobra v1.8.0
 	github.com/stretchr/testify v1.7.0
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/sys v0.5.0
 )
 
 require (
@@ -14,14 +17,11 @@ require (
 	github.com/elliotwutingfeng/asciiset v0.0.0-20230602022725-51bbb787efab // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/klauspost/compress v1.17.4 // indirect
 	github.com/pierrec/lz4/v4 v4.1.17 // indirect
 	github.com/pkg/xattr v0.4.9 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/ulikunitz/xz v0.5.11 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -0,0 +1,90 @@
+// Package bls parses and edits Type #1 boot loader entries of the Boot Loader Specification
+// (loader/entries/*.conf).
+package bls
+
+import (
+	"strings"
+)
+
+// Entry is a parsed boot loader entry. Lines other than the edited ones are preserved verbatim,
+// including comments and blank lines.
+type Entry struct {
+	lines []string
+}
+
+// Parse parses the content of a boot loader entry file.
+func Parse(content []byte) *Entry {
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return &Entry{}
+	}
+	return &Entry{lines: strings.Split(text, "\n")}
+}
+
+// Values returns the values of all lines with the given key, in file order.
+func (e *Entry) Values(key string) []string {
+	var values []string
+	for _, line := range e.lines {
+		if k, v, ok := splitLine(line); ok && k == key {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Get returns the value of the first line with the given key.
+func (e *Entry) Get(key string) (string, bool) {
+	values := e.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// Options returns the kernel cmdline of the entry: all options lines joined by spaces.
+func (e *Entry) Options() string {
+	return strings.Join(e.Values("options"), " ")
+}
+
+// SetOptions replaces the kernel cmdline of the entry.
+// The first options line is rewritten and further options lines are removed.
+// If the entry has no options line, one is appended.
+func (e *Entry) SetOptions(options string) {
+	var lines []string
+	var set bool
+	for _, line := range e.lines {
+		if k, _, ok := splitLine(line); ok && k == "options" {
+			if !set {
+				lines = append(lines, "options "+options)
+				set = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if !set {
+		lines = append(lines, "options "+options)
+	}
+	e.lines = lines
+}
+
+// Bytes returns the content of the entry file.
+func (e *Entry) Bytes() []byte {
+	if len(e.lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(e.lines, "\n") + "\n")
+}
+
+// splitLine splits a line into key and value. Comments and blank lines have no key.
+func splitLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, "", true
+	}
+	return line[:i], strings.TrimSpace(line[i+1:]), true
+}
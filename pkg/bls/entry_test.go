@@ -0,0 +1,65 @@
+package bls
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry(t *testing.T) {
+	testCases := map[string]struct {
+		content     string
+		options     string
+		setOptions  string
+		wantContent string
+	}{
+		"single options line": {
+			content:     "# generated\ntitle Fedora\nlinux /vmlinuz\noptions quiet roothash=00\n",
+			options:     "quiet roothash=00",
+			setOptions:  "quiet roothash=ab",
+			wantContent: "# generated\ntitle Fedora\nlinux /vmlinuz\noptions quiet roothash=ab\n",
+		},
+		"multiple options lines": {
+			content:     "title Fedora\noptions quiet\ninitrd /initrd\noptions\troothash=00\n",
+			options:     "quiet roothash=00",
+			setOptions:  "quiet roothash=ab",
+			wantContent: "title Fedora\noptions quiet roothash=ab\ninitrd /initrd\n",
+		},
+		"no options": {
+			content:     "title Fedora\nlinux /vmlinuz",
+			setOptions:  "roothash=ab",
+			wantContent: "title Fedora\nlinux /vmlinuz\noptions roothash=ab\n",
+		},
+		"empty": {
+			setOptions:  "roothash=ab",
+			wantContent: "options roothash=ab\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			entry := Parse([]byte(tc.content))
+			assert.Equal(tc.options, entry.Options())
+			entry.SetOptions(tc.setOptions)
+			assert.Equal(tc.setOptions, entry.Options())
+			assert.Equal(tc.wantContent, string(entry.Bytes()))
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+
+	entry := Parse([]byte("  title   Fedora Linux \n#linux /commented\nlinux /vmlinuz\ninitrd /a\ninitrd /b\n"))
+	title, ok := entry.Get("title")
+	assert.True(ok)
+	assert.Equal("Fedora Linux", title)
+	linux, ok := entry.Get("linux")
+	assert.True(ok)
+	assert.Equal("/vmlinuz", linux)
+	assert.Equal([]string{"/a", "/b"}, entry.Values("initrd"))
+	_, ok = entry.Get("options")
+	assert.False(ok)
+}
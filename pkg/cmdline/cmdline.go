@@ -21,6 +21,14 @@ func New(handle handle, capacity int64) *Cmdline {
 	}
 }
 
+// NewMemory returns a cmdline held in memory, for cmdlines stored in files that can be rewritten.
+// The content is padded with spaces to capacity, which is the room available for edits.
+func NewMemory(content string, capacity int64) *Cmdline {
+	capacity = max(capacity, int64(len(content)))
+	buf := append([]byte(content), padding(capacity-int64(len(content)))...)
+	return New(memoryHandle(buf), capacity)
+}
+
 func (c *Cmdline) String() (string, error) {
 	reader := make([]byte, c.capacity)
 	_, err := c.handle.ReadAt(reader, 0)
@@ -138,6 +146,52 @@ func (c *Cmdline) SetOne(key, value string, inPlace bool) error {
 	return c.Set(map[string]string{string(key): string(value)}, true)
 }
 
+// SetOption sets key to value (a flag if value is empty). An existing option is replaced in place
+// if the new value fits, otherwise it is removed and the option is appended.
+func (c *Cmdline) SetOption(key, value string) error {
+	option := key
+	if value != "" {
+		option += "=" + value
+	}
+	_, ok, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.Append(option)
+	}
+	if err := c.setInPlace([]byte(key), []byte(value)); err == nil {
+		return nil
+	}
+	content, err := c.String()
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, existing := range strings.Fields(content) {
+		if existing != key && !strings.HasPrefix(existing, key+"=") {
+			kept = append(kept, existing)
+		}
+	}
+	kept = append(kept, option)
+	return c.Replace(strings.Join(kept, " "))
+}
+
+// Pairs returns all options of the cmdline. Flags without value map to the empty string.
+func (c *Cmdline) Pairs() (map[string]string, error) {
+	return c.getKeyValuePairs()
+}
+
+// Get returns the value of key and whether key is present on the cmdline.
+func (c *Cmdline) Get(key string) (string, bool, error) {
+	pairs, err := c.getKeyValuePairs()
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := pairs[key]
+	return value, ok, nil
+}
+
 func (c *Cmdline) setInPlace(key, value []byte) error {
 	sizeOfMatch := len(key) + 1 + len(value)
 	if len(value) == 0 {
@@ -165,12 +219,13 @@ func (c *Cmdline) setInPlace(key, value []byte) error {
 		WriterAt: c.handle,
 		offset:   int64(*offset),
 	}
-	producer.Write(key)
+	replacement := key
 	if len(value) > 0 {
-		producer.Write([]byte{'='})
-		producer.Write(value)
+		replacement = append(append(append([]byte(nil), key...), '='), value...)
+	}
+	if _, err := producer.Write(append(replacement, pad...)); err != nil {
+		return err
 	}
-	producer.Write(pad)
 	return nil
 }
 
@@ -242,6 +297,30 @@ type handle interface {
 	io.WriterAt
 }
 
+type memoryHandle []byte
+
+func (m memoryHandle) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memoryHandle) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(m[off:], p)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 type sectionHandle struct {
 	handle       handle
 	offset, size int64
@@ -2,6 +2,7 @@ package cmdline
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -144,3 +145,96 @@ func (h *testingCmdlineHandle) ReadAt(p []byte, off int64) (n int, err error) {
 	}
 	return
 }
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := testingCmdline("foo=1 bar  roothash=abc   ")
+	value, ok, err := c.Get("roothash")
+	require.NoError(err)
+	assert.True(ok)
+	assert.Equal("abc", value)
+
+	value, ok, err = c.Get("bar")
+	require.NoError(err)
+	assert.True(ok)
+	assert.Equal("", value)
+
+	_, ok, err = c.Get("usrhash")
+	require.NoError(err)
+	assert.False(ok)
+}
+
+func TestNewMemory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := NewMemory("quiet roothash=00", 40)
+	require.NoError(c.SetOne("roothash", "ab", true))
+	require.NoError(c.Append("usrhash=cd"))
+	content, err := c.String()
+	require.NoError(err)
+	assert.Len(content, 40)
+	assert.Equal("quiet roothash=ab usrhash=cd", strings.TrimRight(content, " "))
+
+	assert.Error(NewMemory("quiet", 0).Append("debug"))
+}
+
+func TestSetOption(t *testing.T) {
+	testCases := map[string]struct {
+		cmdline string
+		key     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		"replace in place": {
+			cmdline: "quiet roothash=0000 ro",
+			key:     "roothash",
+			value:   "ab",
+			want:    "quiet roothash=ab   ro",
+		},
+		"move longer value to end": {
+			cmdline: "quiet roothash=0 ro",
+			key:     "roothash",
+			value:   "abcd",
+			want:    "quiet ro roothash=abcd",
+		},
+		"append": {
+			cmdline: "quiet",
+			key:     "usrhash",
+			value:   "ab",
+			want:    "quiet usrhash=ab",
+		},
+		"append flag": {
+			cmdline: "quiet",
+			key:     "debug",
+			want:    "quiet debug",
+		},
+		"not enough space": {
+			cmdline: "quiet",
+			key:     "roothash",
+			value:   strings.Repeat("a", 64),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			c := NewMemory(tc.cmdline, 32)
+			err := c.SetOption(tc.key, tc.value)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			content, err := c.String()
+			require.NoError(err)
+			assert.Equal(tc.want, strings.TrimRight(content, " "))
+		})
+	}
+}
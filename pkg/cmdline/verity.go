@@ -0,0 +1,274 @@
+package cmdline
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Finding describes a problem with a cmdline option.
+type Finding struct {
+	Option  string
+	Message string
+}
+
+// VerityConfig is the dm-verity setup of the root or usr partition described by the cmdline.
+// See systemd-veritysetup-generator(8).
+type VerityConfig struct {
+	// Designator is either root or usr.
+	Designator string
+	// RootHash is the value of roothash= or usrhash= (may be empty).
+	RootHash string
+	// DataDevice and HashDevice are the values of systemd.verity_<designator>_data= and
+	// systemd.verity_<designator>_hash= (may be empty).
+	DataDevice string
+	HashDevice string
+	// Options are the entries of systemd.verity_<designator>_options=.
+	// Flags without value map to the empty string.
+	Options map[string]string
+}
+
+// Algorithm returns the hash algorithm configured by the options (sha256 by default).
+func (v VerityConfig) Algorithm() string {
+	if algorithm, ok := v.Options["hash"]; ok {
+		return algorithm
+	}
+	return "sha256"
+}
+
+// DeviceKind classifies a device specification.
+type DeviceKind int
+
+const (
+	// DeviceOther is a device that cannot be resolved within the image (e.g. a filesystem UUID or a /dev node).
+	DeviceOther DeviceKind = iota
+	DevicePartUUID
+	DevicePartLabel
+)
+
+// ParseDevice splits a device specification like PARTUUID=..., PARTLABEL=...
+// or /dev/disk/by-partuuid/... into its kind and value.
+func ParseDevice(spec string) (DeviceKind, string) {
+	switch {
+	case strings.HasPrefix(spec, "PARTUUID="):
+		return DevicePartUUID, strings.TrimPrefix(spec, "PARTUUID=")
+	case strings.HasPrefix(spec, "/dev/disk/by-partuuid/"):
+		return DevicePartUUID, strings.TrimPrefix(spec, "/dev/disk/by-partuuid/")
+	case strings.HasPrefix(spec, "PARTLABEL="):
+		return DevicePartLabel, strings.TrimPrefix(spec, "PARTLABEL=")
+	case strings.HasPrefix(spec, "/dev/disk/by-partlabel/"):
+		return DevicePartLabel, strings.TrimPrefix(spec, "/dev/disk/by-partlabel/")
+	}
+	return DeviceOther, spec
+}
+
+var verityDigestSizes = map[string]int{
+	"sha1":   20,
+	"sha224": 28,
+	"sha256": 32,
+	"sha384": 48,
+	"sha512": 64,
+}
+
+// verityOptionValidators checks the value of every known entry of systemd.verity_*_options=.
+// A nil validator marks a flag that takes no value.
+var verityOptionValidators = map[string]func(string) error{
+	"superblock":            validateBool,
+	"format":                validateOneOf("0", "1"),
+	"data-block-size":       validateBlockSize,
+	"hash-block-size":       validateBlockSize,
+	"data-blocks":           validateUint,
+	"hash-offset":           validateUint,
+	"salt":                  validateSalt,
+	"uuid":                  validateUUID,
+	"hash":                  validateAlgorithm,
+	"fec-device":            validateNonEmpty,
+	"fec-offset":            validateUint,
+	"fec-roots":             validateUint,
+	"root-hash-signature":   validateNonEmpty,
+	"ignore-corruption":     nil,
+	"restart-on-corruption": nil,
+	"panic-on-corruption":   nil,
+	"ignore-zero-blocks":    nil,
+	"check-at-most-once":    nil,
+}
+
+// ParseVerity extracts the dm-verity configuration from the key value pairs of a cmdline
+// and checks the syntax of all related options.
+func ParseVerity(pairs map[string]string) ([]VerityConfig, []Finding) {
+	var findings []Finding
+	for _, key := range []string{"systemd.verity", "rd.systemd.verity"} {
+		if value, ok := pairs[key]; ok {
+			if err := validateBool(value); err != nil {
+				findings = append(findings, Finding{Option: key, Message: err.Error()})
+			}
+		}
+	}
+	var unknown []string
+	for key := range pairs {
+		if !strings.HasPrefix(key, "systemd.verity_") {
+			continue
+		}
+		known := false
+		for _, designator := range []string{"root", "usr"} {
+			for _, suffix := range []string{"data", "hash", "options"} {
+				known = known || key == fmt.Sprintf("systemd.verity_%s_%s", designator, suffix)
+			}
+		}
+		if !known {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		findings = append(findings, Finding{Option: key, Message: "unknown option"})
+	}
+
+	var configs []VerityConfig
+	for _, designator := range []string{"root", "usr"} {
+		config, ok, configFindings := parseVerityConfig(pairs, designator)
+		findings = append(findings, configFindings...)
+		if ok {
+			configs = append(configs, config)
+		}
+	}
+	return configs, findings
+}
+
+func parseVerityConfig(pairs map[string]string, designator string) (VerityConfig, bool, []Finding) {
+	hashKey := designator + "hash"
+	dataKey := "systemd.verity_" + designator + "_data"
+	hashDeviceKey := "systemd.verity_" + designator + "_hash"
+	optionsKey := "systemd.verity_" + designator + "_options"
+
+	config := VerityConfig{
+		Designator: designator,
+		RootHash:   pairs[hashKey],
+		DataDevice: pairs[dataKey],
+		HashDevice: pairs[hashDeviceKey],
+		Options:    make(map[string]string),
+	}
+	_, hasHash := pairs[hashKey]
+	_, hasData := pairs[dataKey]
+	_, hasHashDevice := pairs[hashDeviceKey]
+	rawOptions, hasOptions := pairs[optionsKey]
+	if !hasHash && !hasData && !hasHashDevice && !hasOptions {
+		return config, false, nil
+	}
+
+	var findings []Finding
+	for _, entry := range strings.Split(rawOptions, ",") {
+		if entry == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(entry, "=")
+		validate, known := verityOptionValidators[name]
+		switch {
+		case !known:
+			findings = append(findings, Finding{Option: optionsKey, Message: fmt.Sprintf("unknown verity option %q", name)})
+		case validate == nil && hasValue:
+			findings = append(findings, Finding{Option: optionsKey, Message: fmt.Sprintf("verity option %q takes no value", name)})
+		case validate != nil:
+			if err := validate(value); err != nil {
+				findings = append(findings, Finding{Option: optionsKey, Message: fmt.Sprintf("verity option %q: %v", name, err)})
+			}
+		}
+		config.Options[name] = value
+	}
+
+	if !hasHash {
+		findings = append(findings, Finding{Option: hashKey, Message: fmt.Sprintf("%s is missing, but other %s verity options are set", hashKey, designator)})
+	} else if err := validateRootHash(config.RootHash, config.Algorithm()); err != nil {
+		findings = append(findings, Finding{Option: hashKey, Message: err.Error()})
+	}
+	for key, device := range map[string]string{dataKey: config.DataDevice, hashDeviceKey: config.HashDevice} {
+		if _, ok := pairs[key]; ok && device == "" {
+			findings = append(findings, Finding{Option: key, Message: "empty device path"})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Option < findings[j].Option })
+	return config, true, findings
+}
+
+func validateRootHash(value, algorithm string) error {
+	raw, err := hex.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return fmt.Errorf("root hash %q is not a hex string", value)
+	}
+	if size, ok := verityDigestSizes[algorithm]; ok && len(raw) != size {
+		return fmt.Errorf("root hash has %d bytes, but %s digests have %d bytes", len(raw), algorithm, size)
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	switch strings.ToLower(value) {
+	case "", "1", "yes", "y", "true", "t", "on", "0", "no", "n", "false", "f", "off":
+		return nil
+	}
+	return fmt.Errorf("%q is not a boolean", value)
+}
+
+func validateOneOf(allowed ...string) func(string) error {
+	return func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+	}
+}
+
+func validateUint(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return fmt.Errorf("%q is not an unsigned integer", value)
+	}
+	return nil
+}
+
+func validateBlockSize(value string) error {
+	size, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || size < 512 || size > 1<<20 || size&(size-1) != 0 {
+		return fmt.Errorf("%q is not a power of two between 512 and 1048576", value)
+	}
+	return nil
+}
+
+func validateSalt(value string) error {
+	if value == "-" {
+		return nil
+	}
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a hex string", value)
+	}
+	if len(raw) > 256 {
+		return fmt.Errorf("salt of %d bytes is longer than 256 bytes", len(raw))
+	}
+	return nil
+}
+
+func validateUUID(value string) error {
+	plain := strings.ReplaceAll(value, "-", "")
+	if _, err := hex.DecodeString(plain); err != nil || len(plain) != 32 {
+		return fmt.Errorf("%q is not a UUID", value)
+	}
+	return nil
+}
+
+func validateAlgorithm(value string) error {
+	if _, ok := verityDigestSizes[value]; !ok {
+		return fmt.Errorf("unsupported hash algorithm %q", value)
+	}
+	return nil
+}
+
+func validateNonEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("value must not be empty")
+	}
+	return nil
+}
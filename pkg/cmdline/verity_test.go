@@ -0,0 +1,96 @@
+package cmdline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVerity(t *testing.T) {
+	rootHash := strings.Repeat("ab", 32)
+	testCases := map[string]struct {
+		cmdline         string
+		wantConfigs     int
+		wantFindingKeys []string
+	}{
+		"no verity": {
+			cmdline: "console=ttyS0 quiet",
+		},
+		"roothash only": {
+			cmdline:     "roothash=" + rootHash,
+			wantConfigs: 1,
+		},
+		"root and usr": {
+			cmdline:     "roothash=" + rootHash + " usrhash=" + rootHash + " systemd.verity=yes",
+			wantConfigs: 2,
+		},
+		"full options": {
+			cmdline: "roothash=" + rootHash + " systemd.verity_root_data=PARTUUID=2c9d3a24-5d76-ef1a-e0d1-99afc0a7332e" +
+				" systemd.verity_root_hash=PARTLABEL=root-verity" +
+				" systemd.verity_root_options=superblock=yes,hash=sha256,data-block-size=4096,hash-block-size=4096,salt=abcd,panic-on-corruption",
+			wantConfigs: 1,
+		},
+		"sha1 hash": {
+			cmdline:     "usrhash=" + strings.Repeat("ab", 20) + " systemd.verity_usr_options=hash=sha1",
+			wantConfigs: 1,
+		},
+		"wrong hash length": {
+			cmdline:         "roothash=" + strings.Repeat("ab", 20),
+			wantConfigs:     1,
+			wantFindingKeys: []string{"roothash"},
+		},
+		"invalid hex": {
+			cmdline:         "usrhash=xyz",
+			wantConfigs:     1,
+			wantFindingKeys: []string{"usrhash"},
+		},
+		"missing roothash": {
+			cmdline:         "systemd.verity_root_data=/dev/sda2",
+			wantConfigs:     1,
+			wantFindingKeys: []string{"roothash"},
+		},
+		"bad options": {
+			cmdline:         "roothash=" + rootHash + " systemd.verity_root_options=data-block-size=1000,frobnicate,salt=xyz,ignore-corruption=1",
+			wantConfigs:     1,
+			wantFindingKeys: []string{"systemd.verity_root_options", "systemd.verity_root_options", "systemd.verity_root_options", "systemd.verity_root_options"},
+		},
+		"unknown option and bad bool": {
+			cmdline:         "roothash=" + rootHash + " systemd.verity_var_data=/dev/sda3 rd.systemd.verity=maybe",
+			wantConfigs:     1,
+			wantFindingKeys: []string{"rd.systemd.verity", "systemd.verity_var_data"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := testingCmdline(tc.cmdline)
+			pairs, err := c.Pairs()
+			require.NoError(t, err)
+
+			configs, findings := ParseVerity(pairs)
+			assert.Len(t, configs, tc.wantConfigs)
+			var keys []string
+			for _, finding := range findings {
+				keys = append(keys, finding.Option)
+			}
+			assert.Equal(t, tc.wantFindingKeys, keys)
+		})
+	}
+}
+
+func TestParseDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	kind, value := ParseDevice("PARTUUID=2c9d3a24-5d76-ef1a-e0d1-99afc0a7332e")
+	assert.Equal(DevicePartUUID, kind)
+	assert.Equal("2c9d3a24-5d76-ef1a-e0d1-99afc0a7332e", value)
+
+	kind, value = ParseDevice("/dev/disk/by-partlabel/root-x86-64")
+	assert.Equal(DevicePartLabel, kind)
+	assert.Equal("root-x86-64", value)
+
+	kind, _ = ParseDevice("/dev/sda2")
+	assert.Equal(DeviceOther, kind)
+}
@@ -0,0 +1,123 @@
+package ddi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki"
+)
+
+// globalAddonDir holds addons that systemd-stub applies to every UKI. It is only searched on the ESP.
+const globalAddonDir = "/loader/addons"
+
+// bootCounter matches the boot counting suffix of a UKI file name (like +3-0 in foo+3-0.efi).
+var bootCounter = regexp.MustCompile(`\+\d+(-\d+)?((?i)\.efi)$`)
+
+// Addons returns the systemd-stub addons (*.addon.efi) that apply to the UKI, in the order the stub
+// loads them: the global addons of /loader/addons on the ESP, followed by the addons of the UKI's
+// drop-in directory (<uki>.efi.extra.d) on the partition of the UKI. Both are sorted by name.
+// Addons are returned as UKI values, so they can be edited with UKICmdline.
+func (i *Image) Addons(u UKI) ([]UKI, error) {
+	global, err := i.addonsIn(gpt.EFISystemPartition, globalAddonDir)
+	if err != nil {
+		return nil, err
+	}
+	dropIn, err := i.addonsIn(u.Partition, addonDropInDir(u.Path))
+	if err != nil {
+		return nil, err
+	}
+	return append(global, dropIn...), nil
+}
+
+// SelectAddons returns the addons of the UKI whose path matches pattern.
+// Patterns without slash are matched against the file name.
+func (i *Image) SelectAddons(u UKI, pattern string) ([]UKI, error) {
+	all, err := i.Addons(u)
+	if err != nil {
+		return nil, err
+	}
+	var selected []UKI
+	for _, addon := range all {
+		matched, err := matchPath(pattern, addon.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid addon pattern: %w", err)
+		}
+		if matched {
+			selected = append(selected, addon)
+		}
+	}
+	return selected, nil
+}
+
+// EffectiveCmdline returns the cmdline systemd-stub passes to the kernel when booting the profile of the UKI:
+// the .cmdline section of the profile followed by the .cmdline sections of the addons of the UKI.
+func (i *Image) EffectiveCmdline(u UKI, profile uki.Profile) (string, error) {
+	ukiCmdline, err := i.ProfileCmdline(u, profile)
+	if err != nil {
+		return "", err
+	}
+	content, err := ukiCmdline.String()
+	if err != nil {
+		return "", err
+	}
+	parts := []string{strings.Trim(content, " \x00")}
+	addons, err := i.Addons(u)
+	if err != nil {
+		return "", err
+	}
+	for _, addon := range addons {
+		addonCmdline, err := i.UKICmdline(addon)
+		if err != nil {
+			// addons may carry only devicetrees or initrds
+			continue
+		}
+		content, err := addonCmdline.String()
+		if err != nil {
+			return "", err
+		}
+		if content = strings.Trim(content, " \x00"); content != "" {
+			parts = append(parts, content)
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// addonDropInDir returns the drop-in directory of a UKI. Boot counting suffixes are not part of the name.
+func addonDropInDir(ukiPath string) string {
+	return bootCounter.ReplaceAllString(ukiPath, "$2") + ".extra.d"
+}
+
+func (i *Image) addonsIn(typ gpt.Type, dir string) ([]UKI, error) {
+	fs, err := i.bootFilesystem(typ)
+	if errors.Is(err, gpt.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	infos, err := fs.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dir, err)
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir && strings.HasSuffix(strings.ToLower(info.Name), ".addon.efi") {
+			names = append(names, info.Name)
+		}
+	}
+	sort.Strings(names)
+	addons := make([]UKI, len(names))
+	for j, name := range names {
+		addons[j] = UKI{Partition: typ, Path: path.Join(dir, name)}
+	}
+	return addons, nil
+}
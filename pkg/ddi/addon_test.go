@@ -0,0 +1,95 @@
+package ddi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAddon(cmdline string) []byte {
+	return ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-64s", cmdline))},
+	)
+}
+
+func TestAddons(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition, gpt.ExtendedBootLoader)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/loader/addons"))
+	require.NoError(esp.WriteFile("/loader/addons/b-console.addon.efi", testAddon("console=ttyS0")))
+	require.NoError(esp.WriteFile("/loader/addons/a-quiet.addon.efi", testAddon("quiet")))
+	require.NoError(esp.MkdirAll("/EFI/Linux/foo.efi.extra.d"))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo+3-0.efi", testUKI("root=/dev/sda")))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi.extra.d/debug.addon.efi", testAddon("debug")))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi.extra.d/dtb.addon.efi", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".dtb", Data: []byte("dtb")})))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi.extra.d/readme.txt", []byte("ignored")))
+	xbootldr, err := image.XBOOTLDR()
+	require.NoError(err)
+	require.NoError(xbootldr.MkdirAll("/EFI/Linux"))
+	require.NoError(xbootldr.WriteFile("/EFI/Linux/bar.efi", testUKI("ro")))
+
+	foo := UKI{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo+3-0.efi"}
+	bar := UKI{Partition: gpt.ExtendedBootLoader, Path: "/EFI/Linux/bar.efi"}
+	addons, err := image.Addons(foo)
+	require.NoError(err)
+	assert.Equal([]UKI{
+		{Partition: gpt.EFISystemPartition, Path: "/loader/addons/a-quiet.addon.efi"},
+		{Partition: gpt.EFISystemPartition, Path: "/loader/addons/b-console.addon.efi"},
+		{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi.extra.d/debug.addon.efi"},
+		{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi.extra.d/dtb.addon.efi"},
+	}, addons)
+
+	profiles, err := image.UKIProfiles(foo)
+	require.NoError(err)
+	effective, err := image.EffectiveCmdline(foo, profiles[0])
+	require.NoError(err)
+	assert.Equal("root=/dev/sda quiet console=ttyS0 debug", effective)
+	profiles, err = image.UKIProfiles(bar)
+	require.NoError(err)
+	effective, err = image.EffectiveCmdline(bar, profiles[0])
+	require.NoError(err)
+	assert.Equal("ro quiet console=ttyS0", effective)
+
+	selected, err := image.SelectAddons(foo, "debug*")
+	require.NoError(err)
+	require.Equal(addons[2:3], selected)
+	addonCmdline, err := image.UKICmdline(selected[0])
+	require.NoError(err)
+	require.NoError(addonCmdline.Append("loglevel=7"))
+	content, err := addonCmdline.String()
+	require.NoError(err)
+	assert.Equal("debug loglevel=7", strings.TrimRight(content, " "))
+}
+
+func TestAddonDropInDir(t *testing.T) {
+	testCases := map[string]struct {
+		ukiPath string
+		want    string
+	}{
+		"plain":              {ukiPath: "/EFI/Linux/foo.efi", want: "/EFI/Linux/foo.efi.extra.d"},
+		"boot counter":       {ukiPath: "/EFI/Linux/foo+3-0.efi", want: "/EFI/Linux/foo.efi.extra.d"},
+		"boot counter left":  {ukiPath: "/EFI/Linux/foo+3.efi", want: "/EFI/Linux/foo.efi.extra.d"},
+		"uppercase":          {ukiPath: "/EFI/Linux/FOO+3-0.EFI", want: "/EFI/Linux/FOO.EFI.extra.d"},
+		"plus in name":       {ukiPath: "/EFI/Linux/foo+bar.efi", want: "/EFI/Linux/foo+bar.efi.extra.d"},
+		"not a boot counter": {ukiPath: "/EFI/Linux/foo+3-0-1.efi", want: "/EFI/Linux/foo+3-0-1.efi.extra.d"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, addonDropInDir(tc.ukiPath))
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package ddi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki"
+)
+
+// efiFallbackNames are the file names of the removable media boot path (/EFI/BOOT) per architecture,
+// as defined by the UEFI specification.
+var efiFallbackNames = map[gpt.Arch]string{
+	gpt.ArchX86:         "BOOTIA32.EFI",
+	gpt.ArchX86_64:      "BOOTX64.EFI",
+	gpt.ArchIA64:        "BOOTIA64.EFI",
+	gpt.ArchARM:         "BOOTARM.EFI",
+	gpt.ArchARM64:       "BOOTAA64.EFI",
+	gpt.ArchRISCV32:     "BOOTRISCV32.EFI",
+	gpt.ArchRISCV64:     "BOOTRISCV64.EFI",
+	gpt.ArchLoongArch64: "BOOTLOONGARCH64.EFI",
+}
+
+// FallbackUKIPath returns the removable media boot path of the architecture (like /EFI/BOOT/BOOTAA64.EFI).
+func FallbackUKIPath(arch gpt.Arch) (string, bool) {
+	name, ok := efiFallbackNames[arch]
+	if !ok {
+		return "", false
+	}
+	return path.Join("/EFI/BOOT", name), true
+}
+
+// Arch returns the architecture of the image, derived from the type of the root partition or,
+// for images without root partition, the usr partition.
+// gpt.ErrNotFound is returned for images without architecture specific partitions.
+func (i *Image) Arch() (gpt.Arch, error) {
+	table, err := i.Partitions()
+	if err != nil {
+		return "", fmt.Errorf("reading partition table: %w", err)
+	}
+	var usrArch gpt.Arch
+	for _, part := range table.Partitions {
+		designator, arch, ok := gpt.Lookup(part.Type)
+		if !ok || arch == "" {
+			continue
+		}
+		switch designator {
+		case gpt.DesignatorRoot, gpt.DesignatorRootVerity, gpt.DesignatorRootVeritySig:
+			return arch, nil
+		case gpt.DesignatorUsr, gpt.DesignatorUsrVerity, gpt.DesignatorUsrVeritySig:
+			if usrArch == "" {
+				usrArch = arch
+			}
+		}
+	}
+	if usrArch == "" {
+		return "", gpt.ErrNotFound
+	}
+	return usrArch, nil
+}
+
+// UKIArch returns the architecture of the UKI from the Machine field of its PE header.
+func (i *Image) UKIArch(u UKI) (gpt.Arch, error) {
+	handle, err := i.openUKI(u)
+	if err != nil {
+		return "", err
+	}
+	arch, err := uki.Arch(handle)
+	if err != nil {
+		return "", fmt.Errorf("reading architecture of uki %s: %w", u, err)
+	}
+	return arch, nil
+}
+
+// DefaultUKIPath returns the removable media boot path for the architecture of the image.
+// For images without architecture specific partitions, the first fallback path present on the ESP
+// is used, and /EFI/BOOT/BOOTX64.EFI if there is none.
+func (i *Image) DefaultUKIPath() (string, error) {
+	arch, err := i.Arch()
+	if err == nil {
+		if p, ok := FallbackUKIPath(arch); ok {
+			return p, nil
+		}
+		return "", fmt.Errorf("no EFI fallback path for architecture %s", arch)
+	}
+	if !errors.Is(err, gpt.ErrNotFound) {
+		return "", err
+	}
+	esp, err := i.ESP()
+	if err != nil {
+		return defaultUKIPath, nil
+	}
+	for _, arch := range []gpt.Arch{gpt.ArchX86_64, gpt.ArchARM64, gpt.ArchRISCV64, gpt.ArchX86, gpt.ArchARM, gpt.ArchLoongArch64, gpt.ArchRISCV32, gpt.ArchIA64} {
+		p, _ := FallbackUKIPath(arch)
+		if _, err := esp.Stat(p); err == nil {
+			return p, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return defaultUKIPath, nil
+}
+
+// CheckUKIArch compares the architecture of the UKI with the architecture of the image.
+// Mismatches are reported as warning, since the image would not boot on the intended machines.
+func (i *Image) CheckUKIArch(u UKI) Finding {
+	check := "uki " + u.String() + " architecture"
+	ukiArch, err := i.UKIArch(u)
+	if err != nil {
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	}
+	imageArch, err := i.Arch()
+	if errors.Is(err, gpt.ErrNotFound) {
+		return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("uki is %s, image has no architecture specific partitions", ukiArch)}
+	}
+	if err != nil {
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	}
+	if ukiArch != imageArch {
+		return Finding{Check: check, Severity: SeverityWarning, Message: fmt.Sprintf("uki is %s, but the image is %s", ukiArch, imageArch)}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("uki matches the %s partitions", imageArch)}
+}
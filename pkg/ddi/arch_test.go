@@ -0,0 +1,112 @@
+package ddi
+
+import (
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArch(t *testing.T) {
+	usrRISCV64, _ := gpt.TypeFor(gpt.DesignatorUsr, gpt.ArchRISCV64)
+	rootARM64, _ := gpt.TypeFor(gpt.DesignatorRoot, gpt.ArchARM64)
+	rootVerityARM64, _ := gpt.TypeFor(gpt.DesignatorRootVerity, gpt.ArchARM64)
+
+	testCases := map[string]struct {
+		types []gpt.Type
+		// fallback is the UKI written to /EFI/BOOT on the ESP, if set
+		fallback        string
+		ukiMachine      uint16
+		wantArch        gpt.Arch
+		wantDefaultPath string
+		wantSeverity    Severity
+		wantMessage     string
+	}{
+		"arm64 root": {
+			types:           []gpt.Type{gpt.EFISystemPartition, rootARM64, rootVerityARM64},
+			fallback:        "/EFI/BOOT/BOOTAA64.EFI",
+			ukiMachine:      ukitest.MachineARM64,
+			wantArch:        gpt.ArchARM64,
+			wantDefaultPath: "/EFI/BOOT/BOOTAA64.EFI",
+			wantSeverity:    SeverityOK,
+		},
+		"usr only": {
+			types:           []gpt.Type{gpt.EFISystemPartition, usrRISCV64},
+			fallback:        "/EFI/BOOT/BOOTRISCV64.EFI",
+			ukiMachine:      ukitest.MachineRISCV64,
+			wantArch:        gpt.ArchRISCV64,
+			wantDefaultPath: "/EFI/BOOT/BOOTRISCV64.EFI",
+			wantSeverity:    SeverityOK,
+		},
+		"mismatch": {
+			types:           []gpt.Type{gpt.EFISystemPartition, rootARM64},
+			fallback:        "/EFI/BOOT/BOOTX64.EFI",
+			ukiMachine:      ukitest.MachineAMD64,
+			wantArch:        gpt.ArchARM64,
+			wantDefaultPath: "/EFI/BOOT/BOOTAA64.EFI",
+			wantSeverity:    SeverityWarning,
+			wantMessage:     "uki is x86-64, but the image is arm64",
+		},
+		"usr only mismatch": {
+			types:           []gpt.Type{gpt.EFISystemPartition, usrRISCV64},
+			fallback:        "/EFI/BOOT/BOOTAA64.EFI",
+			ukiMachine:      ukitest.MachineARM64,
+			wantArch:        gpt.ArchRISCV64,
+			wantDefaultPath: "/EFI/BOOT/BOOTRISCV64.EFI",
+			wantSeverity:    SeverityWarning,
+			wantMessage:     "uki is arm64, but the image is riscv64",
+		},
+		"no root partition": {
+			types:           []gpt.Type{gpt.EFISystemPartition},
+			fallback:        "/EFI/BOOT/BOOTIA32.EFI",
+			ukiMachine:      ukitest.MachineI386,
+			wantDefaultPath: "/EFI/BOOT/BOOTIA32.EFI",
+			wantSeverity:    SeverityOK,
+		},
+		"no root partition and no fallback": {
+			types:           []gpt.Type{gpt.EFISystemPartition},
+			wantDefaultPath: "/EFI/BOOT/BOOTX64.EFI",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			image, err := New(newTestImage(t, tc.types...), 0, "")
+			require.NoError(err)
+			defer image.Close()
+			if tc.fallback != "" {
+				esp, err := image.ESP()
+				require.NoError(err)
+				require.NoError(esp.MkdirAll("/EFI/BOOT"))
+				require.NoError(esp.WriteFile(tc.fallback, ukitest.Build(tc.ukiMachine,
+					ukitest.Section{Name: ".cmdline", Data: []byte("quiet")},
+					ukitest.Section{Name: ".linux", Data: []byte("kernel")})))
+			}
+
+			arch, err := image.Arch()
+			if tc.wantArch == "" {
+				assert.ErrorIs(err, gpt.ErrNotFound)
+			} else {
+				require.NoError(err)
+				assert.Equal(tc.wantArch, arch)
+			}
+			defaultPath, err := image.DefaultUKIPath()
+			require.NoError(err)
+			assert.Equal(tc.wantDefaultPath, defaultPath)
+
+			if tc.fallback == "" {
+				return
+			}
+			finding := image.CheckUKIArch(UKI{Partition: gpt.EFISystemPartition, Path: tc.fallback})
+			assert.Equal(tc.wantSeverity, finding.Severity, finding.Message)
+			if tc.wantMessage != "" {
+				assert.Equal(tc.wantMessage, finding.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package ddi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/bls"
+	"github.com/malt3/ddi-tool/pkg/cmdline"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+)
+
+// bootEntryDir is the directory of Type #1 boot loader entries on the ESP and the XBOOTLDR partition.
+const bootEntryDir = "/loader/entries"
+
+// bootEntryGrowth is the room for additional cmdline options when editing a boot loader entry.
+// Entries are rewritten as a whole, so the capacity is not bound by the file.
+const bootEntryGrowth = 4096
+
+// BootEntry is a Type #1 boot loader entry of the Boot Loader Specification.
+type BootEntry struct {
+	// Partition is the type of the partition holding the entry
+	// (gpt.EFISystemPartition or gpt.ExtendedBootLoader).
+	Partition gpt.Type
+	Path      string
+}
+
+func (e BootEntry) String() string {
+	return e.Partition.String() + ":" + e.Path
+}
+
+// BootEntries returns all boot loader entries (/loader/entries/*.conf) of the ESP and the XBOOTLDR partition.
+func (i *Image) BootEntries() ([]BootEntry, error) {
+	var entries []BootEntry
+	for _, typ := range []gpt.Type{gpt.EFISystemPartition, gpt.ExtendedBootLoader} {
+		fs, err := i.bootFilesystem(typ)
+		if errors.Is(err, gpt.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos, err := fs.ReadDir(bootEntryDir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", bootEntryDir, err)
+		}
+		for _, info := range infos {
+			if info.IsDir || !strings.HasSuffix(strings.ToLower(info.Name), ".conf") {
+				continue
+			}
+			entries = append(entries, BootEntry{Partition: typ, Path: path.Join(bootEntryDir, info.Name)})
+		}
+	}
+	return entries, nil
+}
+
+// SelectBootEntries returns the boot loader entries to patch: all entries found by BootEntries
+// whose path matches pattern (all if pattern is empty).
+// If a UKI path was given to New, no entries are selected.
+func (i *Image) SelectBootEntries(pattern string) ([]BootEntry, error) {
+	if i.ukiPath != "" {
+		return nil, nil
+	}
+	all, err := i.BootEntries()
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		return all, nil
+	}
+	var selected []BootEntry
+	for _, e := range all {
+		matched, err := matchPath(pattern, e.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry pattern: %w", err)
+		}
+		if matched {
+			selected = append(selected, e)
+		}
+	}
+	return selected, nil
+}
+
+// BootEntryCmdline is the editable options of a boot loader entry.
+// Changes are kept in memory until Save rewrites the entry file.
+type BootEntryCmdline struct {
+	*cmdline.Cmdline
+	image *Image
+	entry BootEntry
+	bls   *bls.Entry
+}
+
+// BootEntryCmdline returns the options of the boot loader entry for editing.
+func (i *Image) BootEntryCmdline(e BootEntry) (*BootEntryCmdline, error) {
+	fs, err := i.bootFilesystem(e.Partition)
+	if err != nil {
+		return nil, err
+	}
+	content, err := fs.ReadFile(e.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading boot entry %s: %w", e, err)
+	}
+	entry := bls.Parse(content)
+	options := entry.Options()
+	return &BootEntryCmdline{
+		Cmdline: cmdline.NewMemory(options, int64(len(options)+bootEntryGrowth)),
+		image:   i,
+		entry:   e,
+		bls:     entry,
+	}, nil
+}
+
+// Save writes the edited options back to the boot loader entry file.
+// Whitespace between options is collapsed to single spaces.
+func (c *BootEntryCmdline) Save() error {
+	options, err := c.String()
+	if err != nil {
+		return err
+	}
+	c.bls.SetOptions(strings.Join(strings.Fields(options), " "))
+	fs, err := c.image.bootFilesystem(c.entry.Partition)
+	if err != nil {
+		return err
+	}
+	if err := fs.WriteFile(c.entry.Path, c.bls.Bytes()); err != nil {
+		return fmt.Errorf("writing boot entry %s: %w", c.entry, err)
+	}
+	return nil
+}
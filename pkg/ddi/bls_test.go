@@ -0,0 +1,70 @@
+package ddi
+
+import (
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootEntries(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition, gpt.ExtendedBootLoader)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/loader/entries"))
+	require.NoError(esp.WriteFile("/loader/entries/fedora.conf",
+		[]byte("# fedora\ntitle Fedora\nlinux /vmlinuz\noptions quiet roothash=0 console=ttyS0\n")))
+	require.NoError(esp.WriteFile("/loader/loader.conf", []byte("timeout 3\n")))
+	xbootldr, err := image.XBOOTLDR()
+	require.NoError(err)
+	require.NoError(xbootldr.MkdirAll("/loader/entries"))
+	require.NoError(xbootldr.WriteFile("/loader/entries/debian.conf",
+		[]byte("title Debian\noptions quiet\noptions usrhash=0123456789\n")))
+
+	entries, err := image.BootEntries()
+	require.NoError(err)
+	assert.Equal([]BootEntry{
+		{Partition: gpt.EFISystemPartition, Path: "/loader/entries/fedora.conf"},
+		{Partition: gpt.ExtendedBootLoader, Path: "/loader/entries/debian.conf"},
+	}, entries)
+	assert.Equal("esp:/loader/entries/fedora.conf", entries[0].String())
+
+	selected, err := image.SelectBootEntries("deb*")
+	require.NoError(err)
+	assert.Equal(entries[1:], selected)
+
+	fedora, err := image.BootEntryCmdline(entries[0])
+	require.NoError(err)
+	require.NoError(fedora.SetOption("roothash", "abcdef"))
+	require.NoError(fedora.SetOption("usrhash", "1234"))
+	require.NoError(fedora.Save())
+	esp, err = image.ESP()
+	require.NoError(err)
+	content, err := esp.ReadFile("/loader/entries/fedora.conf")
+	require.NoError(err)
+	assert.Equal("# fedora\ntitle Fedora\nlinux /vmlinuz\noptions quiet console=ttyS0 roothash=abcdef usrhash=1234\n", string(content))
+
+	debian, err := image.BootEntryCmdline(entries[1])
+	require.NoError(err)
+	require.NoError(debian.SetOption("usrhash", "abcd"))
+	require.NoError(debian.Save())
+	xbootldr, err = image.XBOOTLDR()
+	require.NoError(err)
+	content, err = xbootldr.ReadFile("/loader/entries/debian.conf")
+	require.NoError(err)
+	assert.Equal("title Debian\noptions quiet usrhash=abcd\n", string(content))
+
+	explicit, err := New(imagePath, 0, "/EFI/Linux/foo.efi")
+	require.NoError(err)
+	defer explicit.Close()
+	selected, err = explicit.SelectBootEntries("")
+	require.NoError(err)
+	assert.Empty(selected)
+}
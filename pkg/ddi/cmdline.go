@@ -0,0 +1,145 @@
+package ddi
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/cmdline"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/verity"
+)
+
+// ValidateCmdline checks the syntax of the dm-verity options of the cmdline and whether they agree
+// with the partitions and verity superblocks of the image.
+func (i *Image) ValidateCmdline(c *cmdline.Cmdline) ([]Finding, error) {
+	pairs, err := c.Pairs()
+	if err != nil {
+		return nil, err
+	}
+	table, err := i.Partitions()
+	if err != nil {
+		return nil, err
+	}
+	sets, err := i.VeritySets()
+	if err != nil {
+		return nil, err
+	}
+
+	configs, syntaxFindings := cmdline.ParseVerity(pairs)
+	var findings []Finding
+	for _, finding := range syntaxFindings {
+		findings = append(findings, Finding{Check: "cmdline " + finding.Option, Severity: SeverityError, Message: finding.Message})
+	}
+	for _, config := range configs {
+		findings = append(findings, i.validateVerityConfig(config, table, sets)...)
+	}
+	return findings, nil
+}
+
+func (i *Image) validateVerityConfig(config cmdline.VerityConfig, table *gpt.Table, sets []VeritySet) []Finding {
+	check := "cmdline " + config.Designator + " verity"
+	var set *VeritySet
+	for _, s := range sets {
+		if string(s.Designator) == config.Designator {
+			set = &s
+			break
+		}
+	}
+	if set == nil {
+		return []Finding{{Check: check, Severity: SeverityError, Message: fmt.Sprintf("cmdline configures %s verity, but the image has no %s verity partitions", config.Designator, config.Designator)}}
+	}
+
+	var findings []Finding
+	if sb, err := i.VeritySuperblock(*set); err != nil {
+		findings = append(findings, Finding{Check: check, Severity: SeverityError, Message: err.Error()})
+	} else {
+		findings = append(findings, compareVerityOptions(check, config, sb)...)
+	}
+
+	for _, device := range []struct {
+		option    string
+		spec      string
+		partition gpt.Partition
+	}{
+		{option: "systemd.verity_" + config.Designator + "_data", spec: config.DataDevice, partition: set.Data},
+		{option: "systemd.verity_" + config.Designator + "_hash", spec: config.HashDevice, partition: set.Hash},
+	} {
+		// without the option, the partition is found by the uuid derived from the root hash,
+		// which is checked by Verify for all cmdlines at once
+		if device.spec == "" {
+			continue
+		}
+		findings = append(findings, checkDevice("cmdline "+device.option, device.spec, device.partition, table))
+	}
+	return findings
+}
+
+func compareVerityOptions(check string, config cmdline.VerityConfig, sb *verity.Superblock) []Finding {
+	var findings []Finding
+	mismatch := func(format string, args ...any) {
+		findings = append(findings, Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf(format, args...)})
+	}
+	if digestSize, err := verity.DigestSize(sb.Algorithm); err == nil && len(config.RootHash) > 0 && len(config.RootHash) != 2*digestSize {
+		mismatch("%shash has %d hex digits, but the superblock uses %s with %d byte digests", config.Designator, len(config.RootHash), sb.Algorithm, digestSize)
+	}
+	uintOptions := map[string]uint64{
+		"format":          uint64(sb.HashType),
+		"data-block-size": uint64(sb.DataBlockSize),
+		"hash-block-size": uint64(sb.HashBlockSize),
+		"data-blocks":     sb.DataBlocks,
+	}
+	for _, name := range []string{"format", "data-block-size", "hash-block-size", "data-blocks"} {
+		value, ok := config.Options[name]
+		if !ok {
+			continue
+		}
+		if parsed, err := strconv.ParseUint(value, 10, 64); err == nil && parsed != uintOptions[name] {
+			mismatch("option %s=%s, but the superblock has %d", name, value, uintOptions[name])
+		}
+	}
+	if algorithm, ok := config.Options["hash"]; ok && algorithm != sb.Algorithm {
+		mismatch("option hash=%s, but the superblock uses %s", algorithm, sb.Algorithm)
+	}
+	if salt, ok := config.Options["salt"]; ok {
+		expected := hex.EncodeToString(sb.Salt)
+		if salt == "-" {
+			salt = ""
+		}
+		if !strings.EqualFold(salt, expected) {
+			mismatch("option salt=%s, but the superblock has salt %s", salt, expected)
+		}
+	}
+	if uuid, ok := config.Options["uuid"]; ok && !strings.EqualFold(uuid, sb.UUIDString()) {
+		mismatch("option uuid=%s, but the superblock has uuid %s", uuid, sb.UUIDString())
+	}
+	if len(findings) == 0 {
+		findings = append(findings, Finding{Check: check, Severity: SeverityOK, Message: "options agree with the verity superblock"})
+	}
+	return findings
+}
+
+func checkDevice(check, spec string, expected gpt.Partition, table *gpt.Table) Finding {
+	kind, value := cmdline.ParseDevice(spec)
+	var part gpt.Partition
+	var err error
+	switch kind {
+	case cmdline.DevicePartUUID:
+		part, err = table.FindByUUID(value)
+	case cmdline.DevicePartLabel:
+		part, err = table.FindByName(value)
+	default:
+		return Finding{Check: check, Severity: SeverityWarning, Message: fmt.Sprintf("device %s cannot be resolved within the image", spec)}
+	}
+	switch {
+	case errors.Is(err, gpt.ErrNotFound):
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("device %s does not exist in the image", spec)}
+	case err != nil:
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	case part.Index != expected.Index:
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("device %s is partition %d, expected partition %d", spec, part.Index+1, expected.Index+1)}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("device %s is partition %d", spec, part.Index+1)}
+}
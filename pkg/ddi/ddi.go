@@ -4,75 +4,85 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"slices"
 
 	"github.com/malt3/ddi-tool/pkg/cmdline"
-	"github.com/malt3/ddi-tool/pkg/fat"
+	"github.com/malt3/ddi-tool/pkg/disk"
 	"github.com/malt3/ddi-tool/pkg/gpt"
-	"github.com/malt3/ddi-tool/pkg/uki"
 )
 
 type Image struct {
 	path      string
-	file      *os.File
+	disk      disk.Disk
 	blocksize int64
 	ukiPath   string
 }
 
 // New creates a new Image instance.
-// imagePath is the path to the image file.
-// blocksize is the blocksize of the image (usually 512, use 0 to enable autodetection).
-// ukiPath is the path to the uki binary inside the EFI partition (usually /EFI/BOOT/BOOTX64.EFI).
+// imagePath is the path to the image file or block device.
+// blocksize is the blocksize of the image (usually 512, use 0 to enable autodetection:
+// block devices report their logical sector size, image files are probed for the GPT header).
+// ukiPath is the path to the uki binary inside the EFI partition (use "" for the fallback path
+// of the image architecture, like /EFI/BOOT/BOOTAA64.EFI, and, where all UKIs are considered, for discovery).
 func New(imagePath string, blocksize int64, ukiPath string) (*Image, error) {
-	file, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	d, err := disk.Open(imagePath)
 	if err != nil {
-		return nil, fmt.Errorf("opening image file: %w", err)
+		return nil, err
+	}
+	return NewFromDisk(d, imagePath, blocksize, ukiPath)
+}
+
+// NewReadOnly creates a new Image instance like New, but opens the image for reading only
+// (see disk.OpenReadOnly).
+func NewReadOnly(imagePath string, blocksize int64, ukiPath string) (*Image, error) {
+	d, err := disk.OpenReadOnly(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromDisk(d, imagePath, blocksize, ukiPath)
+}
+
+// NewFromDisk creates a new Image instance on an opened disk, which is closed with the image.
+// imagePath names the image for its sidecar files. See New for blocksize and ukiPath.
+func NewFromDisk(d disk.Disk, imagePath string, blocksize int64, ukiPath string) (*Image, error) {
+	var err error
+	if blocksize == 0 {
+		blocksize = d.SectorSize()
 	}
 	if blocksize == 0 {
-		blocksize, err = learnBlocksize(file)
+		blocksize, err = learnBlocksize(d)
 		if err != nil {
+			d.Close()
 			return nil, fmt.Errorf("learning blocksize: %w", err)
 		}
 	}
-	if ukiPath == "" {
-		ukiPath = "/EFI/BOOT/BOOTX64.EFI"
-	}
 	return &Image{
 		path:      imagePath,
-		file:      file,
+		disk:      d,
 		blocksize: blocksize,
 		ukiPath:   ukiPath,
 	}, nil
 }
 
+// Close closes the image. Changes to block devices are flushed.
 func (i *Image) Close() error {
-	return i.file.Close()
+	return i.disk.Close()
 }
 
+// GetCmdline returns the cmdline of the UKI at the path given to New or at DefaultUKIPath.
 func (i *Image) GetCmdline() (*cmdline.Cmdline, error) {
-	efiSectionStart, efiSectionSize, err := gpt.EFIPartitionSection(i.path)
-	if err != nil {
-		return nil, fmt.Errorf("finding cmdline: getting EFI partition section: %w", err)
-	}
-
-	efiPartition := io.NewSectionReader(i.file, efiSectionStart, efiSectionSize)
-
-	fileContentOffset, fileContentSize, err := fat.FileContentSection(efiPartition, efiSectionSize, i.blocksize, i.ukiPath)
-	if err != nil {
-		return nil, fmt.Errorf("finding cmdline: getting file content section within EFI partition: %w", err)
+	ukiPath := i.ukiPath
+	if ukiPath == "" {
+		var err error
+		if ukiPath, err = i.DefaultUKIPath(); err != nil {
+			return nil, fmt.Errorf("finding cmdline: %w", err)
+		}
 	}
-
-	ukiReader := io.NewSectionReader(i.file, efiSectionStart+fileContentOffset, fileContentSize)
-	cmdlineOffset, cmdlineSize, err := uki.SectionBounds(ukiReader, ".cmdline")
+	cmdline, err := i.UKICmdline(UKI{Partition: gpt.EFISystemPartition, Path: ukiPath})
 	if err != nil {
-		return nil, fmt.Errorf("finding cmdline: getting ,cmdline section within uki: %w", err)
+		return nil, fmt.Errorf("finding cmdline: %w", err)
 	}
-
-	return cmdline.New(
-		cmdline.NewSectionHandle(i.file, efiSectionStart+fileContentOffset+cmdlineOffset, cmdlineSize),
-		cmdlineSize,
-	), nil
+	return cmdline, nil
 }
 
 func learnBlocksize(r io.ReaderAt) (int64, error) {
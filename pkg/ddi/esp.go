@@ -0,0 +1,22 @@
+package ddi
+
+import (
+	"fmt"
+
+	"github.com/malt3/ddi-tool/pkg/fat"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+)
+
+// ESP opens the FAT filesystem of the EFI system partition for reading and writing.
+// Accesses are confined to the bounds of the partition.
+func (i *Image) ESP() (*fat.FileSystem, error) {
+	start, size, err := gpt.EFIPartitionSection(i.disk, i.blocksize)
+	if err != nil {
+		return nil, fmt.Errorf("getting EFI partition section: %w", err)
+	}
+	esp, err := fat.Open(fat.NewExtentHandle(i.disk, start, []fat.Extent{{Size: size}}), size)
+	if err != nil {
+		return nil, fmt.Errorf("opening EFI partition: %w", err)
+	}
+	return esp, nil
+}
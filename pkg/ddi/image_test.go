@@ -0,0 +1,212 @@
+package ddi
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	ddisk "github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	dgpt "github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/malt3/ddi-tool/pkg/disk"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPartitionSize = 64 << 20
+
+// newTestImage creates a sparse GPT image with a partition of 64 MiB for each type.
+// ESP and XBOOTLDR partitions are formatted with FAT32.
+func newTestImage(t *testing.T, types ...gpt.Type) string {
+	imagePath := filepath.Join(t.TempDir(), "image.raw")
+	const sectors = testPartitionSize / 512
+	d, err := diskfs.Create(imagePath, int64(len(types)+1)*testPartitionSize, diskfs.Raw, diskfs.SectorSizeDefault)
+	require.NoError(t, err)
+	defer d.File.Close()
+	table := &dgpt.Table{ProtectiveMBR: true, LogicalSectorSize: 512, PhysicalSectorSize: 512}
+	for i, typ := range types {
+		start := uint64(2048 + i*sectors)
+		table.Partitions = append(table.Partitions, &dgpt.Partition{
+			Start: start,
+			End:   start + sectors - 1,
+			Type:  dgpt.Type(typ),
+			Name:  typ.String(),
+		})
+	}
+	require.NoError(t, d.Partition(table))
+	for i, typ := range types {
+		if typ == gpt.EFISystemPartition || typ == gpt.ExtendedBootLoader {
+			_, err := d.CreateFilesystem(ddisk.FilesystemSpec{Partition: i + 1, FSType: filesystem.TypeFat32})
+			require.NoError(t, err)
+		}
+	}
+	return imagePath
+}
+
+// toQcow2 converts a raw image to qcow2, skipping zero clusters.
+func convertImage(t *testing.T, rawPath, format string) string {
+	src, err := disk.Open(rawPath)
+	require.NoError(t, err)
+	defer src.Close()
+	path := strings.TrimSuffix(rawPath, ".raw") + "." + format
+	_, err = disk.Export(context.Background(), path, format, src)
+	require.NoError(t, err)
+	return path
+}
+
+func TestImageFormats(t *testing.T) {
+	for _, format := range []string{disk.FormatQcow2, disk.FormatVHD, disk.FormatVHDDynamic, disk.FormatVHDX} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			rawPath := newTestImage(t, gpt.EFISystemPartition)
+			image, err := New(rawPath, 0, "")
+			require.NoError(err)
+			esp, err := image.ESP()
+			require.NoError(err)
+			require.NoError(esp.MkdirAll("/EFI/Linux"))
+			require.NoError(esp.WriteFile("/EFI/Linux/foo.efi", testUKI("roothash=0000")))
+			require.NoError(image.Close())
+
+			path := convertImage(t, rawPath, format)
+			image, err = New(path, 0, "")
+			require.NoError(err)
+			ukis, err := image.UKIs()
+			require.NoError(err)
+			require.Equal([]UKI{{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi"}}, ukis)
+			c, err := image.UKICmdline(ukis[0])
+			require.NoError(err)
+			require.NoError(c.SetOne("roothash", "abcd", true))
+			esp, err = image.ESP()
+			require.NoError(err)
+			require.NoError(esp.WriteFile("/EFI/Linux/new.txt", bytes.Repeat([]byte("new file "), 10000)))
+			require.NoError(image.Close())
+
+			image, err = New(path, 0, "")
+			require.NoError(err)
+			defer image.Close()
+			c, err = image.UKICmdline(ukis[0])
+			require.NoError(err)
+			content, err := c.String()
+			require.NoError(err)
+			assert.Equal("roothash=abcd", strings.TrimRight(content, " "))
+			esp, err = image.ESP()
+			require.NoError(err)
+			problems, err := esp.Check(false)
+			require.NoError(err)
+			assert.Empty(problems)
+		})
+	}
+}
+
+func TestCompressedImage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rawPath := newTestImage(t, gpt.EFISystemPartition)
+	image, err := New(rawPath, 0, "")
+	require.NoError(err)
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi", testUKI("roothash=0000")))
+	require.NoError(image.Close())
+	zstPath := convertImage(t, rawPath, disk.FormatZstd)
+
+	// reading works in place, writing needs an overlay
+	image, err = New(zstPath, 0, "")
+	require.NoError(err)
+	ukis, err := image.UKIs()
+	require.NoError(err)
+	require.Equal([]UKI{{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi"}}, ukis)
+	c, err := image.UKICmdline(ukis[0])
+	require.NoError(err)
+	assert.ErrorIs(c.SetOne("roothash", "abcd", true), disk.ErrReadOnly)
+	require.NoError(image.Close())
+
+	d, err := disk.Open(zstPath)
+	require.NoError(err)
+	overlay := disk.NewOverlay(d)
+	image, err = NewFromDisk(overlay, "", 0, "")
+	require.NoError(err)
+	c, err = image.UKICmdline(ukis[0])
+	require.NoError(err)
+	require.NoError(c.SetOne("roothash", "abcd", true))
+	outputPath := filepath.Join(t.TempDir(), "finalized.raw.xz")
+	_, err = disk.Export(context.Background(), outputPath, disk.FormatXz, overlay)
+	require.NoError(err)
+	require.NoError(image.Close())
+
+	image, err = New(outputPath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	c, err = image.UKICmdline(ukis[0])
+	require.NoError(err)
+	content, err := c.String()
+	require.NoError(err)
+	assert.Equal("roothash=abcd", strings.TrimRight(content, " "))
+	esp, err = image.ESP()
+	require.NoError(err)
+	problems, err := esp.Check(false)
+	require.NoError(err)
+	assert.Empty(problems)
+}
+
+func TestRemoteImage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rawPath := newTestImage(t, gpt.EFISystemPartition)
+	image, err := New(rawPath, 0, "")
+	require.NoError(err)
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi", testUKI("roothash=0000")))
+	require.NoError(image.Close())
+	seekablePath := convertImage(t, rawPath, disk.FormatSeekableZstd)
+
+	var transferred atomic.Int64
+	files := http.FileServer(http.Dir(filepath.Dir(rawPath)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files.ServeHTTP(&countingWriter{ResponseWriter: w, n: &transferred}, r)
+	}))
+	defer server.Close()
+
+	for _, name := range []string{filepath.Base(rawPath), filepath.Base(seekablePath)} {
+		image, err := New(server.URL+"/"+name, 0, "")
+		require.NoError(err)
+		ukis, err := image.UKIs()
+		require.NoError(err)
+		require.Equal([]UKI{{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi"}}, ukis)
+		c, err := image.UKICmdline(ukis[0])
+		require.NoError(err)
+		content, err := c.String()
+		require.NoError(err)
+		assert.Equal("roothash=0000", strings.TrimRight(content, " "))
+		assert.ErrorIs(c.SetOne("roothash", "abcd", true), disk.ErrReadOnly)
+		require.NoError(image.Close())
+	}
+	// only the partition table and the ESP metadata were fetched
+	assert.Less(transferred.Load(), int64(testPartitionSize/4))
+}
+
+// countingWriter adds the bytes written to the response to n.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,70 @@
+package ddi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/disk"
+)
+
+// NeedsSidecars reports whether the image has neither a UKI nor a boot loader entry whose cmdline could
+// carry the root hashes. Such images (like system extensions, or images with only a boot loader on
+// their ESP) use sidecar files instead.
+func (i *Image) NeedsSidecars() (bool, error) {
+	ukis, err := i.SelectUKIs("")
+	if err != nil {
+		return false, err
+	}
+	entries, err := i.SelectBootEntries("")
+	if err != nil {
+		return false, err
+	}
+	return len(ukis) == 0 && len(entries) == 0, nil
+}
+
+// archiveSuffixes are the suffixes of compressed images and tar.gz archives. Sidecars belong to the
+// image once it is decompressed, so they are named after the image without them.
+var archiveSuffixes = []string{".tar.gz", ".tgz", ".zst", ".zstd", ".xz", ".gz"}
+
+// SidecarPath returns the path systemd-dissect looks at for a sidecar file of the image.
+// Compression and archive suffixes are removed first. A .raw suffix of the image is replaced,
+// other names get the suffix appended (image.raw and image.raw.zst become image.roothash,
+// image.img becomes image.img.roothash).
+func SidecarPath(imagePath, suffix string) string {
+	for _, archive := range archiveSuffixes {
+		if strings.HasSuffix(imagePath, archive) {
+			imagePath = strings.TrimSuffix(imagePath, archive)
+			break
+		}
+	}
+	return strings.TrimSuffix(imagePath, ".raw") + suffix
+}
+
+// WriteHashSidecar writes the hex encoded hash to the .roothash or .usrhash sidecar.
+// key is the cmdline key of the hash (roothash or usrhash).
+func (i *Image) WriteHashSidecar(ctx context.Context, key, hash string) (string, error) {
+	path := SidecarPath(i.path, "."+key)
+	if err := writeSidecar(ctx, path, []byte(hash+"\n")); err != nil {
+		return "", fmt.Errorf("writing %s sidecar: %w", key, err)
+	}
+	return path, nil
+}
+
+// WriteSignatureSidecar writes the DER encoded PKCS #7 signature of a hash to the .roothash.p7s or .usrhash.p7s sidecar.
+func (i *Image) WriteSignatureSidecar(ctx context.Context, key string, signature []byte) (string, error) {
+	path := SidecarPath(i.path, "."+key+".p7s")
+	if err := writeSidecar(ctx, path, signature); err != nil {
+		return "", fmt.Errorf("writing %s signature sidecar: %w", key, err)
+	}
+	return path, nil
+}
+
+// writeSidecar writes a sidecar file, or uploads it next to an image in S3.
+func writeSidecar(ctx context.Context, path string, content []byte) error {
+	if disk.IsS3URL(path) {
+		return disk.WriteS3Object(ctx, path, content)
+	}
+	return os.WriteFile(path, content, 0o644)
+}
@@ -0,0 +1,68 @@
+package ddi
+
+import (
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSidecarPath(t *testing.T) {
+	testCases := map[string]struct {
+		imagePath string
+		suffix    string
+		want      string
+	}{
+		"raw":            {imagePath: "/var/lib/extensions/foo.raw", suffix: ".roothash", want: "/var/lib/extensions/foo.roothash"},
+		"other name":     {imagePath: "foo.img", suffix: ".usrhash.p7s", want: "foo.img.usrhash.p7s"},
+		"zstd":           {imagePath: "foo.raw.zst", suffix: ".roothash", want: "foo.roothash"},
+		"seekable zstd":  {imagePath: "foo.raw.zstd", suffix: ".usrhash", want: "foo.usrhash"},
+		"xz":             {imagePath: "foo.raw.xz", suffix: ".roothash.p7s", want: "foo.roothash.p7s"},
+		"gzip":           {imagePath: "foo.raw.gz", suffix: ".roothash", want: "foo.roothash"},
+		"tar.gz":         {imagePath: "foo.tar.gz", suffix: ".roothash", want: "foo.roothash"},
+		"compressed img": {imagePath: "foo.img.zst", suffix: ".roothash", want: "foo.img.roothash"},
+		"s3":             {imagePath: "s3://images/os/foo.raw.zst", suffix: ".roothash", want: "s3://images/os/foo.roothash"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, SidecarPath(tc.imagePath, tc.suffix))
+		})
+	}
+}
+
+func TestNeedsSidecars(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+
+	// an ESP with only systemd-boot has no cmdline to carry the root hash
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/BOOT"))
+	require.NoError(esp.WriteFile("/EFI/BOOT/BOOTX64.EFI", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".sdmagic", Data: []byte("#### LoaderInfo: systemd-boot 256 ####")},
+	)))
+	sidecars, err := image.NeedsSidecars()
+	require.NoError(err)
+	assert.True(sidecars)
+
+	require.NoError(esp.MkdirAll("/loader/entries"))
+	require.NoError(esp.WriteFile("/loader/entries/entry.conf", []byte("title Entry\nlinux /vmlinuz\n")))
+	sidecars, err = image.NeedsSidecars()
+	require.NoError(err)
+	assert.False(sidecars)
+
+	require.NoError(esp.Remove("/loader/entries/entry.conf"))
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/uki.efi", testUKI("roothash=0000")))
+	sidecars, err = image.NeedsSidecars()
+	require.NoError(err)
+	assert.False(sidecars)
+}
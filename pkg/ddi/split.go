@@ -0,0 +1,320 @@
+package ddi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/malt3/ddi-tool/api/repart"
+	"github.com/malt3/ddi-tool/pkg/disk"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+)
+
+// splitDisk presents the partition files written by systemd-repart --split=yes as a disk: every file
+// is placed at the offset of its partition in the full image, behind a partition table built from the
+// repart output. If the full image is present, everything but the split partitions is read from it
+// and all writes go to both the split files and the image, which keeps them consistent.
+type splitDisk struct {
+	size      int64
+	blocksize int64
+	// parts are sorted by start.
+	parts []splitPartition
+	// image is the full image (optional). Without it, primary and backup are the partition table.
+	image           disk.Disk
+	primary, backup []byte
+}
+
+type splitPartition struct {
+	path      string
+	partition gpt.Partition
+	disk      disk.Disk
+}
+
+// NewSplit creates an Image from the split partition files listed (as split_path) in the output of
+// systemd-repart --split=yes. Partitions without split file are not part of the image.
+// imagePath is the full image written by the same run of systemd-repart (optional). If given, its
+// partition table is used, writes go to the split files and the image alike and sidecars are named
+// after it. See New for blocksize (which defaults to 512 without image) and ukiPath.
+// With readOnly, the image and the split files are opened for reading only.
+func NewSplit(partitions repart.Output, imagePath string, blocksize int64, ukiPath string, readOnly bool) (*Image, error) {
+	open := disk.Open
+	if readOnly {
+		open = disk.OpenReadOnly
+	}
+	d := &splitDisk{}
+	if imagePath != "" {
+		image, err := open(imagePath)
+		if err != nil {
+			return nil, err
+		}
+		d.image = image
+	}
+	if err := d.open(partitions, blocksize, open); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return NewFromDisk(d, imagePath, d.blocksize, ukiPath)
+}
+
+func (d *splitDisk) open(partitions repart.Output, blocksize int64, open func(path string) (disk.Disk, error)) error {
+	var err error
+	switch {
+	case blocksize != 0:
+	case d.image == nil:
+		blocksize = 512
+	case d.image.SectorSize() != 0:
+		blocksize = d.image.SectorSize()
+	default:
+		if blocksize, err = learnBlocksize(d.image); err != nil {
+			return fmt.Errorf("learning blocksize: %w", err)
+		}
+	}
+	d.blocksize = blocksize
+
+	var end int64
+	for _, p := range partitions {
+		if p.SplitPath == "" {
+			continue
+		}
+		part, err := openSplitPartition(p, blocksize, open)
+		if err != nil {
+			return err
+		}
+		d.parts = append(d.parts, part)
+		end = max(end, part.partition.Start+part.partition.Size)
+	}
+	if len(d.parts) == 0 {
+		return errors.New("repart output lists no split partition files (split_path), run systemd-repart with --split=yes")
+	}
+	sort.Slice(d.parts, func(i, j int) bool { return d.parts[i].partition.Start < d.parts[j].partition.Start })
+	for i := 1; i < len(d.parts); i++ {
+		if d.parts[i].partition.Start < d.parts[i-1].partition.Start+d.parts[i-1].partition.Size {
+			return fmt.Errorf("split partitions %s and %s overlap", d.parts[i-1].path, d.parts[i].path)
+		}
+	}
+
+	if d.image != nil {
+		d.size = d.image.Size()
+		return d.matchImage()
+	}
+	entriesSize := (128*128 + blocksize - 1) / blocksize * blocksize
+	d.size = (end+blocksize-1)/blocksize*blocksize + entriesSize + blocksize
+	table := make([]gpt.Partition, len(d.parts))
+	for i, part := range d.parts {
+		table[i] = part.partition
+	}
+	d.primary, d.backup, err = gpt.Build(blocksize, d.size, string(gpt.Unused), table)
+	return err
+}
+
+func openSplitPartition(p repart.Partition, blocksize int64, open func(path string) (disk.Disk, error)) (splitPartition, error) {
+	typ, err := gpt.ParseType(p.Type)
+	if err != nil {
+		return splitPartition{}, fmt.Errorf("split partition %s: %w", p.SplitPath, err)
+	}
+	if p.Offset%blocksize != 0 || p.RawSize%blocksize != 0 || p.RawSize == 0 {
+		return splitPartition{}, fmt.Errorf("split partition %s at %d with %d bytes is not aligned to blocks of %d bytes", p.SplitPath, p.Offset, p.RawSize, blocksize)
+	}
+	d, err := open(p.SplitPath)
+	if err != nil {
+		return splitPartition{}, fmt.Errorf("opening split partition: %w", err)
+	}
+	if d.Size() != p.RawSize {
+		d.Close()
+		return splitPartition{}, fmt.Errorf("split partition %s has %d bytes, repart output says %d", p.SplitPath, d.Size(), p.RawSize)
+	}
+	return splitPartition{
+		path: p.SplitPath,
+		partition: gpt.Partition{
+			Index:    int(p.Partno),
+			Type:     typ,
+			UUID:     strings.ToUpper(p.UUID),
+			Name:     p.Label,
+			FirstLBA: uint64(p.Offset / blocksize),
+			LastLBA:  uint64((p.Offset+p.RawSize)/blocksize - 1),
+			Start:    p.Offset,
+			Size:     p.RawSize,
+		},
+		disk: d,
+	}, nil
+}
+
+// matchImage checks that the split partitions are partitions of the full image.
+func (d *splitDisk) matchImage() error {
+	table, err := gpt.Read(d.image, d.blocksize)
+	if err != nil {
+		return fmt.Errorf("reading partition table of the image: %w", err)
+	}
+	for _, part := range d.parts {
+		found, err := table.FindByUUID(part.partition.UUID)
+		if err != nil || found.Start != part.partition.Start || found.Size != part.partition.Size {
+			return fmt.Errorf("split partition %s (uuid %s at %d with %d bytes) is not a partition of the image", part.path, part.partition.UUID, part.partition.Start, part.partition.Size)
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the full image.
+func (d *splitDisk) Size() int64 {
+	return d.size
+}
+
+// SectorSize returns the blocksize of the partition table.
+func (d *splitDisk) SectorSize() int64 {
+	return d.blocksize
+}
+
+// Close closes the split files and the image.
+func (d *splitDisk) Close() error {
+	var errs []error
+	for _, part := range d.parts {
+		errs = append(errs, part.disk.Close())
+	}
+	if d.image != nil {
+		errs = append(errs, d.image.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (d *splitDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), d.size-off))
+	err := d.segments(p[:n], off, func(part *splitPartition, pos int64, b []byte) error {
+		switch {
+		case part != nil:
+			_, err := part.disk.ReadAt(b, pos-part.partition.Start)
+			return err
+		case d.image != nil:
+			_, err := d.image.ReadAt(b, pos)
+			return err
+		}
+		clear(b)
+		copyOverlap(b, pos, d.primary, 0)
+		copyOverlap(b, pos, d.backup, d.size-int64(len(d.backup)))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *splitDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > d.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the disk of %d bytes", len(p), off, d.size)
+	}
+	err := d.segments(p, off, func(part *splitPartition, pos int64, b []byte) error {
+		if part == nil && d.image == nil {
+			return fmt.Errorf("writing at %d outside of the split partitions (like to the partition table) needs the full image", pos)
+		}
+		if part != nil {
+			if _, err := part.disk.WriteAt(b, pos-part.partition.Start); err != nil {
+				return fmt.Errorf("writing to %s: %w", part.path, err)
+			}
+		}
+		if d.image != nil {
+			if _, err := d.image.WriteAt(b, pos); err != nil {
+				return fmt.Errorf("writing to the image: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// segments splits p (at off) into the pieces within a split partition and in between, and calls fn for each.
+func (d *splitDisk) segments(p []byte, off int64, fn func(part *splitPartition, pos int64, b []byte) error) error {
+	end := off + int64(len(p))
+	for pos := off; pos < end; {
+		var part *splitPartition
+		segmentEnd := end
+		for i := range d.parts {
+			candidate := &d.parts[i]
+			if candidate.partition.Start > pos {
+				segmentEnd = min(end, candidate.partition.Start)
+				break
+			}
+			if pos < candidate.partition.Start+candidate.partition.Size {
+				part = candidate
+				segmentEnd = min(end, candidate.partition.Start+candidate.partition.Size)
+				break
+			}
+		}
+		if err := fn(part, pos, p[pos-off:segmentEnd-off]); err != nil {
+			return err
+		}
+		pos = segmentEnd
+	}
+	return nil
+}
+
+// copyOverlap copies the part of src (at srcOff) that overlaps dst (at dstOff).
+func copyOverlap(dst []byte, dstOff int64, src []byte, srcOff int64) {
+	start := max(dstOff, srcOff)
+	end := min(dstOff+int64(len(dst)), srcOff+int64(len(src)))
+	if start < end {
+		copy(dst[start-dstOff:end-dstOff], src[start-srcOff:])
+	}
+}
+
+// checkSplitPartitions compares the split files of the partitions that ddi-tool modifies (ESP, XBOOTLDR
+// and verity signature partitions) with the full image. The other partitions are immutable once written
+// by systemd-repart and are covered by the verity checks.
+func (d *splitDisk) checkSplitPartitions() []Finding {
+	if d.image == nil {
+		return nil
+	}
+	var findings []Finding
+	for _, part := range d.parts {
+		designator, _, _ := gpt.Lookup(part.partition.Type)
+		if designator != gpt.DesignatorESP && designator != gpt.DesignatorXBOOTLDR && !strings.HasSuffix(string(designator), "-verity-sig") {
+			continue
+		}
+		check := fmt.Sprintf("split %s", part.partition.Type)
+		if off, err := d.compare(part); err != nil {
+			findings = append(findings, Finding{Check: check, Severity: SeverityError, Message: err.Error()})
+		} else if off >= 0 {
+			findings = append(findings, Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("%s differs from partition %d of the image at offset %d", part.path, part.partition.Index+1, off)})
+		} else {
+			findings = append(findings, Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("%s matches partition %d of the image", part.path, part.partition.Index+1)})
+		}
+	}
+	return findings
+}
+
+// compare returns the offset of the first difference between the split file and the image, or -1.
+func (d *splitDisk) compare(part splitPartition) (int64, error) {
+	const chunk = 1 << 20
+	split, image := make([]byte, chunk), make([]byte, chunk)
+	for off := int64(0); off < part.partition.Size; off += chunk {
+		n := min(chunk, part.partition.Size-off)
+		if _, err := part.disk.ReadAt(split[:n], off); err != nil {
+			return 0, fmt.Errorf("reading %s: %w", part.path, err)
+		}
+		if _, err := d.image.ReadAt(image[:n], part.partition.Start+off); err != nil {
+			return 0, fmt.Errorf("reading the image: %w", err)
+		}
+		if !bytes.Equal(split[:n], image[:n]) {
+			for i := int64(0); ; i++ {
+				if split[i] != image[i] {
+					return off + i, nil
+				}
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,170 @@
+package ddi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/malt3/ddi-tool/api/repart"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splitTestImage copies the partitions of the image into split files, like systemd-repart --split=yes,
+// and returns the matching repart output.
+func splitTestImage(t *testing.T, imagePath string) repart.Output {
+	image, err := New(imagePath, 0, "")
+	require.NoError(t, err)
+	defer image.Close()
+	table, err := image.Partitions()
+	require.NoError(t, err)
+	src, err := os.Open(imagePath)
+	require.NoError(t, err)
+	defer src.Close()
+
+	var output repart.Output
+	for _, part := range table.Partitions {
+		splitPath := filepath.Join(filepath.Dir(imagePath), fmt.Sprintf("image.%s.raw", part.Type))
+		dst, err := os.Create(splitPath)
+		require.NoError(t, err)
+		_, err = io.Copy(dst, io.NewSectionReader(src, part.Start, part.Size))
+		require.NoError(t, err)
+		require.NoError(t, dst.Close())
+		output = append(output, repart.Partition{
+			Type:      part.Type.String(),
+			Label:     part.Name,
+			UUID:      strings.ToLower(part.UUID),
+			Partno:    int64(part.Index),
+			Offset:    part.Start,
+			RawSize:   part.Size,
+			SplitPath: splitPath,
+		})
+	}
+	return output
+}
+
+func TestSplitImage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition, gpt.Home)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.efi", testUKI("roothash=0000")))
+	require.NoError(image.Close())
+	output := splitTestImage(t, imagePath)
+	ukiCmdline := func(image *Image) string {
+		c, err := image.UKICmdline(UKI{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi"})
+		require.NoError(err)
+		content, err := c.String()
+		require.NoError(err)
+		return strings.TrimRight(content, " ")
+	}
+
+	// without image, the split files are placed behind a synthesized partition table
+	split, err := NewSplit(output, "", 0, "", false)
+	require.NoError(err)
+	table, err := split.Partitions()
+	require.NoError(err)
+	require.Len(table.Partitions, 2)
+	assert.Equal(gpt.EFISystemPartition, table.Partitions[0].Type)
+	assert.Equal(output[1].Offset, table.Partitions[1].Start)
+	ukis, err := split.UKIs()
+	require.NoError(err)
+	assert.Equal([]UKI{{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo.efi"}}, ukis)
+	c, err := split.UKICmdline(ukis[0])
+	require.NoError(err)
+	require.NoError(c.SetOne("roothash", "abcd", true))
+	_, err = split.disk.WriteAt([]byte("x"), 0)
+	require.Error(err)
+	assert.Contains(err.Error(), "needs the full image")
+	require.NoError(split.Close())
+
+	split, err = NewSplit(output, "", 0, "", false)
+	require.NoError(err)
+	assert.Equal("roothash=abcd", ukiCmdline(split))
+	require.NoError(split.Close())
+	image, err = New(imagePath, 0, "")
+	require.NoError(err)
+	assert.Equal("roothash=0000", ukiCmdline(image))
+	require.NoError(image.Close())
+
+	// with image, writes go to both
+	split, err = NewSplit(output, imagePath, 0, "", false)
+	require.NoError(err)
+	findings := split.disk.(*splitDisk).checkSplitPartitions()
+	require.Len(findings, 1)
+	assert.Equal(SeverityError, findings[0].Severity)
+	c, err = split.UKICmdline(ukis[0])
+	require.NoError(err)
+	require.NoError(c.SetOne("roothash", "ef01", true))
+	assert.Equal([]Finding{{
+		Check:    "split esp",
+		Severity: SeverityOK,
+		Message:  fmt.Sprintf("%s matches partition 1 of the image", output[0].SplitPath),
+	}}, split.disk.(*splitDisk).checkSplitPartitions())
+	require.NoError(split.Close())
+	image, err = New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	assert.Equal("roothash=ef01", ukiCmdline(image))
+}
+
+func TestSplitImageErrors(t *testing.T) {
+	imagePath := newTestImage(t, gpt.EFISystemPartition, gpt.Home)
+	output := splitTestImage(t, imagePath)
+
+	testCases := map[string]struct {
+		change    func(output repart.Output)
+		imagePath string
+		wantErr   string
+	}{
+		"no split files": {
+			change: func(output repart.Output) {
+				output[0].SplitPath = ""
+				output[1].SplitPath = ""
+			},
+			wantErr: "lists no split partition files",
+		},
+		"size": {
+			change:  func(output repart.Output) { output[1].RawSize -= 512 },
+			wantErr: "repart output says",
+		},
+		"overlap": {
+			change:  func(output repart.Output) { output[1].Offset = output[0].Offset + 512 },
+			wantErr: "overlap",
+		},
+		"unaligned": {
+			change:  func(output repart.Output) { output[1].Offset++ },
+			wantErr: "is not aligned",
+		},
+		"unknown type": {
+			change:  func(output repart.Output) { output[1].Type = "no-such-type" },
+			wantErr: "no-such-type",
+		},
+		"not in image": {
+			change:    func(output repart.Output) { output[1].UUID = "ab8b1831-458c-c7ab-793d-39933f42b013" },
+			imagePath: imagePath,
+			wantErr:   "is not a partition of the image",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			changed := append(repart.Output{}, output...)
+			tc.change(changed)
+			_, err := NewSplit(changed, tc.imagePath, 0, "", false)
+			require.Error(err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package ddi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/cmdline"
+	"github.com/malt3/ddi-tool/pkg/fat"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki"
+)
+
+// defaultUKIPath is used if the architecture of the image is unknown.
+const defaultUKIPath = "/EFI/BOOT/BOOTX64.EFI"
+
+// UKI is a unified kernel image found on the ESP or the XBOOTLDR partition.
+type UKI struct {
+	// Partition is the type of the partition holding the UKI
+	// (gpt.EFISystemPartition or gpt.ExtendedBootLoader).
+	Partition gpt.Type
+	Path      string
+}
+
+func (u UKI) String() string {
+	return u.Partition.String() + ":" + u.Path
+}
+
+// ukiDirs are the directories searched for UKIs: the removable media fallback path
+// (ESP only) and the Type #2 entry directory of the Boot Loader Specification.
+var ukiDirs = map[gpt.Type][]string{
+	gpt.EFISystemPartition: {"/EFI/BOOT", "/EFI/Linux"},
+	gpt.ExtendedBootLoader: {"/EFI/Linux"},
+}
+
+// XBOOTLDR opens the FAT filesystem of the extended boot loader partition.
+func (i *Image) XBOOTLDR() (*fat.FileSystem, error) {
+	table, err := i.Partitions()
+	if err != nil {
+		return nil, fmt.Errorf("reading partition table: %w", err)
+	}
+	part, err := table.FindByType(gpt.ExtendedBootLoader)
+	if err != nil {
+		return nil, err
+	}
+	xbootldr, err := fat.Open(fat.NewExtentHandle(i.disk, part.Start, []fat.Extent{{Size: part.Size}}), part.Size)
+	if err != nil {
+		return nil, fmt.Errorf("opening XBOOTLDR partition: %w", err)
+	}
+	return xbootldr, nil
+}
+
+// bootFilesystem opens the ESP or the XBOOTLDR partition.
+func (i *Image) bootFilesystem(typ gpt.Type) (*fat.FileSystem, error) {
+	if typ == gpt.ExtendedBootLoader {
+		return i.XBOOTLDR()
+	}
+	return i.ESP()
+}
+
+// UKIs returns all UKIs in the standard locations of the ESP and the XBOOTLDR partition,
+// including boot-counted names like /EFI/Linux/foo+3-0.efi.
+// PE files without kernel (like systemd-boot or addons) are skipped.
+func (i *Image) UKIs() ([]UKI, error) {
+	var ukis []UKI
+	for _, typ := range []gpt.Type{gpt.EFISystemPartition, gpt.ExtendedBootLoader} {
+		fs, err := i.bootFilesystem(typ)
+		if errors.Is(err, gpt.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range ukiDirs[typ] {
+			entries, err := fs.ReadDir(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", dir, err)
+			}
+			for _, entry := range entries {
+				name := strings.ToLower(entry.Name)
+				if entry.IsDir || !strings.HasSuffix(name, ".efi") || strings.HasSuffix(name, ".addon.efi") {
+					continue
+				}
+				p := path.Join(dir, entry.Name)
+				handle, err := fs.OpenFile(p)
+				if err != nil {
+					return nil, err
+				}
+				if uki.IsUKI(handle) {
+					ukis = append(ukis, UKI{Partition: typ, Path: p})
+				}
+			}
+		}
+	}
+	return ukis, nil
+}
+
+// SelectUKIs returns the UKIs to patch: the UKI path given to New if one was set,
+// otherwise all UKIs found by UKIs whose path matches pattern (all if pattern is empty).
+// Patterns without slash are matched against the file name.
+func (i *Image) SelectUKIs(pattern string) ([]UKI, error) {
+	if i.ukiPath != "" {
+		return []UKI{{Partition: gpt.EFISystemPartition, Path: i.ukiPath}}, nil
+	}
+	all, err := i.UKIs()
+	if err != nil {
+		return nil, err
+	}
+	if pattern == "" {
+		return all, nil
+	}
+	var selected []UKI
+	for _, u := range all {
+		matched, err := matchPath(pattern, u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uki pattern: %w", err)
+		}
+		if matched {
+			selected = append(selected, u)
+		}
+	}
+	return selected, nil
+}
+
+// matchPath matches p against a glob pattern. Patterns without slash are matched against the file name.
+func matchPath(pattern, p string) (bool, error) {
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	return path.Match(pattern, p)
+}
+
+// UKICmdline returns the .cmdline section of the UKI (or addon) for editing.
+// For multi-profile UKIs this is the cmdline of the base, see ProfileCmdline.
+func (i *Image) UKICmdline(u UKI) (*cmdline.Cmdline, error) {
+	ukiHandle, err := i.openUKI(u)
+	if err != nil {
+		return nil, err
+	}
+	cmdlineOffset, cmdlineSize, err := uki.SectionBounds(ukiHandle, ".cmdline")
+	if err != nil {
+		return nil, fmt.Errorf("getting .cmdline section within uki %s: %w", u, err)
+	}
+	return cmdline.New(
+		cmdline.NewSectionHandle(ukiHandle, cmdlineOffset, cmdlineSize),
+		cmdlineSize,
+	), nil
+}
+
+// UKIProfiles returns the profiles of the UKI. UKIs without .profile sections have a single profile.
+func (i *Image) UKIProfiles(u UKI) ([]uki.Profile, error) {
+	ukiHandle, err := i.openUKI(u)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := uki.Profiles(ukiHandle)
+	if err != nil {
+		return nil, fmt.Errorf("reading profiles of uki %s: %w", u, err)
+	}
+	return profiles, nil
+}
+
+// ProfileCmdline returns the effective .cmdline section of a profile of the UKI for editing.
+// Profiles without own .cmdline section share the section of the base.
+func (i *Image) ProfileCmdline(u UKI, profile uki.Profile) (*cmdline.Cmdline, error) {
+	ukiHandle, err := i.openUKI(u)
+	if err != nil {
+		return nil, err
+	}
+	section, ok := profile.Section(".cmdline")
+	if !ok {
+		return nil, fmt.Errorf("profile %s of uki %s has no .cmdline section", profile, u)
+	}
+	return cmdline.New(
+		cmdline.NewSectionHandle(ukiHandle, section.Offset, section.Size),
+		section.Size,
+	), nil
+}
+
+// SharedCmdline is a distinct .cmdline section of a UKI and the profiles using it.
+type SharedCmdline struct {
+	Profiles []uki.Profile
+	Cmdline  *cmdline.Cmdline
+}
+
+func (s SharedCmdline) String() string {
+	names := make([]string, len(s.Profiles))
+	for i, profile := range s.Profiles {
+		names[i] = profile.String()
+	}
+	return "profile " + strings.Join(names, ", ")
+}
+
+// DistinctCmdlines returns the distinct .cmdline sections of the profiles of the UKI.
+// Profiles without own .cmdline section share the section of the base.
+func (i *Image) DistinctCmdlines(u UKI) ([]SharedCmdline, error) {
+	profiles, err := i.UKIProfiles(u)
+	if err != nil {
+		return nil, err
+	}
+	var cmdlines []SharedCmdline
+	index := make(map[int64]int)
+	for _, profile := range profiles {
+		section, ok := profile.Section(".cmdline")
+		if !ok {
+			continue
+		}
+		if j, ok := index[section.Offset]; ok {
+			cmdlines[j].Profiles = append(cmdlines[j].Profiles, profile)
+			continue
+		}
+		c, err := i.ProfileCmdline(u, profile)
+		if err != nil {
+			return nil, err
+		}
+		index[section.Offset] = len(cmdlines)
+		cmdlines = append(cmdlines, SharedCmdline{Profiles: []uki.Profile{profile}, Cmdline: c})
+	}
+	if len(cmdlines) == 0 {
+		return nil, fmt.Errorf("uki %s has no .cmdline section", u)
+	}
+	return cmdlines, nil
+}
+
+func (i *Image) openUKI(u UKI) (*fat.ExtentHandle, error) {
+	fs, err := i.bootFilesystem(u.Partition)
+	if err != nil {
+		return nil, err
+	}
+	ukiHandle, err := fs.OpenFile(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("opening uki: %w", err)
+	}
+	return ukiHandle, nil
+}
@@ -0,0 +1,117 @@
+package ddi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUKI(cmdline string) []byte {
+	return ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".osrel", Data: []byte("ID=test\n")},
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-256s", cmdline))},
+		ukitest.Section{Name: ".linux", Data: []byte("kernel")},
+	)
+}
+
+func TestUKIs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition, gpt.ExtendedBootLoader)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/BOOT"))
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/BOOT/BOOTX64.EFI", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".sdmagic", Data: []byte("#### LoaderInfo: systemd-boot ####")})))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo+3-0.efi", testUKI("console=ttyS0")))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo.addon.efi", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".cmdline", Data: []byte("debug")})))
+	require.NoError(esp.WriteFile("/EFI/Linux/notes.txt", []byte("not a PE")))
+	xbootldr, err := image.XBOOTLDR()
+	require.NoError(err)
+	require.NoError(xbootldr.MkdirAll("/EFI/Linux"))
+	require.NoError(xbootldr.WriteFile("/EFI/Linux/bar.efi", testUKI("quiet")))
+
+	ukis, err := image.UKIs()
+	require.NoError(err)
+	assert.Equal([]UKI{
+		{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/foo+3-0.efi"},
+		{Partition: gpt.ExtendedBootLoader, Path: "/EFI/Linux/bar.efi"},
+	}, ukis)
+	assert.Equal("xbootldr:/EFI/Linux/bar.efi", ukis[1].String())
+
+	selected, err := image.SelectUKIs("bar*")
+	require.NoError(err)
+	assert.Equal(ukis[1:], selected)
+	selected, err = image.SelectUKIs("/EFI/Linux/foo*")
+	require.NoError(err)
+	assert.Equal(ukis[:1], selected)
+
+	cmdline, err := image.UKICmdline(ukis[1])
+	require.NoError(err)
+	require.NoError(cmdline.SetOne("roothash", "abcd", false))
+	content, err := cmdline.String()
+	require.NoError(err)
+	assert.Equal("quiet roothash=abcd", strings.TrimRight(content, " \x00"))
+
+	explicit, err := New(imagePath, 0, "/EFI/Linux/foo+3-0.efi")
+	require.NoError(err)
+	defer explicit.Close()
+	selected, err = explicit.SelectUKIs("bar*")
+	require.NoError(err)
+	assert.Equal(ukis[:1], selected)
+}
+
+func TestUKIProfiles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath := newTestImage(t, gpt.EFISystemPartition)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/multi.efi", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-64s", "roothash=0000"))},
+		ukitest.Section{Name: ".linux", Data: []byte("kernel")},
+		ukitest.Section{Name: ".profile", Data: []byte("ID=default\n")},
+		ukitest.Section{Name: ".profile", Data: []byte("ID=debug\nTITLE=Debug\n")},
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-64s", "roothash=0000 debug"))},
+	)))
+
+	u := UKI{Partition: gpt.EFISystemPartition, Path: "/EFI/Linux/multi.efi"}
+	profiles, err := image.UKIProfiles(u)
+	require.NoError(err)
+	require.Len(profiles, 2)
+	assert.Equal("1 debug (Debug)", profiles[1].String())
+
+	debug, err := image.ProfileCmdline(u, profiles[1])
+	require.NoError(err)
+	require.NoError(debug.SetOne("roothash", "abcd", true))
+
+	for _, want := range []struct {
+		profile int
+		cmdline string
+	}{
+		{profile: 0, cmdline: "roothash=0000"},
+		{profile: 1, cmdline: "roothash=abcd debug"},
+	} {
+		c, err := image.ProfileCmdline(u, profiles[want.profile])
+		require.NoError(err)
+		content, err := c.String()
+		require.NoError(err)
+		assert.Equal(want.cmdline, strings.Join(strings.Fields(content), " "))
+	}
+}
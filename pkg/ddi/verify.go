@@ -0,0 +1,342 @@
+package ddi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/cmdline"
+	"github.com/malt3/ddi-tool/pkg/disk"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/verity"
+)
+
+// Severity classifies a Finding.
+type Severity int
+
+const (
+	SeverityOK Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOK:
+		return "ok"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Finding is the outcome of a single consistency check.
+type Finding struct {
+	Check    string
+	Severity Severity
+	Message  string
+}
+
+// VerifyOptions configures Image.Verify.
+type VerifyOptions struct {
+	// Certificate is used to verify verity signatures. Signatures are not verified if it is nil.
+	Certificate *x509.Certificate
+	// RehashData recomputes the root hash from the data partitions instead of trusting the stored hash tree.
+	RehashData bool
+	// Progress returns the progress callback used while rehashing a set (optional).
+	Progress func(set VeritySet) verity.ProgressFunc
+}
+
+// bootCmdline is a kernel cmdline that finalize patches: a distinct .cmdline section of a UKI
+// or the options of a boot loader entry.
+type bootCmdline struct {
+	// file names the UKI or the entry.
+	file string
+	// profiles names the profiles using the section, if the UKI has several.
+	profiles string
+	cmdline  *cmdline.Cmdline
+}
+
+func (c bootCmdline) String() string {
+	if c.profiles == "" {
+		return c.file
+	}
+	return c.file + " " + c.profiles
+}
+
+// bootCmdlines returns the cmdlines finalize patches, grouped by UKI or boot loader entry: the distinct
+// .cmdline sections of every UKI and the options of every boot loader entry on the ESP and
+// the XBOOTLDR partition. Files that cannot be read are reported as findings.
+func (i *Image) bootCmdlines() ([][]bootCmdline, []Finding) {
+	var groups [][]bootCmdline
+	var findings []Finding
+	ukis, err := i.SelectUKIs("")
+	if err != nil {
+		findings = append(findings, Finding{Check: "cmdline", Severity: SeverityError, Message: err.Error()})
+	}
+	for _, u := range ukis {
+		shared, err := i.DistinctCmdlines(u)
+		if err != nil {
+			findings = append(findings, Finding{Check: "cmdline " + u.String(), Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		group := make([]bootCmdline, len(shared))
+		for j, s := range shared {
+			group[j] = bootCmdline{file: u.String(), cmdline: s.Cmdline}
+			if len(shared) > 1 {
+				group[j].profiles = s.String()
+			}
+		}
+		groups = append(groups, group)
+	}
+	entries, err := i.SelectBootEntries("")
+	if err != nil {
+		findings = append(findings, Finding{Check: "cmdline", Severity: SeverityError, Message: err.Error()})
+	}
+	for _, e := range entries {
+		options, err := i.BootEntryCmdline(e)
+		if err != nil {
+			findings = append(findings, Finding{Check: "cmdline " + e.String(), Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		groups = append(groups, []bootCmdline{{file: e.String(), cmdline: options.Cmdline}})
+	}
+	return groups, findings
+}
+
+// Verify cross-checks the root hashes found in the hash trees, the verity signature partitions and
+// the kernel cmdlines of all UKIs (every profile) and boot loader entries, and compares the architecture
+// of the UKIs with the image.
+// Only failures to read the partition table are returned as error, everything else is reported as finding.
+func (i *Image) Verify(ctx context.Context, opts VerifyOptions) ([]Finding, error) {
+	sets, err := i.VeritySets()
+	if err != nil {
+		return nil, err
+	}
+	// like finalize, images without UKI or boot loader entry are checked against their sidecars
+	cmdlines, cmdlineFindings := i.bootCmdlines()
+	sidecars := len(cmdlines) == 0 && len(cmdlineFindings) == 0
+
+	var findings []Finding
+	for _, set := range sets {
+		findings = append(findings, i.verifySet(ctx, set, sidecars, cmdlines, opts)...)
+	}
+	if !sidecars {
+		findings = append(findings, i.checkUKIArchs()...)
+	}
+	findings = append(findings, cmdlineFindings...)
+	for _, group := range cmdlines {
+		for _, c := range group {
+			validated, err := i.ValidateCmdline(c.cmdline)
+			if err != nil {
+				findings = append(findings, Finding{Check: "cmdline " + c.String(), Severity: SeverityError, Message: err.Error()})
+				continue
+			}
+			for _, finding := range validated {
+				finding.Check += " " + c.String()
+				findings = append(findings, finding)
+			}
+		}
+	}
+	if split, ok := i.disk.(*splitDisk); ok {
+		findings = append(findings, split.checkSplitPartitions()...)
+	}
+	return findings, nil
+}
+
+func (i *Image) verifySet(ctx context.Context, set VeritySet, sidecars bool, cmdlines [][]bootCmdline, opts VerifyOptions) []Finding {
+	check := func(name string) string {
+		return fmt.Sprintf("%s %s", set.Designator, name)
+	}
+	sb, err := i.VeritySuperblock(set)
+	if err != nil {
+		return []Finding{{Check: check("superblock"), Severity: SeverityError, Message: err.Error()}}
+	}
+	findings := []Finding{checkSuperblock(check("superblock"), set, sb)}
+
+	storedRootHash, err := i.StoredRootHash(set)
+	if err != nil {
+		return append(findings, Finding{Check: check("hash tree"), Severity: SeverityError, Message: err.Error()})
+	}
+	rootHash := hex.EncodeToString(storedRootHash)
+	findings = append(findings, Finding{Check: check("hash tree"), Severity: SeverityOK, Message: fmt.Sprintf("root hash %s", rootHash)})
+
+	if opts.RehashData {
+		var progress verity.ProgressFunc
+		if opts.Progress != nil {
+			progress = opts.Progress(set)
+		}
+		computed, err := i.ComputeRootHash(ctx, set, progress)
+		switch {
+		case err != nil:
+			findings = append(findings, Finding{Check: check("data"), Severity: SeverityError, Message: err.Error()})
+		case hex.EncodeToString(computed) != rootHash:
+			findings = append(findings, Finding{Check: check("data"), Severity: SeverityError, Message: fmt.Sprintf("data hashes to %x, hash tree belongs to %s", computed, rootHash)})
+		default:
+			findings = append(findings, Finding{Check: check("data"), Severity: SeverityOK, Message: "data matches hash tree"})
+		}
+	}
+
+	findings = append(findings, checkVerityUUIDs(check("partition uuids"), set, storedRootHash, reliesOnVerityUUIDs(set.Designator, cmdlines)))
+	if !sidecars {
+		findings = append(findings, checkCmdlineHashes(check("cmdline"), set.CmdlineKey(), rootHash, cmdlines)...)
+	} else if i.path == "" {
+		findings = append(findings, Finding{Check: check("sidecar"), Severity: SeverityWarning, Message: "image has no UKI or boot loader entry and no image path to find the sidecar"})
+	} else {
+		findings = append(findings, checkSidecarHash(ctx, check("sidecar"), SidecarPath(i.path, "."+set.CmdlineKey()), rootHash))
+	}
+
+	if set.Signature == nil {
+		return findings
+	}
+	sig, err := i.VeritySignature(set)
+	if err != nil {
+		return append(findings, Finding{Check: check("signature"), Severity: SeverityError, Message: err.Error()})
+	}
+	if !strings.EqualFold(sig.RootHash, rootHash) {
+		findings = append(findings, Finding{Check: check("signature"), Severity: SeverityError, Message: fmt.Sprintf("signature is for root hash %s, hash tree belongs to %s", sig.RootHash, rootHash)})
+	}
+	if opts.Certificate == nil {
+		return append(findings, Finding{Check: check("signature"), Severity: SeverityWarning, Message: "no certificate given, signature not verified"})
+	}
+	if err := sig.Verify(opts.Certificate); err != nil {
+		return append(findings, Finding{Check: check("signature"), Severity: SeverityError, Message: err.Error()})
+	}
+	return append(findings, Finding{Check: check("signature"), Severity: SeverityOK, Message: fmt.Sprintf("signature by %s is valid", opts.Certificate.Subject)})
+}
+
+// checkUKIArchs compares the architecture of every UKI with the architecture of the image.
+func (i *Image) checkUKIArchs() []Finding {
+	ukis, err := i.SelectUKIs("")
+	if err != nil {
+		return []Finding{{Check: "uki architecture", Severity: SeverityError, Message: err.Error()}}
+	}
+	var findings []Finding
+	for _, u := range ukis {
+		findings = append(findings, i.CheckUKIArch(u))
+	}
+	return findings
+}
+
+// checkCmdlineHashes compares key in every cmdline with the root hash. Like finalize, profiles of
+// multi-profile UKIs that do not set key are skipped, as long as one profile does.
+func checkCmdlineHashes(check, key, rootHash string, cmdlines [][]bootCmdline) []Finding {
+	if len(cmdlines) == 0 {
+		return []Finding{{Check: check, Severity: SeverityError, Message: "no readable UKI or boot loader entry found"}}
+	}
+	var findings []Finding
+	for _, group := range cmdlines {
+		var checked int
+		for _, c := range group {
+			if len(group) > 1 {
+				if _, ok, err := c.cmdline.Get(key); err == nil && !ok {
+					continue
+				}
+			}
+			findings = append(findings, checkCmdlineHash(check+" "+c.String(), key, rootHash, c.cmdline))
+			checked++
+		}
+		if checked == 0 {
+			findings = append(findings, Finding{Check: check + " " + group[0].file, Severity: SeverityWarning, Message: fmt.Sprintf("no profile sets %s", key)})
+		}
+	}
+	return findings
+}
+
+func checkCmdlineHash(check, key, rootHash string, cmdline *cmdline.Cmdline) Finding {
+	value, ok, err := cmdline.Get(key)
+	switch {
+	case err != nil:
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	case !ok:
+		return Finding{Check: check, Severity: SeverityWarning, Message: fmt.Sprintf("cmdline does not set %s", key)}
+	case !strings.EqualFold(value, rootHash):
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("cmdline sets %s=%s, hash tree belongs to %s", key, value, rootHash)}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("%s matches hash tree", key)}
+}
+
+// checkVerityUUIDs compares the partition uuids with the uuids derived from the root hash. A mismatch is
+// an error if a cmdline relies on the derived uuids to find the partitions, and a warning otherwise.
+func checkVerityUUIDs(check string, set VeritySet, rootHash []byte, required bool) Finding {
+	severity := SeverityWarning
+	if required {
+		severity = SeverityError
+	}
+	dataUUID, hashUUID, err := VerityUUIDs(rootHash)
+	if err != nil {
+		return Finding{Check: check, Severity: severity, Message: err.Error()}
+	}
+	var mismatches []string
+	if !strings.EqualFold(set.Data.UUID, dataUUID) {
+		mismatches = append(mismatches, fmt.Sprintf("data partition has uuid %s, root hash implies %s", set.Data.UUID, dataUUID))
+	}
+	if !strings.EqualFold(set.Hash.UUID, hashUUID) {
+		mismatches = append(mismatches, fmt.Sprintf("hash partition has uuid %s, root hash implies %s", set.Hash.UUID, hashUUID))
+	}
+	if len(mismatches) > 0 {
+		return Finding{Check: check, Severity: severity, Message: strings.Join(mismatches, "; ")}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: "partition uuids match root hash"}
+}
+
+// reliesOnVerityUUIDs reports whether a cmdline sets the root hash of the designator without naming
+// both the data and the hash partition, which are then found by the uuids derived from the root hash.
+func reliesOnVerityUUIDs(designator gpt.Designator, cmdlines [][]bootCmdline) bool {
+	for _, group := range cmdlines {
+		for _, c := range group {
+			pairs, err := c.cmdline.Pairs()
+			if err != nil {
+				continue
+			}
+			configs, _ := cmdline.ParseVerity(pairs)
+			for _, config := range configs {
+				if config.Designator == string(designator) && config.RootHash != "" && (config.DataDevice == "" || config.HashDevice == "") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func checkSidecarHash(ctx context.Context, check, path, rootHash string) Finding {
+	var content []byte
+	var err error
+	if disk.IsURL(path) || disk.IsS3URL(path) {
+		content, err = disk.ReadURL(ctx, path)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return Finding{Check: check, Severity: SeverityWarning, Message: fmt.Sprintf("image has no UKI or boot loader entry and no sidecar %s", path)}
+	} else if err != nil {
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	}
+	if hash := strings.TrimSpace(string(content)); !strings.EqualFold(hash, rootHash) {
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("%s contains %s, hash tree belongs to %s", path, hash, rootHash)}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("%s matches hash tree", path)}
+}
+
+func checkSuperblock(check string, set VeritySet, sb *verity.Superblock) Finding {
+	treeSize, err := sb.TreeSize()
+	if err != nil {
+		return Finding{Check: check, Severity: SeverityError, Message: err.Error()}
+	}
+	switch {
+	case sb.DataSize() > set.Data.Size:
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("%d data blocks of %d bytes (%d bytes) exceed the data partition of %d bytes", sb.DataBlocks, sb.DataBlockSize, sb.DataSize(), set.Data.Size)}
+	case treeSize > set.Hash.Size:
+		return Finding{Check: check, Severity: SeverityError, Message: fmt.Sprintf("hash tree of %d bytes exceeds the hash partition of %d bytes", treeSize, set.Hash.Size)}
+	case sb.DataSize() < set.Data.Size:
+		return Finding{Check: check, Severity: SeverityWarning, Message: fmt.Sprintf("%d data blocks of %d bytes (%d bytes) only cover part of the data partition of %d bytes", sb.DataBlocks, sb.DataBlockSize, sb.DataSize(), set.Data.Size)}
+	}
+	return Finding{Check: check, Severity: SeverityOK, Message: fmt.Sprintf("%d data blocks of %d bytes fit the data partition", sb.DataBlocks, sb.DataBlockSize)}
+}
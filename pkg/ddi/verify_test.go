@@ -0,0 +1,155 @@
+package ddi
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyUKICmdlines(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath, rootHash := newTestVerityImage(t, gpt.EFISystemPartition, gpt.ExtendedBootLoader)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+
+	// an ESP without UKI or boot loader entry falls back to sidecars, like finalize
+	findings, err := image.Verify(context.Background(), VerifyOptions{})
+	require.NoError(err)
+	assert.Contains(findings, Finding{Check: "root sidecar", Severity: SeverityWarning, Message: "image has no UKI or boot loader entry and no sidecar " + SidecarPath(imagePath, ".roothash")})
+
+	good := "roothash=" + hex.EncodeToString(rootHash)
+	stale := "roothash=" + hex.EncodeToString(make([]byte, len(rootHash)))
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/EFI/Linux"))
+	require.NoError(esp.WriteFile("/EFI/Linux/good.efi", testUKI(good)))
+	require.NoError(esp.WriteFile("/EFI/Linux/foo+3-0.efi", testUKI(stale)))
+	require.NoError(esp.WriteFile("/EFI/Linux/multi.efi", ukitest.Build(ukitest.MachineAMD64,
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-256s", good))},
+		ukitest.Section{Name: ".linux", Data: []byte("kernel")},
+		ukitest.Section{Name: ".profile", Data: []byte("ID=default\n")},
+		ukitest.Section{Name: ".profile", Data: []byte("ID=debug\n")},
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-256s", stale+" debug"))},
+		ukitest.Section{Name: ".profile", Data: []byte("ID=shell\n")},
+		ukitest.Section{Name: ".cmdline", Data: []byte(fmt.Sprintf("%-256s", "rd.shell"))},
+	)))
+	xbootldr, err := image.XBOOTLDR()
+	require.NoError(err)
+	require.NoError(xbootldr.MkdirAll("/EFI/Linux"))
+	require.NoError(xbootldr.WriteFile("/EFI/Linux/other.efi", testUKI(stale)))
+
+	findings, err = image.Verify(context.Background(), VerifyOptions{})
+	require.NoError(err)
+	staleMessage := fmt.Sprintf("cmdline sets roothash=%x, hash tree belongs to %x", make([]byte, len(rootHash)), rootHash)
+	for _, want := range []Finding{
+		{Check: "root cmdline esp:/EFI/Linux/good.efi", Severity: SeverityOK, Message: "roothash matches hash tree"},
+		{Check: "root cmdline esp:/EFI/Linux/foo+3-0.efi", Severity: SeverityError, Message: staleMessage},
+		{Check: "root cmdline esp:/EFI/Linux/multi.efi profile 0 default", Severity: SeverityOK, Message: "roothash matches hash tree"},
+		{Check: "root cmdline esp:/EFI/Linux/multi.efi profile 1 debug", Severity: SeverityError, Message: staleMessage},
+		{Check: "root cmdline xbootldr:/EFI/Linux/other.efi", Severity: SeverityError, Message: staleMessage},
+	} {
+		assert.Contains(findings, want)
+	}
+	for _, finding := range findings {
+		assert.NotContains(finding.Check, "profile 2 shell", "profiles without roothash are skipped")
+	}
+}
+
+func TestVerifyBootEntryCmdlines(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	imagePath, rootHash := newTestVerityImage(t, gpt.EFISystemPartition, gpt.ExtendedBootLoader)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	esp, err := image.ESP()
+	require.NoError(err)
+	require.NoError(esp.MkdirAll("/loader/entries"))
+	require.NoError(esp.WriteFile("/loader/entries/good.conf",
+		[]byte(fmt.Sprintf("title Good\nlinux /vmlinuz\noptions roothash=%x systemd.verity_root_options=frobnicate\n", rootHash))))
+	xbootldr, err := image.XBOOTLDR()
+	require.NoError(err)
+	require.NoError(xbootldr.MkdirAll("/loader/entries"))
+	require.NoError(xbootldr.WriteFile("/loader/entries/stale.conf",
+		[]byte(fmt.Sprintf("title Stale\nlinux /vmlinuz\noptions roothash=%x\n", make([]byte, len(rootHash))))))
+
+	findings, err := image.Verify(context.Background(), VerifyOptions{})
+	require.NoError(err)
+	for _, want := range []Finding{
+		{Check: "root cmdline esp:/loader/entries/good.conf", Severity: SeverityOK, Message: "roothash matches hash tree"},
+		{Check: "cmdline systemd.verity_root_options esp:/loader/entries/good.conf", Severity: SeverityError, Message: `unknown verity option "frobnicate"`},
+		{Check: "root cmdline xbootldr:/loader/entries/stale.conf", Severity: SeverityError, Message: fmt.Sprintf("cmdline sets roothash=%x, hash tree belongs to %x", make([]byte, len(rootHash)), rootHash)},
+	} {
+		assert.Contains(findings, want)
+	}
+}
+
+func TestVerifyPartitionUUIDs(t *testing.T) {
+	testCases := map[string]struct {
+		// options of the boot loader entry, if any; %[1]x is the root hash, %[2]s and %[3]s are the
+		// uuids of the data and hash partitions
+		options      string
+		wantSeverity Severity
+	}{
+		"sidecar": {
+			wantSeverity: SeverityWarning,
+		},
+		"derived uuids": {
+			options:      "roothash=%[1]x",
+			wantSeverity: SeverityError,
+		},
+		"derived hash partition uuid": {
+			options:      "roothash=%[1]x systemd.verity_root_data=PARTUUID=%[2]s",
+			wantSeverity: SeverityError,
+		},
+		"partitions named": {
+			options:      "roothash=%[1]x systemd.verity_root_data=PARTUUID=%[2]s systemd.verity_root_hash=PARTUUID=%[3]s",
+			wantSeverity: SeverityWarning,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			imagePath, rootHash := newTestVerityImage(t, gpt.EFISystemPartition)
+			image, err := New(imagePath, 0, "")
+			require.NoError(err)
+			defer image.Close()
+			sets, err := image.VeritySets()
+			require.NoError(err)
+			require.Len(sets, 1)
+			if tc.options != "" {
+				esp, err := image.ESP()
+				require.NoError(err)
+				require.NoError(esp.MkdirAll("/loader/entries"))
+				options := fmt.Sprintf(tc.options, rootHash, sets[0].Data.UUID, sets[0].Hash.UUID)
+				require.NoError(esp.WriteFile("/loader/entries/entry.conf", []byte("title Entry\nlinux /vmlinuz\noptions "+options+"\n")))
+			}
+
+			// the partitions of the test image have random uuids
+			findings, err := image.Verify(context.Background(), VerifyOptions{})
+			require.NoError(err)
+			var found bool
+			for _, finding := range findings {
+				if finding.Check == "root partition uuids" {
+					found = true
+					assert.Equal(tc.wantSeverity, finding.Severity)
+					assert.Contains(finding.Message, "root hash implies")
+				}
+			}
+			assert.True(found)
+		})
+	}
+}
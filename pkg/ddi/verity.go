@@ -0,0 +1,138 @@
+package ddi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/verity"
+)
+
+// VeritySet is a data partition together with its dm-verity hash partition
+// and, if present, its verity signature partition.
+type VeritySet struct {
+	// Designator is either root or usr.
+	Designator gpt.Designator
+	Arch       gpt.Arch
+	Data       gpt.Partition
+	Hash       gpt.Partition
+	Signature  *gpt.Partition
+}
+
+func (i *Image) Partitions() (*gpt.Table, error) {
+	return gpt.Read(i.disk, i.blocksize)
+}
+
+// VeritySets returns all root and usr partitions of the image that are protected by dm-verity.
+func (i *Image) VeritySets() ([]VeritySet, error) {
+	table, err := i.Partitions()
+	if err != nil {
+		return nil, fmt.Errorf("reading partition table: %w", err)
+	}
+	var sets []VeritySet
+	for _, data := range table.Partitions {
+		designator, arch, ok := gpt.Lookup(data.Type)
+		if !ok || (designator != gpt.DesignatorRoot && designator != gpt.DesignatorUsr) {
+			continue
+		}
+		hashType, _ := gpt.TypeFor(designator+"-verity", arch)
+		hash, err := table.FindByType(hashType)
+		if err != nil {
+			continue
+		}
+		set := VeritySet{
+			Designator: designator,
+			Arch:       arch,
+			Data:       data,
+			Hash:       hash,
+		}
+		sigType, _ := gpt.TypeFor(designator+"-verity-sig", arch)
+		if sig, err := table.FindByType(sigType); err == nil {
+			set.Signature = &sig
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// VeritySuperblock reads the superblock at the start of the hash partition.
+func (i *Image) VeritySuperblock(set VeritySet) (*verity.Superblock, error) {
+	return verity.ReadSuperblock(i.disk, set.Hash.Start)
+}
+
+// ComputeRootHash hashes the data partition using the parameters found in the superblock of the hash partition.
+func (i *Image) ComputeRootHash(ctx context.Context, set VeritySet, progress verity.ProgressFunc) ([]byte, error) {
+	sb, err := i.VeritySuperblock(set)
+	if err != nil {
+		return nil, err
+	}
+	if sb.DataSize() > set.Data.Size {
+		return nil, fmt.Errorf("verity superblock covers %d bytes, but data partition is only %d bytes", sb.DataSize(), set.Data.Size)
+	}
+	hasher := &verity.Hasher{
+		Params:   sb.Params(),
+		Progress: progress,
+	}
+	return hasher.RootHash(ctx, i.disk, set.Data.Start, sb.DataSize())
+}
+
+// VeritySignature reads the verity signature partition of the set.
+func (i *Image) VeritySignature(set VeritySet) (*verity.Signature, error) {
+	if set.Signature == nil {
+		return nil, fmt.Errorf("%s partition has no verity signature partition", set.Designator)
+	}
+	return verity.ReadSignature(i.disk, set.Signature.Start, set.Signature.Size)
+}
+
+// StoredRootHash returns the root hash of the hash tree stored in the hash partition.
+func (i *Image) StoredRootHash(set VeritySet) ([]byte, error) {
+	sb, err := i.VeritySuperblock(set)
+	if err != nil {
+		return nil, err
+	}
+	return verity.StoredRootHash(i.disk, set.Hash.Start, sb)
+}
+
+// CmdlineKey is the kernel cmdline option that carries the root hash of the set (roothash or usrhash).
+func (s VeritySet) CmdlineKey() string {
+	return string(s.Designator) + "hash"
+}
+
+// WriteVeritySignature replaces the content of the verity signature partition of the set.
+func (i *Image) WriteVeritySignature(set VeritySet, sig *verity.Signature) error {
+	if set.Signature == nil {
+		return fmt.Errorf("%s partition has no verity signature partition", set.Designator)
+	}
+	content, err := sig.MarshalPadded(set.Signature.Size)
+	if err != nil {
+		return err
+	}
+	_, err = i.disk.WriteAt(content, set.Signature.Start)
+	return err
+}
+
+// VerityUUIDs returns the partition UUIDs systemd-repart derives from a root hash:
+// the first 128 bits identify the data partition and the last 128 bits the hash partition.
+func VerityUUIDs(rootHash []byte) (data, hash string, err error) {
+	if len(rootHash) < 32 {
+		return "", "", fmt.Errorf("root hash of %d bytes is too short to derive partition UUIDs", len(rootHash))
+	}
+	return formatUUID(rootHash[:16]), formatUUID(rootHash[len(rootHash)-16:]), nil
+}
+
+// SetVerityUUIDs rewrites the UUIDs of the data and hash partitions of the set to match the root hash.
+func (i *Image) SetVerityUUIDs(set VeritySet, rootHash []byte) error {
+	dataUUID, hashUUID, err := VerityUUIDs(rootHash)
+	if err != nil {
+		return err
+	}
+	return gpt.SetPartitionUUIDs(i.disk, i.blocksize, map[int]string{
+		set.Data.Index: dataUUID,
+		set.Hash.Index: hashUUID,
+	})
+}
+
+func formatUUID(b []byte) string {
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
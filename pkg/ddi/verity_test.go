@@ -0,0 +1,240 @@
+package ddi
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/malt3/ddi-tool/pkg/verity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestVerityImage creates an image with zeroed root data, its verity hash tree (sha256, blocks of
+// 4096 bytes, two levels), an empty verity signature partition and a partition for each extra type.
+// It returns the root hash.
+func newTestVerityImage(t *testing.T, extra ...gpt.Type) (string, []byte) {
+	dataType, _ := gpt.TypeFor(gpt.DesignatorRoot, gpt.ArchX86_64)
+	hashType, _ := gpt.TypeFor(gpt.DesignatorRootVerity, gpt.ArchX86_64)
+	sigType, _ := gpt.TypeFor(gpt.DesignatorRootVeritySig, gpt.ArchX86_64)
+	imagePath := newTestImage(t, append([]gpt.Type{dataType, hashType, sigType}, extra...)...)
+
+	const blockSize = 4096
+	const dataBlocks = testPartitionSize / blockSize
+	salt := bytes.Repeat([]byte{0x5a}, 32)
+	sum := func(block []byte) []byte {
+		digest := sha256.Sum256(append(append([]byte{}, salt...), block...))
+		return digest[:]
+	}
+	// all data blocks are zero, so every block of a level is the same
+	level0 := bytes.Repeat(sum(make([]byte, blockSize)), blockSize/sha256.Size)
+	top := bytes.Repeat(sum(level0), dataBlocks/(blockSize/sha256.Size))
+	rootHash := sum(top)
+
+	superblock := make([]byte, blockSize)
+	copy(superblock, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(superblock[8:12], 1)
+	binary.LittleEndian.PutUint32(superblock[12:16], 1)
+	copy(superblock[32:64], "sha256")
+	binary.LittleEndian.PutUint32(superblock[64:68], blockSize)
+	binary.LittleEndian.PutUint32(superblock[68:72], blockSize)
+	binary.LittleEndian.PutUint64(superblock[72:80], dataBlocks)
+	binary.LittleEndian.PutUint16(superblock[80:82], uint16(len(salt)))
+	copy(superblock[88:], salt)
+	tree := append(superblock, top...)
+	for i := 0; i < dataBlocks/(blockSize/sha256.Size); i++ {
+		tree = append(tree, level0...)
+	}
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteAt(tree, 2048*512+testPartitionSize)
+	require.NoError(t, err)
+	return imagePath, rootHash
+}
+
+func testCertificate(t *testing.T, commonName string) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestVeritySignature(t *testing.T) {
+	cert, key := testCertificate(t, "verity test")
+	otherCert, _ := testCertificate(t, "other")
+
+	testCases := map[string]struct {
+		// signature returns the content of the signature partition.
+		signature    func(t *testing.T, rootHash []byte) []byte
+		cert         *x509.Certificate
+		wantSeverity Severity
+		wantMessage  string
+	}{
+		"valid": {
+			signature:    signedRootHash(cert, key, nil),
+			cert:         cert,
+			wantSeverity: SeverityOK,
+			wantMessage:  "signature by CN=verity test is valid",
+		},
+		"no certificate": {
+			signature:    signedRootHash(cert, key, nil),
+			wantSeverity: SeverityWarning,
+			wantMessage:  "no certificate given, signature not verified",
+		},
+		"tampered signature": {
+			signature: signedRootHash(cert, key, func(sig *verity.Signature) {
+				sig.Signature[len(sig.Signature)-1] ^= 0xff
+			}),
+			cert:         cert,
+			wantSeverity: SeverityError,
+			wantMessage:  "verifying signature",
+		},
+		"wrong certificate": {
+			signature:    signedRootHash(cert, key, nil),
+			cert:         otherCert,
+			wantSeverity: SeverityError,
+			wantMessage:  "does not match certificate",
+		},
+		"wrong certificate without fingerprint": {
+			signature: signedRootHash(cert, key, func(sig *verity.Signature) {
+				sig.CertificateFingerprint = ""
+			}),
+			cert:         otherCert,
+			wantSeverity: SeverityError,
+			wantMessage:  "no signer matches the certificate",
+		},
+		"root hash differs from hash tree": {
+			signature: func(t *testing.T, rootHash []byte) []byte {
+				other := bytes.Repeat([]byte{0xab}, len(rootHash))
+				return signedRootHash(cert, key, nil)(t, other)
+			},
+			cert:         cert,
+			wantSeverity: SeverityError,
+			wantMessage:  "signature is for root hash abab",
+		},
+		"invalid json": {
+			signature: func(t *testing.T, rootHash []byte) []byte {
+				return []byte(`{"rootHash": "`)
+			},
+			cert:         cert,
+			wantSeverity: SeverityError,
+			wantMessage:  "decoding verity signature",
+		},
+		"empty": {
+			signature: func(t *testing.T, rootHash []byte) []byte {
+				return nil
+			},
+			cert:         cert,
+			wantSeverity: SeverityError,
+			wantMessage:  "verity signature partition is empty",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			imagePath, rootHash := newTestVerityImage(t)
+			image, err := New(imagePath, 0, "")
+			require.NoError(err)
+			defer image.Close()
+			sets, err := image.VeritySets()
+			require.NoError(err)
+			require.Len(sets, 1)
+			require.NotNil(sets[0].Signature)
+			_, err = image.disk.WriteAt(tc.signature(t, rootHash), sets[0].Signature.Start)
+			require.NoError(err)
+
+			findings, err := image.Verify(context.Background(), VerifyOptions{Certificate: tc.cert, RehashData: true})
+			require.NoError(err)
+			assert.Contains(findings, Finding{Check: "root hash tree", Severity: SeverityOK, Message: "root hash " + hex.EncodeToString(rootHash)})
+			assert.Contains(findings, Finding{Check: "root data", Severity: SeverityOK, Message: "data matches hash tree"})
+			var signatureFindings []Finding
+			for _, finding := range findings {
+				if finding.Check == "root signature" {
+					signatureFindings = append(signatureFindings, finding)
+				}
+			}
+			require.NotEmpty(signatureFindings)
+			last := signatureFindings[len(signatureFindings)-1]
+			if tc.wantSeverity == SeverityError {
+				assert.Equal(SeverityError, signatureFindings[0].Severity)
+				found := false
+				for _, finding := range signatureFindings {
+					found = found || strings.Contains(finding.Message, tc.wantMessage)
+				}
+				assert.True(found, "no finding contains %q: %v", tc.wantMessage, signatureFindings)
+				return
+			}
+			require.Len(signatureFindings, 1)
+			assert.Equal(tc.wantSeverity, last.Severity)
+			assert.Equal(tc.wantMessage, last.Message)
+		})
+	}
+}
+
+// signedRootHash returns the content of a signature partition signing the root hash, optionally modified.
+func signedRootHash(cert *x509.Certificate, key crypto.Signer, modify func(sig *verity.Signature)) func(t *testing.T, rootHash []byte) []byte {
+	return func(t *testing.T, rootHash []byte) []byte {
+		sig, err := verity.Sign(rootHash, cert, key)
+		require.NoError(t, err)
+		if modify != nil {
+			modify(sig)
+		}
+		content, err := sig.MarshalPadded(4096)
+		require.NoError(t, err)
+		return content
+	}
+}
+
+func TestReadVeritySignature(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cert, key := testCertificate(t, "verity test")
+	imagePath, rootHash := newTestVerityImage(t)
+	image, err := New(imagePath, 0, "")
+	require.NoError(err)
+	defer image.Close()
+	sets, err := image.VeritySets()
+	require.NoError(err)
+	require.Len(sets, 1)
+	assert.Equal(gpt.DesignatorRoot, sets[0].Designator)
+	assert.Equal(gpt.ArchX86_64, sets[0].Arch)
+	require.NotNil(sets[0].Signature)
+
+	sig, err := verity.Sign(rootHash, cert, key)
+	require.NoError(err)
+	require.NoError(image.WriteVeritySignature(sets[0], sig))
+	read, err := image.VeritySignature(sets[0])
+	require.NoError(err)
+	assert.Equal(hex.EncodeToString(rootHash), read.RootHash)
+	assert.Equal(verity.CertificateFingerprint(cert), read.CertificateFingerprint)
+	assert.Equal(sig.Signature, read.Signature)
+	assert.NoError(read.Verify(cert))
+}
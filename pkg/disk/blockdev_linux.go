@@ -0,0 +1,78 @@
+//go:build linux
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlockDevice is a disk or loop device.
+type BlockDevice struct {
+	*os.File
+	size       int64
+	sectorSize int64
+	written    bool
+}
+
+// openBlockDevice opens the device with O_EXCL, which fails if the kernel uses the device
+// (like for a mounted filesystem), and queries its size and logical sector size.
+// Devices opened for reading only are not opened exclusively.
+func openBlockDevice(path string, readOnly bool) (Disk, error) {
+	flag := os.O_RDWR | unix.O_EXCL
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening block device: %w", err)
+	}
+	fd := int(file.Fd())
+	sectorSize, err := unix.IoctlGetInt(fd, unix.BLKSSZGET)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("getting sector size of %s: %w", path, err)
+	}
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		file.Close()
+		return nil, fmt.Errorf("getting size of %s: %w", path, errno)
+	}
+	return &BlockDevice{File: file, size: int64(size), sectorSize: int64(sectorSize)}, nil
+}
+
+// Size returns the size of the device as reported by BLKGETSIZE64.
+func (d *BlockDevice) Size() int64 {
+	return d.size
+}
+
+// SectorSize returns the logical sector size of the device as reported by BLKSSZGET.
+func (d *BlockDevice) SectorSize() int64 {
+	return d.sectorSize
+}
+
+func (d *BlockDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.written = true
+	return d.File.WriteAt(p, off)
+}
+
+// Close flushes written data to the device and drops the buffer cache of the device (BLKFLSBUF),
+// so that partition and filesystem tools see the changes.
+func (d *BlockDevice) Close() error {
+	if !d.written {
+		return d.File.Close()
+	}
+	err := d.File.Sync()
+	if err == nil {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, d.File.Fd(), unix.BLKFLSBUF, 0); errno != 0 {
+			err = fmt.Errorf("flushing buffers of %s: %w", d.Name(), errno)
+		}
+	}
+	if closeErr := d.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package disk
+
+import "errors"
+
+func openBlockDevice(path string, readOnly bool) (Disk, error) {
+	return nil, errors.New("block devices are only supported on Linux")
+}
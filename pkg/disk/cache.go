@@ -0,0 +1,49 @@
+package disk
+
+import "container/list"
+
+// chunkCache keeps the most recently used chunks of a disk, by chunk index.
+// It is not safe for concurrent use.
+type chunkCache struct {
+	limit   int
+	lru     *list.List
+	entries map[int64]*list.Element
+}
+
+type chunkCacheEntry struct {
+	index int64
+	data  []byte
+}
+
+func newChunkCache(limit int) *chunkCache {
+	return &chunkCache{limit: limit, lru: list.New(), entries: make(map[int64]*list.Element)}
+}
+
+func (c *chunkCache) get(index int64) ([]byte, bool) {
+	element, ok := c.entries[index]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*chunkCacheEntry).data, true
+}
+
+// put adds a chunk, evicting the least recently used one if the cache is full.
+func (c *chunkCache) put(index int64, data []byte) {
+	if element, ok := c.entries[index]; ok {
+		element.Value.(*chunkCacheEntry).data = data
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[index] = c.lru.PushFront(&chunkCacheEntry{index: index, data: data})
+	if c.lru.Len() > c.limit {
+		oldest := c.lru.Remove(c.lru.Back()).(*chunkCacheEntry)
+		delete(c.entries, oldest.index)
+	}
+}
+
+// clear drops all chunks.
+func (c *chunkCache) clear() {
+	c.lru.Init()
+	clear(c.entries)
+}
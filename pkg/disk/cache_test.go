@@ -0,0 +1,31 @@
+package disk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newChunkCache(2)
+	c.put(1, []byte("one"))
+	c.put(2, []byte("two"))
+	_, ok := c.get(1) // 2 is now the least recently used chunk
+	assert.True(ok)
+	c.put(3, []byte("three"))
+	_, ok = c.get(2)
+	assert.False(ok)
+	data, ok := c.get(1)
+	assert.True(ok)
+	assert.Equal("one", string(data))
+
+	c.put(3, []byte("THREE"))
+	data, _ = c.get(3)
+	assert.Equal("THREE", string(data))
+
+	c.clear()
+	_, ok = c.get(1)
+	assert.False(ok)
+}
@@ -0,0 +1,503 @@
+package disk
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressed image formats, detected by their magic and created by file extension.
+const (
+	FormatZstd = "zstd"
+	FormatXz   = "xz"
+	FormatGzip = "gzip"
+)
+
+const (
+	// compressedChunk is the unit in which decompressed data is cached.
+	compressedChunk = 64 << 10
+	// compressedCacheChunks bounds the cache of a compressed image to 256 MiB.
+	compressedCacheChunks = 4096
+)
+
+var compressionMagics = []struct {
+	format string
+	magic  string
+}{
+	{FormatZstd, "\x28\xb5\x2f\xfd"},
+	{FormatXz, "\xfd7zXZ\x00"},
+	{FormatGzip, "\x1f\x8b"},
+}
+
+// ErrReadOnly is returned when writing to an image that cannot be modified in place.
+var ErrReadOnly = errors.New("image is read-only")
+
+// Compression returns the compression format of the stream in r, or "" if it is not compressed.
+func Compression(r io.ReaderAt) string {
+	magic := make([]byte, 6)
+	n, _ := r.ReadAt(magic, 0)
+	for _, m := range compressionMagics {
+		if strings.HasPrefix(string(magic[:n]), m.magic) {
+			return m.format
+		}
+	}
+	return ""
+}
+
+// Compressed is a read-only raw image compressed with zstd, xz or gzip.
+// The stream is decompressed on demand: reads ahead of the stream position skip forward,
+// reads behind it are served from a cache of recently read chunks or restart the decompression.
+// Since the streams carry no (reliable) uncompressed size, the size of the disk is taken from
+// the location of the backup GPT header. For tar.gz archives (as used by Google Compute Engine),
+// the disk is the disk.raw member of the archive.
+type Compressed struct {
+	file   *os.File
+	format string
+	size   int64
+	// tarHeader is the header of the disk.raw member of tar.gz archives.
+	tarHeader *tar.Header
+
+	// mu guards the stream and the cache.
+	mu     sync.Mutex
+	stream io.Reader
+	close  func()
+	pos    int64
+	cache  *chunkCache
+}
+
+// OpenCompressed opens the compressed image stored in file.
+func OpenCompressed(file *os.File) (*Compressed, error) {
+	c := &Compressed{
+		file:   file,
+		format: Compression(file),
+		cache:  newChunkCache(compressedCacheChunks),
+	}
+	if c.format == "" {
+		return nil, errors.New("not a compressed image")
+	}
+	if c.format == FormatGzip && isTarGz(file) {
+		// the size of the disk is the size of its archive member
+		c.format = FormatTarGz
+		if err := c.restart(); err != nil {
+			c.stop()
+			return nil, err
+		}
+		return c, nil
+	}
+	first, err := c.chunk(0)
+	if err != nil {
+		c.stop()
+		return nil, err
+	}
+	size, ok := gptDiskSize(first)
+	if !ok {
+		c.stop()
+		return nil, fmt.Errorf("cannot determine the size of the %s compressed image: no GPT header found", c.format)
+	}
+	c.size = size
+	return c, nil
+}
+
+// gptDiskSize derives the size of a disk from the primary GPT header (at LBA 1 of 512 or 4096 byte sectors),
+// which points to the backup header in the last sector.
+func gptDiskSize(start []byte) (int64, bool) {
+	for sectorSize := 512; sectorSize <= 4096; sectorSize *= 8 {
+		if len(start) < 2*sectorSize || string(start[sectorSize:sectorSize+8]) != "EFI PART" {
+			continue
+		}
+		backup := binary.LittleEndian.Uint64(start[sectorSize+32 : sectorSize+40])
+		return int64(backup+1) * int64(sectorSize), true
+	}
+	return 0, false
+}
+
+// Format returns the compression format of the image.
+func (c *Compressed) Format() string {
+	return c.format
+}
+
+// Size returns the size of the decompressed disk.
+func (c *Compressed) Size() int64 {
+	return c.size
+}
+
+// SectorSize returns 0, since compressed images carry no sector size.
+func (c *Compressed) SectorSize() int64 {
+	return 0
+}
+
+// Close stops the decompression and closes the file.
+func (c *Compressed) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop()
+	return c.file.Close()
+}
+
+// WriteAt fails, since compressed images cannot be modified in place.
+func (c *Compressed) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: %s compressed images cannot be modified in place", ErrReadOnly, c.format)
+}
+
+func (c *Compressed) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), c.size-off))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		data, err := c.chunk(pos / compressedChunk)
+		if err != nil {
+			return done, err
+		}
+		inChunk := int(pos % compressedChunk)
+		if inChunk >= len(data) {
+			return done, io.ErrUnexpectedEOF
+		}
+		done += copy(p[done:n], data[inChunk:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk returns the decompressed chunk with the given index. c.mu must be held.
+func (c *Compressed) chunk(index int64) ([]byte, error) {
+	if data, ok := c.cache.get(index); ok {
+		return data, nil
+	}
+	start := index * compressedChunk
+	if c.stream == nil || start < c.pos {
+		if err := c.restart(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, c.stream, start-c.pos); err != nil {
+		c.stop()
+		return nil, fmt.Errorf("decompressing %s image: %w", c.format, err)
+	}
+	c.pos = start
+	data := make([]byte, compressedChunk)
+	n, err := io.ReadFull(c.stream, data)
+	if err != nil && (!errors.Is(err, io.ErrUnexpectedEOF) || start+int64(n) < c.size) {
+		c.stop()
+		return nil, fmt.Errorf("decompressing %s image: %w", c.format, err)
+	}
+	data = data[:n]
+	c.pos += int64(n)
+	c.cache.put(index, data)
+	return data, nil
+}
+
+// stop stops the decompression.
+func (c *Compressed) stop() {
+	if c.close != nil {
+		c.close()
+	}
+	c.stream, c.close, c.pos = nil, nil, 0
+}
+
+// restart starts decompressing from the start of the file.
+func (c *Compressed) restart() error {
+	c.stop()
+	r := bufio.NewReaderSize(io.NewSectionReader(c.file, 0, 1<<63-1), 1<<20)
+	switch c.format {
+	case FormatZstd:
+		// allow the windows of zstd --long=31
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderMaxWindow(1<<31))
+		if err != nil {
+			return err
+		}
+		c.stream, c.close = decoder, decoder.Close
+	case FormatXz:
+		decoder, err := xz.NewReader(r)
+		if err != nil {
+			return err
+		}
+		c.stream, c.close = decoder, func() {}
+	case FormatGzip, FormatTarGz:
+		decoder, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		c.stream, c.close = decoder, func() { decoder.Close() }
+	}
+	if c.format == FormatTarGz {
+		member, header, err := tarDisk(c.stream)
+		if err != nil {
+			c.stop()
+			return err
+		}
+		c.stream, c.size, c.tarHeader = member, header.Size, header
+	}
+	return nil
+}
+
+// WriteCompressed streams the content of src into w, compressed with the given format.
+func WriteCompressed(ctx context.Context, w io.Writer, format string, src Disk) error {
+	var encoder io.WriteCloser
+	switch format {
+	case FormatZstd:
+		zstdEncoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return err
+		}
+		zstdEncoder.ResetContentSize(w, src.Size())
+		encoder = zstdEncoder
+	case FormatXz:
+		xzEncoder, err := xz.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		encoder = xzEncoder
+	case FormatGzip:
+		encoder = gzip.NewWriter(w)
+	default:
+		return fmt.Errorf("unknown compression format %q", format)
+	}
+	buf := make([]byte, copyChunk)
+	for off := int64(0); off < src.Size(); off += copyChunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf[:min(copyChunk, src.Size()-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil {
+			return fmt.Errorf("reading at %d: %w", off, err)
+		}
+		if _, err := encoder.Write(chunk); err != nil {
+			return fmt.Errorf("compressing: %w", err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("compressing: %w", err)
+	}
+	return nil
+}
+
+// Overlay keeps all writes to a disk in memory and leaves the underlying disk untouched.
+// It is used to patch read-only (like compressed) images before exporting them.
+type Overlay struct {
+	base Disk
+
+	mu     sync.Mutex
+	chunks map[int64][]byte
+}
+
+const overlayChunk = 4096
+
+// NewOverlay returns an overlay on base. Closing the overlay closes base.
+func NewOverlay(base Disk) *Overlay {
+	return &Overlay{base: base, chunks: make(map[int64][]byte)}
+}
+
+// Size returns the size of the underlying disk.
+func (o *Overlay) Size() int64 {
+	return o.base.Size()
+}
+
+// SectorSize returns the sector size of the underlying disk.
+func (o *Overlay) SectorSize() int64 {
+	return o.base.SectorSize()
+}
+
+// Close closes the underlying disk and drops all writes.
+func (o *Overlay) Close() error {
+	return o.base.Close()
+}
+
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.base.ReadAt(p, off)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for index := off / overlayChunk; index*overlayChunk < off+int64(n); index++ {
+		chunk, ok := o.chunks[index]
+		if !ok {
+			continue
+		}
+		start := index * overlayChunk
+		if start < off {
+			copy(p[:n], chunk[off-start:])
+		} else {
+			copy(p[start-off:n], chunk)
+		}
+	}
+	return n, err
+}
+
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > o.base.Size() {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the disk of %d bytes", len(p), off, o.base.Size())
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for index := off / overlayChunk; index*overlayChunk < off+int64(len(p)); index++ {
+		start := index * overlayChunk
+		chunk, ok := o.chunks[index]
+		if !ok {
+			chunk = make([]byte, overlayChunk)
+			n, err := o.base.ReadAt(chunk, start)
+			if err != nil && !(errors.Is(err, io.EOF) && start+int64(n) == o.base.Size()) {
+				return 0, err
+			}
+			o.chunks[index] = chunk
+		}
+		if start < off {
+			copy(chunk[off-start:], p)
+		} else {
+			copy(chunk, p[start-off:])
+		}
+	}
+	return len(p), nil
+}
+
+// Base returns the underlying disk.
+func (o *Overlay) Base() Disk {
+	return o.base
+}
+
+// modifiedIn reports whether anything was written to the overlay between off and off+length.
+func (o *Overlay) modifiedIn(off, length int64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for index := off / overlayChunk; index*overlayChunk < off+length; index++ {
+		if _, ok := o.chunks[index]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Modified reports whether anything was written to the overlay.
+func (o *Overlay) Modified() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.chunks) > 0
+}
+
+// Export writes the content of src to a new image at path. Compressed formats are streamed,
+// all others are created by Create. s3:// URLs are uploaded (see exportS3). It returns the size of the exported disk,
+// which is larger than src for formats that require alignment. The backup GPT of padded disks is moved to the new end.
+func Export(ctx context.Context, path, format string, src Disk) (size int64, retErr error) {
+	if IsS3URL(path) {
+		return exportS3(ctx, path, format, src)
+	}
+	switch format {
+	case FormatZstd, FormatSeekableZstd, FormatXz, FormatGzip, FormatTarGz:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if err := file.Close(); retErr == nil {
+				retErr = err
+			}
+			if retErr != nil {
+				os.Remove(path)
+			}
+		}()
+		w := bufio.NewWriterSize(file, 1<<20)
+		if err := writeStream(ctx, w, format, src); err != nil {
+			return 0, err
+		}
+		return src.Size(), w.Flush()
+	}
+	dst, err := Create(path, format, src.Size())
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dst.Close(); retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			os.Remove(path)
+		}
+	}()
+	if err := Copy(ctx, dst, src); err != nil {
+		return 0, err
+	}
+	if dst.Size() != src.Size() {
+		if err := resizeGPT(dst, src.SectorSize()); err != nil {
+			return 0, fmt.Errorf("moving backup GPT to the end of the padded disk: %w", err)
+		}
+	}
+	return dst.Size(), nil
+}
+
+// Replace rewrites the local image at path with the content of src in the given format, like for patching
+// compressed images in place. src is exported to a temporary file next to path, which then replaces the image
+// with its permissions, so src may still be read from the image at path. It returns the size of the exported disk.
+func Replace(ctx context.Context, path, format string, src Disk) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	// Export creates the file exclusively
+	tmpPath := tmp.Name()
+	if err := errors.Join(tmp.Close(), os.Remove(tmpPath)); err != nil {
+		return 0, err
+	}
+	size, err := Export(ctx, tmpPath, format, src)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return size, nil
+}
+
+// resizeGPT moves the backup GPT to the end of d. Without known blocksize, the primary GPT header is
+// looked for in blocks of 512 and 4096 bytes. Disks without GPT are left as they are.
+func resizeGPT(d Disk, blocksize int64) error {
+	blocksizes := []int64{512, 4096}
+	if blocksize != 0 {
+		blocksizes = []int64{blocksize}
+	}
+	for _, blocksize := range blocksizes {
+		if _, err := gpt.Read(d, blocksize); err == nil {
+			return gpt.Resize(d, blocksize, d.Size())
+		}
+	}
+	return nil
+}
+
+// writeStream writes src to w in one of the compressed formats.
+func writeStream(ctx context.Context, w io.Writer, format string, src Disk) error {
+	switch format {
+	case FormatSeekableZstd:
+		return WriteSeekableZstd(ctx, w, src)
+	case FormatTarGz:
+		return WriteTarGz(ctx, w, src)
+	default:
+		return WriteCompressed(ctx, w, format, src)
+	}
+}
@@ -0,0 +1,185 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testGPTDisk returns a disk of the given size with a primary GPT header pointing to the last sector
+// and some content.
+func testGPTDisk(size int64) []byte {
+	content := make([]byte, size)
+	copy(content[512:], "EFI PART")
+	binary.LittleEndian.PutUint64(content[512+32:], uint64(size/512-1))
+	for off := int64(1 << 20); off < size; off += 300 << 10 {
+		copy(content[off:], bytes.Repeat([]byte{byte(off >> 10)}, 5000))
+	}
+	return content
+}
+
+func TestCompressed(t *testing.T) {
+	for _, format := range []string{FormatZstd, FormatXz, FormatGzip} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			dir := t.TempDir()
+			content := testGPTDisk(3<<20 + 4096)
+			require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+			src, err := Open(filepath.Join(dir, "image.raw"))
+			require.NoError(err)
+			defer src.Close()
+			path := filepath.Join(dir, "image.raw.compressed")
+			size, err := Export(context.Background(), path, format, src)
+			require.NoError(err)
+			assert.Equal(int64(len(content)), size)
+
+			d, err := Open(path)
+			require.NoError(err)
+			defer d.Close()
+			require.IsType(&Compressed{}, d)
+			c := d.(*Compressed)
+			assert.Equal(format, c.Format())
+			assert.Equal(int64(len(content)), d.Size())
+
+			// forward, backward (cached) and past the end
+			for _, off := range []int64{2 << 20, 1<<20 + 100, 3<<20 + 4000} {
+				got := make([]byte, 96)
+				_, err := d.ReadAt(got, off)
+				require.NoError(err)
+				assert.Equal(content[off:off+96], got)
+			}
+			got := make([]byte, 200)
+			n, err := d.ReadAt(got, int64(len(content))-100)
+			assert.Equal(100, n)
+			assert.Error(err)
+
+			// backward after the chunks were evicted
+			c.cache.clear()
+			got = make([]byte, 1<<20)
+			_, err = d.ReadAt(got, 1<<19)
+			require.NoError(err)
+			assert.Equal(content[1<<19:3<<19], got)
+
+			_, err = d.WriteAt([]byte("x"), 0)
+			assert.ErrorIs(err, ErrReadOnly)
+		})
+	}
+}
+
+func TestExportPadded(t *testing.T) {
+	for _, format := range []string{FormatVHD, FormatVHDDynamic, FormatVHDX} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			dir := t.TempDir()
+			const size = 3<<20 + 4096
+			primary, backup, err := gpt.Build(512, size, "11111111-2222-3333-4444-555555555555", []gpt.Partition{
+				{Type: gpt.LinuxGeneric, UUID: "2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", Name: "root", FirstLBA: 2048, LastLBA: 4095},
+			})
+			require.NoError(err)
+			content := make([]byte, size)
+			copy(content, primary)
+			copy(content[size-len(backup):], backup)
+			require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+			src, err := Open(filepath.Join(dir, "image.raw"))
+			require.NoError(err)
+			defer src.Close()
+			path := filepath.Join(dir, "image."+format)
+			padded, err := Export(context.Background(), path, format, src)
+			require.NoError(err)
+			assert.Equal(int64(4<<20), padded)
+
+			d, err := Open(path)
+			require.NoError(err)
+			defer d.Close()
+			table, err := gpt.Read(d, 512)
+			require.NoError(err)
+			lastLBA := uint64(padded/512 - 1)
+			assert.Equal(lastLBA, table.Header.AlternateLBA)
+			assert.Equal(lastLBA-33, table.Header.LastUsableLBA)
+			require.Len(table.Partitions, 1)
+			assert.Equal("root", table.Partitions[0].Name)
+
+			// the backup GPT is valid at the new end and the old one is gone
+			header := make([]byte, 512)
+			_, err = d.ReadAt(header, int64(lastLBA)*512)
+			require.NoError(err)
+			assert.Equal("EFI PART", string(header[:8]))
+			assert.Equal(lastLBA, binary.LittleEndian.Uint64(header[24:32]))
+			assert.Equal(uint64(1), binary.LittleEndian.Uint64(header[32:40]))
+			entries := make([]byte, 128*128)
+			_, err = d.ReadAt(entries, int64(lastLBA-32)*512)
+			require.NoError(err)
+			assert.Equal(binary.LittleEndian.Uint32(header[88:92]), crc32.ChecksumIEEE(entries))
+			_, err = d.ReadAt(header, size-512)
+			require.NoError(err)
+			assert.Equal(make([]byte, 512), header)
+		})
+	}
+}
+
+func TestCompressedWithoutGPT(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), make([]byte, 1<<20), 0o644))
+	src, err := Open(filepath.Join(dir, "image.raw"))
+	require.NoError(err)
+	defer src.Close()
+	_, err = Export(context.Background(), filepath.Join(dir, "image.raw.zst"), FormatZstd, src)
+	require.NoError(err)
+
+	_, err = Open(filepath.Join(dir, "image.raw.zst"))
+	require.Error(err)
+	assert.Contains(t, err.Error(), "no GPT header")
+}
+
+func TestOverlay(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.raw")
+	content := bytes.Repeat([]byte("base "), 4000)
+	require.NoError(os.WriteFile(path, content, 0o644))
+	base, err := Open(path)
+	require.NoError(err)
+	o := NewOverlay(base)
+	defer o.Close()
+	assert.False(o.Modified())
+
+	patch := bytes.Repeat([]byte("overlay "), 1000) // spans three chunks
+	_, err = o.WriteAt(patch, 4000)
+	require.NoError(err)
+	_, err = o.WriteAt([]byte("end"), int64(len(content))-3)
+	require.NoError(err)
+	_, err = o.WriteAt([]byte("x"), int64(len(content)))
+	assert.Error(err)
+	assert.True(o.Modified())
+
+	want := bytes.Clone(content)
+	copy(want[4000:], patch)
+	copy(want[len(want)-3:], "end")
+	got := make([]byte, len(content))
+	_, err = o.ReadAt(got, 0)
+	require.NoError(err)
+	assert.Equal(want, got)
+	got = make([]byte, 10)
+	_, err = o.ReadAt(got, 8190)
+	require.NoError(err)
+	assert.Equal(want[8190:8200], got)
+
+	unchanged, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.Equal(content, unchanged)
+}
@@ -0,0 +1,257 @@
+// Package disk provides the storage backends of images: a raw view of the disk that the gpt, fat
+// and verity packages read and write, independent of where and how the image is stored.
+package disk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Image formats that can be created (see also the compressed formats).
+const (
+	FormatRaw        = "raw"
+	FormatQcow2      = "qcow2"
+	FormatVHD        = "vhd" // fixed VHD, as required by Azure
+	FormatVHDDynamic = "vhd-dynamic"
+	FormatVHDX       = "vhdx"
+)
+
+// Formats lists the image formats that can be created.
+var Formats = []string{FormatRaw, FormatQcow2, FormatVHD, FormatVHDDynamic, FormatVHDX, FormatZstd, FormatSeekableZstd, FormatXz, FormatGzip, FormatTarGz}
+
+// copyChunk is the unit in which Copy reads the source and skips zeros.
+const copyChunk = 1 << 20
+
+// Disk is the raw view of an image.
+type Disk interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Size returns the size of the disk in bytes.
+	Size() int64
+	// SectorSize returns the logical sector size of the disk,
+	// or 0 if the backend does not know it and the partition table has to be probed.
+	SectorSize() int64
+}
+
+// Open opens the image at path for reading and writing.
+// Block devices are opened exclusively and use the sector size reported by the kernel.
+// qcow2, VHDX and VHD images are detected by their signatures and present their virtual disk.
+// zstd, xz and gzip compressed images and disk.raw in tar.gz archives are decompressed on demand
+// and cannot be written.
+// Seekable zstd images are read frame by frame.
+// http and https URLs of raw and seekable zstd images are read with range requests and cannot be written.
+// s3:// URLs are read the same way, raw objects are rewritten by Export.
+func Open(path string) (Disk, error) {
+	return open(path, false)
+}
+
+// OpenReadOnly opens the image at path like Open, but for reading only: files are opened with O_RDONLY,
+// block devices are not opened exclusively and qcow2 images that were not closed cleanly can be read.
+// Writes fail with ErrReadOnly.
+func OpenReadOnly(path string) (Disk, error) {
+	return open(path, true)
+}
+
+func open(path string, readOnly bool) (Disk, error) {
+	if IsS3URL(path) {
+		return openS3(path)
+	}
+	if IsURL(path) {
+		return openURL(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening image file: %w", err)
+	}
+	if info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		d, err := openBlockDevice(path, readOnly)
+		if err != nil || !readOnly {
+			return d, err
+		}
+		return readOnlyDisk{d}, nil
+	}
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening image file: %w", err)
+	}
+	if IsQcow2(file) {
+		q, err := OpenQcow2(file, path, readOnly)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return q, nil
+	}
+	if Compression(file) == FormatZstd && IsSeekableZstd(file, info.Size()) {
+		s, err := OpenSeekableZstd(file, info.Size(), file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	if Compression(file) != "" {
+		c, err := OpenCompressed(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	var d Disk = &File{File: file, size: info.Size()}
+	if IsVHDX(file) {
+		if d, err = OpenVHDX(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if IsVHD(file, info.Size()) {
+		if d, err = OpenVHD(file, info.Size()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if readOnly {
+		return readOnlyDisk{d}, nil
+	}
+	return d, nil
+}
+
+// readOnlyDisk rejects writes to a disk opened with OpenReadOnly.
+type readOnlyDisk struct {
+	Disk
+}
+
+func (d readOnlyDisk) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: image was opened for reading", ErrReadOnly)
+}
+
+// File is a raw image in a regular file.
+type File struct {
+	*os.File
+	size int64
+}
+
+// Size returns the size of the file when it was opened.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// SectorSize returns 0, since image files carry no sector size.
+func (f *File) SectorSize() int64 {
+	return 0
+}
+
+// FormatFromPath returns the image format matching the extension of path, defaulting to raw.
+func FormatFromPath(path string) string {
+	if lower := strings.ToLower(path); strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+		return FormatTarGz
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".qcow2":
+		return FormatQcow2
+	case ".vhd":
+		return FormatVHD
+	case ".vhdx":
+		return FormatVHDX
+	case ".zst", ".zstd":
+		return FormatZstd
+	case ".xz":
+		return FormatXz
+	case ".gz":
+		return FormatGzip
+	}
+	return FormatRaw
+}
+
+// Create creates an empty image of the given format for a disk of the given size and opens it for writing.
+// VHD and VHDX images are rounded up to a multiple of 1 MiB. Existing files are never overwritten.
+// Compressed images cannot be created for random access writes, use Export instead.
+func Create(path, format string, size int64) (Disk, error) {
+	switch format {
+	case FormatRaw:
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &File{File: file, size: size}, nil
+	case FormatQcow2:
+		return CreateQcow2(path, size)
+	case FormatVHD, FormatVHDDynamic:
+		return CreateVHD(path, size, format == FormatVHDDynamic)
+	case FormatVHDX:
+		return CreateVHDX(path, size)
+	case FormatZstd, FormatSeekableZstd, FormatXz, FormatGzip, FormatTarGz:
+		return nil, fmt.Errorf("%s compressed images can only be exported", format)
+	}
+	return nil, fmt.Errorf("unknown image format %q (supported: %s)", format, strings.Join(Formats, ", "))
+}
+
+// Copy copies the content of src to the start of the freshly created dst.
+// Chunks of zeros are skipped, so sparse formats stay sparse.
+func Copy(ctx context.Context, dst, src Disk) error {
+	if dst.Size() < src.Size() {
+		return fmt.Errorf("destination of %d bytes is smaller than the source of %d bytes", dst.Size(), src.Size())
+	}
+	buf := make([]byte, copyChunk)
+	zeros := make([]byte, copyChunk)
+	for off := int64(0); off < src.Size(); off += copyChunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf[:min(copyChunk, src.Size()-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil {
+			return fmt.Errorf("reading at %d: %w", off, err)
+		}
+		if bytes.Equal(chunk, zeros[:len(chunk)]) {
+			continue
+		}
+		if _, err := dst.WriteAt(chunk, off); err != nil {
+			return fmt.Errorf("writing at %d: %w", off, err)
+		}
+	}
+	return nil
+}
+
+// openURL opens a remote image. Only raw and seekable zstd images can be read over HTTP,
+// since the other formats are either modified in place or need to be read as a whole.
+func openURL(url string) (Disk, error) {
+	h, err := OpenHTTP(url)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return openRemote(h, h)
+}
+
+// openRemote detects the format of the remote image h. raw is returned for raw images.
+func openRemote(h *HTTP, raw Disk) (Disk, error) {
+	switch compression := Compression(h); {
+	case compression == FormatZstd && IsSeekableZstd(h, h.Size()):
+		s, err := OpenSeekableZstd(h, h.Size(), h)
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		return s, nil
+	case compression != "":
+		h.Close()
+		return nil, fmt.Errorf("%s: %s compressed images can only be read over HTTP in the seekable zstd format", h.url, compression)
+	case IsQcow2(h), IsVHDX(h), IsVHD(h, h.Size()):
+		h.Close()
+		return nil, fmt.Errorf("%s: qcow2, VHD and VHDX images cannot be read over HTTP, convert them to raw or seekable zstd", h.url)
+	}
+	return raw, nil
+}
@@ -0,0 +1,172 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.raw")
+	require.NoError(os.WriteFile(path, make([]byte, 8192), 0o644))
+
+	d, err := Open(path)
+	require.NoError(err)
+	assert.Equal(int64(8192), d.Size())
+	assert.Equal(int64(0), d.SectorSize())
+	_, err = d.WriteAt([]byte("EFI PART"), 512)
+	require.NoError(err)
+	require.NoError(d.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.Equal("EFI PART", string(content[512:520]))
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing.raw"))
+	assert.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.raw")
+	require.NoError(os.WriteFile(path, []byte("EFI PART"), 0o444))
+	d, err := OpenReadOnly(path)
+	require.NoError(err)
+	buf := make([]byte, 8)
+	_, err = d.ReadAt(buf, 0)
+	require.NoError(err)
+	assert.Equal("EFI PART", string(buf))
+	_, err = d.WriteAt(buf, 0)
+	assert.ErrorIs(err, ErrReadOnly)
+	require.NoError(d.Close())
+
+	// qcow2 images that were not closed cleanly can only be read
+	qcow2Path := filepath.Join(dir, "image.qcow2")
+	q, err := createQcow2(qcow2Path, 1<<20, 16, "")
+	require.NoError(err)
+	_, err = q.WriteAt([]byte("dirty"), 4096)
+	require.NoError(err)
+	require.NoError(q.Close())
+	file, err := os.OpenFile(qcow2Path, os.O_RDWR, 0)
+	require.NoError(err)
+	incompatible := make([]byte, 8)
+	binary.BigEndian.PutUint64(incompatible, qcow2IncompatDirty)
+	_, err = file.WriteAt(incompatible, 72)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	_, err = Open(qcow2Path)
+	assert.Error(err)
+	d, err = OpenReadOnly(qcow2Path)
+	require.NoError(err)
+	defer d.Close()
+	buf = make([]byte, 5)
+	_, err = d.ReadAt(buf, 4096)
+	require.NoError(err)
+	assert.Equal("dirty", string(buf))
+	_, err = d.WriteAt(buf, 0)
+	assert.Error(err)
+}
+
+func TestOpenBlockDevice(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.raw")
+	require.NoError(os.WriteFile(path, make([]byte, 1<<20), 0o644))
+	out, err := exec.Command("losetup", "--find", "--show", "--sector-size", "4096", path).Output()
+	if err != nil {
+		t.Skipf("cannot set up loop device: %v", err)
+	}
+	device := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "--detach", device).Run()
+
+	d, err := Open(device)
+	require.NoError(err)
+	assert.Equal(int64(1<<20), d.Size())
+	assert.Equal(int64(4096), d.SectorSize())
+
+	_, err = Open(device)
+	assert.Error(err, "second exclusive open must fail")
+	readOnly, err := OpenReadOnly(device)
+	require.NoError(err, "read-only open is not exclusive")
+	require.NoError(readOnly.Close())
+
+	_, err = d.WriteAt([]byte("EFI PART"), 4096)
+	require.NoError(err)
+	require.NoError(d.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.Equal("EFI PART", string(content[4096:4104]))
+}
+
+func TestCopy(t *testing.T) {
+	testCases := map[string]struct {
+		format   string
+		wantSize int64
+		wantType Disk
+	}{
+		"raw":         {format: FormatRaw, wantSize: 3<<20 + 4096, wantType: &File{}},
+		"qcow2":       {format: FormatQcow2, wantSize: 3<<20 + 4096, wantType: &Qcow2{}},
+		"fixed vhd":   {format: FormatVHD, wantSize: 4 << 20, wantType: &VHD{}},
+		"dynamic vhd": {format: FormatVHDDynamic, wantSize: 4 << 20, wantType: &VHD{}},
+		"vhdx":        {format: FormatVHDX, wantSize: 4 << 20, wantType: &VHDX{}},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			dir := t.TempDir()
+			content := make([]byte, 3<<20+4096)
+			copy(content[512:], "EFI PART")
+			copy(content[3<<20+100:], bytes.Repeat([]byte("tail "), 100))
+			require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+			src, err := Open(filepath.Join(dir, "image.raw"))
+			require.NoError(err)
+			defer src.Close()
+
+			path := filepath.Join(dir, "converted")
+			dst, err := Create(path, tc.format, src.Size())
+			require.NoError(err)
+			require.NoError(Copy(context.Background(), dst, src))
+			require.NoError(dst.Close())
+			_, err = Create(path, tc.format, src.Size())
+			assert.ErrorIs(err, os.ErrExist)
+
+			d, err := Open(path)
+			require.NoError(err)
+			defer d.Close()
+			assert.IsType(tc.wantType, d)
+			assert.Equal(tc.wantSize, d.Size())
+			got := make([]byte, d.Size())
+			_, err = d.ReadAt(got, 0)
+			require.NoError(err)
+			assert.Equal(content, got[:len(content)])
+			assert.Equal(make([]byte, len(got)-len(content)), got[len(content):])
+		})
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(FormatVHD, FormatFromPath("image.VHD"))
+	assert.Equal(FormatVHDX, FormatFromPath("/tmp/image.vhdx"))
+	assert.Equal(FormatQcow2, FormatFromPath("image.qcow2"))
+	assert.Equal(FormatRaw, FormatFromPath("image.img"))
+}
@@ -0,0 +1,265 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// httpBlock is the unit in which remote images are fetched and cached.
+	httpBlock = 64 << 10
+	// httpCacheBlocks bounds the cache of a remote image to 256 MiB.
+	httpCacheBlocks = 4096
+	// httpMaxRequest bounds the size of a single (coalesced) range request.
+	httpMaxRequest = 16 << 20
+)
+
+var contentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// IsURL reports whether path is an http or https URL.
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// ReadURL returns the content of a (small) file on a web server or in S3, like a sidecar of a remote image.
+// A missing file is reported as os.ErrNotExist.
+func ReadURL(ctx context.Context, url string) ([]byte, error) {
+	if IsS3URL(url) {
+		return readS3Object(ctx, url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", url, os.ErrNotExist)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// HTTP is a read-only image on a web server that supports range requests.
+// Data is fetched in blocks of 64 KiB and cached. Missing blocks of a read are fetched with a single
+// request, and concurrent reads of the same block wait for the same request.
+type HTTP struct {
+	client *http.Client
+	url    string
+	size   int64
+	// sign (optional) authenticates requests.
+	sign func(req *http.Request)
+	// ctx is canceled by Close, which aborts the requests in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards the cache and the fetches in flight.
+	mu       sync.Mutex
+	cache    *chunkCache
+	inflight map[int64]*httpFetch
+}
+
+type httpFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// OpenHTTP opens the image at url. The first block is fetched to learn the size of the image.
+func OpenHTTP(url string) (*HTTP, error) {
+	return openHTTP(&http.Client{Timeout: 5 * time.Minute}, url, nil)
+}
+
+func openHTTP(client *http.Client, url string, sign func(req *http.Request)) (*HTTP, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &HTTP{
+		client:   client,
+		url:      url,
+		sign:     sign,
+		ctx:      ctx,
+		cancel:   cancel,
+		cache:    newChunkCache(httpCacheBlocks),
+		inflight: make(map[int64]*httpFetch),
+	}
+	data, size, err := h.fetch(0, httpBlock)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	h.size = size
+	h.cache.put(0, data)
+	return h, nil
+}
+
+// fetch requests length bytes at off and returns the data (shorter at the end of the image)
+// and the size of the image.
+func (h *HTTP) fetch(off, length int64) ([]byte, int64, error) {
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	if h.sign != nil {
+		h.sign(req)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, 0, fmt.Errorf("%s: server does not support range requests", h.url)
+	default:
+		return nil, 0, fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+	match := contentRange.FindStringSubmatch(resp.Header.Get("Content-Range"))
+	if match == nil {
+		return nil, 0, fmt.Errorf("%s: invalid Content-Range %q", h.url, resp.Header.Get("Content-Range"))
+	}
+	start, _ := strconv.ParseInt(match[1], 10, 64)
+	end, _ := strconv.ParseInt(match[2], 10, 64)
+	size, _ := strconv.ParseInt(match[3], 10, 64)
+	if start != off || end < start {
+		return nil, 0, fmt.Errorf("%s: requested bytes %d-%d, got %d-%d", h.url, off, off+length-1, start, end)
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", h.url, err)
+	}
+	return data, size, nil
+}
+
+// Size returns the size of the image.
+func (h *HTTP) Size() int64 {
+	return h.size
+}
+
+// SectorSize returns 0, since web servers report no sector size.
+func (h *HTTP) SectorSize() int64 {
+	return 0
+}
+
+// Close aborts the requests in flight and drops the cache.
+func (h *HTTP) Close() error {
+	h.cancel()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cache.clear()
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// WriteAt fails, since remote images cannot be modified.
+func (h *HTTP) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: %s cannot be modified", ErrReadOnly, h.url)
+}
+
+func (h *HTTP) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), h.size-off))
+	first, last := off/httpBlock, (off+int64(n)-1)/httpBlock
+	blocks, err := h.blocks(first, last)
+	if err != nil {
+		return 0, err
+	}
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		data := blocks[pos/httpBlock-first]
+		inBlock := int(pos % httpBlock)
+		if inBlock >= len(data) {
+			return done, io.ErrUnexpectedEOF
+		}
+		done += copy(p[done:n], data[inBlock:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blocks returns the blocks first to last. Cached blocks are used directly, blocks being fetched by
+// other reads are waited for and runs of the remaining blocks are fetched with one request each.
+func (h *HTTP) blocks(first, last int64) ([][]byte, error) {
+	blocks := make([][]byte, last-first+1)
+	fetches := make([]*httpFetch, len(blocks))
+	var own []int64
+	h.mu.Lock()
+	for index := first; index <= last; index++ {
+		if data, ok := h.cache.get(index); ok {
+			blocks[index-first] = data
+		} else if fetch, ok := h.inflight[index]; ok {
+			fetches[index-first] = fetch
+		} else {
+			fetch := &httpFetch{done: make(chan struct{})}
+			h.inflight[index] = fetch
+			fetches[index-first] = fetch
+			own = append(own, index)
+		}
+	}
+	h.mu.Unlock()
+
+	for len(own) > 0 {
+		run := 1
+		for run < len(own) && own[run] == own[0]+int64(run) && int64(run+1)*httpBlock <= httpMaxRequest {
+			run++
+		}
+		h.fetchRun(own[0], own[:run], fetches[own[0]-first:own[0]-first+int64(run)])
+		own = own[run:]
+	}
+
+	for i, fetch := range fetches {
+		if fetch == nil {
+			continue
+		}
+		<-fetch.done
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+		blocks[i] = fetch.data
+	}
+	return blocks, nil
+}
+
+// fetchRun fetches consecutive blocks with a single request and completes their fetches.
+func (h *HTTP) fetchRun(first int64, indices []int64, fetches []*httpFetch) {
+	start := first * httpBlock
+	length := min(int64(len(indices))*httpBlock, h.size-start)
+	data, _, err := h.fetch(start, length)
+	if err == nil && int64(len(data)) != length {
+		err = fmt.Errorf("%s: short response of %d bytes for %d bytes at %d", h.url, len(data), length, start)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, fetch := range fetches {
+		if err != nil {
+			fetch.err = err
+		} else {
+			fetch.data = data[int64(i)*httpBlock : min(int64(i+1)*httpBlock, int64(len(data)))]
+			h.cache.put(indices[i], fetch.data)
+		}
+		delete(h.inflight, indices[i])
+		close(fetch.done)
+	}
+}
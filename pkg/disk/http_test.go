@@ -0,0 +1,280 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeServer serves the files of dir with range requests and records the requested ranges.
+type rangeServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(t *testing.T, dir string) *rangeServer {
+	s := &rangeServer{}
+	files := http.FileServer(http.Dir(dir))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *rangeServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranges := s.ranges
+	s.ranges = nil
+	return ranges
+}
+
+func TestHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	content := make([]byte, 100*httpBlock+1234)
+	for i := range content {
+		content[i] = byte(i / 1000 % 251)
+	}
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+	server := newRangeServer(t, dir)
+
+	d, err := Open(server.URL + "/image.raw")
+	require.NoError(err)
+	defer d.Close()
+	require.IsType(&HTTP{}, d)
+	assert.Equal(int64(len(content)), d.Size())
+	// the size comes with the first block, detecting the format reads the last one
+	assert.Equal([]string{"bytes=0-65535", "bytes=6553600-6554833"}, server.requests())
+
+	// the first block is cached, the missing blocks are fetched with one request
+	got := make([]byte, 3*httpBlock)
+	_, err = d.ReadAt(got, 1000)
+	require.NoError(err)
+	assert.Equal(content[1000:1000+3*httpBlock], got)
+	assert.Equal([]string{"bytes=65536-262143"}, server.requests())
+	_, err = d.ReadAt(got, 2000)
+	require.NoError(err)
+	assert.Equal(content[2000:2000+3*httpBlock], got)
+	assert.Empty(server.requests())
+
+	// cached blocks split the missing ones into runs
+	_, err = d.ReadAt(make([]byte, httpBlock), 10*httpBlock)
+	require.NoError(err)
+	server.requests()
+	got = make([]byte, 4*httpBlock)
+	_, err = d.ReadAt(got, 9*httpBlock)
+	require.NoError(err)
+	assert.Equal(content[9*httpBlock:13*httpBlock], got)
+	assert.Equal([]string{"bytes=589824-655359", "bytes=720896-851967"}, server.requests())
+
+	// concurrent reads of the same blocks share the request
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := make([]byte, 2*httpBlock)
+			_, err := d.ReadAt(got, 50*httpBlock)
+			assert.NoError(err)
+			assert.Equal(content[50*httpBlock:52*httpBlock], got)
+		}()
+	}
+	wg.Wait()
+	server.requests()
+
+	// the end of the image
+	got = make([]byte, 2000)
+	n, err := d.ReadAt(got, int64(len(content))-1000)
+	assert.Equal(1000, n)
+	assert.ErrorIs(err, io.EOF)
+	assert.Equal(content[len(content)-1000:], got[:n])
+	assert.Empty(server.requests())
+
+	_, err = d.WriteAt([]byte("x"), 0)
+	assert.ErrorIs(err, ErrReadOnly)
+}
+
+func TestHTTPConcurrentFetch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	content := bytes.Repeat([]byte{1, 2, 3}, 10*httpBlock)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if !first {
+			<-release
+		}
+		http.ServeContent(w, r, "image.raw", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	d, err := OpenHTTP(server.URL)
+	require.NoError(err)
+	defer d.Close()
+
+	// all readers wait for the request of the first one
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := make([]byte, 100)
+			_, err := d.ReadAt(got, 5*httpBlock)
+			assert.NoError(err)
+			assert.Equal(content[5*httpBlock:5*httpBlock+100], got)
+		}()
+	}
+	require.Eventually(func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.inflight) == 1
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // let the other readers find the fetch in flight
+	close(release)
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(2, requests)
+}
+
+func TestHTTPClose(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	content := bytes.Repeat([]byte{1, 2, 3}, 10*httpBlock)
+	var mu sync.Mutex
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if !first {
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "image.raw", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	d, err := OpenHTTP(server.URL)
+	require.NoError(err)
+
+	// closing the image aborts the read waiting for the server
+	errs := make(chan error)
+	go func() {
+		_, err := d.ReadAt(make([]byte, 100), 5*httpBlock)
+		errs <- err
+	}()
+	require.Eventually(func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.inflight) == 1
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(d.Close())
+	select {
+	case err := <-errs:
+		assert.ErrorIs(err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not aborted by Close")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	testCases := map[string]struct {
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		"not found": {
+			handler: http.NotFound,
+			wantErr: "404 Not Found",
+		},
+		"no range support": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(make([]byte, 1<<20))
+			},
+			wantErr: "server does not support range requests",
+		},
+		"compressed": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "image.raw.xz", time.Time{}, bytes.NewReader([]byte("\xfd7zXZ\x00 and some more bytes")))
+			},
+			wantErr: "xz compressed images can only be read over HTTP in the seekable zstd format",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+			_, err := Open(server.URL)
+			require.Error(err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestHTTPSeekableZstd(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	content := make([]byte, 8*seekableFrameSize) // incompressible, so that frames span many blocks
+	_, err := rand.New(rand.NewSource(1)).Read(content)
+	require.NoError(err)
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+	src, err := Open(filepath.Join(dir, "image.raw"))
+	require.NoError(err)
+	defer src.Close()
+	_, err = Export(context.Background(), filepath.Join(dir, "image.raw.zst"), FormatSeekableZstd, src)
+	require.NoError(err)
+	server := newRangeServer(t, dir)
+
+	d, err := Open(server.URL + "/image.raw.zst")
+	require.NoError(err)
+	defer d.Close()
+	require.IsType(&SeekableZstd{}, d)
+	assert.Equal(int64(len(content)), d.Size())
+	server.requests()
+
+	// reading a few bytes fetches only the blocks of one frame
+	got := make([]byte, 100)
+	_, err = d.ReadAt(got, 5*seekableFrameSize+10)
+	require.NoError(err)
+	assert.Equal(content[5*seekableFrameSize+10:5*seekableFrameSize+110], got)
+	assert.Len(server.requests(), 1)
+
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.roothash"), []byte("abcdef\n"), 0o644))
+	sidecar, err := ReadURL(context.Background(), server.URL+"/image.roothash")
+	require.NoError(err)
+	assert.Equal("abcdef\n", string(sidecar))
+	_, err = ReadURL(context.Background(), server.URL+"/image.usrhash")
+	assert.ErrorIs(err, os.ErrNotExist)
+}
@@ -0,0 +1,748 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	qcow2IncompatDirty       = 1 << 0
+	qcow2IncompatCorrupt     = 1 << 1
+	qcow2IncompatDataFile    = 1 << 2
+	qcow2IncompatCompression = 1 << 3
+	qcow2IncompatExtendedL2  = 1 << 4
+
+	qcow2CompressionZlib = 0
+	qcow2CompressionZstd = 1
+
+	// L1, L2 and refcount table entries.
+	qcow2OffsetMask = 0x00fffffffffffe00
+	qcow2Copied     = 1 << 63
+	qcow2Compressed = 1 << 62
+	qcow2Zero       = 1 << 0
+
+	qcow2ExtEnd           = 0
+	qcow2ExtBackingFormat = 0xE2792ACA
+
+	// header fields updated when writing
+	qcow2RefcountTableField = 48 // offset and number of clusters
+	qcow2AutoclearField     = 88
+)
+
+// Qcow2 is an image in the QEMU copy-on-write format (version 2 and 3).
+// Reads follow the L1 and L2 tables, decompress compressed clusters and fall through to the backing
+// file for unallocated clusters. Writes allocate clusters at the end of the file, copying the previous
+// content of the cluster (compressed, zero or from the backing file) first. Backing files are never modified.
+type Qcow2 struct {
+	file        *os.File
+	readOnly    bool
+	version     uint32
+	clusterBits uint32
+	clusterSize int64
+	size        int64
+	compression byte
+	snapshots   uint32
+	autoclear   uint64
+	backing     Disk
+
+	l1       []uint64
+	l1Offset int64
+
+	refcountTableOffset int64
+	refcountTable       []uint64
+	refcountBits        int64
+
+	// end is the cluster aligned end of the host file, where new clusters are allocated.
+	end int64
+
+	// mu guards the metadata and caches. Data clusters are read without holding it.
+	mu         sync.Mutex
+	l2Cache    map[int64][]uint64
+	lastEntry  uint64
+	lastInflat []byte
+}
+
+// IsQcow2 reports whether r starts with the qcow2 magic.
+func IsQcow2(r io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == qcow2Magic
+}
+
+// OpenQcow2 opens a qcow2 image stored in file. path is used to resolve relative backing file names.
+func OpenQcow2(file *os.File, path string, readOnly bool) (*Qcow2, error) {
+	header := make([]byte, 104)
+	if _, err := file.ReadAt(header[:72], 0); err != nil {
+		return nil, fmt.Errorf("reading qcow2 header: %w", err)
+	}
+	if string(header[0:4]) != qcow2Magic {
+		return nil, errors.New("not a qcow2 image")
+	}
+	q := &Qcow2{
+		file:         file,
+		readOnly:     readOnly,
+		version:      binary.BigEndian.Uint32(header[4:8]),
+		clusterBits:  binary.BigEndian.Uint32(header[20:24]),
+		size:         int64(binary.BigEndian.Uint64(header[24:32])),
+		l1Offset:     int64(binary.BigEndian.Uint64(header[40:48])),
+		snapshots:    binary.BigEndian.Uint32(header[60:64]),
+		refcountBits: 16,
+		l2Cache:      make(map[int64][]uint64),
+	}
+	headerLength := uint32(72)
+	switch q.version {
+	case 2:
+	case 3:
+		if _, err := file.ReadAt(header[72:104], 72); err != nil {
+			return nil, fmt.Errorf("reading qcow2 header: %w", err)
+		}
+		incompatible := binary.BigEndian.Uint64(header[72:80])
+		q.autoclear = binary.BigEndian.Uint64(header[88:96])
+		refcountOrder := binary.BigEndian.Uint32(header[96:100])
+		headerLength = binary.BigEndian.Uint32(header[100:104])
+		if refcountOrder > 6 {
+			return nil, fmt.Errorf("invalid qcow2 refcount order %d", refcountOrder)
+		}
+		q.refcountBits = 1 << refcountOrder
+		if headerLength > 104 {
+			compression := make([]byte, 1)
+			if _, err := file.ReadAt(compression, 104); err != nil {
+				return nil, fmt.Errorf("reading qcow2 header: %w", err)
+			}
+			q.compression = compression[0]
+		}
+		if err := q.checkFeatures(incompatible); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", q.version)
+	}
+	if crypt := binary.BigEndian.Uint32(header[32:36]); crypt != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	if q.clusterBits < 9 || q.clusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster size 2^%d", q.clusterBits)
+	}
+	q.clusterSize = 1 << q.clusterBits
+
+	var err error
+	l1Size := int64(binary.BigEndian.Uint32(header[36:40]))
+	if q.l1, err = q.readTable(q.l1Offset, l1Size); err != nil {
+		return nil, fmt.Errorf("reading qcow2 L1 table: %w", err)
+	}
+	if l1Size*(q.clusterSize/8)*q.clusterSize < q.size {
+		return nil, fmt.Errorf("qcow2 L1 table of %d entries is too small for %d bytes", l1Size, q.size)
+	}
+	q.refcountTableOffset = int64(binary.BigEndian.Uint64(header[48:56]))
+	refcountClusters := int64(binary.BigEndian.Uint32(header[56:60]))
+	if q.refcountTable, err = q.readTable(q.refcountTableOffset, refcountClusters*q.clusterSize/8); err != nil {
+		return nil, fmt.Errorf("reading qcow2 refcount table: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	q.end = (info.Size() + q.clusterSize - 1) &^ (q.clusterSize - 1)
+
+	backingOffset := int64(binary.BigEndian.Uint64(header[8:16]))
+	if backingOffset != 0 {
+		name := make([]byte, binary.BigEndian.Uint32(header[16:20]))
+		if _, err := file.ReadAt(name, backingOffset); err != nil {
+			return nil, fmt.Errorf("reading qcow2 backing file name: %w", err)
+		}
+		format, err := q.backingFormat(int64(headerLength))
+		if err != nil {
+			return nil, err
+		}
+		if q.backing, err = openBacking(path, string(name), format); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *Qcow2) checkFeatures(incompatible uint64) error {
+	switch {
+	case incompatible&qcow2IncompatCorrupt != 0:
+		return errors.New("qcow2 image is marked corrupt")
+	case incompatible&qcow2IncompatDataFile != 0:
+		return errors.New("qcow2 images with external data file are not supported")
+	case incompatible&qcow2IncompatExtendedL2 != 0:
+		return errors.New("qcow2 images with extended L2 entries are not supported")
+	case incompatible&^(qcow2IncompatDirty|qcow2IncompatCompression) != 0:
+		return fmt.Errorf("qcow2 image has unknown incompatible features 0x%x", incompatible)
+	case !q.readOnly && incompatible&qcow2IncompatDirty != 0:
+		return errors.New("qcow2 image was not closed cleanly, repair it with qemu-img check -r all")
+	}
+	if incompatible&qcow2IncompatCompression == 0 {
+		q.compression = qcow2CompressionZlib
+	}
+	if q.compression != qcow2CompressionZlib && q.compression != qcow2CompressionZstd {
+		return fmt.Errorf("unsupported qcow2 compression type %d", q.compression)
+	}
+	return nil
+}
+
+// backingFormat reads the backing file format from the header extensions ("" if not given).
+func (q *Qcow2) backingFormat(offset int64) (string, error) {
+	ext := make([]byte, 8)
+	for offset+8 <= q.clusterSize {
+		if _, err := q.file.ReadAt(ext, offset); err != nil {
+			return "", fmt.Errorf("reading qcow2 header extension: %w", err)
+		}
+		typ, length := binary.BigEndian.Uint32(ext[0:4]), int64(binary.BigEndian.Uint32(ext[4:8]))
+		if typ == qcow2ExtEnd {
+			return "", nil
+		}
+		if typ == qcow2ExtBackingFormat {
+			format := make([]byte, length)
+			if _, err := q.file.ReadAt(format, offset+8); err != nil {
+				return "", fmt.Errorf("reading qcow2 backing format: %w", err)
+			}
+			return string(format), nil
+		}
+		offset += 8 + (length+7)&^7
+	}
+	return "", nil
+}
+
+// openBacking opens the backing file read-only. Relative names are relative to the directory of the image.
+func openBacking(imagePath, name, format string) (Disk, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(imagePath), name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening qcow2 backing file: %w", err)
+	}
+	switch {
+	case format == "qcow2" || (format == "" && IsQcow2(file)):
+		backing, err := OpenQcow2(file, name, true)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("opening qcow2 backing file %s: %w", name, err)
+		}
+		return backing, nil
+	case format == "" || format == "raw":
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &File{File: file, size: info.Size()}, nil
+	}
+	file.Close()
+	return nil, fmt.Errorf("unsupported qcow2 backing file format %q", format)
+}
+
+func (q *Qcow2) readTable(offset, entries int64) ([]uint64, error) {
+	raw := make([]byte, entries*8)
+	if _, err := q.file.ReadAt(raw, offset); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(raw[i*8:])
+	}
+	return table, nil
+}
+
+// Size returns the virtual size of the image.
+func (q *Qcow2) Size() int64 {
+	return q.size
+}
+
+// SectorSize returns 0, since qcow2 images carry no sector size.
+func (q *Qcow2) SectorSize() int64 {
+	return 0
+}
+
+// Close closes the image and its backing file.
+func (q *Qcow2) Close() error {
+	err := q.file.Close()
+	if q.backing != nil {
+		if backingErr := q.backing.Close(); err == nil {
+			err = backingErr
+		}
+	}
+	return err
+}
+
+func (q *Qcow2) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= q.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), q.size-off))
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		cluster, inCluster := pos/q.clusterSize, pos%q.clusterSize
+		chunk := p[done : done+int(min(q.clusterSize-inCluster, int64(n-done)))]
+		if err := q.readCluster(cluster, inCluster, chunk); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (q *Qcow2) readCluster(cluster, inCluster int64, p []byte) error {
+	q.mu.Lock()
+	entry, err := q.l2Entry(cluster)
+	if err != nil || entry&qcow2Compressed != 0 {
+		if err == nil {
+			err = q.readClusterLocked(entry, cluster, inCluster, p)
+		}
+		q.mu.Unlock()
+		return err
+	}
+	q.mu.Unlock()
+	return q.readClusterLocked(entry, cluster, inCluster, p)
+}
+
+// readClusterLocked reads from the cluster with the given L2 entry. q.mu must be held for compressed clusters.
+func (q *Qcow2) readClusterLocked(entry uint64, cluster, inCluster int64, p []byte) error {
+	host := int64(entry & qcow2OffsetMask)
+	switch {
+	case entry&qcow2Compressed != 0:
+		data, err := q.inflate(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+		return nil
+	case entry&qcow2Zero != 0:
+		clear(p)
+		return nil
+	case host == 0:
+		return q.readBacking(cluster*q.clusterSize+inCluster, p)
+	}
+	if _, err := q.file.ReadAt(p, host+inCluster); err != nil {
+		return fmt.Errorf("reading qcow2 cluster %d: %w", cluster, err)
+	}
+	return nil
+}
+
+func (q *Qcow2) readBacking(off int64, p []byte) error {
+	clear(p)
+	if q.backing == nil || off >= q.backing.Size() {
+		return nil
+	}
+	n := min(int64(len(p)), q.backing.Size()-off)
+	if _, err := q.backing.ReadAt(p[:n], off); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading qcow2 backing file: %w", err)
+	}
+	return nil
+}
+
+// l2Entry returns the L2 entry of a guest cluster (0 if the cluster is unallocated).
+func (q *Qcow2) l2Entry(cluster int64) (uint64, error) {
+	l2Offset, index, err := q.l2Location(cluster)
+	if err != nil || l2Offset == 0 {
+		return 0, err
+	}
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return 0, err
+	}
+	return table[index], nil
+}
+
+// l2Location returns the offset of the L2 table of a guest cluster (0 if unallocated) and the index within it.
+func (q *Qcow2) l2Location(cluster int64) (int64, int64, error) {
+	l2Entries := q.clusterSize / 8
+	l1Index := cluster / l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		return 0, 0, fmt.Errorf("qcow2 cluster %d is outside of the L1 table", cluster)
+	}
+	return int64(q.l1[l1Index] & qcow2OffsetMask), cluster % l2Entries, nil
+}
+
+func (q *Qcow2) l2Table(offset int64) ([]uint64, error) {
+	if table, ok := q.l2Cache[offset]; ok {
+		return table, nil
+	}
+	table, err := q.readTable(offset, q.clusterSize/8)
+	if err != nil {
+		return nil, fmt.Errorf("reading qcow2 L2 table: %w", err)
+	}
+	q.l2Cache[offset] = table
+	return table, nil
+}
+
+// compressedLocation returns the host offset and size of a compressed cluster.
+func (q *Qcow2) compressedLocation(entry uint64) (int64, int64) {
+	offsetBits := 62 - (q.clusterBits - 8)
+	host := int64(entry & (1<<offsetBits - 1))
+	sectors := int64((entry &^ (qcow2Copied | qcow2Compressed)) >> offsetBits)
+	return host, (sectors+1)*512 - host%512
+}
+
+// inflate decompresses a compressed cluster. The last decompressed cluster is cached.
+func (q *Qcow2) inflate(entry uint64) ([]byte, error) {
+	if entry == q.lastEntry && q.lastInflat != nil {
+		return q.lastInflat, nil
+	}
+	host, size := q.compressedLocation(entry)
+	compressed := make([]byte, size)
+	// the last compressed cluster may end before its last sector
+	if n, err := q.file.ReadAt(compressed, host); err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, fmt.Errorf("reading compressed qcow2 cluster: %w", err)
+	}
+	data := make([]byte, q.clusterSize)
+	switch q.compression {
+	case qcow2CompressionZlib:
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed)), data); err != nil {
+			return nil, fmt.Errorf("decompressing qcow2 cluster: %w", err)
+		}
+	case qcow2CompressionZstd:
+		decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		if _, err := io.ReadFull(decoder, data); err != nil {
+			return nil, fmt.Errorf("decompressing qcow2 cluster: %w", err)
+		}
+	}
+	q.lastEntry, q.lastInflat = entry, data
+	return data, nil
+}
+
+func (q *Qcow2) WriteAt(p []byte, off int64) (int, error) {
+	switch {
+	case q.readOnly:
+		return 0, errors.New("qcow2 image is read-only")
+	case q.snapshots > 0:
+		return 0, errors.New("writing qcow2 images with internal snapshots is not supported")
+	case off < 0 || off+int64(len(p)) > q.size:
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the qcow2 image of %d bytes", len(p), off, q.size)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.autoclear != 0 {
+		// autoclear features (like bitmaps) are invalidated by writers that do not know them
+		if _, err := q.file.WriteAt(make([]byte, 8), qcow2AutoclearField); err != nil {
+			return 0, fmt.Errorf("clearing qcow2 autoclear features: %w", err)
+		}
+		q.autoclear = 0
+	}
+	for done := 0; done < len(p); {
+		pos := off + int64(done)
+		cluster, inCluster := pos/q.clusterSize, pos%q.clusterSize
+		chunk := p[done : done+int(min(q.clusterSize-inCluster, int64(len(p)-done)))]
+		if err := q.writeCluster(cluster, inCluster, chunk); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	return len(p), nil
+}
+
+func (q *Qcow2) writeCluster(cluster, inCluster int64, p []byte) error {
+	l2Offset, index, err := q.l2Location(cluster)
+	if err != nil {
+		return err
+	}
+	if l2Offset == 0 {
+		if l2Offset, err = q.allocateL2(cluster); err != nil {
+			return err
+		}
+	}
+	table, err := q.l2Table(l2Offset)
+	if err != nil {
+		return err
+	}
+	entry := table[index]
+	host := int64(entry & qcow2OffsetMask)
+	if entry&(qcow2Compressed|qcow2Zero) == 0 && host != 0 {
+		if entry&qcow2Copied == 0 {
+			return fmt.Errorf("qcow2 cluster %d is shared", cluster)
+		}
+		if _, err := q.file.WriteAt(p, host+inCluster); err != nil {
+			return fmt.Errorf("writing qcow2 cluster %d: %w", cluster, err)
+		}
+		return nil
+	}
+
+	// copy on write: the cluster is compressed, zero or unallocated
+	data := make([]byte, q.clusterSize)
+	if err := q.readClusterLocked(entry, cluster, 0, data); err != nil {
+		return err
+	}
+	copy(data[inCluster:], p)
+	if entry&qcow2Compressed != 0 || host == 0 {
+		// preallocated zero clusters are reused
+		if host, err = q.allocate(); err != nil {
+			return err
+		}
+	}
+	if _, err := q.file.WriteAt(data, host); err != nil {
+		return fmt.Errorf("writing qcow2 cluster %d: %w", cluster, err)
+	}
+	if entry&qcow2Compressed != 0 {
+		if err := q.releaseCompressed(entry); err != nil {
+			return err
+		}
+		q.lastInflat = nil
+	}
+	table[index] = uint64(host) | qcow2Copied
+	return q.writeEntry(l2Offset+index*8, table[index])
+}
+
+// allocateL2 allocates an empty L2 table for the guest cluster.
+func (q *Qcow2) allocateL2(cluster int64) (int64, error) {
+	offset, err := q.allocate()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.file.WriteAt(make([]byte, q.clusterSize), offset); err != nil {
+		return 0, fmt.Errorf("writing qcow2 L2 table: %w", err)
+	}
+	l1Index := cluster / (q.clusterSize / 8)
+	q.l1[l1Index] = uint64(offset) | qcow2Copied
+	q.l2Cache[offset] = make([]uint64, q.clusterSize/8)
+	return offset, q.writeEntry(q.l1Offset+l1Index*8, q.l1[l1Index])
+}
+
+func (q *Qcow2) writeEntry(offset int64, entry uint64) error {
+	if _, err := q.file.WriteAt(binary.BigEndian.AppendUint64(nil, entry), offset); err != nil {
+		return fmt.Errorf("writing qcow2 table entry: %w", err)
+	}
+	return nil
+}
+
+// allocate reserves a cluster at the end of the file and sets its refcount to 1.
+// The caller writes the content of the cluster.
+func (q *Qcow2) allocate() (int64, error) {
+	offset := q.end
+	q.end += q.clusterSize
+	return offset, q.setRefcount(offset, 1)
+}
+
+// releaseCompressed decrements the refcounts of the host clusters holding a compressed cluster.
+func (q *Qcow2) releaseCompressed(entry uint64) error {
+	host, size := q.compressedLocation(entry)
+	for cluster := host &^ (q.clusterSize - 1); cluster < host+size; cluster += q.clusterSize {
+		refcount, err := q.refcount(cluster)
+		if err != nil {
+			return err
+		}
+		if refcount > 0 {
+			if err := q.setRefcount(cluster, refcount-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refcountLocation returns the index of the refcount table entry and the bit position within
+// the refcount block for the host cluster at offset.
+func (q *Qcow2) refcountLocation(offset int64) (int64, int64) {
+	perBlock := q.clusterSize * 8 / q.refcountBits
+	cluster := offset / q.clusterSize
+	return cluster / perBlock, (cluster % perBlock) * q.refcountBits
+}
+
+func (q *Qcow2) refcount(offset int64) (uint64, error) {
+	tableIndex, bit := q.refcountLocation(offset)
+	if tableIndex >= int64(len(q.refcountTable)) {
+		return 0, nil
+	}
+	block := int64(q.refcountTable[tableIndex] &^ 0x1ff)
+	if block == 0 {
+		return 0, nil
+	}
+	raw := make([]byte, max(q.refcountBits/8, 1))
+	if _, err := q.file.ReadAt(raw, block+bit/8); err != nil {
+		return 0, fmt.Errorf("reading qcow2 refcount: %w", err)
+	}
+	return decodeRefcount(raw, bit, q.refcountBits), nil
+}
+
+func (q *Qcow2) setRefcount(offset int64, refcount uint64) error {
+	tableIndex, bit := q.refcountLocation(offset)
+	if tableIndex >= int64(len(q.refcountTable)) {
+		if err := q.growRefcountTable(tableIndex + 1); err != nil {
+			return err
+		}
+	}
+	block := int64(q.refcountTable[tableIndex] &^ 0x1ff)
+	if block == 0 {
+		block = q.end
+		q.end += q.clusterSize
+		if _, err := q.file.WriteAt(make([]byte, q.clusterSize), block); err != nil {
+			return fmt.Errorf("writing qcow2 refcount block: %w", err)
+		}
+		q.refcountTable[tableIndex] = uint64(block)
+		if err := q.writeEntry(q.refcountTableOffset+tableIndex*8, uint64(block)); err != nil {
+			return err
+		}
+		if err := q.setRefcount(block, 1); err != nil {
+			return err
+		}
+	}
+	raw := make([]byte, max(q.refcountBits/8, 1))
+	if _, err := q.file.ReadAt(raw, block+bit/8); err != nil {
+		return fmt.Errorf("reading qcow2 refcount: %w", err)
+	}
+	encodeRefcount(raw, bit, q.refcountBits, refcount)
+	if _, err := q.file.WriteAt(raw, block+bit/8); err != nil {
+		return fmt.Errorf("writing qcow2 refcount: %w", err)
+	}
+	return nil
+}
+
+// growRefcountTable moves the refcount table to the end of the file with room for at least entries entries.
+func (q *Qcow2) growRefcountTable(entries int64) error {
+	perBlock := q.clusterSize * 8 / q.refcountBits
+	entries = max(entries, 2*int64(len(q.refcountTable)))
+	clusters := (entries*8 + q.clusterSize - 1) / q.clusterSize
+	// the table and the refcount blocks covering it are allocated behind the current end
+	entries = max(entries, (q.end+(clusters+2)*q.clusterSize)/q.clusterSize/perBlock+1)
+	clusters = (entries*8 + q.clusterSize - 1) / q.clusterSize
+
+	oldOffset, oldClusters := q.refcountTableOffset, (int64(len(q.refcountTable))*8+q.clusterSize-1)/q.clusterSize
+	offset := q.end
+	q.end += clusters * q.clusterSize
+	table := make([]uint64, clusters*q.clusterSize/8)
+	copy(table, q.refcountTable)
+	raw := make([]byte, len(table)*8)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(raw[i*8:], entry)
+	}
+	if _, err := q.file.WriteAt(raw, offset); err != nil {
+		return fmt.Errorf("writing qcow2 refcount table: %w", err)
+	}
+	header := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	header = binary.BigEndian.AppendUint32(header, uint32(clusters))
+	if _, err := q.file.WriteAt(header, qcow2RefcountTableField); err != nil {
+		return fmt.Errorf("writing qcow2 header: %w", err)
+	}
+	q.refcountTable, q.refcountTableOffset = table, offset
+	for i := int64(0); i < clusters; i++ {
+		if err := q.setRefcount(offset+i*q.clusterSize, 1); err != nil {
+			return err
+		}
+	}
+	for i := int64(0); i < oldClusters; i++ {
+		if err := q.setRefcount(oldOffset+i*q.clusterSize, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeRefcount reads a big endian refcount of bits bits at bit offset bit of raw.
+// Refcounts narrower than a byte start at the least significant bit.
+func decodeRefcount(raw []byte, bit, bits int64) uint64 {
+	if bits < 8 {
+		return uint64(raw[0]>>(bit%8)) & (1<<bits - 1)
+	}
+	var value uint64
+	for _, b := range raw[:bits/8] {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func encodeRefcount(raw []byte, bit, bits int64, value uint64) {
+	if bits < 8 {
+		mask := byte(1<<bits-1) << (bit % 8)
+		raw[0] = raw[0]&^mask | byte(value<<(bit%8))&mask
+		return
+	}
+	for i := bits/8 - 1; i >= 0; i-- {
+		raw[i] = byte(value)
+		value >>= 8
+	}
+}
+
+// CreateQcow2 creates an empty qcow2 (version 3) image of the given virtual size with 64 KiB clusters
+// and opens it for writing.
+func CreateQcow2(path string, size int64) (*Qcow2, error) {
+	return createQcow2(path, size, 16, "")
+}
+
+// createQcow2 creates an empty qcow2 image. The layout follows qemu-img: header, refcount table,
+// refcount block and L1 table in the first clusters. backing names a raw backing file (optional).
+func createQcow2(path string, size int64, clusterBits uint32, backing string) (*Qcow2, error) {
+	clusterSize := int64(1) << clusterBits
+	l2Coverage := clusterSize / 8 * clusterSize
+	l1Entries := (size + l2Coverage - 1) / l2Coverage
+	l1Clusters := max((l1Entries*8+clusterSize-1)/clusterSize, 1)
+
+	header := make([]byte, clusterSize)
+	copy(header[0:4], qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:8], 3)
+	binary.BigEndian.PutUint32(header[20:24], clusterBits)
+	binary.BigEndian.PutUint64(header[24:32], uint64(size))
+	binary.BigEndian.PutUint32(header[36:40], uint32(l1Entries))
+	binary.BigEndian.PutUint64(header[40:48], uint64(3*clusterSize))
+	binary.BigEndian.PutUint64(header[48:56], uint64(clusterSize))
+	binary.BigEndian.PutUint32(header[56:60], 1)
+	binary.BigEndian.PutUint32(header[96:100], 4) // 16 bit refcounts
+	binary.BigEndian.PutUint32(header[100:104], 104)
+	if backing != "" {
+		ext := binary.BigEndian.AppendUint32(nil, qcow2ExtBackingFormat)
+		ext = binary.BigEndian.AppendUint32(ext, 3)
+		ext = append(ext, "raw\x00\x00\x00\x00\x00"...)
+		ext = append(ext, make([]byte, 8)...) // end of extensions
+		copy(header[104:], ext)
+		nameOffset := 104 + len(ext)
+		if nameOffset+len(backing) > len(header) {
+			return nil, errors.New("qcow2 backing file name too long")
+		}
+		copy(header[nameOffset:], backing)
+		binary.BigEndian.PutUint64(header[8:16], uint64(nameOffset))
+		binary.BigEndian.PutUint32(header[16:20], uint32(len(backing)))
+	}
+
+	clusters := 3 + l1Clusters
+	refcountTable := make([]byte, clusterSize)
+	binary.BigEndian.PutUint64(refcountTable, uint64(2*clusterSize))
+	refcountBlock := make([]byte, clusterSize)
+	for i := int64(0); i < clusters; i++ {
+		binary.BigEndian.PutUint16(refcountBlock[i*2:], 1)
+	}
+	if clusters*2 > clusterSize {
+		return nil, errors.New("qcow2 L1 table too large for the first refcount block")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	content := append(header, refcountTable...)
+	content = append(content, refcountBlock...)
+	content = append(content, make([]byte, l1Clusters*clusterSize)...)
+	if _, err := file.WriteAt(content, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	q, err := OpenQcow2(file, path, false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return q, nil
+}
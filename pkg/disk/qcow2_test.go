@@ -0,0 +1,244 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQcow2(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.qcow2")
+	q, err := createQcow2(path, 1<<20, 12, "")
+	require.NoError(err)
+
+	buf := make([]byte, 10000)
+	n, err := q.ReadAt(buf, 5000)
+	require.NoError(err)
+	assert.Equal(len(buf), n)
+	assert.Equal(make([]byte, len(buf)), buf)
+
+	pattern := bytes.Repeat([]byte("qcow2 "), 2000)
+	_, err = q.WriteAt(pattern, 4000)
+	require.NoError(err)
+	_, err = q.WriteAt([]byte("end"), 1<<20-3)
+	require.NoError(err)
+	_, err = q.WriteAt([]byte("x"), 1<<20)
+	assert.Error(err)
+	require.NoError(q.Close())
+
+	d, err := Open(path)
+	require.NoError(err)
+	defer d.Close()
+	assert.Equal(int64(1<<20), d.Size())
+	got := make([]byte, len(pattern)+2)
+	_, err = d.ReadAt(got, 3999)
+	require.NoError(err)
+	assert.Equal(append(append([]byte{0}, pattern...), 0), got)
+	got = make([]byte, 4)
+	n, err = d.ReadAt(got, 1<<20-3)
+	assert.Equal(3, n)
+	assert.Equal("end", string(got[:3]))
+	assert.Error(err)
+	checkQcow2Refcounts(t, d.(*Qcow2))
+}
+
+func TestQcow2Compressed(t *testing.T) {
+	for name, compression := range map[string]byte{"zlib": qcow2CompressionZlib, "zstd": qcow2CompressionZstd} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			path := filepath.Join(t.TempDir(), "image.qcow2")
+			q, err := createQcow2(path, 1<<20, 12, "")
+			require.NoError(err)
+			q.compression = compression
+			cluster := bytes.Repeat([]byte("compressed cluster "), 4096/19+1)[:4096]
+			writeCompressedCluster(t, q, 3, cluster)
+			writeCompressedCluster(t, q, 4, bytes.Repeat([]byte{'z'}, 4096))
+
+			got := make([]byte, 100)
+			_, err = q.ReadAt(got, 3*4096+10)
+			require.NoError(err)
+			assert.Equal(cluster[10:110], got)
+
+			// writing into a compressed cluster moves it to a regular cluster
+			_, err = q.WriteAt([]byte("patched"), 3*4096+100)
+			require.NoError(err)
+			want := append([]byte(nil), cluster...)
+			copy(want[100:], "patched")
+			got = make([]byte, 4096)
+			_, err = q.ReadAt(got, 3*4096)
+			require.NoError(err)
+			assert.Equal(want, got)
+			_, err = q.ReadAt(got, 4*4096)
+			require.NoError(err)
+			assert.Equal(bytes.Repeat([]byte{'z'}, 4096), got)
+			checkQcow2Refcounts(t, q)
+			require.NoError(q.Close())
+		})
+	}
+}
+
+func TestQcow2Backing(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	backing := bytes.Repeat([]byte("backing "), 3000)
+	require.NoError(os.WriteFile(filepath.Join(dir, "base.raw"), backing, 0o644))
+	q, err := createQcow2(filepath.Join(dir, "overlay.qcow2"), 1<<16, 12, "base.raw")
+	require.NoError(err)
+	require.NoError(q.Close())
+
+	d, err := Open(filepath.Join(dir, "overlay.qcow2"))
+	require.NoError(err)
+	defer d.Close()
+	got := make([]byte, 200)
+	_, err = d.ReadAt(got, 23900)
+	require.NoError(err)
+	assert.Equal(append(append([]byte(nil), backing[23900:]...), make([]byte, 100)...), got)
+
+	_, err = d.WriteAt([]byte("overlay"), 4100)
+	require.NoError(err)
+	got = make([]byte, 4096)
+	_, err = d.ReadAt(got, 4096)
+	require.NoError(err)
+	want := append([]byte(nil), backing[4096:8192]...)
+	copy(want[4:], "overlay")
+	assert.Equal(want, got)
+
+	content, err := os.ReadFile(filepath.Join(dir, "base.raw"))
+	require.NoError(err)
+	assert.Equal(backing, content)
+	checkQcow2Refcounts(t, d.(*Qcow2))
+}
+
+func TestQcow2RefcountGrowth(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// 512 byte clusters: a refcount block covers 256 clusters, the refcount table 64 blocks (8 MiB)
+	q, err := createQcow2(filepath.Join(t.TempDir(), "image.qcow2"), 16<<20, 9, "")
+	require.NoError(err)
+	defer q.Close()
+	tableOffset := q.refcountTableOffset
+	for off := int64(0); off < 12<<20; off += 512 {
+		_, err := q.WriteAt([]byte{byte(off / 1024 % 251)}, off)
+		require.NoError(err)
+	}
+	assert.NotEqual(tableOffset, q.refcountTableOffset)
+	got := make([]byte, 1)
+	_, err = q.ReadAt(got, 11<<20)
+	require.NoError(err)
+	assert.Equal(byte((11<<20)/1024%251), got[0])
+	checkQcow2Refcounts(t, q)
+
+	reopened, err := OpenQcow2(q.file, "", true)
+	require.NoError(err)
+	assert.Equal(q.refcountTable, reopened.refcountTable)
+}
+
+func TestQcow2Refcount(t *testing.T) {
+	for _, bits := range []int64{1, 2, 4, 8, 16, 32, 64} {
+		raw := make([]byte, max(bits/8, 1))
+		bit := (3 * bits) % 8
+		if bits >= 8 {
+			bit = 0
+		}
+		encodeRefcount(raw, bit, bits, 1)
+		assert.Equal(t, uint64(1), decodeRefcount(raw, bit, bits), "refcount bits %d", bits)
+		encodeRefcount(raw, bit, bits, 0)
+		assert.Equal(t, make([]byte, len(raw)), raw, "refcount bits %d", bits)
+	}
+}
+
+// writeCompressedCluster stores data as compressed guest cluster like qemu-img convert -c.
+func writeCompressedCluster(t *testing.T, q *Qcow2, cluster int64, data []byte) {
+	var compressed bytes.Buffer
+	switch q.compression {
+	case qcow2CompressionZlib:
+		w, err := flate.NewWriter(&compressed, flate.BestCompression)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	case qcow2CompressionZstd:
+		w, err := zstd.NewWriter(&compressed)
+		require.NoError(t, err)
+		compressed.Write(w.EncodeAll(data, nil))
+		require.NoError(t, w.Close())
+	}
+	l2Offset, index, err := q.l2Location(cluster)
+	require.NoError(t, err)
+	if l2Offset == 0 {
+		l2Offset, err = q.allocateL2(cluster)
+		require.NoError(t, err)
+	}
+	host, err := q.allocate()
+	require.NoError(t, err)
+	// start within the cluster like packed compressed clusters do
+	host += 100
+	_, err = q.file.WriteAt(compressed.Bytes(), host)
+	require.NoError(t, err)
+	require.Less(t, int64(100+compressed.Len()), q.clusterSize)
+	sectors := (host%512+int64(compressed.Len())+511)/512 - 1
+	entry := uint64(host) | uint64(sectors)<<(62-(q.clusterBits-8)) | qcow2Compressed
+	table, err := q.l2Table(l2Offset)
+	require.NoError(t, err)
+	table[index] = entry
+	require.NoError(t, q.writeEntry(l2Offset+index*8, entry))
+}
+
+// checkQcow2Refcounts compares the refcounts of all host clusters with the references of the metadata.
+func checkQcow2Refcounts(t *testing.T, q *Qcow2) {
+	expected := make(map[int64]uint64)
+	ref := func(offset, clusters int64) {
+		for i := int64(0); i < clusters; i++ {
+			expected[offset&^(q.clusterSize-1)+i*q.clusterSize]++
+		}
+	}
+	ref(0, 1)
+	ref(q.l1Offset, (int64(len(q.l1))*8+q.clusterSize-1)/q.clusterSize)
+	ref(q.refcountTableOffset, int64(len(q.refcountTable))*8/q.clusterSize)
+	for _, block := range q.refcountTable {
+		if block != 0 {
+			ref(int64(block), 1)
+		}
+	}
+	for _, l1 := range q.l1 {
+		l2Offset := int64(l1 & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		ref(l2Offset, 1)
+		raw := make([]byte, q.clusterSize)
+		_, err := q.file.ReadAt(raw, l2Offset)
+		require.NoError(t, err)
+		for i := int64(0); i < q.clusterSize/8; i++ {
+			entry := binary.BigEndian.Uint64(raw[i*8:])
+			switch {
+			case entry&qcow2Compressed != 0:
+				host, size := q.compressedLocation(entry)
+				first := host &^ (q.clusterSize - 1)
+				ref(first, (host+size-first+q.clusterSize-1)/q.clusterSize)
+			case entry&qcow2OffsetMask != 0:
+				ref(int64(entry&qcow2OffsetMask), 1)
+			}
+		}
+	}
+	for offset := int64(0); offset < q.end; offset += q.clusterSize {
+		refcount, err := q.refcount(offset)
+		require.NoError(t, err)
+		assert.Equal(t, expected[offset], refcount, "refcount of cluster at %d", offset)
+	}
+}
@@ -0,0 +1,460 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MinPartSize is the size of the parts of multipart uploads, unless the object needs more than s3MaxParts.
+	s3MinPartSize = 16 << 20
+	s3MaxParts    = 10000
+	// emptySHA256 is the payload hash of requests without body.
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// IsS3URL reports whether path is an s3://bucket/key URL.
+func IsS3URL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// parseS3URL splits an s3://bucket/key URL.
+func parseS3URL(s3URL string) (bucket, key string, err error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(s3URL, "s3://"), "/")
+	if !IsS3URL(s3URL) || !ok || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", s3URL)
+	}
+	return bucket, key, nil
+}
+
+// s3Client talks to S3 or a compatible object storage (like MinIO). It is configured like the AWS CLI:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN are the credentials (requests are
+// anonymous without them), AWS_REGION or AWS_DEFAULT_REGION the region (us-east-1 by default) and
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL the endpoint of compatible storages, which is addressed path-style.
+type s3Client struct {
+	http         *http.Client
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+func newS3Client() *s3Client {
+	c := &s3Client{
+		http:         &http.Client{Timeout: 5 * time.Minute},
+		endpoint:     strings.TrimSuffix(firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"), "/"),
+		region:       firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		now:          time.Now,
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	return c
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// objectURL returns the URL of an object with the given (unencoded) query parameters.
+func (c *s3Client) objectURL(bucket, key string, query url.Values) string {
+	var base string
+	switch {
+	case c.endpoint != "":
+		base = c.endpoint + "/" + bucket
+	case strings.Contains(bucket, "."):
+		// virtual-hosted buckets with dots do not match the certificate
+		base = fmt.Sprintf("https://s3.%s.amazonaws.com/%s", c.region, bucket)
+	default:
+		base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, c.region)
+	}
+	objectURL := base + "/" + s3Escape(key, false)
+	if len(query) > 0 {
+		objectURL += "?" + s3Query(query)
+	}
+	return objectURL
+}
+
+// s3Escape encodes s as required by signature version 4: everything but unreserved characters
+// (and slashes in paths) is percent-encoded.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query string: sorted by key, with keys and values encoded.
+func s3Query(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// sign adds an AWS signature version 4 to req. payloadHash is the hex encoded SHA-256 of the body.
+// The host, Range, Content-Type and x-amz-* headers are signed.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+	if c.accessKey == "" {
+		return
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), c.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{now.Format("20060102"), c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error is the error document of S3.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// do sends a signed request and returns the response headers and body. Error documents are returned as errors,
+// also when S3 sends them with status 200 (as it may for copies and completed uploads).
+func (c *s3Client) do(ctx context.Context, method, bucket, key string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(bucket, key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(payloadHash[:]))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+	}
+	var s3Err s3Error
+	if resp.StatusCode >= 300 || (method != http.MethodGet && xml.Unmarshal(content, &s3Err) == nil) {
+		if xml.Unmarshal(content, &s3Err) != nil || s3Err.Code == "" {
+			s3Err.Code = resp.Status
+		}
+		err := fmt.Errorf("%s s3://%s/%s: %s %s", method, bucket, key, s3Err.Code, s3Err.Message)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %w", os.ErrNotExist, err)
+		}
+		return nil, nil, err
+	}
+	return resp.Header, content, nil
+}
+
+func readS3Object(ctx context.Context, s3URL string) ([]byte, error) {
+	bucket, key, err := parseS3URL(s3URL)
+	if err != nil {
+		return nil, err
+	}
+	_, content, err := newS3Client().do(ctx, http.MethodGet, bucket, key, nil, nil, nil)
+	return content, err
+}
+
+// WriteS3Object uploads a (small) object, like a sidecar of an image in S3.
+func WriteS3Object(ctx context.Context, s3URL string, content []byte) error {
+	bucket, key, err := parseS3URL(s3URL)
+	if err != nil {
+		return err
+	}
+	_, _, err = newS3Client().do(ctx, http.MethodPut, bucket, key, nil, nil, content)
+	return err
+}
+
+// S3 is an object in S3 read with ranged GETs (see HTTP). It cannot be written, but Export
+// rewrites it with a multipart upload that copies unchanged parts within S3.
+type S3 struct {
+	*HTTP
+	client      *s3Client
+	bucket, key string
+}
+
+// OpenS3 opens the object at an s3://bucket/key URL.
+func OpenS3(s3URL string) (*S3, error) {
+	bucket, key, err := parseS3URL(s3URL)
+	if err != nil {
+		return nil, err
+	}
+	client := newS3Client()
+	h, err := openHTTP(client.http, client.objectURL(bucket, key, nil), func(req *http.Request) {
+		client.sign(req, emptySHA256)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return &S3{HTTP: h, client: client, bucket: bucket, key: key}, nil
+}
+
+// openS3 opens a raw or seekable zstd image in S3.
+func openS3(s3URL string) (Disk, error) {
+	s, err := OpenS3(s3URL)
+	if err != nil {
+		return nil, err
+	}
+	return openRemote(s.HTTP, s)
+}
+
+// WriteAt fails, since objects cannot be modified in place.
+func (s *S3) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: s3://%s/%s cannot be modified in place", ErrReadOnly, s.bucket, s.key)
+}
+
+// s3PartSize returns the size of the parts of an upload of size bytes: 16 MiB,
+// or the multiple of 1 MiB that keeps the upload within 10000 parts.
+func s3PartSize(size int64) int64 {
+	return max(s3MinPartSize, alignUp((size+s3MaxParts-1)/s3MaxParts, 1<<20))
+}
+
+// s3Upload is a multipart upload.
+type s3Upload struct {
+	client      *s3Client
+	bucket, key string
+	id          string
+	parts       []s3Part
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (c *s3Client) createUpload(ctx context.Context, bucket, key string) (*s3Upload, error) {
+	_, content, err := c.do(ctx, http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(content, &result); err != nil || result.UploadID == "" {
+		return nil, fmt.Errorf("creating upload of s3://%s/%s: invalid response %q", bucket, key, content)
+	}
+	return &s3Upload{client: c, bucket: bucket, key: key, id: result.UploadID}, nil
+}
+
+func (u *s3Upload) partQuery() url.Values {
+	return url.Values{"partNumber": {strconv.Itoa(len(u.parts) + 1)}, "uploadId": {u.id}}
+}
+
+// upload uploads the next part.
+func (u *s3Upload) upload(ctx context.Context, data []byte) error {
+	header, _, err := u.client.do(ctx, http.MethodPut, u.bucket, u.key, u.partQuery(), nil, data)
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, s3Part{Number: len(u.parts) + 1, ETag: header.Get("ETag")})
+	return nil
+}
+
+// copy makes length bytes at off of another object the next part.
+func (u *s3Upload) copy(ctx context.Context, bucket, key string, off, length int64) error {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s3Escape(bucket+"/"+key, false))
+	header.Set("x-amz-copy-source-range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	_, content, err := u.client.do(ctx, http.MethodPut, u.bucket, u.key, u.partQuery(), header, nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := xml.Unmarshal(content, &result); err != nil || result.ETag == "" {
+		return fmt.Errorf("copying part %d of s3://%s/%s: invalid response %q", len(u.parts)+1, u.bucket, u.key, content)
+	}
+	u.parts = append(u.parts, s3Part{Number: len(u.parts) + 1, ETag: result.ETag})
+	return nil
+}
+
+// complete makes the uploaded parts the content of the object.
+func (u *s3Upload) complete(ctx context.Context) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+	_, _, err = u.client.do(ctx, http.MethodPost, u.bucket, u.key, url.Values{"uploadId": {u.id}}, nil, body)
+	return err
+}
+
+// abort drops the uploaded parts.
+func (u *s3Upload) abort() {
+	u.client.do(context.Background(), http.MethodDelete, u.bucket, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+}
+
+// s3Writer uploads everything written to it as parts of an upload.
+type s3Writer struct {
+	ctx      context.Context
+	upload   *s3Upload
+	partSize int
+	buf      []byte
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), w.partSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		if len(w.buf) == w.partSize {
+			if err := w.upload.upload(w.ctx, w.buf); err != nil {
+				return 0, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return written, nil
+}
+
+// flush uploads the last part. An upload needs at least one part, even an empty one.
+func (w *s3Writer) flush() error {
+	if len(w.buf) == 0 && len(w.upload.parts) > 0 {
+		return nil
+	}
+	return w.upload.upload(w.ctx, w.buf)
+}
+
+// exportS3 uploads src to an s3://bucket/key URL, replacing the object if it exists.
+// Raw images are uploaded in parts of (at least) 16 MiB; if src is an overlay on an object in S3,
+// the parts without changes are copied within S3 instead of being uploaded.
+// Compressed formats are streamed. Other formats are not supported, since they are written out of order.
+func exportS3(ctx context.Context, s3URL, format string, src Disk) (size int64, retErr error) {
+	bucket, key, err := parseS3URL(s3URL)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case FormatRaw, FormatZstd, FormatSeekableZstd, FormatXz, FormatGzip, FormatTarGz:
+	default:
+		return 0, fmt.Errorf("%s images cannot be written to S3, only raw and compressed images", format)
+	}
+	upload, err := newS3Client().createUpload(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if retErr != nil {
+			upload.abort()
+		}
+	}()
+
+	partSize := s3PartSize(src.Size())
+	if format != FormatRaw {
+		w := &s3Writer{ctx: ctx, upload: upload, partSize: int(partSize)}
+		if err := writeStream(ctx, w, format, src); err != nil {
+			return 0, err
+		}
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+		return src.Size(), upload.complete(ctx)
+	}
+
+	var base *S3
+	overlay, ok := src.(*Overlay)
+	if ok {
+		base, _ = overlay.Base().(*S3)
+	}
+	buf := make([]byte, partSize)
+	for off := int64(0); off < src.Size(); off += partSize {
+		length := min(partSize, src.Size()-off)
+		if base != nil && !overlay.modifiedIn(off, length) {
+			if err := upload.copy(ctx, base.bucket, base.key, off, length); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := src.ReadAt(buf[:length], off); err != nil {
+			return 0, fmt.Errorf("reading at %d: %w", off, err)
+		}
+		if err := upload.upload(ctx, buf[:length]); err != nil {
+			return 0, err
+		}
+	}
+	return src.Size(), upload.complete(ctx)
+}
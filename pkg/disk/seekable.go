@@ -0,0 +1,226 @@
+package disk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// FormatSeekableZstd is the seekable zstd format: independent zstd frames followed by a seek table
+// in a skippable frame (see contrib/seekable_format in the zstd repository).
+// Regular zstd decoders read it like any other zstd stream.
+const FormatSeekableZstd = "seekable-zstd"
+
+const (
+	seekableSkippableMagic = 0x184D2A5E
+	seekableMagic          = 0x8F92EAB1
+	seekableFooterSize     = 9
+	seekableChecksumFlag   = 1 << 7
+
+	// seekableFrameSize is the decompressed size of the frames written by WriteSeekableZstd.
+	seekableFrameSize = 1 << 20
+	// seekableCacheFrames bounds the cache of decompressed frames.
+	seekableCacheFrames = 64
+)
+
+type seekableFrame struct {
+	compressedOffset   int64
+	compressedSize     int64
+	decompressedOffset int64
+	decompressedSize   int64
+}
+
+// SeekableZstd is a read-only image in the seekable zstd format. Reads only decompress the frames they touch,
+// so random access is cheap. The compressed data is read through an io.ReaderAt and need not be a local file.
+type SeekableZstd struct {
+	r      io.ReaderAt
+	closer io.Closer
+	frames []seekableFrame
+	size   int64
+
+	// mu guards the decoder and the cache of decompressed frames.
+	mu      sync.Mutex
+	decoder *zstd.Decoder
+	cache   *chunkCache
+}
+
+// IsSeekableZstd reports whether the data of the given size ends with a seek table.
+func IsSeekableZstd(r io.ReaderAt, size int64) bool {
+	if size < seekableFooterSize+8 {
+		return false
+	}
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, size-4); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(magic) == seekableMagic
+}
+
+// OpenSeekableZstd reads the seek table of seekable zstd data of the given size.
+// closer (optional) is closed with the image.
+func OpenSeekableZstd(r io.ReaderAt, size int64, closer io.Closer) (*SeekableZstd, error) {
+	if !IsSeekableZstd(r, size) {
+		return nil, errors.New("no seekable zstd seek table found")
+	}
+	footer := make([]byte, seekableFooterSize)
+	if _, err := r.ReadAt(footer, size-seekableFooterSize); err != nil {
+		return nil, fmt.Errorf("reading seek table: %w", err)
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	entrySize := int64(8)
+	if footer[4]&seekableChecksumFlag != 0 {
+		entrySize = 12
+	}
+	tableSize := frames*entrySize + seekableFooterSize
+	if 8+tableSize > size {
+		return nil, fmt.Errorf("seek table of %d frames exceeds the file", frames)
+	}
+	table := make([]byte, 8+tableSize)
+	if _, err := r.ReadAt(table, size-int64(len(table))); err != nil {
+		return nil, fmt.Errorf("reading seek table: %w", err)
+	}
+	if binary.LittleEndian.Uint32(table[0:4]) != seekableSkippableMagic || int64(binary.LittleEndian.Uint32(table[4:8])) != tableSize {
+		return nil, errors.New("seek table frame is invalid")
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	s := &SeekableZstd{r: r, closer: closer, decoder: decoder, cache: newChunkCache(seekableCacheFrames)}
+	var compressedOffset int64
+	for i := int64(0); i < frames; i++ {
+		entry := table[8+i*entrySize:]
+		frame := seekableFrame{
+			compressedOffset:   compressedOffset,
+			compressedSize:     int64(binary.LittleEndian.Uint32(entry[0:4])),
+			decompressedOffset: s.size,
+			decompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:8])),
+		}
+		compressedOffset += frame.compressedSize
+		s.size += frame.decompressedSize
+		s.frames = append(s.frames, frame)
+	}
+	if compressedOffset+8+tableSize != size {
+		decoder.Close()
+		return nil, errors.New("seek table does not match the size of the compressed data")
+	}
+	return s, nil
+}
+
+// Size returns the size of the decompressed disk.
+func (s *SeekableZstd) Size() int64 {
+	return s.size
+}
+
+// SectorSize returns 0, since compressed images carry no sector size.
+func (s *SeekableZstd) SectorSize() int64 {
+	return 0
+}
+
+// Close releases the decoder and closes the underlying data.
+func (s *SeekableZstd) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decoder.Close()
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// WriteAt fails, since compressed images cannot be modified in place.
+func (s *SeekableZstd) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: seekable zstd images cannot be modified in place", ErrReadOnly)
+}
+
+func (s *SeekableZstd) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), s.size-off))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := sort.Search(len(s.frames), func(i int) bool {
+		return s.frames[i].decompressedOffset+s.frames[i].decompressedSize > off
+	})
+	for done := 0; done < n; index++ {
+		data, err := s.frame(index)
+		if err != nil {
+			return done, err
+		}
+		done += copy(p[done:n], data[off+int64(done)-s.frames[index].decompressedOffset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// frame returns the decompressed frame with the given index. s.mu must be held.
+func (s *SeekableZstd) frame(index int) ([]byte, error) {
+	if data, ok := s.cache.get(int64(index)); ok {
+		return data, nil
+	}
+	frame := s.frames[index]
+	compressed := make([]byte, frame.compressedSize)
+	if _, err := s.r.ReadAt(compressed, frame.compressedOffset); err != nil {
+		return nil, fmt.Errorf("reading zstd frame %d: %w", index, err)
+	}
+	data, err := s.decoder.DecodeAll(compressed, make([]byte, 0, frame.decompressedSize))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing zstd frame %d: %w", index, err)
+	}
+	if int64(len(data)) != frame.decompressedSize {
+		return nil, fmt.Errorf("zstd frame %d has %d bytes, the seek table says %d", index, len(data), frame.decompressedSize)
+	}
+	s.cache.put(int64(index), data)
+	return data, nil
+}
+
+// WriteSeekableZstd writes the content of src to w in the seekable zstd format, in frames of 1 MiB.
+// The seek table carries no checksums.
+func WriteSeekableZstd(ctx context.Context, w io.Writer, src Disk) error {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	table := binary.LittleEndian.AppendUint32(nil, seekableSkippableMagic)
+	table = binary.LittleEndian.AppendUint32(table, 0) // frame size, set below
+	buf := make([]byte, seekableFrameSize)
+	var compressed []byte
+	var frames uint32
+	for off := int64(0); off < src.Size(); off += seekableFrameSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := buf[:min(seekableFrameSize, src.Size()-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil {
+			return fmt.Errorf("reading at %d: %w", off, err)
+		}
+		compressed = encoder.EncodeAll(chunk, compressed[:0])
+		if _, err := w.Write(compressed); err != nil {
+			return fmt.Errorf("writing zstd frame: %w", err)
+		}
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(compressed)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(chunk)))
+		frames++
+	}
+	table = binary.LittleEndian.AppendUint32(table, frames)
+	table = append(table, 0) // descriptor: no checksums
+	table = binary.LittleEndian.AppendUint32(table, seekableMagic)
+	binary.LittleEndian.PutUint32(table[4:8], uint32(len(table)-8))
+	if _, err := w.Write(table); err != nil {
+		return fmt.Errorf("writing seek table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeekableZstd(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	content := make([]byte, 3*seekableFrameSize+1234) // no GPT needed, the seek table has the size
+	for i := range content {
+		content[i] = byte(i / 1000 % 251)
+	}
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+	src, err := Open(filepath.Join(dir, "image.raw"))
+	require.NoError(err)
+	defer src.Close()
+	path := filepath.Join(dir, "image.raw.zst")
+	_, err = Export(context.Background(), path, FormatSeekableZstd, src)
+	require.NoError(err)
+
+	d, err := Open(path)
+	require.NoError(err)
+	defer d.Close()
+	require.IsType(&SeekableZstd{}, d)
+	s := d.(*SeekableZstd)
+	assert.Len(s.frames, 4)
+	assert.Equal(int64(len(content)), d.Size())
+	for _, off := range []int64{3*seekableFrameSize - 9000, 100, seekableFrameSize - 10, 2*seekableFrameSize - 5000} {
+		got := make([]byte, 10000) // spans frames
+		_, err := d.ReadAt(got, off)
+		require.NoError(err)
+		assert.Equal(content[off:off+10000], got)
+	}
+	got := make([]byte, 100)
+	n, err := d.ReadAt(got, int64(len(content))-10)
+	assert.Equal(10, n)
+	assert.ErrorIs(err, io.EOF)
+	_, err = d.WriteAt([]byte("x"), 0)
+	assert.ErrorIs(err, ErrReadOnly)
+
+	// regular decoders skip the seek table
+	compressed, err := os.ReadFile(path)
+	require.NoError(err)
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	require.NoError(err)
+	defer decoder.Close()
+	decompressed, err := io.ReadAll(decoder)
+	require.NoError(err)
+	assert.Equal(content, decompressed)
+
+	// any io.ReaderAt works
+	r, err := OpenSeekableZstd(bytes.NewReader(compressed), int64(len(compressed)), nil)
+	require.NoError(err)
+	defer r.Close()
+	got = make([]byte, 5)
+	_, err = r.ReadAt(got, 2*seekableFrameSize)
+	require.NoError(err)
+	assert.Equal(content[2*seekableFrameSize:2*seekableFrameSize+5], got)
+
+	_, err = OpenSeekableZstd(bytes.NewReader(compressed[:len(compressed)-1]), int64(len(compressed)-1), nil)
+	assert.Error(err)
+}
@@ -0,0 +1,224 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// FormatTarGz is a gzip compressed tar archive containing the disk as disk.raw,
+// the image format of Google Compute Engine.
+const FormatTarGz = "tar.gz"
+
+const (
+	tarDiskName = "disk.raw"
+	tarBlock    = 512
+	// tarSparseBlock is the granularity in which holes are detected when writing sparse archives.
+	tarSparseBlock = 4096
+	// entries of the sparse map in the header and in each extended header of the old GNU format
+	tarHeaderSparseEntries   = 4
+	tarExtendedSparseEntries = 21
+)
+
+// isTarGz reports whether the gzip stream in r contains a tar archive.
+func isTarGz(r io.ReaderAt) bool {
+	decoder, err := gzip.NewReader(io.NewSectionReader(r, 0, 1<<63-1))
+	if err != nil {
+		return false
+	}
+	defer decoder.Close()
+	header := make([]byte, tarBlock)
+	if _, err := io.ReadFull(decoder, header); err != nil {
+		return false
+	}
+	return string(header[257:262]) == "ustar"
+}
+
+// tarDisk advances the archive to the disk.raw member and returns a reader of its content
+// (with the holes of sparse members filled with zeros) and its header.
+func tarDisk(r io.Reader) (io.Reader, *tar.Header, error) {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("archive contains no %s", tarDiskName)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading archive: %w", err)
+		}
+		if path.Clean(header.Name) == tarDiskName && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeGNUSparse) {
+			return archive, header, nil
+		}
+	}
+}
+
+// sourceTarHeader returns the header of the disk.raw member src is read from,
+// or a header owned by root and modified now if src is not (an overlay on) a tar.gz archive.
+func sourceTarHeader(src Disk) *tar.Header {
+	if overlay, ok := src.(*Overlay); ok {
+		src = overlay.Base()
+	}
+	if c, ok := src.(*Compressed); ok && c.tarHeader != nil {
+		return c.tarHeader
+	}
+	return &tar.Header{Mode: 0o644, Uname: "root", Gname: "root", ModTime: time.Now()}
+}
+
+type sparseRegion struct {
+	offset, size int64
+}
+
+// sparseRegions returns the regions of src that contain data, in blocks of 4 KiB.
+func sparseRegions(ctx context.Context, src Disk) ([]sparseRegion, error) {
+	var regions []sparseRegion
+	buf := make([]byte, copyChunk)
+	zeros := make([]byte, tarSparseBlock)
+	for off := int64(0); off < src.Size(); off += copyChunk {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		chunk := buf[:min(copyChunk, src.Size()-off)]
+		if _, err := src.ReadAt(chunk, off); err != nil {
+			return nil, fmt.Errorf("reading at %d: %w", off, err)
+		}
+		for start := 0; start < len(chunk); start += tarSparseBlock {
+			block := chunk[start:min(start+tarSparseBlock, len(chunk))]
+			if bytes.Equal(block, zeros[:len(block)]) {
+				continue
+			}
+			blockOffset := off + int64(start)
+			if last := len(regions) - 1; last >= 0 && regions[last].offset+regions[last].size == blockOffset {
+				regions[last].size += int64(len(block))
+			} else {
+				regions = append(regions, sparseRegion{offset: blockOffset, size: int64(len(block))})
+			}
+		}
+	}
+	return regions, nil
+}
+
+// WriteTarGz writes src as disk.raw into a gzip compressed tar archive. The member is a sparse file in the
+// old GNU format (like tar --format=oldgnu -S creates), so that holes take no space in the archive.
+// If src is read from a tar.gz archive, mode, owner and modification time of its disk.raw member are kept.
+// src is read twice: once to find the holes and once to copy the data.
+func WriteTarGz(ctx context.Context, w io.Writer, src Disk) error {
+	regions, err := sparseRegions(ctx, src)
+	if err != nil {
+		return err
+	}
+	encoder := gzip.NewWriter(w)
+	if _, err := encoder.Write(sparseTarHeaders(sourceTarHeader(src), src.Size(), regions)); err != nil {
+		return fmt.Errorf("compressing: %w", err)
+	}
+	buf := make([]byte, copyChunk)
+	var written int64
+	for _, region := range regions {
+		for off := region.offset; off < region.offset+region.size; off += copyChunk {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			chunk := buf[:min(copyChunk, region.offset+region.size-off)]
+			if _, err := src.ReadAt(chunk, off); err != nil {
+				return fmt.Errorf("reading at %d: %w", off, err)
+			}
+			if _, err := encoder.Write(chunk); err != nil {
+				return fmt.Errorf("compressing: %w", err)
+			}
+			written += int64(len(chunk))
+		}
+	}
+	// pad the member to full blocks and end the archive with two zero blocks
+	padding := (tarBlock-written%tarBlock)%tarBlock + 2*tarBlock
+	if _, err := encoder.Write(make([]byte, padding)); err != nil {
+		return fmt.Errorf("compressing: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("compressing: %w", err)
+	}
+	return nil
+}
+
+// sparseTarHeaders returns the header of the sparse disk.raw member in the old GNU format, with mode, owner
+// and modification time of meta, followed by the extended headers for the sparse map entries that do not
+// fit into it. Like GNU tar, a file ending in a hole gets a final empty entry at its end.
+func sparseTarHeaders(meta *tar.Header, size int64, regions []sparseRegion) []byte {
+	var stored int64
+	for _, region := range regions {
+		stored += region.size
+	}
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].size < size {
+		regions = append(regions, sparseRegion{offset: size})
+	}
+
+	header := make([]byte, tarBlock)
+	copy(header[0:100], tarDiskName)
+	putTarNumber(header[100:108], meta.Mode&0o7777)
+	putTarNumber(header[108:116], int64(meta.Uid))
+	putTarNumber(header[116:124], int64(meta.Gid))
+	putTarNumber(header[124:136], stored)
+	putTarNumber(header[136:148], meta.ModTime.Unix())
+	header[156] = tar.TypeGNUSparse
+	copy(header[257:265], "ustar  \x00")
+	copy(header[265:296], meta.Uname)
+	copy(header[297:328], meta.Gname)
+	putTarNumber(header[483:495], size)
+	inHeader := min(len(regions), tarHeaderSparseEntries)
+	putSparseEntries(header[386:], regions[:inHeader])
+	regions = regions[inHeader:]
+	if len(regions) > 0 {
+		header[482] = 1
+	}
+	putTarChecksum(header)
+
+	headers := header
+	for len(regions) > 0 {
+		extended := make([]byte, tarBlock)
+		n := min(len(regions), tarExtendedSparseEntries)
+		putSparseEntries(extended, regions[:n])
+		regions = regions[n:]
+		if len(regions) > 0 {
+			extended[504] = 1
+		}
+		headers = append(headers, extended...)
+	}
+	return headers
+}
+
+func putSparseEntries(b []byte, regions []sparseRegion) {
+	for i, region := range regions {
+		putTarNumber(b[i*24:i*24+12], region.offset)
+		putTarNumber(b[i*24+12:i*24+24], region.size)
+	}
+}
+
+// putTarNumber writes n as NUL terminated octal number, or in the base-256 encoding of GNU tar if it does not fit.
+func putTarNumber(b []byte, n int64) {
+	octal := strconv.FormatInt(n, 8)
+	if len(octal) < len(b) {
+		copy(b, fmt.Sprintf("%0*s\x00", len(b)-1, octal))
+		return
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] = 0x80
+}
+
+// putTarChecksum computes the header checksum, counting the checksum field as spaces.
+func putTarChecksum(header []byte) {
+	copy(header[148:156], "        ")
+	var sum int64
+	for _, c := range header {
+		sum += int64(c)
+	}
+	copy(header[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
@@ -0,0 +1,160 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarGz(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	// 30 data regions need extended sparse headers, and the disk ends in a hole
+	content := make([]byte, 8<<20+512)
+	for i := int64(0); i < 30; i++ {
+		copy(content[i*(256<<10)+1000:], bytes.Repeat([]byte{byte(i + 1)}, 5000))
+	}
+	require.NoError(os.WriteFile(filepath.Join(dir, "image.raw"), content, 0o644))
+	src, err := Open(filepath.Join(dir, "image.raw"))
+	require.NoError(err)
+	defer src.Close()
+	path := filepath.Join(dir, "image.tar.gz")
+	assert.Equal(FormatTarGz, FormatFromPath(path))
+	_, err = Export(context.Background(), path, FormatTarGz, src)
+	require.NoError(err)
+
+	archive, err := os.Open(path)
+	require.NoError(err)
+	defer archive.Close()
+	decoder, err := gzip.NewReader(archive)
+	require.NoError(err)
+	r := tar.NewReader(decoder)
+	header, err := r.Next()
+	require.NoError(err)
+	assert.Equal("disk.raw", header.Name)
+	assert.Equal(byte(tar.TypeGNUSparse), header.Typeflag)
+	assert.Equal(int64(len(content)), header.Size)
+	got, err := io.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(content, got)
+	_, err = r.Next()
+	assert.ErrorIs(err, io.EOF)
+
+	d, err := Open(path)
+	require.NoError(err)
+	defer d.Close()
+	require.IsType(&Compressed{}, d)
+	assert.Equal(FormatTarGz, d.(*Compressed).Format())
+	assert.Equal(int64(len(content)), d.Size())
+	got = make([]byte, 6000)
+	_, err = d.ReadAt(got, 29*(256<<10))
+	require.NoError(err)
+	assert.Equal(content[29*(256<<10):29*(256<<10)+6000], got)
+
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not found")
+	}
+	out := t.TempDir()
+	require.NoError(exec.Command("tar", "-xzSf", path, "-C", out).Run())
+	extracted, err := os.ReadFile(filepath.Join(out, "disk.raw"))
+	require.NoError(err)
+	assert.Equal(content, extracted)
+}
+
+func TestTarGzReplace(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.tar.gz")
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var archive bytes.Buffer
+	encoder := gzip.NewWriter(&archive)
+	w := tar.NewWriter(encoder)
+	content := bytes.Repeat([]byte("disk"), 4096)
+	require.NoError(w.WriteHeader(&tar.Header{
+		Name: "./disk.raw", Mode: 0o600, Size: int64(len(content)), ModTime: modified,
+		Uid: 1000, Gid: 1000, Uname: "builder", Gname: "builder", Format: tar.FormatGNU,
+	}))
+	_, err := w.Write(content)
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(encoder.Close())
+	require.NoError(os.WriteFile(path, archive.Bytes(), 0o640))
+
+	src, err := Open(path)
+	require.NoError(err)
+	defer src.Close()
+	overlay := NewOverlay(src)
+	_, err = overlay.WriteAt([]byte("patched"), 100)
+	require.NoError(err)
+	_, err = Replace(context.Background(), path, FormatTarGz, overlay)
+	require.NoError(err)
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0o640), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(err)
+	assert.Len(entries, 1, "no temporary file is left behind")
+
+	file, err := os.Open(path)
+	require.NoError(err)
+	defer file.Close()
+	decoder, err := gzip.NewReader(file)
+	require.NoError(err)
+	r := tar.NewReader(decoder)
+	header, err := r.Next()
+	require.NoError(err)
+	assert.Equal("disk.raw", header.Name)
+	assert.Equal(int64(0o600), header.Mode)
+	assert.True(modified.Equal(header.ModTime), header.ModTime)
+	assert.Equal(1000, header.Uid)
+	assert.Equal(1000, header.Gid)
+	assert.Equal("builder", header.Uname)
+	assert.Equal("builder", header.Gname)
+	got, err := io.ReadAll(r)
+	require.NoError(err)
+	copy(content[100:], "patched")
+	assert.Equal(content, got)
+}
+
+func TestTarGzWithoutDisk(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.tar.gz")
+	var archive bytes.Buffer
+	encoder := gzip.NewWriter(&archive)
+	w := tar.NewWriter(encoder)
+	require.NoError(w.WriteHeader(&tar.Header{Name: "other.raw", Mode: 0o644, Size: 3}))
+	_, err := w.Write([]byte("foo"))
+	require.NoError(err)
+	require.NoError(w.Close())
+	require.NoError(encoder.Close())
+	require.NoError(os.WriteFile(path, archive.Bytes(), 0o644))
+
+	_, err = Open(path)
+	require.Error(err)
+	assert.Contains(t, err.Error(), "no disk.raw")
+}
+
+func TestPutTarNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	b := make([]byte, 12)
+	putTarNumber(b, 0o644)
+	assert.Equal("00000000644\x00", string(b))
+	putTarNumber(b, 20<<30) // 20 GiB does not fit 11 octal digits
+	assert.Equal([]byte{0x80, 0, 0, 0, 0, 0, 0, 0x05, 0, 0, 0, 0}, b)
+}
@@ -0,0 +1,366 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	vhdFooterCookie  = "conectix"
+	vhdDynamicCookie = "cxsparse"
+	vhdFooterSize    = 512
+	vhdDynamicSize   = 1024
+	vhdSector        = 512
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdUnallocated = 0xFFFFFFFF
+	// vhdBlockSize is the block size of created dynamic VHDs (the default of Hyper-V and qemu).
+	vhdBlockSize = 2 << 20
+	// vhdAlignment is the size granularity Azure requires for VHDs.
+	vhdAlignment = 1 << 20
+)
+
+// vhdEpoch is the reference of VHD timestamps.
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// VHD is a fixed or dynamic Virtual Hard Disk (the format of Virtual PC, Hyper-V and Azure).
+// Fixed VHDs are raw images followed by a footer. Dynamic VHDs map blocks through a block
+// allocation table (BAT); writes to unallocated blocks append new blocks to the file.
+type VHD struct {
+	file   *os.File
+	footer []byte
+	size   int64
+
+	// dynamic VHDs only
+	dynamic    bool
+	blockSize  int64
+	bitmapSize int64
+	batOffset  int64
+	bat        []uint32
+	footerAt   int64
+
+	// mu guards the BAT and the position of the footer.
+	mu sync.Mutex
+}
+
+// IsVHD reports whether the image of the given size is a VHD: dynamic VHDs start with a copy
+// of the footer, fixed VHDs end with it.
+func IsVHD(r io.ReaderAt, size int64) bool {
+	cookie := make([]byte, 8)
+	if _, err := r.ReadAt(cookie, 0); err == nil && string(cookie) == vhdFooterCookie {
+		return true
+	}
+	if size < vhdFooterSize {
+		return false
+	}
+	if _, err := r.ReadAt(cookie, size-vhdFooterSize); err != nil {
+		return false
+	}
+	return string(cookie) == vhdFooterCookie
+}
+
+// OpenVHD opens a fixed or dynamic VHD of the given file size.
+func OpenVHD(file *os.File, fileSize int64) (*VHD, error) {
+	if fileSize < vhdFooterSize {
+		return nil, errors.New("file too small for a VHD")
+	}
+	footer := make([]byte, vhdFooterSize)
+	if _, err := file.ReadAt(footer, fileSize-vhdFooterSize); err != nil {
+		return nil, fmt.Errorf("reading VHD footer: %w", err)
+	}
+	if string(footer[0:8]) != vhdFooterCookie || !validVHDChecksum(footer, 64) {
+		// dynamic VHDs keep a copy of the footer at the start of the file
+		if _, err := file.ReadAt(footer, 0); err != nil {
+			return nil, fmt.Errorf("reading VHD footer: %w", err)
+		}
+		if string(footer[0:8]) != vhdFooterCookie || !validVHDChecksum(footer, 64) {
+			return nil, errors.New("VHD footer is invalid")
+		}
+	}
+	v := &VHD{
+		file:     file,
+		footer:   footer,
+		size:     int64(binary.BigEndian.Uint64(footer[48:56])),
+		footerAt: fileSize - vhdFooterSize,
+	}
+	switch binary.BigEndian.Uint32(footer[60:64]) {
+	case vhdTypeFixed:
+		if v.size > v.footerAt {
+			return nil, fmt.Errorf("fixed VHD of %d bytes is truncated", v.size)
+		}
+		return v, nil
+	case vhdTypeDynamic:
+		if err := v.readDynamicHeader(int64(binary.BigEndian.Uint64(footer[16:24]))); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case vhdTypeDifferencing:
+		return nil, errors.New("differencing VHDs are not supported")
+	}
+	return nil, fmt.Errorf("unknown VHD disk type %d", binary.BigEndian.Uint32(footer[60:64]))
+}
+
+func (v *VHD) readDynamicHeader(offset int64) error {
+	header := make([]byte, vhdDynamicSize)
+	if _, err := v.file.ReadAt(header, offset); err != nil {
+		return fmt.Errorf("reading VHD dynamic disk header: %w", err)
+	}
+	if string(header[0:8]) != vhdDynamicCookie || !validVHDChecksum(header, 36) {
+		return errors.New("VHD dynamic disk header is invalid")
+	}
+	v.dynamic = true
+	v.batOffset = int64(binary.BigEndian.Uint64(header[16:24]))
+	v.blockSize = int64(binary.BigEndian.Uint32(header[32:36]))
+	if v.blockSize < vhdSector || v.blockSize&(v.blockSize-1) != 0 {
+		return fmt.Errorf("invalid VHD block size %d", v.blockSize)
+	}
+	v.bitmapSize = alignUp(v.blockSize/vhdSector/8, vhdSector)
+	entries := int64(binary.BigEndian.Uint32(header[28:32]))
+	if entries*v.blockSize < v.size {
+		return fmt.Errorf("VHD block allocation table of %d entries is too small for %d bytes", entries, v.size)
+	}
+	raw := make([]byte, entries*4)
+	if _, err := v.file.ReadAt(raw, v.batOffset); err != nil {
+		return fmt.Errorf("reading VHD block allocation table: %w", err)
+	}
+	v.bat = make([]uint32, entries)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+	return nil
+}
+
+// Size returns the virtual size of the disk.
+func (v *VHD) Size() int64 {
+	return v.size
+}
+
+// SectorSize returns 0, since VHDs always use 512 byte sectors but DDIs may use larger ones.
+func (v *VHD) SectorSize() int64 {
+	return 0
+}
+
+func (v *VHD) Close() error {
+	return v.file.Close()
+}
+
+func (v *VHD) ReadAt(p []byte, off int64) (int, error) {
+	return v.do(p, off, false)
+}
+
+func (v *VHD) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > v.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the VHD of %d bytes", len(p), off, v.size)
+	}
+	return v.do(p, off, true)
+}
+
+func (v *VHD) do(p []byte, off int64, write bool) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), v.size-off))
+	if !v.dynamic {
+		var err error
+		if write {
+			n, err = v.file.WriteAt(p[:n], off)
+		} else {
+			n, err = v.file.ReadAt(p[:n], off)
+		}
+		if err == nil && n < len(p) {
+			err = io.EOF
+		}
+		return n, err
+	}
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		block, inBlock := pos/v.blockSize, pos%v.blockSize
+		chunk := p[done : done+int(min(v.blockSize-inBlock, int64(n-done)))]
+		if err := v.doBlock(block, inBlock, chunk, write); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *VHD) doBlock(block, inBlock int64, p []byte, write bool) error {
+	v.mu.Lock()
+	entry := v.bat[block]
+	if entry == vhdUnallocated {
+		if !write {
+			v.mu.Unlock()
+			clear(p)
+			return nil
+		}
+		var err error
+		if entry, err = v.allocate(block); err != nil {
+			v.mu.Unlock()
+			return err
+		}
+	}
+	v.mu.Unlock()
+	offset := int64(entry)*vhdSector + v.bitmapSize + inBlock
+	var err error
+	if write {
+		_, err = v.file.WriteAt(p, offset)
+	} else {
+		_, err = v.file.ReadAt(p, offset)
+	}
+	if err != nil {
+		return fmt.Errorf("accessing VHD block %d: %w", block, err)
+	}
+	return nil
+}
+
+// allocate appends a zeroed block in place of the footer, rewrites the footer behind it
+// and updates the BAT. All sectors of the block are marked present in its bitmap.
+func (v *VHD) allocate(block int64) (uint32, error) {
+	start := v.footerAt
+	content := make([]byte, v.bitmapSize+v.blockSize+vhdFooterSize)
+	for i := int64(0); i < v.blockSize/vhdSector/8; i++ {
+		content[i] = 0xFF
+	}
+	copy(content[v.bitmapSize+v.blockSize:], v.footer)
+	if _, err := v.file.WriteAt(content, start); err != nil {
+		return 0, fmt.Errorf("allocating VHD block %d: %w", block, err)
+	}
+	v.footerAt = start + v.bitmapSize + v.blockSize
+	entry := uint32(start / vhdSector)
+	if _, err := v.file.WriteAt(binary.BigEndian.AppendUint32(nil, entry), v.batOffset+block*4); err != nil {
+		return 0, fmt.Errorf("writing VHD block allocation table: %w", err)
+	}
+	v.bat[block] = entry
+	return entry, nil
+}
+
+// CreateVHD creates a VHD for a disk of the given size, rounded up to 1 MiB as required by Azure.
+// Fixed VHDs are created as sparse files. Dynamic VHDs use blocks of 2 MiB.
+func CreateVHD(path string, size int64, dynamic bool) (*VHD, error) {
+	size = alignUp(size, vhdAlignment)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	footer := vhdFooter(size, dynamic)
+	var content []byte
+	var fileSize int64
+	if dynamic {
+		entries := (size + vhdBlockSize - 1) / vhdBlockSize
+		batOffset := int64(vhdFooterSize + vhdDynamicSize)
+		header := make([]byte, vhdDynamicSize)
+		copy(header[0:8], vhdDynamicCookie)
+		binary.BigEndian.PutUint64(header[8:16], 0xFFFFFFFFFFFFFFFF)
+		binary.BigEndian.PutUint64(header[16:24], uint64(batOffset))
+		binary.BigEndian.PutUint32(header[24:28], 0x00010000)
+		binary.BigEndian.PutUint32(header[28:32], uint32(entries))
+		binary.BigEndian.PutUint32(header[32:36], vhdBlockSize)
+		binary.BigEndian.PutUint32(header[36:40], vhdChecksum(header))
+		bat := bytes.Repeat([]byte{0xFF}, int(alignUp(entries*4, vhdSector)))
+		content = append(append(append(footer, header...), bat...), footer...)
+		fileSize = int64(len(content))
+	} else {
+		content = footer
+		fileSize = size + vhdFooterSize
+	}
+	if _, err := file.WriteAt(content, fileSize-int64(len(content))); err != nil {
+		file.Close()
+		return nil, err
+	}
+	v, err := OpenVHD(file, fileSize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// vhdFooter returns the footer of a new VHD.
+func vhdFooter(size int64, dynamic bool) []byte {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer[0:8], vhdFooterCookie)
+	binary.BigEndian.PutUint32(footer[8:12], 2) // reserved feature bit
+	binary.BigEndian.PutUint32(footer[12:16], 0x00010000)
+	binary.BigEndian.PutUint64(footer[16:24], 0xFFFFFFFFFFFFFFFF)
+	diskType := uint32(vhdTypeFixed)
+	if dynamic {
+		binary.BigEndian.PutUint64(footer[16:24], vhdFooterSize)
+		diskType = vhdTypeDynamic
+	}
+	binary.BigEndian.PutUint32(footer[24:28], uint32(time.Since(vhdEpoch)/time.Second))
+	copy(footer[28:32], "ddit")
+	binary.BigEndian.PutUint32(footer[32:36], 0x00010000)
+	copy(footer[36:40], "Wi2k")
+	binary.BigEndian.PutUint64(footer[40:48], uint64(size))
+	binary.BigEndian.PutUint64(footer[48:56], uint64(size))
+	cylinders, heads, sectors := vhdGeometry(size)
+	binary.BigEndian.PutUint16(footer[56:58], cylinders)
+	footer[58], footer[59] = heads, sectors
+	binary.BigEndian.PutUint32(footer[60:64], diskType)
+	_, _ = rand.Read(footer[68:84])
+	binary.BigEndian.PutUint32(footer[64:68], vhdChecksum(footer))
+	return footer
+}
+
+// vhdGeometry computes the CHS geometry of a disk as specified in the VHD specification.
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := min(size/vhdSector, 65535*16*255)
+	var cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack, heads = 255, 16
+		cylinderTimesHeads = totalSectors / int64(sectorsPerTrack)
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / int64(sectorsPerTrack)
+		heads = uint8(max((cylinderTimesHeads+1023)/1024, 4))
+		if cylinderTimesHeads >= int64(heads)*1024 || heads > 16 {
+			sectorsPerTrack, heads = 31, 16
+			cylinderTimesHeads = totalSectors / int64(sectorsPerTrack)
+		}
+		if cylinderTimesHeads >= int64(heads)*1024 {
+			sectorsPerTrack, heads = 63, 16
+			cylinderTimesHeads = totalSectors / int64(sectorsPerTrack)
+		}
+	}
+	return uint16(cylinderTimesHeads / int64(heads)), heads, sectorsPerTrack
+}
+
+// vhdChecksum is the one's complement of the byte sum of a footer or dynamic disk header,
+// with the checksum field counted as zero.
+func vhdChecksum(raw []byte) uint32 {
+	checksumAt := 64
+	if string(raw[0:8]) == vhdDynamicCookie {
+		checksumAt = 36
+	}
+	var sum uint32
+	for i, b := range raw {
+		if i < checksumAt || i >= checksumAt+4 {
+			sum += uint32(b)
+		}
+	}
+	return ^sum
+}
+
+func validVHDChecksum(raw []byte, checksumAt int) bool {
+	return binary.BigEndian.Uint32(raw[checksumAt:checksumAt+4]) == vhdChecksum(raw)
+}
+
+func alignUp(value, alignment int64) int64 {
+	return (value + alignment - 1) / alignment * alignment
+}
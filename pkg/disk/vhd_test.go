@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVHD(t *testing.T) {
+	testCases := map[string]struct {
+		dynamic      bool
+		wantFileSize int64
+	}{
+		"fixed": {wantFileSize: 3<<20 + vhdFooterSize},
+		// footer copy, dynamic header, BAT, two allocated blocks and the footer
+		"dynamic": {dynamic: true, wantFileSize: 3*vhdFooterSize + vhdDynamicSize + 2*(vhdSector+vhdBlockSize)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			path := filepath.Join(t.TempDir(), "image.vhd")
+			v, err := CreateVHD(path, 2<<20+1, tc.dynamic)
+			require.NoError(err)
+			assert.Equal(int64(3<<20), v.Size())
+
+			pattern := bytes.Repeat([]byte("vhd "), 1000)
+			_, err = v.WriteAt(pattern, 2<<20-2000) // spans two blocks
+			require.NoError(err)
+			_, err = v.WriteAt([]byte("x"), 3<<20)
+			assert.Error(err)
+			require.NoError(v.Close())
+
+			info, err := os.Stat(path)
+			require.NoError(err)
+			assert.Equal(tc.wantFileSize, info.Size())
+			content, err := os.ReadFile(path)
+			require.NoError(err)
+			footer := content[len(content)-vhdFooterSize:]
+			assert.Equal(vhdFooterCookie, string(footer[0:8]))
+			assert.True(validVHDChecksum(footer, 64))
+			assert.Equal(uint64(3<<20), binary.BigEndian.Uint64(footer[48:56]))
+
+			d, err := Open(path)
+			require.NoError(err)
+			defer d.Close()
+			require.IsType(&VHD{}, d)
+			assert.Equal(int64(3<<20), d.Size())
+			got := make([]byte, len(pattern)+2)
+			_, err = d.ReadAt(got, 2<<20-2001)
+			require.NoError(err)
+			assert.Equal(append(append([]byte{0}, pattern...), 0), got)
+			got = make([]byte, 100)
+			_, err = d.ReadAt(got, 2<<20+1<<19)
+			require.NoError(err)
+			assert.Equal(make([]byte, 100), got)
+			n, err := d.ReadAt(got, 3<<20-10)
+			assert.Equal(10, n)
+			assert.Error(err)
+		})
+	}
+}
+
+func TestVHDGeometry(t *testing.T) {
+	testCases := map[string]struct {
+		size      int64
+		cylinders uint16
+		heads     uint8
+		sectors   uint8
+	}{
+		"128 MiB":  {size: 128 << 20, cylinders: 963, heads: 16, sectors: 17},
+		"127 GiB":  {size: 127 << 30, cylinders: 65278, heads: 16, sectors: 255},
+		"capped":   {size: 4 << 40, cylinders: 65535, heads: 16, sectors: 255},
+		"4 MiB":    {size: 4 << 20, cylinders: 120, heads: 4, sectors: 17},
+		"1000 MiB": {size: 1000 << 20, cylinders: 2031, heads: 16, sectors: 63},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			cylinders, heads, sectors := vhdGeometry(tc.size)
+			assert.Equal(tc.cylinders, cylinders)
+			assert.Equal(tc.heads, heads)
+			assert.Equal(tc.sectors, sectors)
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"unicode/utf16"
+)
+
+const (
+	vhdxSignature       = "vhdxfile"
+	vhdxHeaderSignature = "head"
+	vhdxRegionSignature = "regi"
+	vhdxMetaSignature   = "metadata"
+
+	vhdxHeaderOffset  = 64 << 10 // second header at 128 KiB
+	vhdxHeaderSize    = 4 << 10
+	vhdxRegionOffset  = 192 << 10 // second region table at 256 KiB
+	vhdxRegionSize    = 64 << 10
+	vhdxMetaTableSize = 64 << 10
+	vhdxAlignment     = 1 << 20
+
+	// BAT entry states of payload blocks. The file offset is stored in MiB in bits 20 to 63.
+	vhdxBlockNotPresent   = 0
+	vhdxBlockUndefined    = 1
+	vhdxBlockZero         = 2
+	vhdxBlockUnmapped     = 3
+	vhdxBlockFullyPresent = 6
+	vhdxBlockPartial      = 7
+	vhdxStateMask         = 7
+
+	vhdxHasParent = 1 << 1
+
+	// vhdxBlockSize is the block size of created VHDX images (the default of Hyper-V).
+	vhdxBlockSize = 32 << 20
+)
+
+// GUIDs of the VHDX regions and metadata items, stored with the first three fields little-endian.
+var (
+	vhdxBATRegion      = [16]byte{0x66, 0x77, 0xC2, 0x2D, 0x23, 0xF6, 0x00, 0x42, 0x9D, 0x64, 0x11, 0x5E, 0x9B, 0xFD, 0x4A, 0x08} // 2DC27766-F623-4200-9D64-115E9BFD4A08
+	vhdxMetadataRegion = [16]byte{0x06, 0xA2, 0x7C, 0x8B, 0x90, 0x47, 0x9A, 0x4B, 0xB8, 0xFE, 0x57, 0x5F, 0x05, 0x0F, 0x88, 0x6E} // 8B7CA206-4790-4B9A-B8FE-575F050F886E
+
+	vhdxFileParameters     = [16]byte{0x37, 0x67, 0xA1, 0xCA, 0x36, 0xFA, 0x43, 0x4D, 0xB3, 0xB6, 0x33, 0xF0, 0xAA, 0x44, 0xE7, 0x6B} // CAA16737-FA36-4D43-B3B6-33F0AA44E76B
+	vhdxVirtualDiskSize    = [16]byte{0x24, 0x42, 0xA5, 0x2F, 0x1B, 0xCD, 0x76, 0x48, 0xB2, 0x11, 0x5D, 0xBE, 0xD8, 0x3B, 0xF4, 0xB8} // 2FA54224-CD1B-4876-B211-5DBED83BF4B8
+	vhdxPage83Data         = [16]byte{0xAB, 0x12, 0xCA, 0xBE, 0xE6, 0xB2, 0x23, 0x45, 0x93, 0xEF, 0xC3, 0x09, 0xE0, 0x00, 0xC7, 0x46} // BECA12AB-B2E6-4523-93EF-C309E000C746
+	vhdxLogicalSectorSize  = [16]byte{0x1D, 0xBF, 0x41, 0x81, 0x6F, 0xA9, 0x09, 0x47, 0xBA, 0x47, 0xF2, 0x33, 0xA8, 0xFA, 0xAB, 0x5F} // 8141BF1D-A96F-4709-BA47-F233A8FAAB5F
+	vhdxPhysicalSectorSize = [16]byte{0xC7, 0x48, 0xA3, 0xCD, 0x5D, 0x44, 0x71, 0x44, 0x9C, 0xC9, 0xE9, 0x88, 0x52, 0x51, 0xC5, 0x56} // CDA348C7-445D-4471-9CC9-E9885251C556
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// VHDX is a dynamic image in the Hyper-V virtual hard disk v2 format.
+// Reads translate offsets through the block allocation table (BAT); blocks that are not present read as zeros.
+// Writes to blocks that are not present allocate a new block at the 1 MiB aligned end of the file.
+// Images with a log that has not been replayed and differencing images are rejected.
+type VHDX struct {
+	file       *os.File
+	size       int64
+	blockSize  int64
+	chunkRatio int64
+	batOffset  int64
+
+	// mu guards the BAT, the end of the file and the header.
+	mu         sync.Mutex
+	bat        []uint64
+	end        int64
+	header     []byte
+	headerSlot int
+	modified   bool
+}
+
+// IsVHDX reports whether r starts with the VHDX file identifier.
+func IsVHDX(r io.ReaderAt) bool {
+	signature := make([]byte, 8)
+	if _, err := r.ReadAt(signature, 0); err != nil {
+		return false
+	}
+	return string(signature) == vhdxSignature
+}
+
+// OpenVHDX opens the VHDX image stored in file.
+func OpenVHDX(file *os.File) (*VHDX, error) {
+	if !IsVHDX(file) {
+		return nil, errors.New("not a VHDX image")
+	}
+	v := &VHDX{file: file, headerSlot: -1}
+	var sequence uint64
+	for slot := 0; slot < 2; slot++ {
+		header := make([]byte, vhdxHeaderSize)
+		if _, err := file.ReadAt(header, int64(vhdxHeaderOffset*(slot+1))); err != nil {
+			return nil, fmt.Errorf("reading VHDX header: %w", err)
+		}
+		if string(header[0:4]) != vhdxHeaderSignature || !validVHDXChecksum(header) {
+			continue
+		}
+		if s := binary.LittleEndian.Uint64(header[8:16]); v.headerSlot < 0 || s > sequence {
+			v.header, v.headerSlot, sequence = header, slot, s
+		}
+	}
+	if v.headerSlot < 0 {
+		return nil, errors.New("VHDX has no valid header")
+	}
+	if version := binary.LittleEndian.Uint16(v.header[66:68]); version != 1 {
+		return nil, fmt.Errorf("unsupported VHDX version %d", version)
+	}
+	if !bytes.Equal(v.header[48:64], make([]byte, 16)) {
+		return nil, errors.New("VHDX log has to be replayed first (attach the image in Hyper-V or run qemu-img check -r all)")
+	}
+	regions, err := v.readRegions()
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := regions[vhdxMetadataRegion]
+	if !ok {
+		return nil, errors.New("VHDX has no metadata region")
+	}
+	bat, ok := regions[vhdxBATRegion]
+	if !ok {
+		return nil, errors.New("VHDX has no block allocation table")
+	}
+	if err := v.readMetadata(metadata); err != nil {
+		return nil, err
+	}
+	v.batOffset = bat
+	blocks := (v.size + v.blockSize - 1) / v.blockSize
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / v.chunkRatio
+	}
+	raw := make([]byte, entries*8)
+	if _, err := file.ReadAt(raw, v.batOffset); err != nil {
+		return nil, fmt.Errorf("reading VHDX block allocation table: %w", err)
+	}
+	v.bat = make([]uint64, entries)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	v.end = alignUp(info.Size(), vhdxAlignment)
+	return v, nil
+}
+
+// readRegions returns the file offsets of the regions, by GUID.
+// Unknown required regions are rejected.
+func (v *VHDX) readRegions() (map[[16]byte]int64, error) {
+	table := make([]byte, vhdxRegionSize)
+	valid := false
+	for slot := 0; slot < 2 && !valid; slot++ {
+		if _, err := v.file.ReadAt(table, int64(vhdxRegionOffset+slot*vhdxRegionSize)); err != nil {
+			return nil, fmt.Errorf("reading VHDX region table: %w", err)
+		}
+		valid = string(table[0:4]) == vhdxRegionSignature && validVHDXChecksum(table)
+	}
+	if !valid {
+		return nil, errors.New("VHDX has no valid region table")
+	}
+	count := int(binary.LittleEndian.Uint32(table[8:12]))
+	if count > (vhdxRegionSize-16)/32 {
+		return nil, fmt.Errorf("VHDX region table has too many entries (%d)", count)
+	}
+	regions := make(map[[16]byte]int64)
+	for i := 0; i < count; i++ {
+		entry := table[16+i*32 : 16+(i+1)*32]
+		var guid [16]byte
+		copy(guid[:], entry[0:16])
+		if guid != vhdxBATRegion && guid != vhdxMetadataRegion {
+			if binary.LittleEndian.Uint32(entry[28:32])&1 != 0 {
+				return nil, fmt.Errorf("VHDX requires unknown region %x", guid)
+			}
+			continue
+		}
+		regions[guid] = int64(binary.LittleEndian.Uint64(entry[16:24]))
+	}
+	return regions, nil
+}
+
+// readMetadata reads the block size, virtual disk size and logical sector size from the metadata region.
+func (v *VHDX) readMetadata(offset int64) error {
+	table := make([]byte, vhdxMetaTableSize)
+	if _, err := v.file.ReadAt(table, offset); err != nil {
+		return fmt.Errorf("reading VHDX metadata: %w", err)
+	}
+	if string(table[0:8]) != vhdxMetaSignature {
+		return errors.New("VHDX metadata table is invalid")
+	}
+	count := int(binary.LittleEndian.Uint16(table[10:12]))
+	if count > (vhdxMetaTableSize-32)/32 {
+		return fmt.Errorf("VHDX metadata table has too many entries (%d)", count)
+	}
+	items := make(map[[16]byte][]byte)
+	for i := 0; i < count; i++ {
+		entry := table[32+i*32 : 32+(i+1)*32]
+		var guid [16]byte
+		copy(guid[:], entry[0:16])
+		switch guid {
+		case vhdxFileParameters, vhdxVirtualDiskSize, vhdxLogicalSectorSize:
+		case vhdxPage83Data, vhdxPhysicalSectorSize:
+			continue
+		default:
+			if binary.LittleEndian.Uint32(entry[24:28])&(1<<2) != 0 {
+				return fmt.Errorf("VHDX requires unknown metadata item %x", guid)
+			}
+			continue
+		}
+		item := make([]byte, binary.LittleEndian.Uint32(entry[20:24]))
+		if len(item) < 4 || len(item) > 8 {
+			return fmt.Errorf("VHDX metadata item %x has invalid length %d", guid, len(item))
+		}
+		if _, err := v.file.ReadAt(item, offset+int64(binary.LittleEndian.Uint32(entry[16:20]))); err != nil {
+			return fmt.Errorf("reading VHDX metadata: %w", err)
+		}
+		items[guid] = item
+	}
+	parameters, size, sectorSize := items[vhdxFileParameters], items[vhdxVirtualDiskSize], items[vhdxLogicalSectorSize]
+	if len(parameters) != 8 || len(size) != 8 || len(sectorSize) != 4 {
+		return errors.New("VHDX metadata is incomplete")
+	}
+	if binary.LittleEndian.Uint32(parameters[4:8])&vhdxHasParent != 0 {
+		return errors.New("differencing VHDX images are not supported")
+	}
+	v.blockSize = int64(binary.LittleEndian.Uint32(parameters[0:4]))
+	v.size = int64(binary.LittleEndian.Uint64(size))
+	logicalSectorSize := int64(binary.LittleEndian.Uint32(sectorSize))
+	if v.blockSize < 1<<20 || v.blockSize > 256<<20 || v.blockSize&(v.blockSize-1) != 0 {
+		return fmt.Errorf("invalid VHDX block size %d", v.blockSize)
+	}
+	if logicalSectorSize != 512 && logicalSectorSize != 4096 {
+		return fmt.Errorf("invalid VHDX logical sector size %d", logicalSectorSize)
+	}
+	v.chunkRatio = (1 << 23) * logicalSectorSize / v.blockSize
+	return nil
+}
+
+// Size returns the virtual size of the disk.
+func (v *VHDX) Size() int64 {
+	return v.size
+}
+
+// SectorSize returns 0, since the logical sector size of the VHDX need not match the one of the DDI.
+func (v *VHDX) SectorSize() int64 {
+	return 0
+}
+
+func (v *VHDX) Close() error {
+	return v.file.Close()
+}
+
+func (v *VHDX) ReadAt(p []byte, off int64) (int, error) {
+	return v.do(p, off, false)
+}
+
+func (v *VHDX) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > v.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of the VHDX of %d bytes", len(p), off, v.size)
+	}
+	return v.do(p, off, true)
+}
+
+func (v *VHDX) do(p []byte, off int64, write bool) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), v.size-off))
+	for done := 0; done < n; {
+		pos := off + int64(done)
+		block, inBlock := pos/v.blockSize, pos%v.blockSize
+		chunk := p[done : done+int(min(v.blockSize-inBlock, int64(n-done)))]
+		if err := v.doBlock(block, inBlock, chunk, write); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *VHDX) doBlock(block, inBlock int64, p []byte, write bool) error {
+	index := block + block/v.chunkRatio // a sector bitmap entry follows every chunk
+	v.mu.Lock()
+	if write {
+		if err := v.updateHeader(); err != nil {
+			v.mu.Unlock()
+			return err
+		}
+	}
+	entry := v.bat[index]
+	switch entry & vhdxStateMask {
+	case vhdxBlockFullyPresent:
+	case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero, vhdxBlockUnmapped:
+		if !write {
+			v.mu.Unlock()
+			clear(p)
+			return nil
+		}
+		var err error
+		if entry, err = v.allocate(index); err != nil {
+			v.mu.Unlock()
+			return err
+		}
+	default:
+		v.mu.Unlock()
+		return fmt.Errorf("VHDX block %d has invalid state %d", block, entry&vhdxStateMask)
+	}
+	v.mu.Unlock()
+	offset := int64(entry>>20)<<20 + inBlock
+	var err error
+	if write {
+		_, err = v.file.WriteAt(p, offset)
+	} else {
+		_, err = v.file.ReadAt(p, offset)
+	}
+	if err != nil {
+		return fmt.Errorf("accessing VHDX block %d: %w", block, err)
+	}
+	return nil
+}
+
+// allocate extends the file by a zeroed block and points the BAT entry at it.
+func (v *VHDX) allocate(index int64) (uint64, error) {
+	start := v.end
+	if err := v.file.Truncate(start + v.blockSize); err != nil {
+		return 0, fmt.Errorf("allocating VHDX block: %w", err)
+	}
+	entry := uint64(start>>20)<<20 | vhdxBlockFullyPresent
+	if _, err := v.file.WriteAt(binary.LittleEndian.AppendUint64(nil, entry), v.batOffset+index*8); err != nil {
+		return 0, fmt.Errorf("writing VHDX block allocation table: %w", err)
+	}
+	v.end = start + v.blockSize
+	v.bat[index] = entry
+	return entry, nil
+}
+
+// updateHeader marks the image as modified before its first write by writing a header with
+// new file and data write GUIDs and the next sequence number into the other header slot.
+func (v *VHDX) updateHeader() error {
+	if v.modified {
+		return nil
+	}
+	header := bytes.Clone(v.header)
+	binary.LittleEndian.PutUint64(header[8:16], binary.LittleEndian.Uint64(header[8:16])+1)
+	if _, err := rand.Read(header[16:48]); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(header[4:8], 0)
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(header, crc32c))
+	slot := 1 - v.headerSlot
+	if _, err := v.file.WriteAt(header, int64(vhdxHeaderOffset*(slot+1))); err != nil {
+		return fmt.Errorf("writing VHDX header: %w", err)
+	}
+	if err := v.file.Sync(); err != nil {
+		return fmt.Errorf("writing VHDX header: %w", err)
+	}
+	v.header, v.headerSlot, v.modified = header, slot, true
+	return nil
+}
+
+// CreateVHDX creates a dynamic VHDX for a disk of the given size, rounded up to 1 MiB, with 512 byte logical
+// sectors and 32 MiB blocks. The layout follows Hyper-V: headers and region tables in the first MiB,
+// followed by the (empty) log, the metadata region and the BAT, each 1 MiB aligned.
+func CreateVHDX(path string, size int64) (*VHDX, error) {
+	size = alignUp(size, vhdxAlignment)
+	const (
+		logOffset      = 1 << 20
+		logLength      = 1 << 20
+		metadataOffset = 2 << 20
+		metadataLength = 1 << 20
+		batOffset      = 3 << 20
+		sectorSize     = 512
+	)
+	chunkRatio := int64((1 << 23) * sectorSize / vhdxBlockSize)
+	blocks := (size + vhdxBlockSize - 1) / vhdxBlockSize
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / chunkRatio
+	}
+	batLength := alignUp(max(entries*8, 1), vhdxAlignment)
+
+	content := make([]byte, batOffset)
+	copy(content, vhdxSignature)
+	for i, c := range utf16.Encode([]rune("ddi-tool")) {
+		binary.LittleEndian.PutUint16(content[8+i*2:], c)
+	}
+
+	header := make([]byte, vhdxHeaderSize)
+	copy(header[0:4], vhdxHeaderSignature)
+	if _, err := rand.Read(header[16:48]); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint16(header[66:68], 1)
+	binary.LittleEndian.PutUint32(header[68:72], logLength)
+	binary.LittleEndian.PutUint64(header[72:80], logOffset)
+	for slot := 0; slot < 2; slot++ {
+		binary.LittleEndian.PutUint64(header[8:16], uint64(slot))
+		binary.LittleEndian.PutUint32(header[4:8], 0)
+		binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(header, crc32c))
+		copy(content[vhdxHeaderOffset*(slot+1):], header)
+	}
+
+	regions := make([]byte, vhdxRegionSize)
+	copy(regions[0:4], vhdxRegionSignature)
+	binary.LittleEndian.PutUint32(regions[8:12], 2)
+	for i, region := range []struct {
+		guid           [16]byte
+		offset, length int64
+	}{
+		{vhdxBATRegion, batOffset, batLength},
+		{vhdxMetadataRegion, metadataOffset, metadataLength},
+	} {
+		entry := regions[16+i*32:]
+		copy(entry[0:16], region.guid[:])
+		binary.LittleEndian.PutUint64(entry[16:24], uint64(region.offset))
+		binary.LittleEndian.PutUint32(entry[24:28], uint32(region.length))
+		binary.LittleEndian.PutUint32(entry[28:32], 1) // required
+	}
+	binary.LittleEndian.PutUint32(regions[4:8], crc32.Checksum(regions, crc32c))
+	copy(content[vhdxRegionOffset:], regions)
+	copy(content[vhdxRegionOffset+vhdxRegionSize:], regions)
+
+	metadata := content[metadataOffset:]
+	copy(metadata[0:8], vhdxMetaSignature)
+	page83 := make([]byte, 16)
+	if _, err := rand.Read(page83); err != nil {
+		return nil, err
+	}
+	itemOffset := uint32(vhdxMetaTableSize)
+	for i, item := range []struct {
+		guid  [16]byte
+		data  []byte
+		flags uint32
+	}{
+		{vhdxFileParameters, binary.LittleEndian.AppendUint64(nil, vhdxBlockSize), 1 << 2},
+		{vhdxVirtualDiskSize, binary.LittleEndian.AppendUint64(nil, uint64(size)), 1<<1 | 1<<2},
+		{vhdxPage83Data, page83, 1<<1 | 1<<2},
+		{vhdxLogicalSectorSize, binary.LittleEndian.AppendUint32(nil, sectorSize), 1<<1 | 1<<2},
+		{vhdxPhysicalSectorSize, binary.LittleEndian.AppendUint32(nil, 4096), 1<<1 | 1<<2},
+	} {
+		entry := metadata[32+i*32:]
+		copy(entry[0:16], item.guid[:])
+		binary.LittleEndian.PutUint32(entry[16:20], itemOffset)
+		binary.LittleEndian.PutUint32(entry[20:24], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(entry[24:28], item.flags)
+		copy(metadata[itemOffset:], item.data)
+		binary.LittleEndian.PutUint16(metadata[10:12], uint16(i+1))
+		itemOffset += uint32(len(item.data))
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteAt(content, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(batOffset + batLength); err != nil {
+		file.Close()
+		return nil, err
+	}
+	v, err := OpenVHDX(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// validVHDXChecksum checks the CRC-32C of a header or region table, stored at offset 4.
+func validVHDXChecksum(raw []byte) bool {
+	checksum := binary.LittleEndian.Uint32(raw[4:8])
+	zeroed := bytes.Clone(raw)
+	binary.LittleEndian.PutUint32(zeroed[4:8], 0)
+	return crc32.Checksum(zeroed, crc32c) == checksum
+}
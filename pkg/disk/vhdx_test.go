@@ -0,0 +1,97 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVHDX(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.vhdx")
+	v, err := CreateVHDX(path, 40<<20+1)
+	require.NoError(err)
+	assert.Equal(int64(41<<20), v.Size())
+
+	got := make([]byte, 4096)
+	_, err = v.ReadAt(got, 33<<20)
+	require.NoError(err)
+	assert.Equal(make([]byte, 4096), got)
+
+	pattern := bytes.Repeat([]byte("vhdx "), 1000)
+	_, err = v.WriteAt(pattern, 32<<20-2000) // spans two blocks
+	require.NoError(err)
+	_, err = v.WriteAt([]byte("x"), 41<<20)
+	assert.Error(err)
+	require.NoError(v.Close())
+
+	d, err := Open(path)
+	require.NoError(err)
+	defer d.Close()
+	require.IsType(&VHDX{}, d)
+	assert.Equal(int64(41<<20), d.Size())
+	assert.Equal(uint64(2), binary.LittleEndian.Uint64(d.(*VHDX).header[8:16])) // the write bumped the sequence number
+	got = make([]byte, len(pattern)+2)
+	_, err = d.ReadAt(got, 32<<20-2001)
+	require.NoError(err)
+	assert.Equal(append(append([]byte{0}, pattern...), 0), got)
+
+	info, err := os.Stat(path)
+	require.NoError(err)
+	assert.Equal(int64(4<<20+2*vhdxBlockSize), info.Size())
+}
+
+func TestVHDXLog(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "image.vhdx")
+	v, err := CreateVHDX(path, 1<<20)
+	require.NoError(err)
+	header := bytes.Clone(v.header)
+	require.NoError(v.Close())
+
+	// a newer header with a log GUID
+	binary.LittleEndian.PutUint64(header[8:16], 5)
+	copy(header[48:64], "pending log data")
+	binary.LittleEndian.PutUint32(header[4:8], 0)
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(header, crc32c))
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = file.WriteAt(header, vhdxHeaderOffset)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	_, err = Open(path)
+	require.Error(err)
+	assert.Contains(t, err.Error(), "log has to be replayed")
+}
+
+func TestVHDXGUIDs(t *testing.T) {
+	for want, guid := range map[string][16]byte{
+		"2DC27766-F623-4200-9D64-115E9BFD4A08": vhdxBATRegion,
+		"8B7CA206-4790-4B9A-B8FE-575F050F886E": vhdxMetadataRegion,
+		"CAA16737-FA36-4D43-B3B6-33F0AA44E76B": vhdxFileParameters,
+		"2FA54224-CD1B-4876-B211-5DBED83BF4B8": vhdxVirtualDiskSize,
+		"BECA12AB-B2E6-4523-93EF-C309E000C746": vhdxPage83Data,
+		"8141BF1D-A96F-4709-BA47-F233A8FAAB5F": vhdxLogicalSectorSize,
+		"CDA348C7-445D-4471-9CC9-E9885251C556": vhdxPhysicalSectorSize,
+	} {
+		got := fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+			binary.LittleEndian.Uint32(guid[0:4]),
+			binary.LittleEndian.Uint16(guid[4:6]),
+			binary.LittleEndian.Uint16(guid[6:8]),
+			guid[8:10],
+			guid[10:16],
+		)
+		assert.Equal(t, want, got)
+	}
+}
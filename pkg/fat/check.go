@@ -0,0 +1,359 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+)
+
+// Problem is an inconsistency of the filesystem found by Check.
+type Problem struct {
+	// Path is the file or directory affected by the problem (empty for filesystem wide problems).
+	Path     string
+	Message  string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Check validates the consistency of the filesystem: it compares the FAT copies, follows the cluster
+// chains of all files and directories looking for invalid, cross-linked and lost clusters, compares
+// file sizes with chain lengths, checks long filename entries against their short entries and
+// validates the free cluster count of the FSInfo sector.
+// With repair set, simple problems are fixed: FAT copies are synchronized from the first FAT,
+// broken chains are truncated, file sizes adjusted, orphaned long filename entries deleted,
+// lost clusters freed and the FSInfo free count corrected.
+func (fs *FileSystem) Check(repair bool) ([]Problem, error) {
+	c := &checker{
+		fs:     fs,
+		repair: repair,
+		owner:  make(map[uint32]string),
+	}
+	if err := c.checkFATCopies(); err != nil {
+		return nil, err
+	}
+	root, err := fs.readDir(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading root directory: %w", err)
+	}
+	if root.clusters != nil {
+		for _, cluster := range root.clusters {
+			c.owner[cluster] = "/"
+		}
+	}
+	if err := c.checkDir("/", root); err != nil {
+		return nil, err
+	}
+	if err := c.checkLostClusters(); err != nil {
+		return nil, err
+	}
+	if err := c.checkFSInfo(); err != nil {
+		return nil, err
+	}
+	return c.problems, nil
+}
+
+type checker struct {
+	fs       *FileSystem
+	repair   bool
+	owner    map[uint32]string
+	problems []Problem
+}
+
+func (c *checker) report(path, message string, repaired bool) {
+	c.problems = append(c.problems, Problem{Path: path, Message: message, Repaired: repaired})
+}
+
+// fatEntry decodes entry cluster of a raw FAT.
+func (fs *FileSystem) fatEntry(raw []byte, cluster uint32) uint32 {
+	switch fs.typ {
+	case FAT12:
+		value := uint32(binary.LittleEndian.Uint16(raw[cluster+cluster/2:]))
+		if cluster%2 == 1 {
+			return value >> 4
+		}
+		return value & 0xFFF
+	case FAT16:
+		return uint32(binary.LittleEndian.Uint16(raw[cluster*2:]))
+	}
+	return binary.LittleEndian.Uint32(raw[cluster*4:]) & 0x0FFFFFFF
+}
+
+func (fs *FileSystem) readFATCopy(n int64) ([]byte, error) {
+	raw := make([]byte, fs.fatSectors*fs.bytesPerSector)
+	if _, err := fs.r.ReadAt(raw, (fs.reservedSectors+n*fs.fatSectors)*fs.bytesPerSector); err != nil {
+		return nil, fmt.Errorf("reading FAT %d: %w", n+1, err)
+	}
+	return raw, nil
+}
+
+func (c *checker) checkFATCopies() error {
+	first, err := c.fs.readFATCopy(0)
+	if err != nil {
+		return err
+	}
+	for n := int64(1); n < c.fs.numFATs; n++ {
+		other, err := c.fs.readFATCopy(n)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(first, other) {
+			continue
+		}
+		var differing int
+		for cluster := uint32(0); cluster < c.fs.clusterCount+firstDataCluster; cluster++ {
+			if c.fs.fatEntry(first, cluster) != c.fs.fatEntry(other, cluster) {
+				differing++
+			}
+		}
+		if c.repair {
+			if err := c.fs.writeAt(first, (c.fs.reservedSectors+n*c.fs.fatSectors)*c.fs.bytesPerSector); err != nil {
+				return fmt.Errorf("writing FAT %d: %w", n+1, err)
+			}
+		}
+		c.report("", fmt.Sprintf("FAT %d differs from FAT 1 in %d entries", n+1, differing), c.repair)
+	}
+	return nil
+}
+
+// checkChain follows the chain of an entry and returns the valid prefix of the chain.
+// The chain ends early at invalid, bad, looping or cross-linked clusters.
+func (c *checker) checkChain(p string, first uint32) ([]uint32, string, error) {
+	clusters, problem, err := c.followChain(first)
+	for _, cluster := range clusters {
+		c.owner[cluster] = p
+	}
+	return clusters, problem, err
+}
+
+func (c *checker) followChain(first uint32) ([]uint32, string, error) {
+	var clusters []uint32
+	seen := make(map[uint32]bool)
+	for cluster := first; cluster != 0; {
+		switch {
+		case !c.fs.validCluster(cluster):
+			return clusters, fmt.Sprintf("cluster chain references invalid cluster %d", cluster), nil
+		case seen[cluster]:
+			return clusters, fmt.Sprintf("cluster chain loops at cluster %d", cluster), nil
+		case c.owner[cluster] != "":
+			return clusters, fmt.Sprintf("cluster %d is cross-linked with %s", cluster, c.owner[cluster]), nil
+		}
+		next, err := c.fs.next(cluster)
+		if err != nil {
+			return nil, "", err
+		}
+		if next == 0 {
+			return clusters, fmt.Sprintf("cluster chain references free cluster %d", cluster), nil
+		}
+		if next == c.fs.typ.badCluster() {
+			return clusters, fmt.Sprintf("cluster chain references bad cluster %d", cluster), nil
+		}
+		seen[cluster] = true
+		clusters = append(clusters, cluster)
+		if next > c.fs.typ.badCluster() {
+			return clusters, "", nil
+		}
+		cluster = next
+	}
+	return clusters, "", nil
+}
+
+func (c *checker) checkDir(dirPath string, dir *directory) error {
+	for _, slot := range orphanedLFNSlots(dir.raw) {
+		repaired := false
+		if c.repair {
+			if err := c.fs.writeSlots(dir, slot, []byte{entryDeleted}); err != nil {
+				return err
+			}
+			repaired = true
+		}
+		c.report(dirPath, fmt.Sprintf("long filename entry in slot %d does not belong to a short entry", slot), repaired)
+	}
+	for _, entry := range dir.entries {
+		p := path.Join(dirPath, entry.name)
+		clusters, problem, err := c.checkChain(p, entry.firstCluster)
+		if err != nil {
+			return err
+		}
+		size := entry.size
+		if problem != "" {
+			if c.repair {
+				if err := c.truncateChain(dir, entry, clusters); err != nil {
+					return err
+				}
+			}
+			c.report(p, problem, c.repair)
+		}
+		if entry.isDir() {
+			if len(clusters) == 0 {
+				c.report(p, "directory has no clusters", false)
+				continue
+			}
+			if size != 0 {
+				c.report(p, fmt.Sprintf("directory has size %d", size), c.repair)
+				if c.repair {
+					if err := c.setSize(dir, entry, 0); err != nil {
+						return err
+					}
+				}
+			}
+			child, err := c.fs.readDir(clusters[0])
+			if err != nil {
+				c.report(p, fmt.Sprintf("reading directory: %v", err), false)
+				continue
+			}
+			if err := c.checkDir(p, child); err != nil {
+				return err
+			}
+			continue
+		}
+		need := c.fs.clustersFor(int64(size))
+		switch {
+		case len(clusters) > need:
+			if c.repair {
+				if err := c.truncateChain(dir, entry, clusters[:need]); err != nil {
+					return err
+				}
+				if err := c.fs.free(clusters[need:]); err != nil {
+					return err
+				}
+				for _, cluster := range clusters[need:] {
+					delete(c.owner, cluster)
+				}
+			}
+			c.report(p, fmt.Sprintf("file of %d bytes has %d clusters instead of %d", size, len(clusters), need), c.repair)
+		case len(clusters) < need:
+			chainSize := uint32(int64(len(clusters)) * c.fs.ClusterSize())
+			if c.repair {
+				if err := c.setSize(dir, entry, chainSize); err != nil {
+					return err
+				}
+			}
+			c.report(p, fmt.Sprintf("file size %d exceeds cluster chain of %d bytes", size, chainSize), c.repair)
+		}
+	}
+	return nil
+}
+
+// truncateChain ends the chain of the entry after clusters. An empty chain releases the entry's first cluster.
+// Clusters after the new end are left for checkLostClusters.
+func (c *checker) truncateChain(dir *directory, entry dirEntry, clusters []uint32) error {
+	if len(clusters) > 0 {
+		return c.fs.setFAT(clusters[len(clusters)-1], c.fs.endOfChain())
+	}
+	raw := append([]byte(nil), dir.raw[entry.index*dirEntrySize:(entry.index+1)*dirEntrySize]...)
+	binary.LittleEndian.PutUint16(raw[20:22], 0)
+	binary.LittleEndian.PutUint16(raw[26:28], 0)
+	binary.LittleEndian.PutUint32(raw[28:32], 0)
+	return c.fs.writeSlots(dir, entry.index, raw)
+}
+
+func (c *checker) setSize(dir *directory, entry dirEntry, size uint32) error {
+	raw := append([]byte(nil), dir.raw[entry.index*dirEntrySize:(entry.index+1)*dirEntrySize]...)
+	binary.LittleEndian.PutUint32(raw[28:32], size)
+	return c.fs.writeSlots(dir, entry.index, raw)
+}
+
+// checkLostClusters reports allocated clusters that belong to no file or directory.
+func (c *checker) checkLostClusters() error {
+	var lost []uint32
+	for cluster := uint32(firstDataCluster); c.fs.validCluster(cluster); cluster++ {
+		value, err := c.fs.next(cluster)
+		if err != nil {
+			return err
+		}
+		if value != 0 && value != c.fs.typ.badCluster() && c.owner[cluster] == "" {
+			lost = append(lost, cluster)
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	if c.repair {
+		for _, cluster := range lost {
+			if err := c.fs.setFAT(cluster, 0); err != nil {
+				return err
+			}
+		}
+	}
+	c.report("", fmt.Sprintf("%d clusters are allocated but not used by any file", len(lost)), c.repair)
+	return nil
+}
+
+func (c *checker) checkFSInfo() error {
+	info, err := c.fs.readFSInfo()
+	if err != nil || info.freeCount == fsInfoUnknown {
+		return nil
+	}
+	var free uint32
+	for cluster := uint32(firstDataCluster); c.fs.validCluster(cluster); cluster++ {
+		value, err := c.fs.next(cluster)
+		if err != nil {
+			return err
+		}
+		if value == 0 {
+			free++
+		}
+	}
+	if info.freeCount == free {
+		return nil
+	}
+	if c.repair {
+		if err := c.fs.writeAt(binary.LittleEndian.AppendUint32(nil, free), c.fs.fsInfoOffset+488); err != nil {
+			return fmt.Errorf("writing FSInfo sector: %w", err)
+		}
+	}
+	c.report("", fmt.Sprintf("FSInfo free cluster count is %d, but %d clusters are free", info.freeCount, free), c.repair)
+	return nil
+}
+
+// orphanedLFNSlots returns the slots of long filename entries that are not part of a complete
+// sequence followed by a short entry with matching checksum.
+func orphanedLFNSlots(raw []byte) []int {
+	var orphaned, pending []int
+	var checksum byte
+	var next int
+	for slot := 0; (slot+1)*dirEntrySize <= len(raw); slot++ {
+		buf := raw[slot*dirEntrySize : (slot+1)*dirEntrySize]
+		if buf[0] == entryFree {
+			break
+		}
+		if buf[0] == entryDeleted {
+			orphaned, pending = append(orphaned, pending...), nil
+			continue
+		}
+		if buf[11]&attrLongName != attrLongName {
+			var short [11]byte
+			copy(short[:], buf[0:11])
+			if len(pending) > 0 && (next != 0 || checksum != shortNameChecksum(short)) {
+				orphaned = append(orphaned, pending...)
+			}
+			pending = nil
+			continue
+		}
+		order := int(buf[0])
+		if order&lfnLast != 0 {
+			orphaned = append(orphaned, pending...)
+			pending, checksum, next = []int{slot}, buf[13], order&^lfnLast-1
+			continue
+		}
+		if len(pending) == 0 || order != next || buf[13] != checksum || next == 0 {
+			orphaned, pending = append(orphaned, pending...), nil
+			orphaned = append(orphaned, slot)
+			continue
+		}
+		pending = append(pending, slot)
+		next--
+	}
+	return append(orphaned, pending...)
+}
@@ -0,0 +1,137 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := map[string]struct {
+		corrupt      func(img *testFS, fs *FileSystem)
+		wantProblems []string
+	}{
+		"clean": {
+			corrupt: func(*testFS, *FileSystem) {},
+		},
+		"differing FAT copies": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				second := (fs.reservedSectors + fs.fatSectors) * fs.bytesPerSector
+				img.testImage[second+100] ^= 0xFF
+			},
+			wantProblems: []string{"FAT 2 differs from FAT 1 in 1 entries"},
+		},
+		"file larger than chain": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				setTestSize(t, fs, "/EFI/BOOT/BOOTX64.EFI", 5000)
+			},
+			wantProblems: []string{"/EFI/BOOT/BOOTX64.EFI: file size 5000 exceeds cluster chain of 2048 bytes"},
+		},
+		"chain longer than file": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				setTestSize(t, fs, "/EFI/BOOT/BOOTX64.EFI", 10)
+			},
+			wantProblems: []string{"/EFI/BOOT/BOOTX64.EFI: file of 10 bytes has 4 clusters instead of 1"},
+		},
+		"cross-linked chains": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				uki := testChain(t, fs, "/EFI/BOOT/BOOTX64.EFI")
+				conf := testChain(t, fs, "/loader/loader.conf")
+				img.setFAT(conf[0], uki[2])
+			},
+			wantProblems: []string{
+				"is cross-linked with /EFI/BOOT/BOOTX64.EFI",
+			},
+		},
+		"lost clusters": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				img.setChain(100, 101)
+			},
+			wantProblems: []string{
+				"2 clusters are allocated but not used by any file",
+				"FSInfo free cluster count is 453, but 451 clusters are free",
+			},
+		},
+		"orphaned long filename entry": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				parent, _, err := fs.lookupParent("/loader/entries/ubuntu-generic.conf")
+				require.NoError(t, err)
+				entry, _ := parent.find("ubuntu-generic.conf")
+				// corrupt the checksum of the first long filename entry
+				raw := append([]byte(nil), parent.raw[(entry.index-1)*dirEntrySize:entry.index*dirEntrySize]...)
+				raw[13]++
+				require.NoError(t, fs.writeSlots(parent, entry.index-1, raw))
+			},
+			wantProblems: []string{
+				"/loader/entries: long filename entry in slot 2 does not belong to a short entry",
+				"/loader/entries: long filename entry in slot 3 does not belong to a short entry",
+			},
+		},
+		"wrong free count": {
+			corrupt: func(img *testFS, fs *FileSystem) {
+				require.NoError(t, fs.updateFSInfo(-7))
+			},
+			wantProblems: []string{"FSInfo free cluster count is"},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			img := newTestFS(FAT32)
+			fs, err := Open(img, int64(len(img.testImage)))
+			require.NoError(err)
+			require.NoError(fs.MkdirAll("/EFI/BOOT"))
+			require.NoError(fs.MkdirAll("/loader/entries"))
+			require.NoError(fs.WriteFile("/EFI/BOOT/BOOTX64.EFI", bytes.Repeat([]byte("uki"), 600)))
+			require.NoError(fs.WriteFile("/loader/loader.conf", []byte("timeout 3\n")))
+			require.NoError(fs.WriteFile("/loader/entries/ubuntu-generic.conf", []byte("title Ubuntu\n")))
+			problems, err := fs.Check(false)
+			require.NoError(err)
+			require.Empty(problems)
+
+			tc.corrupt(img, fs)
+			fs, err = Open(img, int64(len(img.testImage)))
+			require.NoError(err)
+			problems, err = fs.Check(false)
+			require.NoError(err)
+			require.Len(problems, len(tc.wantProblems), "%v", problems)
+			for i, want := range tc.wantProblems {
+				assert.Contains(problems[i].String(), want)
+				assert.False(problems[i].Repaired)
+			}
+
+			// repairing one problem may resolve others (freeing lost clusters fixes the free count)
+			problems, err = fs.Check(true)
+			require.NoError(err)
+			assert.Equal(len(tc.wantProblems) == 0, len(problems) == 0)
+			for _, problem := range problems {
+				assert.True(problem.Repaired, problem.String())
+			}
+			problems, err = fs.Check(false)
+			require.NoError(err)
+			assert.Empty(problems)
+		})
+	}
+}
+
+func testChain(t *testing.T, fs *FileSystem, path string) []uint32 {
+	entry, err := fs.lookup(path)
+	require.NoError(t, err)
+	clusters, err := fs.chain(entry.firstCluster)
+	require.NoError(t, err)
+	return clusters
+}
+
+func setTestSize(t *testing.T, fs *FileSystem, path string, size uint32) {
+	parent, name, err := fs.lookupParent(path)
+	require.NoError(t, err)
+	entry, _ := parent.find(name)
+	raw := append([]byte(nil), parent.raw[entry.index*dirEntrySize:(entry.index+1)*dirEntrySize]...)
+	binary.LittleEndian.PutUint32(raw[28:32], size)
+	require.NoError(t, fs.writeSlots(parent, entry.index, raw))
+}
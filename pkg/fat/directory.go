@@ -0,0 +1,277 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	dirEntrySize = 32
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	entryFree    = 0x00
+	entryDeleted = 0xE5
+
+	lfnLast        = 0x40
+	lfnCharsPerEnt = 13
+
+	// flags in the reserved byte (NTRes) of short entries, as written by Windows and Linux
+	ntLowerBase = 0x08
+	ntLowerExt  = 0x10
+)
+
+// dirEntry is a decoded directory entry together with its long filename, if any.
+type dirEntry struct {
+	name         string
+	shortName    [11]byte
+	attr         byte
+	firstCluster uint32
+	size         uint32
+	modTime      time.Time
+	// index is the slot of the short entry within its directory and slots the number of
+	// slots used including the long filename entries.
+	index int
+	slots int
+}
+
+func (e dirEntry) isDir() bool {
+	return e.attr&attrDirectory != 0
+}
+
+// directory is the raw content of a directory together with its location.
+type directory struct {
+	// cluster is the first cluster of the directory, 0 for the root directory of FAT12/16.
+	cluster  uint32
+	clusters []uint32
+	raw      []byte
+	entries  []dirEntry
+}
+
+// readDir returns the directory starting at cluster.
+// Cluster 0 refers to the root directory, which lives outside of the data region on FAT12/16.
+func (fs *FileSystem) readDir(cluster uint32) (*directory, error) {
+	if cluster == 0 && fs.typ != FAT32 {
+		raw := make([]byte, fs.rootEntries*dirEntrySize)
+		if _, err := fs.r.ReadAt(raw, fs.rootOffset); err != nil {
+			return nil, fmt.Errorf("reading root directory: %w", err)
+		}
+		return &directory{raw: raw, entries: parseDir(raw)}, nil
+	}
+	if cluster == 0 {
+		cluster = fs.rootCluster
+	}
+	clusters, err := fs.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := fs.readChain(clusters)
+	if err != nil {
+		return nil, err
+	}
+	return &directory{cluster: cluster, clusters: clusters, raw: raw, entries: parseDir(raw)}, nil
+}
+
+// parseDir decodes the entries of a directory.
+// The dot entries and volume labels are skipped.
+func parseDir(raw []byte) []dirEntry {
+	var entries []dirEntry
+	var lfn []uint16
+	var lfnChecksum byte
+	var lfnNext, lfnSlots int
+	for off := 0; off+dirEntrySize <= len(raw); off += dirEntrySize {
+		buf := raw[off : off+dirEntrySize]
+		switch buf[0] {
+		case entryFree:
+			return entries
+		case entryDeleted:
+			lfn = nil
+			continue
+		}
+		attr := buf[11]
+		if attr&attrLongName == attrLongName {
+			order := int(buf[0])
+			if order&lfnLast != 0 {
+				lfnNext = order &^ lfnLast
+				lfn = make([]uint16, lfnNext*lfnCharsPerEnt)
+				lfnChecksum = buf[13]
+				lfnSlots = 0
+			} else if lfn == nil || order != lfnNext || buf[13] != lfnChecksum {
+				lfn = nil
+				continue
+			}
+			if lfnNext == 0 {
+				lfn = nil
+				continue
+			}
+			putLFNChars(lfn[(lfnNext-1)*lfnCharsPerEnt:], buf)
+			lfnNext--
+			lfnSlots++
+			continue
+		}
+		entry := dirEntry{
+			attr:         attr,
+			firstCluster: uint32(binary.LittleEndian.Uint16(buf[20:22]))<<16 | uint32(binary.LittleEndian.Uint16(buf[26:28])),
+			size:         binary.LittleEndian.Uint32(buf[28:32]),
+			modTime:      decodeTime(binary.LittleEndian.Uint16(buf[24:26]), binary.LittleEndian.Uint16(buf[22:24])),
+			index:        off / dirEntrySize,
+			slots:        1,
+		}
+		copy(entry.shortName[:], buf[0:11])
+		if lfn != nil && lfnNext == 0 && lfnChecksum == shortNameChecksum(entry.shortName) {
+			entry.name = decodeLFN(lfn)
+			entry.slots += lfnSlots
+		} else {
+			entry.name = decodeShortName(entry.shortName, buf[12])
+		}
+		lfn = nil
+		if attr&attrVolumeID != 0 || entry.name == "." || entry.name == ".." {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// find returns the entry with the given name. Names are compared case-insensitively, like FAT does.
+func (d *directory) find(name string) (dirEntry, bool) {
+	for _, e := range d.entries {
+		if strings.EqualFold(e.name, name) || strings.EqualFold(decodeShortName(e.shortName, 0), name) {
+			return e, true
+		}
+	}
+	return dirEntry{}, false
+}
+
+// lfnCharRanges are the byte ranges of a long filename entry holding its 13 UCS-2 characters.
+var lfnCharRanges = [][2]int{{1, 11}, {14, 26}, {28, 32}}
+
+// putLFNChars copies the 13 UCS-2 characters of a long filename entry into dst.
+func putLFNChars(dst []uint16, buf []byte) {
+	var i int
+	for _, r := range lfnCharRanges {
+		for off := r[0]; off < r[1]; off += 2 {
+			dst[i] = binary.LittleEndian.Uint16(buf[off : off+2])
+			i++
+		}
+	}
+}
+
+func decodeLFN(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0x0000 || c == 0xFFFF {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+func decodeShortName(name [11]byte, ntFlags byte) string {
+	if name[0] == 0x05 {
+		name[0] = entryDeleted
+	}
+	base := strings.TrimRight(string(name[0:8]), " ")
+	ext := strings.TrimRight(string(name[8:11]), " ")
+	if ntFlags&ntLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if ntFlags&ntLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// decodeTime converts a FAT date and time. Timestamps are interpreted as UTC.
+func decodeTime(date, t uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xF), int(date&0x1F),
+		int(t>>11), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.UTC)
+}
+
+// encodeTime converts t into a FAT date and time (with two second resolution).
+func encodeTime(t time.Time) (date, tm uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+// shortNameChecksum is the checksum of a short name stored in its long filename entries.
+func shortNameChecksum(name [11]byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// lookup resolves an absolute or relative path starting at the root directory.
+func (fs *FileSystem) lookup(path string) (dirEntry, error) {
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	if name == "" {
+		return dirEntry{attr: attrDirectory}, nil
+	}
+	entry, ok := parent.find(name)
+	if !ok {
+		return dirEntry{}, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return entry, nil
+}
+
+// lookupParent returns the directory containing path and the last component of path.
+// The name is empty for the root directory.
+func (fs *FileSystem) lookupParent(path string) (*directory, string, error) {
+	components := splitPath(path)
+	dir, err := fs.readDir(0)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading root directory: %w", err)
+	}
+	if len(components) == 0 {
+		return dir, "", nil
+	}
+	for _, component := range components[:len(components)-1] {
+		entry, ok := dir.find(component)
+		if !ok {
+			return nil, "", fmt.Errorf("%s: %w", path, os.ErrNotExist)
+		}
+		if !entry.isDir() {
+			return nil, "", fmt.Errorf("%s: %s is not a directory", path, entry.name)
+		}
+		if dir, err = fs.readDir(entry.firstCluster); err != nil {
+			return nil, "", fmt.Errorf("reading directory %s: %w", entry.name, err)
+		}
+	}
+	return dir, components[len(components)-1], nil
+}
+
+func splitPath(path string) []string {
+	var components []string
+	for _, component := range strings.Split(path, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	return components
+}
@@ -0,0 +1,87 @@
+package fat
+
+import (
+	"errors"
+	"io"
+)
+
+// Extent is a contiguous byte range of a file.
+type Extent struct {
+	Offset int64
+	Size   int64
+}
+
+// ExtentHandle provides scatter/gather access to a file stored in a list of extents.
+// Offsets passed to ReadAt and WriteAt are relative to the start of the file.
+type ExtentHandle struct {
+	r       io.ReaderAt
+	base    int64
+	extents []Extent
+	size    int64
+}
+
+// NewExtentHandle returns a handle for the file made up of extents, which are relative to base in r.
+// Writes are only possible if r also implements io.WriterAt.
+func NewExtentHandle(r io.ReaderAt, base int64, extents []Extent) *ExtentHandle {
+	var size int64
+	for _, extent := range extents {
+		size += extent.Size
+	}
+	return &ExtentHandle{
+		r:       r,
+		base:    base,
+		extents: extents,
+		size:    size,
+	}
+}
+
+// Size is the size of the file.
+func (h *ExtentHandle) Size() int64 {
+	return h.size
+}
+
+func (h *ExtentHandle) ReadAt(p []byte, off int64) (int, error) {
+	return h.do(p, off, h.r.ReadAt)
+}
+
+func (h *ExtentHandle) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := h.r.(io.WriterAt)
+	if !ok {
+		return 0, errors.New("extent handle is read-only")
+	}
+	return h.do(p, off, w.WriteAt)
+}
+
+// do splits the request at extent boundaries and passes the pieces to op.
+func (h *ExtentHandle) do(p []byte, off int64, op func([]byte, int64) (int, error)) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	var done int
+	var start int64
+	for _, extent := range h.extents {
+		if done == len(p) {
+			break
+		}
+		if off >= start+extent.Size {
+			start += extent.Size
+			continue
+		}
+		within := off - start
+		n := min(int64(len(p)-done), extent.Size-within)
+		written, err := op(p[done:done+int(n)], h.base+extent.Offset+within)
+		done += written
+		if err != nil {
+			return done, err
+		}
+		off += n
+		start += extent.Size
+	}
+	if done < len(p) {
+		return done, io.EOF
+	}
+	return done, nil
+}
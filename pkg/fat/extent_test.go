@@ -0,0 +1,58 @@
+package fat
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtentHandle(t *testing.T) {
+	testCases := map[string]struct {
+		off     int64
+		size    int
+		want    string
+		wantErr error
+	}{
+		"within first extent":  {off: 1, size: 2, want: "bc"},
+		"across extents":       {off: 2, size: 4, want: "cdij"},
+		"across all extents":   {off: 0, size: 8, want: "abcdijxy"},
+		"short read at end":    {off: 6, size: 4, want: "xy", wantErr: io.EOF},
+		"beyond end":           {off: 8, size: 1, want: "", wantErr: io.EOF},
+		"start of last extent": {off: 6, size: 1, want: "x"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			img := testImage("__abcd__ij____xyz")
+			handle := NewExtentHandle(img, 1, []Extent{{Offset: 1, Size: 4}, {Offset: 7, Size: 2}, {Offset: 13, Size: 2}})
+			assert.Equal(int64(8), handle.Size())
+			got := make([]byte, tc.size)
+			n, err := handle.ReadAt(got, tc.off)
+			assert.Equal(tc.wantErr, err)
+			assert.Equal(tc.want, string(got[:n]))
+		})
+	}
+}
+
+func TestExtentHandleWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	img := testImage("__abcd__ij____xyz")
+	handle := NewExtentHandle(img, 0, []Extent{{Offset: 2, Size: 4}, {Offset: 8, Size: 2}, {Offset: 14, Size: 2}})
+	n, err := handle.WriteAt([]byte("DIJX"), 3)
+	assert.NoError(err)
+	assert.Equal(4, n)
+	n, err = handle.WriteAt([]byte("YZ"), 7)
+	assert.Equal(io.EOF, err)
+	assert.Equal(1, n)
+	assert.Equal("__abcD__IJ____XYz", string(img))
+
+	_, err = NewExtentHandle(readOnly{img}, 0, []Extent{{Offset: 0, Size: 1}}).WriteAt([]byte("a"), 0)
+	assert.Error(err)
+}
+
+type readOnly struct {
+	io.ReaderAt
+}
@@ -1,40 +1,368 @@
 package fat
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"time"
+)
+
+const firstDataCluster = 2
+
+// Type is the FAT variant of a filesystem, named after the width of its FAT entries.
+type Type int
 
-	"github.com/diskfs/go-diskfs/filesystem/fat32"
-	"github.com/diskfs/go-diskfs/util"
+const (
+	FAT12 Type = 12
+	FAT16 Type = 16
+	FAT32 Type = 32
 )
 
-type FATReader interface {
-	io.ReaderAt
-	io.Seeker
+func (t Type) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// maxFAT12Clusters is the cluster count at which a filesystem with a FAT16-style BPB becomes FAT16.
+const maxFAT12Clusters = 4085
+
+// badCluster is the FAT entry marking a bad cluster. Entries above it mark the end of a chain.
+func (t Type) badCluster() uint32 {
+	switch t {
+	case FAT12:
+		return 0xFF7
+	case FAT16:
+		return 0xFFF7
+	}
+	return 0x0FFFFFF7
+}
+
+// FileSystem is a FAT filesystem accessed through an io.ReaderAt.
+// Offsets are relative to the start of the filesystem (the start of the partition).
+type FileSystem struct {
+	r    io.ReaderAt
+	size int64
+	typ  Type
+
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	reservedSectors   int64
+	numFATs           int64
+	fatSectors        int64
+	rootCluster       uint32
+	rootOffset        int64
+	rootEntries       int64
+	clusterCount      uint32
+	dataOffset        int64
+	fsInfoOffset      int64
+
+	fatCache map[int64][]byte
+	// nextFree is the cluster where the search for free clusters starts.
+	nextFree uint32
+	// now returns the time used for timestamps of new and modified entries.
+	now func() time.Time
+}
+
+// Open reads the boot sector of the FAT filesystem of the given size in r.
+func Open(r io.ReaderAt, size int64) (*FileSystem, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, fmt.Errorf("reading boot sector: %w", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, errors.New("invalid boot sector signature")
+	}
+	fs := &FileSystem{
+		r:                 r,
+		size:              size,
+		bytesPerSector:    int64(binary.LittleEndian.Uint16(bs[11:13])),
+		sectorsPerCluster: int64(bs[13]),
+		reservedSectors:   int64(binary.LittleEndian.Uint16(bs[14:16])),
+		numFATs:           int64(bs[16]),
+		fatCache:          make(map[int64][]byte),
+		nextFree:          firstDataCluster,
+		now:               time.Now,
+	}
+	switch fs.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid bytes per sector %d", fs.bytesPerSector)
+	}
+	if fs.sectorsPerCluster == 0 || fs.sectorsPerCluster&(fs.sectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster %d", fs.sectorsPerCluster)
+	}
+	if fs.reservedSectors == 0 || fs.numFATs == 0 {
+		return nil, errors.New("invalid boot sector: no reserved sectors or FATs")
+	}
+	fs.rootEntries = int64(binary.LittleEndian.Uint16(bs[17:19]))
+	fs.fatSectors = int64(binary.LittleEndian.Uint16(bs[22:24]))
+	if fs.fatSectors == 0 {
+		// like Linux, treat every BPB without 16 bit FAT size as FAT32, regardless of the cluster count
+		fs.typ = FAT32
+		fs.fatSectors = int64(binary.LittleEndian.Uint32(bs[36:40]))
+		fs.rootCluster = binary.LittleEndian.Uint32(bs[44:48])
+		fs.rootEntries = 0
+		if sector := int64(binary.LittleEndian.Uint16(bs[48:50])); sector != 0 && sector != 0xFFFF && sector < fs.reservedSectors {
+			fs.fsInfoOffset = sector * fs.bytesPerSector
+		}
+	} else if fs.rootEntries == 0 {
+		return nil, errors.New("invalid boot sector: no root directory entries")
+	}
+
+	totalSectors := int64(binary.LittleEndian.Uint16(bs[19:21]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(bs[32:36]))
+	}
+	if totalSectors*fs.bytesPerSector > size {
+		return nil, fmt.Errorf("filesystem of %d bytes does not fit into %d bytes", totalSectors*fs.bytesPerSector, size)
+	}
+	fs.rootOffset = (fs.reservedSectors + fs.numFATs*fs.fatSectors) * fs.bytesPerSector
+	rootSectors := (fs.rootEntries*dirEntrySize + fs.bytesPerSector - 1) / fs.bytesPerSector
+	dataSector := fs.reservedSectors + fs.numFATs*fs.fatSectors + rootSectors
+	if dataSector >= totalSectors {
+		return nil, errors.New("invalid boot sector: no data region")
+	}
+	fs.dataOffset = dataSector * fs.bytesPerSector
+	fs.clusterCount = uint32((totalSectors - dataSector) / fs.sectorsPerCluster)
+	if fs.typ != FAT32 {
+		fs.typ = FAT16
+		if fs.clusterCount < maxFAT12Clusters {
+			fs.typ = FAT12
+		}
+	}
+	if maxClusters := fs.fatSectors * fs.bytesPerSector * 8 / int64(fs.typ); int64(fs.clusterCount)+firstDataCluster > maxClusters {
+		fs.clusterCount = uint32(maxClusters - firstDataCluster)
+	}
+	if fs.typ == FAT32 && !fs.validCluster(fs.rootCluster) {
+		return nil, fmt.Errorf("invalid root directory cluster %d", fs.rootCluster)
+	}
+	if info, err := fs.readFSInfo(); err == nil && fs.validCluster(info.nextFree) {
+		fs.nextFree = info.nextFree
+	}
+	return fs, nil
+}
+
+// Type is the FAT variant of the filesystem.
+func (fs *FileSystem) Type() Type {
+	return fs.typ
+}
+
+// ClusterSize is the size of a cluster in bytes.
+func (fs *FileSystem) ClusterSize() int64 {
+	return fs.bytesPerSector * fs.sectorsPerCluster
+}
+
+func (fs *FileSystem) validCluster(cluster uint32) bool {
+	return cluster >= firstDataCluster && cluster < fs.clusterCount+firstDataCluster
+}
+
+func (fs *FileSystem) clusterOffset(cluster uint32) int64 {
+	return fs.dataOffset + int64(cluster-firstDataCluster)*fs.ClusterSize()
+}
+
+// next returns the FAT entry of the cluster (the following cluster of the chain).
+func (fs *FileSystem) next(cluster uint32) (uint32, error) {
+	switch fs.typ {
+	case FAT12:
+		buf, err := fs.readFAT(int64(cluster)+int64(cluster)/2, 2)
+		if err != nil {
+			return 0, err
+		}
+		value := uint32(binary.LittleEndian.Uint16(buf))
+		if cluster%2 == 1 {
+			return value >> 4, nil
+		}
+		return value & 0xFFF, nil
+	case FAT16:
+		buf, err := fs.readFAT(int64(cluster)*2, 2)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(binary.LittleEndian.Uint16(buf)), nil
+	}
+	buf, err := fs.readFAT(int64(cluster)*4, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf) & 0x0FFFFFFF, nil
+}
+
+// readFAT reads from the first FAT, one sector at a time, caching the sectors read.
+func (fs *FileSystem) readFAT(offset, size int64) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for size > 0 {
+		sector := offset / fs.bytesPerSector
+		buf, ok := fs.fatCache[sector]
+		if !ok {
+			buf = make([]byte, fs.bytesPerSector)
+			if _, err := fs.r.ReadAt(buf, fs.reservedSectors*fs.bytesPerSector+sector*fs.bytesPerSector); err != nil {
+				return nil, fmt.Errorf("reading FAT: %w", err)
+			}
+			fs.fatCache[sector] = buf
+		}
+		start := offset % fs.bytesPerSector
+		n := min(size, fs.bytesPerSector-start)
+		out = append(out, buf[start:start+n]...)
+		offset += n
+		size -= n
+	}
+	return out, nil
+}
+
+// chain follows the cluster chain starting at first.
+func (fs *FileSystem) chain(first uint32) ([]uint32, error) {
+	if first == 0 {
+		return nil, nil
+	}
+	var clusters []uint32
+	for cluster := first; ; {
+		if !fs.validCluster(cluster) {
+			return nil, fmt.Errorf("cluster chain starting at %d references invalid cluster %d", first, cluster)
+		}
+		if uint32(len(clusters)) >= fs.clusterCount {
+			return nil, fmt.Errorf("cluster chain starting at %d contains a loop", first)
+		}
+		clusters = append(clusters, cluster)
+		next, err := fs.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case next > fs.typ.badCluster():
+			return clusters, nil
+		case next == fs.typ.badCluster():
+			return nil, fmt.Errorf("cluster chain starting at %d references bad cluster", first)
+		}
+		cluster = next
+	}
+}
+
+// extents converts a cluster chain into a list of byte ranges, merging adjacent clusters.
+// The last extent is truncated so that the extents cover exactly size bytes.
+func (fs *FileSystem) extents(clusters []uint32, size int64) ([]Extent, error) {
+	if int64(len(clusters))*fs.ClusterSize() < size {
+		return nil, fmt.Errorf("cluster chain of %d bytes is shorter than the file size %d", int64(len(clusters))*fs.ClusterSize(), size)
+	}
+	var extents []Extent
+	for i := 0; i < len(clusters) && size > 0; i++ {
+		length := min(fs.ClusterSize(), size)
+		size -= length
+		if n := len(extents); n > 0 && clusters[i] == clusters[i-1]+1 {
+			extents[n-1].Size += length
+			continue
+		}
+		extents = append(extents, Extent{Offset: fs.clusterOffset(clusters[i]), Size: length})
+	}
+	return extents, nil
+}
+
+// readChain reads the full content of a cluster chain.
+func (fs *FileSystem) readChain(clusters []uint32) ([]byte, error) {
+	extents, err := fs.extents(clusters, int64(len(clusters))*fs.ClusterSize())
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int64(len(clusters))*fs.ClusterSize())
+	if _, err := NewExtentHandle(fs.r, 0, extents).ReadAt(buf, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// FileExtents returns the byte ranges occupied by the file at path, in file order.
+func (fs *FileSystem) FileExtents(path string) ([]Extent, error) {
+	entry, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.isDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	clusters, err := fs.chain(entry.firstCluster)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fs.extents(clusters, int64(entry.size))
 }
 
-func FileContentSection(r FATReader, size, blocksize int64, path string) (int64, int64, error) {
-	var fsFile util.File
-	fsFile = &nopWriter{r}
-	fs, err := fat32.Read(fsFile, size, 0, blocksize)
+// OpenFile returns a handle for reading and writing the content of the file at path.
+// The size of the file cannot be changed through the handle.
+func (fs *FileSystem) OpenFile(path string) (*ExtentHandle, error) {
+	extents, err := fs.FileExtents(path)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	file, err := fs.OpenFile(path, os.O_RDONLY)
+	return NewExtentHandle(fs.r, 0, extents), nil
+}
+
+// ReadFile returns the content of the file at path.
+func (fs *FileSystem) ReadFile(path string) ([]byte, error) {
+	handle, err := fs.OpenFile(path)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	defer file.Close()
-	fat32File := file.(*fat32.File)
+	content := make([]byte, handle.Size())
+	if _, err := handle.ReadAt(content, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return content, nil
+}
 
-	return fat32File.GetContentSection()
+// FileInfo describes a file or directory.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	IsDir   bool
+	ModTime time.Time
 }
 
-type nopWriter struct {
-	FATReader
+func (e dirEntry) info() FileInfo {
+	return FileInfo{
+		Name:    e.name,
+		Size:    int64(e.size),
+		IsDir:   e.isDir(),
+		ModTime: e.modTime,
+	}
+}
+
+// Stat returns information about the file or directory at path.
+func (fs *FileSystem) Stat(path string) (FileInfo, error) {
+	entry, err := fs.lookup(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if entry.name == "" {
+		entry.name = "/"
+	}
+	return entry.info(), nil
 }
 
-func (w *nopWriter) WriteAt(p []byte, off int64) (n int, err error) {
-	return 0, errors.New("reader is read-only")
+// ReadDir returns the entries of the directory at path.
+func (fs *FileSystem) ReadDir(path string) ([]FileInfo, error) {
+	entry, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	dir, err := fs.readDir(entry.firstCluster)
+	if err != nil {
+		return nil, fmt.Errorf("reading directory %s: %w", path, err)
+	}
+	infos := make([]FileInfo, 0, len(dir.entries))
+	for _, e := range dir.entries {
+		infos = append(infos, e.info())
+	}
+	return infos, nil
+}
+
+// FileExtents opens the FAT filesystem of the given size in r and returns the
+// byte ranges occupied by the file at path.
+func FileExtents(r io.ReaderAt, size int64, path string) ([]Extent, error) {
+	fs, err := Open(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileExtents(path)
 }
@@ -0,0 +1,243 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testImage []byte
+
+func (d testImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d testImage) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+const (
+	testSectorSize = 512
+	testReserved   = 32
+)
+
+// testFS is an in-memory FAT filesystem with 512 byte clusters.
+type testFS struct {
+	testImage
+	typ         Type
+	fatSectors  int
+	rootEntries int
+}
+
+// newTestFS creates an empty filesystem of the given type.
+// On FAT32 the root directory is in cluster 2.
+func newTestFS(typ Type) *testFS {
+	fs := &testFS{typ: typ}
+	var totalSectors int
+	switch typ {
+	case FAT12:
+		totalSectors, fs.fatSectors, fs.rootEntries = 512, 2, 64
+	case FAT16:
+		totalSectors, fs.fatSectors, fs.rootEntries = 4400, 18, 512
+	case FAT32:
+		totalSectors, fs.fatSectors = 512, 8
+	}
+	fs.testImage = make(testImage, totalSectors*testSectorSize)
+	bs := fs.testImage[0:testSectorSize]
+	copy(bs[0:3], []byte{0xEB, 0x58, 0x90})
+	copy(bs[3:11], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(bs[11:13], testSectorSize)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:16], testReserved)
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:19], uint16(fs.rootEntries))
+	bs[21] = 0xF8
+	binary.LittleEndian.PutUint32(bs[32:36], uint32(totalSectors))
+	if typ == FAT32 {
+		binary.LittleEndian.PutUint32(bs[36:40], uint32(fs.fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:48], 2)
+		binary.LittleEndian.PutUint16(bs[48:50], 1)
+		copy(bs[82:90], "FAT32   ")
+		info := fs.testImage[testSectorSize : 2*testSectorSize]
+		binary.LittleEndian.PutUint32(info[0:4], fsInfoLeadSignature)
+		binary.LittleEndian.PutUint32(info[484:488], fsInfoStructSignature)
+		binary.LittleEndian.PutUint32(info[488:492], uint32(totalSectors-testReserved-2*fs.fatSectors-1))
+		binary.LittleEndian.PutUint32(info[492:496], 3)
+		binary.LittleEndian.PutUint32(info[508:512], fsInfoTrailSignature)
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:24], uint16(fs.fatSectors))
+		copy(bs[54:62], typ.String()+"   ")
+	}
+	bs[510], bs[511] = 0x55, 0xAA
+	fs.setFAT(0, 0x0FFFFFF8)
+	fs.setFAT(1, 0x0FFFFFFF)
+	if typ == FAT32 {
+		fs.setChain(2)
+	}
+	return fs
+}
+
+func (fs *testFS) setFAT(cluster, value uint32) {
+	for i := 0; i < 2; i++ {
+		fat := fs.testImage[(testReserved+i*fs.fatSectors)*testSectorSize:]
+		switch fs.typ {
+		case FAT12:
+			off := cluster + cluster/2
+			old := binary.LittleEndian.Uint16(fat[off:])
+			if cluster%2 == 1 {
+				binary.LittleEndian.PutUint16(fat[off:], old&0x000F|uint16(value&0xFFF)<<4)
+			} else {
+				binary.LittleEndian.PutUint16(fat[off:], old&0xF000|uint16(value&0xFFF))
+			}
+		case FAT16:
+			binary.LittleEndian.PutUint16(fat[cluster*2:], uint16(value))
+		case FAT32:
+			binary.LittleEndian.PutUint32(fat[cluster*4:], value)
+		}
+	}
+}
+
+func (fs *testFS) setChain(clusters ...uint32) {
+	for i, cluster := range clusters {
+		next := uint32(0x0FFFFFFF)
+		if i+1 < len(clusters) {
+			next = clusters[i+1]
+		}
+		fs.setFAT(cluster, next)
+	}
+}
+
+func (fs *testFS) rootOffset() int64 {
+	return int64(testReserved+2*fs.fatSectors) * testSectorSize
+}
+
+func (fs *testFS) clusterOffset(cluster uint32) int64 {
+	return fs.rootOffset() + int64(fs.rootEntries*dirEntrySize) + int64(cluster-2)*testSectorSize
+}
+
+func (fs *testFS) writeChain(clusters []uint32, data []byte) {
+	fs.setChain(clusters...)
+	for i, cluster := range clusters {
+		chunk := data[min(i*testSectorSize, len(data)):min((i+1)*testSectorSize, len(data))]
+		copy(fs.testImage[fs.clusterOffset(cluster):], chunk)
+	}
+}
+
+// writeRoot writes the entries of the root directory.
+func (fs *testFS) writeRoot(entries []byte) {
+	if fs.typ == FAT32 {
+		fs.writeChain([]uint32{2}, entries)
+		return
+	}
+	copy(fs.testImage[fs.rootOffset():], entries)
+}
+
+// testEntry encodes a short directory entry, preceded by long filename entries if longName is set.
+func testEntry(longName string, shortName string, attr byte, first, size uint32) []byte {
+	var short [11]byte
+	copy(short[:], shortName)
+	entry := shortEntry(short, 0, attr, first, size, 0, 0)
+	if longName == "" {
+		return entry
+	}
+	return append(encodeLFN(longName, short), entry...)
+}
+
+func TestFileExtents(t *testing.T) {
+	for _, typ := range []Type{FAT12, FAT16, FAT32} {
+		t.Run(typ.String(), func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			img := newTestFS(typ)
+			img.writeRoot(testEntry("", "EFI        ", attrDirectory, 3, 0))
+			img.writeChain([]uint32{3}, testEntry("", "BOOT       ", attrDirectory, 4, 0))
+			content := bytes.Repeat([]byte("0123456789abcdef"), 3*testSectorSize/16+10)
+			clusters := []uint32{10, 11, 5, 21}
+			img.writeChain([]uint32{4}, bytes.Join([][]byte{
+				testEntry("", "\xe5ELETED EFI", attrArchive, 30, 10),
+				testEntry("", "BOOTX64 EFI", attrArchive, clusters[0], uint32(len(content))),
+				testEntry("linux-6.1.0.efi", "LINUX-~1EFI", attrArchive, 12, 100),
+			}, nil))
+			img.writeChain(clusters, content)
+			img.setChain(12)
+
+			fs, err := Open(img, int64(len(img.testImage)))
+			require.NoError(err)
+			assert.Equal(typ, fs.Type())
+			extents, err := fs.FileExtents("/efi/boot/bootx64.efi")
+			require.NoError(err)
+			assert.Equal([]Extent{
+				{Offset: img.clusterOffset(10), Size: 2 * testSectorSize},
+				{Offset: img.clusterOffset(5), Size: testSectorSize},
+				{Offset: img.clusterOffset(21), Size: int64(len(content)) - 3*testSectorSize},
+			}, extents)
+
+			handle := NewExtentHandle(img, 0, extents)
+			got := make([]byte, len(content))
+			_, err = handle.ReadAt(got, 0)
+			require.NoError(err)
+			assert.Equal(content, got)
+
+			extents, err = fs.FileExtents("/EFI/BOOT/Linux-6.1.0.efi")
+			require.NoError(err)
+			assert.Equal([]Extent{{Offset: img.clusterOffset(12), Size: 100}}, extents)
+			_, err = fs.FileExtents("/EFI/BOOT/LINUX-~1.EFI")
+			assert.NoError(err)
+
+			_, err = fs.FileExtents("/EFI/BOOT/DELETED.EFI")
+			assert.ErrorIs(err, os.ErrNotExist)
+			_, err = fs.FileExtents("/EFI/BOOT")
+			assert.Error(err)
+
+			// a chain that is too short for the file size
+			img.setChain(10, 11)
+			_, err = FileExtents(img, int64(len(img.testImage)), "/EFI/BOOT/BOOTX64.EFI")
+			assert.Error(err)
+			// a chain that loops
+			img.setFAT(11, 10)
+			_, err = FileExtents(img, int64(len(img.testImage)), "/EFI/BOOT/BOOTX64.EFI")
+			assert.Error(err)
+		})
+	}
+}
+
+func TestFileExtentsDiskfs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const size = 64 << 20
+	file, err := os.Create(filepath.Join(t.TempDir(), "esp.img"))
+	require.NoError(err)
+	defer file.Close()
+	require.NoError(file.Truncate(size))
+	diskfs, err := fat32.Create(file, size, 0, 512, "ESP")
+	require.NoError(err)
+	require.NoError(diskfs.Mkdir("/EFI/BOOT"))
+	f, err := diskfs.OpenFile("/EFI/BOOT/BOOTX64.EFI", os.O_CREATE|os.O_RDWR)
+	require.NoError(err)
+	content := bytes.Repeat([]byte("uki"), 10000)
+	_, err = f.Write(content)
+	require.NoError(err)
+
+	extents, err := FileExtents(file, size, "/EFI/BOOT/BOOTX64.EFI")
+	require.NoError(err)
+	got := make([]byte, len(content))
+	_, err = NewExtentHandle(file, 0, extents).ReadAt(got, 0)
+	require.NoError(err)
+	assert.Equal(content, got)
+}
@@ -0,0 +1,166 @@
+package fat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	maxNameLength = 255
+	// invalidChars may not appear in long filenames.
+	invalidChars = "\"*/:<>?\\|"
+	// shortSpecialChars are allowed in short names in addition to letters and digits.
+	shortSpecialChars = "$%'-_@~`!(){}^#&"
+)
+
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if len(utf16.Encode([]rune(name))) > maxNameLength {
+		return fmt.Errorf("file name %q is longer than %d characters", name, maxNameLength)
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(invalidChars, c) {
+			return fmt.Errorf("file name %q contains invalid character %q", name, c)
+		}
+	}
+	if strings.TrimRight(name, ". ") != name {
+		return fmt.Errorf("file name %q ends with a dot or space", name)
+	}
+	return nil
+}
+
+// shortNameFor returns the short name stored for name in dir.
+// If name is a valid 8.3 name in a single case per part, no long filename entries are needed
+// and the case is recorded in the NT flags like Windows does.
+// Otherwise a unique short name with a numeric tail (like BOOTX6~1.EFI) is generated.
+func shortNameFor(name string, dir *directory) (short [11]byte, ntFlags byte, needLFN bool) {
+	if short, ntFlags, ok := exactShortName(name); ok {
+		return short, ntFlags, false
+	}
+
+	var base, ext string
+	trimmed := strings.TrimLeft(strings.ReplaceAll(name, " ", ""), ".")
+	if dot := strings.LastIndex(trimmed, "."); dot >= 0 {
+		base, ext = trimmed[:dot], trimmed[dot+1:]
+	} else {
+		base = trimmed
+	}
+	base = shortNameChars(strings.ReplaceAll(base, ".", ""))
+	ext = shortNameChars(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	for n := 1; ; n++ {
+		tail := "~" + strconv.Itoa(n)
+		candidate := base
+		if len(candidate) > 8-len(tail) {
+			candidate = candidate[:8-len(tail)]
+		}
+		short = padShortName(candidate+tail, ext)
+		if !dir.hasShortName(short) {
+			return short, 0, true
+		}
+	}
+}
+
+// exactShortName encodes name as short name if it is a valid 8.3 name.
+func exactShortName(name string) (short [11]byte, ntFlags byte, ok bool) {
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return short, 0, false
+	}
+	if strings.HasSuffix(name, ".") {
+		return short, 0, false
+	}
+	for _, part := range []struct {
+		s    string
+		flag byte
+	}{{base, ntLowerBase}, {ext, ntLowerExt}} {
+		if shortNameChars(strings.ToUpper(part.s)) != strings.ToUpper(part.s) {
+			return short, 0, false
+		}
+		switch part.s {
+		case strings.ToUpper(part.s):
+		case strings.ToLower(part.s):
+			ntFlags |= part.flag
+		default:
+			return short, 0, false
+		}
+	}
+	return padShortName(strings.ToUpper(base), strings.ToUpper(ext)), ntFlags, true
+}
+
+// shortNameChars converts s to upper case and replaces characters that are not allowed in short names.
+func shortNameChars(s string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(s) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune(shortSpecialChars, c):
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func padShortName(base, ext string) [11]byte {
+	var short [11]byte
+	copy(short[:], fmt.Sprintf("%-8s%-3s", base, ext))
+	if short[0] == entryDeleted {
+		short[0] = 0x05
+	}
+	return short
+}
+
+func (d *directory) hasShortName(short [11]byte) bool {
+	for _, e := range d.entries {
+		if e.shortName == short {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeLFN returns the long filename entries for name, in on-disk order.
+func encodeLFN(name string, short [11]byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	count := (len(chars) + lfnCharsPerEnt - 1) / lfnCharsPerEnt
+	padded := make([]uint16, count*lfnCharsPerEnt)
+	for i := range padded {
+		switch {
+		case i < len(chars):
+			padded[i] = chars[i]
+		case i == len(chars):
+			padded[i] = 0
+		default:
+			padded[i] = 0xFFFF
+		}
+	}
+	checksum := shortNameChecksum(short)
+	var out []byte
+	for order := count; order > 0; order-- {
+		entry := make([]byte, dirEntrySize)
+		entry[0] = byte(order)
+		if order == count {
+			entry[0] |= lfnLast
+		}
+		entry[11] = attrLongName
+		entry[13] = checksum
+		part := padded[(order-1)*lfnCharsPerEnt:]
+		var i int
+		for _, r := range lfnCharRanges {
+			for off := r[0]; off < r[1]; off += 2 {
+				entry[off] = byte(part[i])
+				entry[off+1] = byte(part[i] >> 8)
+				i++
+			}
+		}
+		out = append(out, entry...)
+	}
+	return out
+}
@@ -0,0 +1,481 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// ErrNoSpace is returned when the filesystem has not enough free clusters.
+var ErrNoSpace = errors.New("no space left in filesystem")
+
+const (
+	fsInfoLeadSignature   = 0x41615252
+	fsInfoStructSignature = 0x61417272
+	fsInfoTrailSignature  = 0xAA550000
+	fsInfoUnknown         = 0xFFFFFFFF
+)
+
+// fsInfo holds the hints of the FAT32 FSInfo sector.
+type fsInfo struct {
+	freeCount uint32
+	nextFree  uint32
+}
+
+func (fs *FileSystem) readFSInfo() (fsInfo, error) {
+	if fs.fsInfoOffset == 0 {
+		return fsInfo{}, errors.New("filesystem has no FSInfo sector")
+	}
+	buf := make([]byte, 512)
+	if _, err := fs.r.ReadAt(buf, fs.fsInfoOffset); err != nil {
+		return fsInfo{}, fmt.Errorf("reading FSInfo sector: %w", err)
+	}
+	if binary.LittleEndian.Uint32(buf[0:4]) != fsInfoLeadSignature ||
+		binary.LittleEndian.Uint32(buf[484:488]) != fsInfoStructSignature ||
+		binary.LittleEndian.Uint32(buf[508:512]) != fsInfoTrailSignature {
+		return fsInfo{}, errors.New("invalid FSInfo signature")
+	}
+	return fsInfo{
+		freeCount: binary.LittleEndian.Uint32(buf[488:492]),
+		nextFree:  binary.LittleEndian.Uint32(buf[492:496]),
+	}, nil
+}
+
+// updateFSInfo adjusts the free cluster count of the FSInfo sector by delta and stores the next free hint.
+// An unknown free count stays unknown. Filesystems without valid FSInfo sector are left alone.
+func (fs *FileSystem) updateFSInfo(delta int64) error {
+	info, err := fs.readFSInfo()
+	if err != nil {
+		return nil
+	}
+	if info.freeCount != fsInfoUnknown {
+		info.freeCount = uint32(int64(info.freeCount) + delta)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], info.freeCount)
+	binary.LittleEndian.PutUint32(buf[4:8], fs.nextFree)
+	return fs.writeAt(buf, fs.fsInfoOffset+488)
+}
+
+func (fs *FileSystem) writeAt(p []byte, off int64) error {
+	w, ok := fs.r.(io.WriterAt)
+	if !ok {
+		return errors.New("filesystem is read-only")
+	}
+	_, err := w.WriteAt(p, off)
+	return err
+}
+
+// setFAT sets the FAT entry of cluster in all FAT copies.
+func (fs *FileSystem) setFAT(cluster, value uint32) error {
+	var offset int64
+	var buf []byte
+	switch fs.typ {
+	case FAT12:
+		offset = int64(cluster) + int64(cluster)/2
+		old, err := fs.readFAT(offset, 2)
+		if err != nil {
+			return err
+		}
+		entry := binary.LittleEndian.Uint16(old)
+		if cluster%2 == 1 {
+			entry = entry&0x000F | uint16(value&0xFFF)<<4
+		} else {
+			entry = entry&0xF000 | uint16(value&0xFFF)
+		}
+		buf = binary.LittleEndian.AppendUint16(nil, entry)
+	case FAT16:
+		offset = int64(cluster) * 2
+		buf = binary.LittleEndian.AppendUint16(nil, uint16(value))
+	default:
+		offset = int64(cluster) * 4
+		old, err := fs.readFAT(offset, 4)
+		if err != nil {
+			return err
+		}
+		// the upper four bits are reserved and must be preserved
+		buf = binary.LittleEndian.AppendUint32(nil, binary.LittleEndian.Uint32(old)&0xF0000000|value&0x0FFFFFFF)
+	}
+	for i := int64(0); i < fs.numFATs; i++ {
+		if err := fs.writeAt(buf, (fs.reservedSectors+i*fs.fatSectors)*fs.bytesPerSector+offset); err != nil {
+			return fmt.Errorf("writing FAT: %w", err)
+		}
+	}
+	for i := range buf {
+		sector := (offset + int64(i)) / fs.bytesPerSector
+		if cached, ok := fs.fatCache[sector]; ok {
+			cached[(offset+int64(i))%fs.bytesPerSector] = buf[i]
+		}
+	}
+	return nil
+}
+
+// endOfChain is the FAT entry written for the last cluster of a chain.
+func (fs *FileSystem) endOfChain() uint32 {
+	return fs.typ.badCluster() | 0xF
+}
+
+// allocate finds count free clusters, links them into a chain and appends the chain to prev (unless 0).
+// Allocated clusters are not zeroed.
+func (fs *FileSystem) allocate(count int, prev uint32) ([]uint32, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	clusters := make([]uint32, 0, count)
+	cluster := fs.nextFree
+	for checked := uint32(0); checked < fs.clusterCount && len(clusters) < count; checked++ {
+		if !fs.validCluster(cluster) {
+			cluster = firstDataCluster
+		}
+		value, err := fs.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		if value == 0 {
+			clusters = append(clusters, cluster)
+		}
+		cluster++
+	}
+	if len(clusters) < count {
+		return nil, fmt.Errorf("allocating %d clusters: %w", count, ErrNoSpace)
+	}
+	for i, c := range clusters {
+		next := fs.endOfChain()
+		if i+1 < len(clusters) {
+			next = clusters[i+1]
+		}
+		if err := fs.setFAT(c, next); err != nil {
+			return nil, err
+		}
+	}
+	if prev != 0 {
+		if err := fs.setFAT(prev, clusters[0]); err != nil {
+			return nil, err
+		}
+	}
+	fs.nextFree = cluster
+	if err := fs.updateFSInfo(-int64(count)); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// free marks the clusters as free.
+func (fs *FileSystem) free(clusters []uint32) error {
+	for _, c := range clusters {
+		if err := fs.setFAT(c, 0); err != nil {
+			return err
+		}
+	}
+	if len(clusters) == 0 {
+		return nil
+	}
+	return fs.updateFSInfo(int64(len(clusters)))
+}
+
+// writeClusters writes data to the clusters and zeroes the rest of the last cluster.
+func (fs *FileSystem) writeClusters(clusters []uint32, data []byte) error {
+	if len(clusters) == 0 {
+		return nil
+	}
+	padded := make([]byte, int64(len(clusters))*fs.ClusterSize())
+	copy(padded, data)
+	extents, err := fs.extents(clusters, int64(len(padded)))
+	if err != nil {
+		return err
+	}
+	_, err = NewExtentHandle(fs.r, 0, extents).WriteAt(padded, 0)
+	return err
+}
+
+func (fs *FileSystem) clustersFor(size int64) int {
+	return int((size + fs.ClusterSize() - 1) / fs.ClusterSize())
+}
+
+// WriteFile creates the file at path or replaces its content. The parent directory must exist.
+func (fs *FileSystem) WriteFile(path string, data []byte) error {
+	if int64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("%s: file of %d bytes is too large for FAT", path, len(data))
+	}
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	existing, exists := parent.find(name)
+	if exists && existing.isDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+	clusters, err := fs.allocate(fs.clustersFor(int64(len(data))), 0)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	// the new clusters are released again if the entry cannot point to them
+	if err := fs.writeClusters(clusters, data); err != nil {
+		return errors.Join(fmt.Errorf("writing %s: %w", path, err), fs.free(clusters))
+	}
+	var first uint32
+	if len(clusters) > 0 {
+		first = clusters[0]
+	}
+	if !exists {
+		if _, err := fs.addEntry(parent, name, attrArchive, first, uint32(len(data))); err != nil {
+			return errors.Join(fmt.Errorf("%s: %w", path, err), fs.free(clusters))
+		}
+		return nil
+	}
+	// the old content is only released once the entry points to the new content
+	old, err := fs.chain(existing.firstCluster)
+	if err != nil {
+		return errors.Join(fmt.Errorf("%s: %w", path, err), fs.free(clusters))
+	}
+	if err := fs.updateEntry(parent, existing, first, uint32(len(data))); err != nil {
+		return errors.Join(fmt.Errorf("%s: %w", path, err), fs.free(clusters))
+	}
+	return fs.free(old)
+}
+
+// Mkdir creates the directory at path. The parent directory must exist.
+func (fs *FileSystem) Mkdir(path string) error {
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	if _, exists := parent.find(name); exists || name == "" {
+		return fmt.Errorf("%s: %w", path, os.ErrExist)
+	}
+	if err := validateName(name); err != nil {
+		return err
+	}
+	clusters, err := fs.allocate(1, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	parentCluster := parent.cluster
+	if parentCluster == fs.rootCluster {
+		// ".." of directories in the root directory always points to cluster 0
+		parentCluster = 0
+	}
+	date, tm := encodeTime(fs.now())
+	dots := append(
+		shortEntry(padShortName(".", ""), 0, attrDirectory, clusters[0], 0, date, tm),
+		shortEntry(padShortName("..", ""), 0, attrDirectory, parentCluster, 0, date, tm)...)
+	if err := fs.writeClusters(clusters, dots); err != nil {
+		return errors.Join(fmt.Errorf("writing %s: %w", path, err), fs.free(clusters))
+	}
+	if _, err := fs.addEntry(parent, name, attrDirectory, clusters[0], 0); err != nil {
+		return errors.Join(fmt.Errorf("%s: %w", path, err), fs.free(clusters))
+	}
+	return nil
+}
+
+// MkdirAll creates the directory at path together with all missing parents.
+func (fs *FileSystem) MkdirAll(path string) error {
+	var current string
+	for _, component := range splitPath(path) {
+		current += "/" + component
+		info, err := fs.Stat(current)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if err := fs.Mkdir(current); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir:
+			return fmt.Errorf("%s is not a directory", current)
+		}
+	}
+	return nil
+}
+
+// Remove deletes the file or empty directory at path.
+func (fs *FileSystem) Remove(path string) error {
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("cannot remove the root directory")
+	}
+	entry, ok := parent.find(name)
+	if !ok {
+		return fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	if entry.isDir() {
+		dir, err := fs.readDir(entry.firstCluster)
+		if err != nil {
+			return fmt.Errorf("reading directory %s: %w", path, err)
+		}
+		if len(dir.entries) > 0 {
+			return fmt.Errorf("directory %s is not empty", path)
+		}
+	}
+	clusters, err := fs.chain(entry.firstCluster)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fs.removeEntry(parent, entry); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return fs.free(clusters)
+}
+
+// RemoveAll deletes the file or directory at path including its content.
+func (fs *FileSystem) RemoveAll(path string) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		children, err := fs.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := fs.RemoveAll(path + "/" + child.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(path)
+}
+
+// shortEntry encodes a short directory entry.
+func shortEntry(short [11]byte, ntFlags, attr byte, first, size uint32, date, tm uint16) []byte {
+	buf := make([]byte, dirEntrySize)
+	copy(buf[0:11], short[:])
+	buf[11] = attr
+	buf[12] = ntFlags
+	binary.LittleEndian.PutUint16(buf[14:16], tm)
+	binary.LittleEndian.PutUint16(buf[16:18], date)
+	binary.LittleEndian.PutUint16(buf[18:20], date)
+	binary.LittleEndian.PutUint16(buf[20:22], uint16(first>>16))
+	binary.LittleEndian.PutUint16(buf[22:24], tm)
+	binary.LittleEndian.PutUint16(buf[24:26], date)
+	binary.LittleEndian.PutUint16(buf[26:28], uint16(first))
+	binary.LittleEndian.PutUint32(buf[28:32], size)
+	return buf
+}
+
+// dirHandle returns a handle for the content of the directory.
+func (fs *FileSystem) dirHandle(d *directory) (*ExtentHandle, error) {
+	if d.clusters == nil {
+		return NewExtentHandle(fs.r, fs.rootOffset, []Extent{{Size: int64(len(d.raw))}}), nil
+	}
+	extents, err := fs.extents(d.clusters, int64(len(d.raw)))
+	if err != nil {
+		return nil, err
+	}
+	return NewExtentHandle(fs.r, 0, extents), nil
+}
+
+// writeSlots writes raw entries starting at slot index of the directory.
+func (fs *FileSystem) writeSlots(d *directory, index int, raw []byte) error {
+	handle, err := fs.dirHandle(d)
+	if err != nil {
+		return err
+	}
+	if _, err := handle.WriteAt(raw, int64(index*dirEntrySize)); err != nil {
+		return fmt.Errorf("writing directory: %w", err)
+	}
+	copy(d.raw[index*dirEntrySize:], raw)
+	d.entries = parseDir(d.raw)
+	return nil
+}
+
+// addEntry adds an entry with long filename entries as needed to the directory,
+// growing the directory if it has no room left.
+func (fs *FileSystem) addEntry(d *directory, name string, attr byte, first, size uint32) (dirEntry, error) {
+	if err := validateName(name); err != nil {
+		return dirEntry{}, err
+	}
+	short, ntFlags, needLFN := shortNameFor(name, d)
+	date, tm := encodeTime(fs.now())
+	var raw []byte
+	if needLFN {
+		raw = encodeLFN(name, short)
+	}
+	raw = append(raw, shortEntry(short, ntFlags, attr, first, size, date, tm)...)
+	slots := len(raw) / dirEntrySize
+
+	index := d.freeSlots(slots)
+	if index < 0 {
+		if d.clusters == nil {
+			return dirEntry{}, errors.New("root directory is full")
+		}
+		// the new cluster starts with free entries, so the run may begin in the old part
+		clusters, err := fs.allocate(fs.clustersFor(int64(slots*dirEntrySize)), d.clusters[len(d.clusters)-1])
+		if err != nil {
+			return dirEntry{}, err
+		}
+		if err := fs.writeClusters(clusters, nil); err != nil {
+			return dirEntry{}, err
+		}
+		d.clusters = append(d.clusters, clusters...)
+		d.raw = append(d.raw, make([]byte, int64(len(clusters))*fs.ClusterSize())...)
+		if index = d.freeSlots(slots); index < 0 {
+			return dirEntry{}, errors.New("directory is full")
+		}
+	}
+	if err := fs.writeSlots(d, index, raw); err != nil {
+		return dirEntry{}, err
+	}
+	entry, _ := d.find(name)
+	return entry, nil
+}
+
+// freeSlots returns the first slot of a run of count free slots in the directory, or -1.
+// Once the end marker is found, only the remaining space counts.
+func (d *directory) freeSlots(count int) int {
+	run := 0
+	total := len(d.raw) / dirEntrySize
+	for i := 0; i < total; i++ {
+		switch d.raw[i*dirEntrySize] {
+		case entryFree:
+			if i-run+count <= total {
+				return i - run
+			}
+			return -1
+		case entryDeleted:
+			run++
+			if run == count {
+				return i - run + 1
+			}
+		default:
+			run = 0
+		}
+	}
+	return -1
+}
+
+// updateEntry points the entry to new content and updates its modification time.
+func (fs *FileSystem) updateEntry(d *directory, e dirEntry, first, size uint32) error {
+	raw := append([]byte(nil), d.raw[e.index*dirEntrySize:(e.index+1)*dirEntrySize]...)
+	date, tm := encodeTime(fs.now())
+	binary.LittleEndian.PutUint16(raw[18:20], date)
+	binary.LittleEndian.PutUint16(raw[20:22], uint16(first>>16))
+	binary.LittleEndian.PutUint16(raw[22:24], tm)
+	binary.LittleEndian.PutUint16(raw[24:26], date)
+	binary.LittleEndian.PutUint16(raw[26:28], uint16(first))
+	binary.LittleEndian.PutUint32(raw[28:32], size)
+	return fs.writeSlots(d, e.index, raw)
+}
+
+// removeEntry marks the entry and its long filename entries as deleted.
+func (fs *FileSystem) removeEntry(d *directory, e dirEntry) error {
+	first := e.index - e.slots + 1
+	raw := append([]byte(nil), d.raw[first*dirEntrySize:(e.index+1)*dirEntrySize]...)
+	for i := 0; i < len(raw); i += dirEntrySize {
+		raw[i] = entryDeleted
+	}
+	return fs.writeSlots(d, first, raw)
+}
@@ -0,0 +1,207 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	for _, typ := range []Type{FAT12, FAT16, FAT32} {
+		t.Run(typ.String(), func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			img := newTestFS(typ)
+			fs, err := Open(img, int64(len(img.testImage)))
+			require.NoError(err)
+			fs.now = func() time.Time { return time.Date(2024, 5, 17, 12, 30, 42, 0, time.UTC) }
+
+			require.NoError(fs.MkdirAll("/EFI/Linux"))
+			assert.Error(fs.Mkdir("/efi"))
+			uki := bytes.Repeat([]byte("kernel"), 500)
+			require.NoError(fs.WriteFile("/EFI/Linux/ubuntu-6.8.0-31-generic.efi", uki))
+			require.NoError(fs.WriteFile("/loader.conf", []byte("timeout 3\n")))
+			require.NoError(fs.WriteFile("/empty", nil))
+
+			content, err := fs.ReadFile("/efi/linux/UBUNTU-6.8.0-31-GENERIC.EFI")
+			require.NoError(err)
+			assert.Equal(uki, content)
+			info, err := fs.Stat("/loader.conf")
+			require.NoError(err)
+			assert.Equal(FileInfo{Name: "loader.conf", Size: 10, ModTime: time.Date(2024, 5, 17, 12, 30, 42, 0, time.UTC)}, info)
+			entries, err := fs.ReadDir("/")
+			require.NoError(err)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			assert.Equal([]string{"EFI", "loader.conf", "empty"}, names)
+
+			// replacing content releases the old clusters
+			free := countFree(t, fs)
+			require.NoError(fs.WriteFile("/EFI/Linux/ubuntu-6.8.0-31-generic.efi", uki[:100]))
+			assert.Equal(free+fs.clustersFor(int64(len(uki)))-1, countFree(t, fs))
+			content, err = fs.ReadFile("/EFI/Linux/ubuntu-6.8.0-31-generic.efi")
+			require.NoError(err)
+			assert.Equal(uki[:100], content)
+
+			// growing a directory beyond its first cluster
+			for i := 0; i < 20; i++ {
+				require.NoError(fs.WriteFile(fmt.Sprintf("/EFI/Linux/entry-%02d.conf", i), []byte{byte(i)}))
+			}
+			entries, err = fs.ReadDir("/EFI/Linux")
+			require.NoError(err)
+			assert.Len(entries, 21)
+			content, err = fs.ReadFile("/EFI/Linux/entry-19.conf")
+			require.NoError(err)
+			assert.Equal([]byte{19}, content)
+
+			assert.Error(fs.Remove("/EFI"))
+			free = countFree(t, fs)
+			require.NoError(fs.Remove("/loader.conf"))
+			assert.Equal(free+1, countFree(t, fs))
+			_, err = fs.Stat("/loader.conf")
+			assert.ErrorIs(err, os.ErrNotExist)
+			require.NoError(fs.RemoveAll("/EFI"))
+			entries, err = fs.ReadDir("/")
+			require.NoError(err)
+			require.Len(entries, 1)
+			assert.Equal("empty", entries[0].Name)
+
+			// both FATs are identical
+			fatSize := fs.fatSectors * fs.bytesPerSector
+			first := fs.reservedSectors * fs.bytesPerSector
+			assert.Equal(img.testImage[first:first+fatSize], img.testImage[first+fatSize:first+2*fatSize])
+			if typ == FAT32 {
+				info, err := fs.readFSInfo()
+				require.NoError(err)
+				assert.Equal(uint32(countFree(t, fs)), info.freeCount)
+			}
+
+			assert.ErrorIs(fs.WriteFile("/big", make([]byte, len(img.testImage))), ErrNoSpace)
+			assert.Error(fs.WriteFile("/a:b", nil))
+			assert.Error(fs.WriteFile("/missing/file", nil))
+		})
+	}
+}
+
+func TestWriteRootFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	img := newTestFS(FAT16)
+	fs, err := Open(img, int64(len(img.testImage)))
+	require.NoError(err)
+	for i := 0; i < img.rootEntries; i++ {
+		require.NoError(fs.WriteFile(fmt.Sprintf("/F%03d", i), nil))
+	}
+
+	// the fixed root directory cannot grow, so the clusters of the new file or directory are released again
+	free := countFree(t, fs)
+	err = fs.WriteFile("/loader.conf", []byte("timeout 3\n"))
+	require.Error(err)
+	assert.Contains(err.Error(), "root directory is full")
+	err = fs.Mkdir("/EFI")
+	require.Error(err)
+	assert.Contains(err.Error(), "root directory is full")
+	assert.Equal(free, countFree(t, fs))
+}
+
+func countFree(t *testing.T, fs *FileSystem) int {
+	var free int
+	for c := uint32(firstDataCluster); fs.validCluster(c); c++ {
+		value, err := fs.next(c)
+		require.NoError(t, err)
+		if value == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+func TestShortNameFor(t *testing.T) {
+	testCases := map[string]struct {
+		existing []string
+		wantName string
+		wantNT   byte
+		wantLFN  bool
+	}{
+		"BOOTX64.EFI":         {wantName: "BOOTX64 EFI"},
+		"bootx64.efi":         {wantName: "BOOTX64 EFI", wantNT: ntLowerBase | ntLowerExt},
+		"README":              {wantName: "README     "},
+		"loader.CONF":         {wantName: "LOADER~1CON", wantLFN: true},
+		"BootX64.efi":         {wantName: "BOOTX6~1EFI", wantLFN: true},
+		"linux-6.8.0.efi":     {wantName: "LINUX-~1EFI", wantLFN: true},
+		"a b+c.tar.gz":        {wantName: "AB_CTA~1GZ ", wantLFN: true},
+		".hidden":             {wantName: "HIDDEN~1   ", wantLFN: true},
+		"ubuntu-generic.efi":  {existing: []string{"UBUNTU~1EFI"}, wantName: "UBUNTU~2EFI", wantLFN: true},
+		"ubuntu-generic2.efi": {existing: []string{"UBUNTU~1EFI", "UBUNTU~2EFI"}, wantName: "UBUNTU~3EFI", wantLFN: true},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			dir := &directory{}
+			for _, existing := range tc.existing {
+				var short [11]byte
+				copy(short[:], existing)
+				dir.entries = append(dir.entries, dirEntry{shortName: short})
+			}
+			short, nt, lfn := shortNameFor(name, dir)
+			assert.Equal(tc.wantName, string(short[:]))
+			assert.Equal(tc.wantNT, nt)
+			assert.Equal(tc.wantLFN, lfn)
+		})
+	}
+}
+
+// TestWriteDiskfs checks that files written by this package can be read by another implementation.
+func TestWriteDiskfs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const size = 64 << 20
+	file, err := os.Create(filepath.Join(t.TempDir(), "esp.img"))
+	require.NoError(err)
+	defer file.Close()
+	require.NoError(file.Truncate(size))
+	_, err = fat32.Create(file, size, 0, 512, "ESP")
+	require.NoError(err)
+
+	fs, err := Open(file, size)
+	require.NoError(err)
+	require.NoError(fs.MkdirAll("/EFI/Linux"))
+	content := bytes.Repeat([]byte("uki"), 10000)
+	require.NoError(fs.WriteFile("/EFI/Linux/linux-6.8.0.efi", content))
+	problems, err := fs.Check(false)
+	require.NoError(err)
+	assert.Empty(problems)
+
+	diskfs, err := fat32.Read(file, size, 0, 512)
+	require.NoError(err)
+	infos, err := diskfs.ReadDir("/EFI/Linux")
+	require.NoError(err)
+	require.Len(infos, 3)
+	assert.Equal("linux-6.8.0.efi", infos[2].Name())
+	f, err := diskfs.OpenFile("/EFI/Linux/linux-6.8.0.efi", os.O_RDONLY)
+	require.NoError(err)
+	got, err := io.ReadAll(f)
+	require.NoError(err)
+	assert.Equal(content, got)
+
+	buf := make([]byte, 512)
+	_, err = file.ReadAt(buf, 512)
+	require.NoError(err)
+	// go-diskfs does not track the free count, so it must stay unknown
+	assert.Equal(uint32(fsInfoUnknown), binary.LittleEndian.Uint32(buf[488:492]))
+}
@@ -1,39 +1,17 @@
 package gpt
 
 import (
-	"errors"
-
-	"github.com/diskfs/go-diskfs"
-	"github.com/diskfs/go-diskfs/partition"
-	"github.com/diskfs/go-diskfs/partition/gpt"
+	"io"
 )
 
-func EFIPartitionSection(path string) (int64, int64, error) {
-	disk, err := diskfs.Open(path, diskfs.WithOpenMode(diskfs.ReadOnly))
-	if err != nil {
-		return 0, 0, err
-	}
-	defer disk.File.Close()
-	table, err := disk.GetPartitionTable()
+func EFIPartitionSection(r io.ReaderAt, blocksize int64) (int64, int64, error) {
+	table, err := Read(r, blocksize)
 	if err != nil {
 		return 0, 0, err
 	}
-	part, err := findPartWithTypeGUID(table, gpt.EFISystemPartition)
+	part, err := table.FindByType(EFISystemPartition)
 	if err != nil {
 		return 0, 0, err
 	}
-	return part.GetStart(), part.GetSize(), nil
-}
-
-func findPartWithTypeGUID(table partition.Table, guid gpt.Type) (*gpt.Partition, error) {
-	for _, part := range table.GetPartitions() {
-		part, ok := part.(*gpt.Partition)
-		if !ok {
-			return nil, errors.New("partition is not GPT")
-		}
-		if part.Type == guid {
-			return part, nil
-		}
-	}
-	return nil, errors.New("partition not found")
+	return part.Start, part.Size, nil
 }
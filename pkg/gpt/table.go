@@ -0,0 +1,211 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// ErrNotFound is returned when no partition matches a lookup.
+var ErrNotFound = errors.New("not found")
+
+const (
+	headerSignature = "EFI PART"
+	minHeaderSize   = 92
+	minEntrySize    = 128
+	// maxEntriesSize bounds the partition entry array read from an unauthenticated header
+	// (the usual array of 128 entries has 16 KiB).
+	maxEntriesSize = 1 << 20
+)
+
+// Header is a GPT header as found at LBA 1 (primary) or at the last LBA of the disk (backup).
+type Header struct {
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC32    uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       string
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC32   uint32
+}
+
+// Partition is a used entry of the GPT partition entry array.
+type Partition struct {
+	// Index is the zero based index of the entry in the partition entry array.
+	Index      int
+	Type       Type
+	UUID       string
+	Name       string
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	// Start is the offset of the partition in bytes.
+	Start int64
+	// Size is the size of the partition in bytes.
+	Size int64
+}
+
+// Table is a parsed GPT.
+type Table struct {
+	Blocksize  int64
+	Header     Header
+	Partitions []Partition
+}
+
+// Read parses the primary GPT of a disk with the given logical blocksize.
+func Read(r io.ReaderAt, blocksize int64) (*Table, error) {
+	header, err := readHeader(r, blocksize, 1)
+	if err != nil {
+		return nil, fmt.Errorf("reading primary GPT header: %w", err)
+	}
+	partitions, err := readEntries(r, blocksize, header)
+	if err != nil {
+		return nil, fmt.Errorf("reading partition entries: %w", err)
+	}
+	return &Table{
+		Blocksize:  blocksize,
+		Header:     header,
+		Partitions: partitions,
+	}, nil
+}
+
+// FindByType returns the first partition with the given type GUID.
+func (t *Table) FindByType(typ Type) (Partition, error) {
+	for _, part := range t.Partitions {
+		if part.Type == typ {
+			return part, nil
+		}
+	}
+	return Partition{}, fmt.Errorf("partition with type %s %w", typ, ErrNotFound)
+}
+
+// FindByUUID returns the partition with the given partition UUID.
+func (t *Table) FindByUUID(uuid string) (Partition, error) {
+	for _, part := range t.Partitions {
+		if strings.EqualFold(part.UUID, uuid) {
+			return part, nil
+		}
+	}
+	return Partition{}, fmt.Errorf("partition with uuid %s %w", uuid, ErrNotFound)
+}
+
+// FindByName returns the first partition with the given partition label.
+func (t *Table) FindByName(name string) (Partition, error) {
+	for _, part := range t.Partitions {
+		if part.Name == name {
+			return part, nil
+		}
+	}
+	return Partition{}, fmt.Errorf("partition with label %q %w", name, ErrNotFound)
+}
+
+func readHeader(r io.ReaderAt, blocksize int64, lba uint64) (Header, error) {
+	buf := make([]byte, blocksize)
+	if _, err := r.ReadAt(buf, int64(lba)*blocksize); err != nil {
+		return Header{}, err
+	}
+	if string(buf[:8]) != headerSignature {
+		return Header{}, errors.New("invalid GPT signature")
+	}
+	header := Header{
+		Revision:       binary.LittleEndian.Uint32(buf[8:12]),
+		HeaderSize:     binary.LittleEndian.Uint32(buf[12:16]),
+		HeaderCRC32:    binary.LittleEndian.Uint32(buf[16:20]),
+		MyLBA:          binary.LittleEndian.Uint64(buf[24:32]),
+		AlternateLBA:   binary.LittleEndian.Uint64(buf[32:40]),
+		FirstUsableLBA: binary.LittleEndian.Uint64(buf[40:48]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(buf[48:56]),
+		DiskGUID:       guidFromBytes(buf[56:72]),
+		EntriesLBA:     binary.LittleEndian.Uint64(buf[72:80]),
+		NumEntries:     binary.LittleEndian.Uint32(buf[80:84]),
+		EntrySize:      binary.LittleEndian.Uint32(buf[84:88]),
+		EntriesCRC32:   binary.LittleEndian.Uint32(buf[88:92]),
+	}
+	if header.HeaderSize < minHeaderSize || int64(header.HeaderSize) > blocksize {
+		return Header{}, fmt.Errorf("invalid GPT header size %d", header.HeaderSize)
+	}
+	if header.EntrySize < minEntrySize || header.EntrySize&(header.EntrySize-1) != 0 {
+		return Header{}, fmt.Errorf("invalid GPT partition entry size %d", header.EntrySize)
+	}
+	if int64(header.NumEntries)*int64(header.EntrySize) > maxEntriesSize {
+		return Header{}, fmt.Errorf("GPT partition entry array of %d entries with %d bytes exceeds %d bytes", header.NumEntries, header.EntrySize, maxEntriesSize)
+	}
+	if crc := headerChecksum(buf[:header.HeaderSize]); crc != header.HeaderCRC32 {
+		return Header{}, fmt.Errorf("GPT header checksum mismatch: expected %08x, got %08x", header.HeaderCRC32, crc)
+	}
+	return header, nil
+}
+
+func readEntries(r io.ReaderAt, blocksize int64, header Header) ([]Partition, error) {
+	buf := make([]byte, int64(header.NumEntries)*int64(header.EntrySize))
+	if _, err := r.ReadAt(buf, int64(header.EntriesLBA)*blocksize); err != nil {
+		return nil, err
+	}
+	if crc := crc32.ChecksumIEEE(buf); crc != header.EntriesCRC32 {
+		return nil, fmt.Errorf("GPT partition entry array checksum mismatch: expected %08x, got %08x", header.EntriesCRC32, crc)
+	}
+
+	var partitions []Partition
+	for i := 0; i < int(header.NumEntries); i++ {
+		entry := buf[i*int(header.EntrySize) : (i+1)*int(header.EntrySize)]
+		if bytes.Equal(entry[0:16], make([]byte, 16)) {
+			continue
+		}
+		part := Partition{
+			Index:      i,
+			Type:       Type(guidFromBytes(entry[0:16])),
+			UUID:       guidFromBytes(entry[16:32]),
+			FirstLBA:   binary.LittleEndian.Uint64(entry[32:40]),
+			LastLBA:    binary.LittleEndian.Uint64(entry[40:48]),
+			Attributes: binary.LittleEndian.Uint64(entry[48:56]),
+			Name:       nameFromBytes(entry[56:128]),
+		}
+		if part.LastLBA < part.FirstLBA {
+			return nil, fmt.Errorf("partition %d ends before it starts", i)
+		}
+		part.Start = int64(part.FirstLBA) * blocksize
+		part.Size = int64(part.LastLBA-part.FirstLBA+1) * blocksize
+		partitions = append(partitions, part)
+	}
+	return partitions, nil
+}
+
+func headerChecksum(raw []byte) uint32 {
+	buf := make([]byte, len(raw))
+	copy(buf, raw)
+	binary.LittleEndian.PutUint32(buf[16:20], 0)
+	return crc32.ChecksumIEEE(buf)
+}
+
+// guidFromBytes converts a mixed-endian on-disk GUID into its canonical uppercase string form.
+func guidFromBytes(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10],
+		b[10:16],
+	)
+}
+
+func nameFromBytes(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i : i+2])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,277 @@
+package gpt
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDisk []byte
+
+func (d testDisk) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, d[off:]), nil
+}
+
+func (d testDisk) WriteAt(p []byte, off int64) (int, error) {
+	return copy(d[off:], p), nil
+}
+
+func TestRead(t *testing.T) {
+	for _, blocksize := range []int64{512, 4096} {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		disk := newTestDisk(t, blocksize, 64, []Partition{
+			{Type: EFISystemPartition, UUID: "0D3BCBB2-A3B1-4F1C-9D64-3F2E1B4A4C11", Name: "esp", FirstLBA: 34, LastLBA: 40},
+			{Type: archTypes[ArchX86_64][DesignatorRoot], UUID: "2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", Name: "root-x86-64", FirstLBA: 41, LastLBA: 50},
+		})
+		table, err := Read(disk, blocksize)
+		require.NoError(err)
+		require.Len(table.Partitions, 2)
+
+		root := table.Partitions[1]
+		assert.Equal(1, root.Index)
+		assert.Equal("root-x86-64", root.Name)
+		assert.Equal("root-x86-64", root.Type.String())
+		assert.Equal("2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", root.UUID)
+		assert.Equal(41*blocksize, root.Start)
+		assert.Equal(10*blocksize, root.Size)
+
+		start, size, err := EFIPartitionSection(disk, blocksize)
+		require.NoError(err)
+		assert.Equal(34*blocksize, start)
+		assert.Equal(7*blocksize, size)
+
+		_, err = table.FindByUUID("2c9d3a24-5d76-ef1a-e0d1-99afc0a7332e")
+		assert.NoError(err)
+		_, err = table.FindByName("usr")
+		assert.Error(err)
+
+		disk[blocksize+20] ^= 0xff
+		_, err = Read(disk, blocksize)
+		assert.Error(err)
+	}
+}
+
+func TestReadInvalidHeader(t *testing.T) {
+	testCases := map[string]struct {
+		numEntries, entrySize uint32
+		entriesCRC32          uint32
+		wantErr               string
+	}{
+		"entry size not a power of two": {
+			numEntries: 128,
+			entrySize:  136,
+			wantErr:    "invalid GPT partition entry size 136",
+		},
+		"entry size too small": {
+			numEntries: 256,
+			entrySize:  64,
+			wantErr:    "invalid GPT partition entry size 64",
+		},
+		"entry array too large": {
+			numEntries: 1 << 24,
+			entrySize:  256,
+			wantErr:    "exceeds",
+		},
+		"entry array checksum": {
+			numEntries:   128,
+			entrySize:    128,
+			entriesCRC32: 1,
+			wantErr:      "checksum mismatch",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			disk := newTestDisk(t, 512, 64, []Partition{
+				{Type: EFISystemPartition, UUID: "0D3BCBB2-A3B1-4F1C-9D64-3F2E1B4A4C11", Name: "esp", FirstLBA: 34, LastLBA: 40},
+			})
+			header := disk[512 : 512+minHeaderSize]
+			binary.LittleEndian.PutUint32(header[80:84], tc.numEntries)
+			binary.LittleEndian.PutUint32(header[84:88], tc.entrySize)
+			if tc.entriesCRC32 != 0 {
+				binary.LittleEndian.PutUint32(header[88:92], tc.entriesCRC32)
+			}
+			binary.LittleEndian.PutUint32(header[16:20], headerChecksum(header))
+			_, err := Read(disk, 512)
+			require.Error(err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestSetPartitionUUIDs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	disk := newTestDisk(t, 512, 64, []Partition{
+		{Type: LinuxGeneric, UUID: "11111111-2222-3333-4444-555555555555", FirstLBA: 34, LastLBA: 40},
+		{Type: LinuxGeneric, UUID: "66666666-7777-8888-9999-AAAAAAAAAAAA", FirstLBA: 41, LastLBA: 50},
+	})
+	require.NoError(SetPartitionUUIDs(disk, 512, map[int]string{1: "2c9d3a24-5d76-ef1a-e0d1-99afc0a7332e"}))
+
+	table, err := Read(disk, 512)
+	require.NoError(err)
+	assert.Equal("11111111-2222-3333-4444-555555555555", table.Partitions[0].UUID)
+	assert.Equal("2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", table.Partitions[1].UUID)
+
+	backup, err := readHeader(disk, 512, table.Header.AlternateLBA)
+	require.NoError(err)
+	entries, err := readEntries(disk, 512, backup)
+	require.NoError(err)
+	assert.Equal("2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", entries[1].UUID)
+
+	assert.Error(SetPartitionUUIDs(disk, 512, map[int]string{0: "not-a-uuid"}))
+}
+
+// newTestDisk creates a disk of the given number of blocks with a primary and a backup GPT.
+func newTestDisk(t *testing.T, blocksize, blocks int64, partitions []Partition) testDisk {
+	const numEntries, entrySize = 4, 128
+	disk := make(testDisk, blocks*blocksize)
+	entries := make([]byte, numEntries*entrySize)
+	for i, part := range partitions {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		typ, err := guidToBytes(string(part.Type))
+		require.NoError(t, err)
+		uuid, err := guidToBytes(part.UUID)
+		require.NoError(t, err)
+		copy(entry[0:16], typ)
+		copy(entry[16:32], uuid)
+		binary.LittleEndian.PutUint64(entry[32:40], part.FirstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], part.LastLBA)
+		for j, c := range utf16.Encode([]rune(part.Name)) {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+	entriesBlocks := (int64(len(entries)) + blocksize - 1) / blocksize
+	writeHeader := func(myLBA, alternateLBA, entriesLBA int64) {
+		copy(disk[entriesLBA*blocksize:], entries)
+		header := disk[myLBA*blocksize : myLBA*blocksize+minHeaderSize]
+		copy(header, headerSignature)
+		binary.LittleEndian.PutUint32(header[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(header[12:16], minHeaderSize)
+		binary.LittleEndian.PutUint64(header[24:32], uint64(myLBA))
+		binary.LittleEndian.PutUint64(header[32:40], uint64(alternateLBA))
+		binary.LittleEndian.PutUint64(header[40:48], uint64(2+entriesBlocks))
+		binary.LittleEndian.PutUint64(header[48:56], uint64(blocks-2-entriesBlocks))
+		binary.LittleEndian.PutUint64(header[72:80], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(header[80:84], numEntries)
+		binary.LittleEndian.PutUint32(header[84:88], entrySize)
+		binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:20], headerChecksum(header))
+	}
+	writeHeader(1, blocks-1, 2)
+	writeHeader(blocks-1, 1, blocks-1-entriesBlocks)
+	return disk
+}
+
+func TestBuild(t *testing.T) {
+	for _, blocksize := range []int64{512, 4096} {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		const blocks = 128
+		partitions := []Partition{
+			{Type: EFISystemPartition, UUID: "0D3BCBB2-A3B1-4F1C-9D64-3F2E1B4A4C11", Name: "esp", FirstLBA: 40, LastLBA: 59},
+			{Index: 2, Type: archTypes[ArchX86_64][DesignatorRoot], UUID: "2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E", Name: "root-x86-64", FirstLBA: 60, LastLBA: 90},
+		}
+		primary, backup, err := Build(blocksize, blocks*blocksize, "11111111-2222-3333-4444-555555555555", partitions)
+		require.NoError(err)
+		disk := make(testDisk, blocks*blocksize)
+		copy(disk, primary)
+		copy(disk[len(disk)-len(backup):], backup)
+		assert.Equal([]byte{0x55, 0xAA}, []byte(disk[510:512]))
+
+		table, err := Read(disk, blocksize)
+		require.NoError(err)
+		assert.Equal("11111111-2222-3333-4444-555555555555", table.Header.DiskGUID)
+		require.Len(table.Partitions, 2)
+		assert.Equal(2, table.Partitions[1].Index)
+		assert.Equal("root-x86-64", table.Partitions[1].Name)
+		assert.Equal(partitions[1].Type, table.Partitions[1].Type)
+		assert.Equal(60*blocksize, table.Partitions[1].Start)
+		assert.Equal(31*blocksize, table.Partitions[1].Size)
+
+		// the backup is valid as well
+		require.NoError(SetPartitionUUIDs(disk, blocksize, map[int]string{0: "2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332F"}))
+		backupHeader, err := readHeader(disk, blocksize, blocks-1)
+		require.NoError(err)
+		entries, err := readEntries(disk, blocksize, backupHeader)
+		require.NoError(err)
+		assert.Equal("2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332F", entries[0].UUID)
+
+		_, _, err = Build(blocksize, blocks*blocksize, "11111111-2222-3333-4444-555555555555", []Partition{
+			{Type: LinuxGeneric, UUID: "0D3BCBB2-A3B1-4F1C-9D64-3F2E1B4A4C11", FirstLBA: 100, LastLBA: blocks - 1},
+		})
+		assert.Error(err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, blocksize := range []int64{512, 4096} {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		const blocks, grownBlocks = 64, 100
+		disk := newTestDisk(t, blocksize, blocks, []Partition{
+			{Type: LinuxGeneric, UUID: "11111111-2222-3333-4444-555555555555", Name: "root", FirstLBA: 34, LastLBA: 50},
+		})
+		disk = append(disk, make(testDisk, (grownBlocks-blocks)*blocksize)...)
+		require.NoError(Resize(disk, blocksize, grownBlocks*blocksize))
+
+		table, err := Read(disk, blocksize)
+		require.NoError(err)
+		assert.Equal(uint64(grownBlocks-1), table.Header.AlternateLBA)
+		assert.Equal(uint64(grownBlocks-3), table.Header.LastUsableLBA)
+		backup, err := readHeader(disk, blocksize, table.Header.AlternateLBA)
+		require.NoError(err)
+		assert.Equal(uint64(grownBlocks-1), backup.MyLBA)
+		assert.Equal(uint64(1), backup.AlternateLBA)
+		assert.Equal(uint64(grownBlocks-2), backup.EntriesLBA)
+		assert.Equal(table.Header.LastUsableLBA, backup.LastUsableLBA)
+		entries, err := readEntries(disk, blocksize, backup)
+		require.NoError(err)
+		assert.Equal(table.Partitions, entries)
+		_, err = readHeader(disk, blocksize, blocks-1)
+		assert.Error(err, "old backup header is cleared")
+
+		// the backup can be updated at its new place
+		require.NoError(SetPartitionUUIDs(disk, blocksize, map[int]string{0: "2C9D3A24-5D76-EF1A-E0D1-99AFC0A7332E"}))
+
+		// partitions have to fit
+		assert.Error(Resize(disk, blocksize, 50*blocksize))
+	}
+}
+
+func TestParseType(t *testing.T) {
+	testCases := map[string]struct {
+		name     string
+		wantType Type
+		wantErr  bool
+	}{
+		"generic":      {name: "esp", wantType: EFISystemPartition},
+		"arch":         {name: "root-x86-64", wantType: archTypes[ArchX86_64][DesignatorRoot]},
+		"arch verity":  {name: "usr-arm64-verity-sig", wantType: archTypes[ArchARM64][DesignatorUsrVeritySig]},
+		"guid":         {name: "0fc63daf-8483-4772-8e79-3d69d8477de4", wantType: LinuxGeneric},
+		"unknown name": {name: "root-z80", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			typ, err := ParseType(tc.name)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantType, typ)
+		})
+	}
+}
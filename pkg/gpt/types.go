@@ -0,0 +1,315 @@
+package gpt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Type is a GPT partition type GUID in its canonical uppercase string form.
+type Type string
+
+// Partition type GUIDs that are not specific to an architecture.
+// See https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+const (
+	Unused             Type = "00000000-0000-0000-0000-000000000000"
+	EFISystemPartition Type = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	ExtendedBootLoader Type = "BC13C2FF-59E6-4262-A352-B275FD6F7172"
+	Swap               Type = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"
+	Home               Type = "933AC7E1-2EB4-4F13-B844-0E14E2AEF915"
+	Srv                Type = "3B8F8425-20E0-4F3B-907F-1A25A76F98E8"
+	Var                Type = "4D21B016-B534-45C2-A9FB-5C16E091FD2D"
+	Tmp                Type = "7EC6F557-3BC5-4ACA-B293-16EF5DF639D1"
+	UserHome           Type = "773F91EF-66D4-49B5-BD83-D683BF40AD16"
+	LinuxGeneric       Type = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+// Arch is a CPU architecture as named by the Discoverable Partitions Specification.
+type Arch string
+
+// Architectures known to the Discoverable Partitions Specification.
+const (
+	ArchAlpha       Arch = "alpha"
+	ArchARC         Arch = "arc"
+	ArchARM         Arch = "arm"
+	ArchARM64       Arch = "arm64"
+	ArchIA64        Arch = "ia64"
+	ArchLoongArch64 Arch = "loongarch64"
+	ArchMIPS        Arch = "mips"
+	ArchMIPS64      Arch = "mips64"
+	ArchMIPSLE      Arch = "mips-le"
+	ArchMIPS64LE    Arch = "mips64-le"
+	ArchPARISC      Arch = "parisc"
+	ArchPPC         Arch = "ppc"
+	ArchPPC64       Arch = "ppc64"
+	ArchPPC64LE     Arch = "ppc64-le"
+	ArchRISCV32     Arch = "riscv32"
+	ArchRISCV64     Arch = "riscv64"
+	ArchS390        Arch = "s390"
+	ArchS390X       Arch = "s390x"
+	ArchTileGX      Arch = "tilegx"
+	ArchX86         Arch = "x86"
+	ArchX86_64      Arch = "x86-64"
+)
+
+// Designator names the purpose of a partition as used by the Discoverable Partitions Specification.
+type Designator string
+
+// Partition designators.
+const (
+	DesignatorESP           Designator = "esp"
+	DesignatorXBOOTLDR      Designator = "xbootldr"
+	DesignatorSwap          Designator = "swap"
+	DesignatorHome          Designator = "home"
+	DesignatorSrv           Designator = "srv"
+	DesignatorVar           Designator = "var"
+	DesignatorTmp           Designator = "tmp"
+	DesignatorUserHome      Designator = "user-home"
+	DesignatorLinuxGeneric  Designator = "linux-generic"
+	DesignatorRoot          Designator = "root"
+	DesignatorRootVerity    Designator = "root-verity"
+	DesignatorRootVeritySig Designator = "root-verity-sig"
+	DesignatorUsr           Designator = "usr"
+	DesignatorUsrVerity     Designator = "usr-verity"
+	DesignatorUsrVeritySig  Designator = "usr-verity-sig"
+)
+
+var genericTypes = map[Type]Designator{
+	EFISystemPartition: DesignatorESP,
+	ExtendedBootLoader: DesignatorXBOOTLDR,
+	Swap:               DesignatorSwap,
+	Home:               DesignatorHome,
+	Srv:                DesignatorSrv,
+	Var:                DesignatorVar,
+	Tmp:                DesignatorTmp,
+	UserHome:           DesignatorUserHome,
+	LinuxGeneric:       DesignatorLinuxGeneric,
+}
+
+var archTypes = map[Arch]map[Designator]Type{
+	ArchAlpha: {
+		DesignatorRoot:          "6523F8AE-3EB1-4E2A-A05A-18B695AE656F",
+		DesignatorRootVerity:    "FC56D9E9-E6E5-4C06-BE32-E74407CE09A5",
+		DesignatorRootVeritySig: "D46495B7-A053-414F-80F7-700C99921EF8",
+		DesignatorUsr:           "E18CF08C-33EC-4C0D-8246-C6C6FB3DA024",
+		DesignatorUsrVerity:     "8CCE0D25-C0D0-4A44-BD87-46331BF1DF67",
+		DesignatorUsrVeritySig:  "5C6E1C76-076A-457A-A0FE-F3B4CD21CE6E",
+	},
+	ArchARC: {
+		DesignatorRoot:          "D27F46ED-2919-4CB8-BD25-9531F3C16534",
+		DesignatorRootVerity:    "24B2D975-0F97-4521-AFA1-CD531E421B8D",
+		DesignatorRootVeritySig: "143A70BA-CBD3-4F06-919F-6C05683A78BC",
+		DesignatorUsr:           "7978A683-6316-4922-BBEE-38BFF5A2FECC",
+		DesignatorUsrVerity:     "FCA0598C-D880-4591-8C16-4EDA05C7347C",
+		DesignatorUsrVeritySig:  "94F9A9A1-9971-427A-A400-50CB297F0F35",
+	},
+	ArchARM: {
+		DesignatorRoot:          "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+		DesignatorRootVerity:    "7386CDF2-203C-47A9-A498-F2ECCE45A2D6",
+		DesignatorRootVeritySig: "42B0455F-EB11-491D-98D3-56145BA9D037",
+		DesignatorUsr:           "7D0359A3-02B3-4F0A-865C-654403E70625",
+		DesignatorUsrVerity:     "C215D751-7BCD-4649-BE90-6627490A4C05",
+		DesignatorUsrVeritySig:  "D7FF812F-37D1-4902-A810-D76BA57B975A",
+	},
+	ArchARM64: {
+		DesignatorRoot:          "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+		DesignatorRootVerity:    "DF3300CE-D69F-4C92-978C-9BFB0F38D820",
+		DesignatorRootVeritySig: "6DB69DE6-29F4-4758-A7A5-962190F00CE3",
+		DesignatorUsr:           "B0E01050-EE5F-4390-949A-9101B17104E9",
+		DesignatorUsrVerity:     "6E11A4E7-FBCA-4DED-B9E9-E1A512BB664E",
+		DesignatorUsrVeritySig:  "C23CE4FF-44BD-4B00-B2D4-B41B3419E02A",
+	},
+	ArchIA64: {
+		DesignatorRoot:          "993D8D3D-F80E-4225-855A-9DAF8ED7EA97",
+		DesignatorRootVerity:    "86ED10D5-B607-45BB-8957-D350F23D0571",
+		DesignatorRootVeritySig: "E98B36EE-32BA-4882-9B12-0CE14655F46A",
+		DesignatorUsr:           "4301D2A6-4E3B-4B2A-BB94-9E0B2C4225EA",
+		DesignatorUsrVerity:     "6A491E03-3BE7-4545-8E38-83320E0EA880",
+		DesignatorUsrVeritySig:  "8DE58BC2-2A43-460D-B14E-A76E4A17B47F",
+	},
+	ArchLoongArch64: {
+		DesignatorRoot:          "77055800-792C-4F94-B39A-98C91B762BB6",
+		DesignatorRootVerity:    "F3393B22-E9AF-4613-A948-9D3BFBD0C535",
+		DesignatorRootVeritySig: "5AFB67EB-ECC8-4F85-AE8E-AC1E7C50E7D0",
+		DesignatorUsr:           "E611C702-575C-4CBE-9A46-434FA0BF7E3F",
+		DesignatorUsrVerity:     "F46B2C26-59AE-48F0-9106-C50ED47F673D",
+		DesignatorUsrVeritySig:  "B024F315-D330-444C-8461-44BBDE524E99",
+	},
+	ArchMIPS: {
+		DesignatorRoot:          "E9434544-6E2C-47CC-BAE2-12D6DEAFB44C",
+		DesignatorRootVerity:    "7A430799-F711-4C7E-8E5B-1D685BD48607",
+		DesignatorRootVeritySig: "BBA210A2-9C5D-45EE-9E87-FF2CCBD002D0",
+		DesignatorUsr:           "773B2ABC-2A99-4398-8BF5-03BAAC40D02B",
+		DesignatorUsrVerity:     "6E5A1BC8-D223-49B7-BCA8-37A5FCCEB996",
+		DesignatorUsrVeritySig:  "97AE158D-F216-497B-8057-F7F905770F54",
+	},
+	ArchMIPS64: {
+		DesignatorRoot:          "D113AF76-80EF-41B4-BDB6-0CFF4D3D4A25",
+		DesignatorRootVerity:    "579536F8-6A33-4055-A95A-DF2D5E2C42A8",
+		DesignatorRootVeritySig: "43CE94D4-0F3D-4999-8250-B9DEAFD98E6E",
+		DesignatorUsr:           "57E13958-7331-4365-8E6E-35EEEE17C61B",
+		DesignatorUsrVerity:     "81CF9D90-7458-4DF4-8DCF-C8A3A404F09B",
+		DesignatorUsrVeritySig:  "05816CE2-DD40-4AC6-A61D-37D32DC1BA7D",
+	},
+	ArchMIPSLE: {
+		DesignatorRoot:          "37C58C8A-D913-4156-A25F-48B1B64E07F0",
+		DesignatorRootVerity:    "D7D150D2-2A04-4A33-8F12-16651205FF7B",
+		DesignatorRootVeritySig: "C919CC1F-4456-4EFF-918C-F75E94525CA5",
+		DesignatorUsr:           "0F4868E9-9952-4706-979F-3ED3A473E947",
+		DesignatorUsrVerity:     "46B98D8D-B55C-4E8F-AAB3-37FCA7F80752",
+		DesignatorUsrVeritySig:  "3E23CA0B-A4BC-4B4E-8087-5AB6A26AA8A9",
+	},
+	ArchMIPS64LE: {
+		DesignatorRoot:          "700BDA43-7A34-4507-B179-EEB93D7A7CA3",
+		DesignatorRootVerity:    "16B417F8-3E06-4F57-8DD2-9B5232F41AA6",
+		DesignatorRootVeritySig: "904E58EF-5C65-4A31-9C57-6AF5FC7C5DE7",
+		DesignatorUsr:           "C97C1F32-BA06-40B4-9F22-236061B08AA8",
+		DesignatorUsrVerity:     "3C3D61FE-B5F3-414D-BB71-8739A694A4EF",
+		DesignatorUsrVeritySig:  "F2C2C7EE-ADCC-4351-B5C6-EE9816B66E16",
+	},
+	ArchPARISC: {
+		DesignatorRoot:          "1AACDB3B-5444-4138-BD9E-E5C2239B2346",
+		DesignatorRootVerity:    "D212A430-FBC5-49F9-A983-A7FEEF2B8D0E",
+		DesignatorRootVeritySig: "15DE6170-65D3-431C-916E-B0DCD8393F25",
+		DesignatorUsr:           "DC4A4480-6917-4262-A4EC-DB9384949F25",
+		DesignatorUsrVerity:     "5843D618-EC37-48D7-9F12-CEA8E08768B2",
+		DesignatorUsrVeritySig:  "450DD7D1-3224-45EC-9CF2-A43A346D71EE",
+	},
+	ArchPPC: {
+		DesignatorRoot:          "1DE3F1EF-FA98-47B5-8DCD-4A860A654D78",
+		DesignatorRootVerity:    "98CFE649-1588-46DC-B2F0-ADD147424925",
+		DesignatorRootVeritySig: "1B31B5AA-ADD9-463A-B2ED-BD467FC857E7",
+		DesignatorUsr:           "7D14FEC5-CC71-415D-9D6C-06BF0B3C3EAF",
+		DesignatorUsrVerity:     "DF765D00-270E-49E5-BC75-F47BB2118B09",
+		DesignatorUsrVeritySig:  "7007891D-D371-4A80-86A4-5CB875B9302E",
+	},
+	ArchPPC64: {
+		DesignatorRoot:          "912ADE1D-A839-4913-8964-A10EEE08FBD2",
+		DesignatorRootVerity:    "9225A9A3-3C19-4D89-B4F6-EEFF88F17631",
+		DesignatorRootVeritySig: "F5E2C20C-45B2-4FFA-BCE9-2A60737E1AAF",
+		DesignatorUsr:           "2C9739E2-F068-46B3-9FD0-01C5A9AFBCCA",
+		DesignatorUsrVerity:     "BDB528A5-A259-475F-A87D-DA53FA736A07",
+		DesignatorUsrVeritySig:  "0B888863-D7F8-4D9E-9766-239FCE4D58AF",
+	},
+	ArchPPC64LE: {
+		DesignatorRoot:          "C31C45E6-3F39-412E-80FB-4809C4980599",
+		DesignatorRootVerity:    "906BD944-4589-4AAE-A4E4-DD983917446A",
+		DesignatorRootVeritySig: "D4A236E7-E873-4C07-BF1D-BF6CF7F1C3C6",
+		DesignatorUsr:           "15BB03AF-77E7-4D4A-B12B-C0D084F7491C",
+		DesignatorUsrVerity:     "EE2B9983-21E8-4153-86D9-B6901A54D1CE",
+		DesignatorUsrVeritySig:  "C8BFBD1E-268E-4521-8BBA-BF314C399557",
+	},
+	ArchRISCV32: {
+		DesignatorRoot:          "60D5A7FE-8E7D-435C-B714-3DD8162144E1",
+		DesignatorRootVerity:    "AE0253BE-1167-4007-AC68-43926C14C5DE",
+		DesignatorRootVeritySig: "3A112A75-8729-4380-B4CF-764D79934448",
+		DesignatorUsr:           "B933FB22-5C3F-4F91-AF90-E2BB0FA50702",
+		DesignatorUsrVerity:     "CB1EE4E3-8CD0-4136-A0A4-AA61A32E8730",
+		DesignatorUsrVeritySig:  "C3836A13-3137-45BA-B583-B16C50FE5EB4",
+	},
+	ArchRISCV64: {
+		DesignatorRoot:          "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+		DesignatorRootVerity:    "B6ED5582-440B-4209-B8DA-5FF7C419EA3D",
+		DesignatorRootVeritySig: "EFE0F087-EA8D-4469-821A-4C2A96A8386A",
+		DesignatorUsr:           "BEAEC34B-8442-439B-A40B-984381ED097D",
+		DesignatorUsrVerity:     "8F1056BE-9B05-47C4-81D6-BE53128E5B54",
+		DesignatorUsrVeritySig:  "D2F9000A-7A18-453F-B5CD-4D32F77A7B32",
+	},
+	ArchS390: {
+		DesignatorRoot:          "08A7ACEA-624C-4A20-91E8-6E0FA67D23F9",
+		DesignatorRootVerity:    "7AC63B47-B25C-463B-8DF8-B4A94E6C90E1",
+		DesignatorRootVeritySig: "3482388E-4254-435A-A241-766A065F9960",
+		DesignatorUsr:           "CD0F869B-D0FB-4CA0-B141-9EA87CC78D66",
+		DesignatorUsrVerity:     "B663C618-E7BC-4D6D-90AA-11B756BB1797",
+		DesignatorUsrVeritySig:  "17440E4F-A8D0-467F-A46E-3912AE6EF2C5",
+	},
+	ArchS390X: {
+		DesignatorRoot:          "5EEAD9A9-FE09-4A1E-A1D7-520D00531306",
+		DesignatorRootVerity:    "B325BFBE-C7BE-4AB8-8357-139E652D2F6B",
+		DesignatorRootVeritySig: "C80187A5-73A3-491A-901A-017C3FA953E9",
+		DesignatorUsr:           "8A4F5770-50AA-4ED3-874A-99B710DB6FEA",
+		DesignatorUsrVerity:     "31741CC4-1A2A-4111-A581-E00B447D2D06",
+		DesignatorUsrVeritySig:  "3F324816-667B-46AE-86EE-9B0C0C6C11B4",
+	},
+	ArchTileGX: {
+		DesignatorRoot:          "C50CDD70-3862-4CC3-90E1-809A8C93EE2C",
+		DesignatorRootVerity:    "966061EC-28E4-4B2E-B4A5-1F0A825A1D84",
+		DesignatorRootVeritySig: "B3671439-97B0-4A53-90F7-2D5A8F3AD47B",
+		DesignatorUsr:           "55497029-C7C1-44CC-AA39-815ED1558630",
+		DesignatorUsrVerity:     "2FB4BF56-07FA-42DA-8132-6B139F2026AE",
+		DesignatorUsrVeritySig:  "4EDE75E2-6CCC-4CC8-B9C7-70334B087510",
+	},
+	ArchX86: {
+		DesignatorRoot:          "44479540-F297-41B2-9AF7-D131D5F0458A",
+		DesignatorRootVerity:    "D13C5D3B-B5D1-422A-B29F-9454FDC89D76",
+		DesignatorRootVeritySig: "5996FC05-109C-48DE-808B-23FA0830B676",
+		DesignatorUsr:           "75250D76-8CC6-458E-BD66-BD47CC81A812",
+		DesignatorUsrVerity:     "8F461B0D-14EE-4E81-9AA9-049B6FB97ABD",
+		DesignatorUsrVeritySig:  "974A71C0-DE41-43C3-BE5D-5C5CCD1AD2C0",
+	},
+	ArchX86_64: {
+		DesignatorRoot:          "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+		DesignatorRootVerity:    "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5",
+		DesignatorRootVeritySig: "41092B05-9FC8-4523-994F-2DEF0408B176",
+		DesignatorUsr:           "8484680C-9521-48C6-9C11-B0720656F69E",
+		DesignatorUsrVerity:     "77FF5F63-E7B6-4633-ACF4-1565B864C0E6",
+		DesignatorUsrVeritySig:  "E7BB33FB-06CF-4E81-8273-E543B413E2E2",
+	},
+}
+
+// TypeFor returns the partition type GUID of an architecture specific designator.
+func TypeFor(designator Designator, arch Arch) (Type, bool) {
+	typ, ok := archTypes[arch][designator]
+	return typ, ok
+}
+
+// Lookup returns the designator and, for architecture specific partitions, the architecture of a partition type.
+func Lookup(typ Type) (Designator, Arch, bool) {
+	if designator, ok := genericTypes[typ]; ok {
+		return designator, "", true
+	}
+	for arch, types := range archTypes {
+		for designator, archType := range types {
+			if archType == typ {
+				return designator, arch, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// String returns the systemd name of a known partition type (e.g. root-x86-64-verity) or the GUID otherwise.
+func (t Type) String() string {
+	designator, arch, ok := Lookup(t)
+	switch {
+	case !ok:
+		return string(t)
+	case arch == "":
+		return string(designator)
+	}
+	base, suffix, _ := strings.Cut(string(designator), "-")
+	if suffix == "" {
+		return base + "-" + string(arch)
+	}
+	return base + "-" + string(arch) + "-" + suffix
+}
+
+// ParseType returns the partition type of a systemd name (e.g. esp or root-x86-64-verity, see Type.String)
+// or of a type GUID.
+func ParseType(name string) (Type, error) {
+	if _, err := guidToBytes(name); err == nil {
+		return Type(strings.ToUpper(name)), nil
+	}
+	for typ := range genericTypes {
+		if typ.String() == name {
+			return typ, nil
+		}
+	}
+	for _, types := range archTypes {
+		for _, typ := range types {
+			if typ.String() == name {
+				return typ, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown partition type %q", name)
+}
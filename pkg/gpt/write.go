@@ -0,0 +1,257 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// ReadWriterAt is a disk that can be patched in place.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// SetPartitionUUIDs changes the UUIDs of the partitions with the given entry indices.
+// Both the primary and the backup GPT are updated and all checksums are recalculated.
+func SetPartitionUUIDs(f ReadWriterAt, blocksize int64, uuids map[int]string) error {
+	encoded := make(map[int][]byte, len(uuids))
+	for index, uuid := range uuids {
+		raw, err := guidToBytes(uuid)
+		if err != nil {
+			return err
+		}
+		encoded[index] = raw
+	}
+	update := func(entries []byte, entrySize int) error {
+		for index, raw := range encoded {
+			if (index+1)*entrySize > len(entries) {
+				return fmt.Errorf("partition entry %d out of range", index)
+			}
+			copy(entries[index*entrySize+16:index*entrySize+32], raw)
+		}
+		return nil
+	}
+
+	primary, err := readHeader(f, blocksize, 1)
+	if err != nil {
+		return fmt.Errorf("reading primary GPT header: %w", err)
+	}
+	backup, err := readHeader(f, blocksize, primary.AlternateLBA)
+	if err != nil {
+		return fmt.Errorf("reading backup GPT header: %w", err)
+	}
+	// the backup is written first so that an interruption leaves a consistent primary GPT
+	if err := rewrite(f, blocksize, backup, update); err != nil {
+		return fmt.Errorf("updating backup GPT: %w", err)
+	}
+	if err := rewrite(f, blocksize, primary, update); err != nil {
+		return fmt.Errorf("updating primary GPT: %w", err)
+	}
+	return nil
+}
+
+// rewrite applies update to the partition entry array of a GPT and writes back the entries
+// and the header with recalculated checksums.
+func rewrite(f ReadWriterAt, blocksize int64, header Header, update func(entries []byte, entrySize int) error) error {
+	entries := make([]byte, int64(header.NumEntries)*int64(header.EntrySize))
+	if _, err := f.ReadAt(entries, int64(header.EntriesLBA)*blocksize); err != nil {
+		return err
+	}
+	if crc := crc32.ChecksumIEEE(entries); crc != header.EntriesCRC32 {
+		return fmt.Errorf("partition entry array checksum mismatch: expected %08x, got %08x", header.EntriesCRC32, crc)
+	}
+	if err := update(entries, int(header.EntrySize)); err != nil {
+		return err
+	}
+
+	raw := make([]byte, header.HeaderSize)
+	if _, err := f.ReadAt(raw, int64(header.MyLBA)*blocksize); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(raw[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(raw[16:20], headerChecksum(raw))
+
+	if _, err := f.WriteAt(entries, int64(header.EntriesLBA)*blocksize); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(raw, int64(header.MyLBA)*blocksize)
+	return err
+}
+
+// Resize moves the backup GPT to the end of a disk that grew to size bytes, like when it is padded for a
+// virtual disk format, and extends the last usable block of both headers up to it. The protective MBR is
+// updated as well.
+func Resize(f ReadWriterAt, blocksize, size int64) error {
+	table, err := Read(f, blocksize)
+	if err != nil {
+		return err
+	}
+	primary := table.Header
+	lastLBA := size/blocksize - 1
+	if primary.AlternateLBA == uint64(lastLBA) {
+		return nil
+	}
+	entries := make([]byte, int64(primary.NumEntries)*int64(primary.EntrySize))
+	if _, err := f.ReadAt(entries, int64(primary.EntriesLBA)*blocksize); err != nil {
+		return err
+	}
+	entriesBlocks := (int64(len(entries)) + blocksize - 1) / blocksize
+	lastUsableLBA := lastLBA - 1 - entriesBlocks
+	for _, part := range table.Partitions {
+		if int64(part.LastLBA) > lastUsableLBA {
+			return fmt.Errorf("partition %d ends at block %d, after the last usable block %d of %d bytes", part.Index+1, part.LastLBA, lastUsableLBA, size)
+		}
+	}
+
+	raw := make([]byte, primary.HeaderSize)
+	if _, err := f.ReadAt(raw, blocksize); err != nil {
+		return err
+	}
+	header := func(myLBA, alternateLBA, entriesLBA int64) []byte {
+		header := bytes.Clone(raw)
+		binary.LittleEndian.PutUint64(header[24:32], uint64(myLBA))
+		binary.LittleEndian.PutUint64(header[32:40], uint64(alternateLBA))
+		binary.LittleEndian.PutUint64(header[48:56], uint64(lastUsableLBA))
+		binary.LittleEndian.PutUint64(header[72:80], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:20], headerChecksum(header))
+		return header
+	}
+
+	// the backup is written first so that an interruption leaves a consistent primary GPT
+	if _, err := f.WriteAt(entries, (lastLBA-entriesBlocks)*blocksize); err != nil {
+		return fmt.Errorf("writing backup GPT: %w", err)
+	}
+	if _, err := f.WriteAt(header(lastLBA, 1, lastLBA-entriesBlocks), lastLBA*blocksize); err != nil {
+		return fmt.Errorf("writing backup GPT: %w", err)
+	}
+	if _, err := f.WriteAt(header(1, lastLBA, int64(primary.EntriesLBA)), blocksize); err != nil {
+		return fmt.Errorf("writing primary GPT: %w", err)
+	}
+	// the old backup header is not found by its position anymore, but it would still be found by a scan
+	if old := int64(primary.AlternateLBA); old > 1 && old < lastLBA-entriesBlocks {
+		if _, err := f.WriteAt(make([]byte, blocksize), old*blocksize); err != nil {
+			return fmt.Errorf("clearing old backup GPT header: %w", err)
+		}
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i : 446+16*(i+1)]
+		if entry[4] == 0xEE && binary.LittleEndian.Uint32(entry[8:12]) == 1 {
+			binary.LittleEndian.PutUint32(entry[12:16], uint32(min(lastLBA, 0xFFFFFFFF)))
+			if _, err := f.WriteAt(entry[12:16], int64(446+16*i+12)); err != nil {
+				return fmt.Errorf("updating protective MBR: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	buildEntries   = 128
+	buildEntrySize = 128
+)
+
+// Build returns the partition table of a disk of size bytes with the given partitions (placed on the disk by
+// their FirstLBA and LastLBA and in the entry array by their Index): primary holds the protective MBR, the primary
+// header and the entry array and starts at the beginning of the disk, backup holds the backup entry
+// array and header and ends at the end of the disk.
+func Build(blocksize, size int64, diskGUID string, partitions []Partition) (primary, backup []byte, err error) {
+	entries := make([]byte, buildEntries*buildEntrySize)
+	for _, part := range partitions {
+		if part.Index < 0 || part.Index >= buildEntries {
+			return nil, nil, fmt.Errorf("partition %d exceeds the %d entries of the partition table", part.Index+1, buildEntries)
+		}
+		entry := entries[part.Index*buildEntrySize : (part.Index+1)*buildEntrySize]
+		if !bytes.Equal(entry[0:16], make([]byte, 16)) {
+			return nil, nil, fmt.Errorf("partition %d is given twice", part.Index+1)
+		}
+		typ, err := guidToBytes(string(part.Type))
+		if err != nil {
+			return nil, nil, err
+		}
+		uuid, err := guidToBytes(part.UUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		copy(entry[0:16], typ)
+		copy(entry[16:32], uuid)
+		binary.LittleEndian.PutUint64(entry[32:40], part.FirstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], part.LastLBA)
+		binary.LittleEndian.PutUint64(entry[48:56], part.Attributes)
+		name := utf16.Encode([]rune(part.Name))
+		if len(name) > 36 {
+			return nil, nil, fmt.Errorf("partition label %q is too long", part.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+2*j:], c)
+		}
+	}
+	guid, err := guidToBytes(diskGUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	entriesBlocks := (int64(len(entries)) + blocksize - 1) / blocksize
+	lastLBA := size/blocksize - 1
+	header := func(myLBA, alternateLBA, entriesLBA int64) []byte {
+		header := make([]byte, blocksize)
+		copy(header, headerSignature)
+		binary.LittleEndian.PutUint32(header[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(header[12:16], minHeaderSize)
+		binary.LittleEndian.PutUint64(header[24:32], uint64(myLBA))
+		binary.LittleEndian.PutUint64(header[32:40], uint64(alternateLBA))
+		binary.LittleEndian.PutUint64(header[40:48], uint64(2+entriesBlocks))
+		binary.LittleEndian.PutUint64(header[48:56], uint64(lastLBA-1-entriesBlocks))
+		copy(header[56:72], guid)
+		binary.LittleEndian.PutUint64(header[72:80], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(header[80:84], buildEntries)
+		binary.LittleEndian.PutUint32(header[84:88], buildEntrySize)
+		binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:20], headerChecksum(header[:minHeaderSize]))
+		return header
+	}
+	for _, part := range partitions {
+		if int64(part.FirstLBA) < 2+entriesBlocks || int64(part.LastLBA) > lastLBA-1-entriesBlocks || part.LastLBA < part.FirstLBA {
+			return nil, nil, fmt.Errorf("partition %q at blocks %d-%d is outside of the usable blocks", part.Name, part.FirstLBA, part.LastLBA)
+		}
+	}
+
+	primary = make([]byte, (2+entriesBlocks)*blocksize)
+	mbr := primary[446:462]
+	mbr[4] = 0xEE // protective partition covering the disk
+	binary.LittleEndian.PutUint32(mbr[8:12], 1)
+	binary.LittleEndian.PutUint32(mbr[12:16], uint32(min(lastLBA, 0xFFFFFFFF)))
+	primary[510], primary[511] = 0x55, 0xAA
+	copy(primary[blocksize:], header(1, lastLBA, 2))
+	copy(primary[2*blocksize:], entries)
+
+	backup = make([]byte, (1+entriesBlocks)*blocksize)
+	copy(backup, entries)
+	copy(backup[entriesBlocks*blocksize:], header(lastLBA, 1, lastLBA-entriesBlocks))
+	return primary, backup, nil
+}
+
+// guidToBytes converts a GUID string into its mixed-endian on-disk form.
+func guidToBytes(guid string) ([]byte, error) {
+	plain := strings.ReplaceAll(guid, "-", "")
+	raw, err := hex.DecodeString(plain)
+	if err != nil || len(raw) != 16 || len(guid) != 36 {
+		return nil, fmt.Errorf("invalid GUID %q", guid)
+	}
+	out := make([]byte, 16)
+	binary.LittleEndian.PutUint32(out[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(out[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(out[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(out[8:], raw[8:])
+	return out, nil
+}
@@ -0,0 +1,314 @@
+// Package pkcs7 implements the subset of PKCS #7 (RFC 2315) SignedData
+// needed for detached signatures as used by dm-verity root hash signatures.
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidEncryptionRSA         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidEncryptionRSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidEncryptionRSASHA384   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidEncryptionRSASHA512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidEncryptionECDSA       = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidEncryptionECDSASHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidEncryptionECDSASHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidEncryptionECDSASHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEncryptionEd25519     = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// encryptionAlgorithms are the accepted digest encryption algorithms of signer infos: the key type
+// alone (hash 0, the digest algorithm of the signer info applies) or the key type with a digest.
+var encryptionAlgorithms = []struct {
+	oid     asn1.ObjectIdentifier
+	keyType string
+	hash    crypto.Hash
+}{
+	{oid: oidEncryptionRSA, keyType: "rsa"},
+	{oid: oidEncryptionRSASHA256, keyType: "rsa", hash: crypto.SHA256},
+	{oid: oidEncryptionRSASHA384, keyType: "rsa", hash: crypto.SHA384},
+	{oid: oidEncryptionRSASHA512, keyType: "rsa", hash: crypto.SHA512},
+	{oid: oidEncryptionECDSA, keyType: "ecdsa"},
+	{oid: oidEncryptionECDSASHA256, keyType: "ecdsa", hash: crypto.SHA256},
+	{oid: oidEncryptionECDSASHA384, keyType: "ecdsa", hash: crypto.SHA384},
+	{oid: oidEncryptionECDSASHA512, keyType: "ecdsa", hash: crypto.SHA512},
+	{oid: oidEncryptionEd25519, keyType: "ed25519"},
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// SignedData is a parsed PKCS #7 SignedData structure.
+type SignedData struct {
+	// Certificates are the certificates embedded in the structure (may be empty).
+	Certificates []*x509.Certificate
+	signers      []signerInfo
+}
+
+// Parse parses a DER encoded PKCS #7 ContentInfo holding SignedData.
+func Parse(der []byte) (*SignedData, error) {
+	var info contentInfo
+	rest, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("parsing content info: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after content info")
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unsupported content type %s", info.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("parsing signed data: %w", err)
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, errors.New("signed data has no signers")
+	}
+	result := &SignedData{signers: sd.SignerInfos}
+	if len(sd.Certificates.Bytes) > 0 {
+		result.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing embedded certificates: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// VerifyDetached checks that a signer identified by cert signed content.
+// The certificate itself is trusted as is, no chain validation is performed.
+func (s *SignedData) VerifyDetached(content []byte, cert *x509.Certificate) error {
+	for _, signer := range s.signers {
+		if !signer.issuedBy(cert) {
+			continue
+		}
+		return signer.verify(content, cert)
+	}
+	return errors.New("no signer matches the certificate")
+}
+
+// SignDetached creates a detached SHA-256 signature over content without authenticated attributes,
+// equivalent to openssl's PKCS7_sign with PKCS7_DETACHED|PKCS7_NOATTR|PKCS7_BINARY.
+// The signing certificate is embedded.
+func SignDetached(content []byte, cert *x509.Certificate, signer crypto.Signer) ([]byte, error) {
+	var encryptionAlgorithm asn1.ObjectIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		encryptionAlgorithm = oidEncryptionRSA
+	case *ecdsa.PublicKey:
+		encryptionAlgorithm = oidEncryptionECDSASHA256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer.Public())
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("private key does not match certificate")
+	}
+
+	digest := sha256.Sum256(content)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	digestAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidDigestSHA256, Parameters: asn1.NullRawValue}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlgorithm},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           digestAlgorithm,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: encryptionAlgorithm},
+			EncryptedDigest:           signature,
+		}},
+	}
+	if encryptionAlgorithm.Equal(oidEncryptionRSA) {
+		sd.SignerInfos[0].DigestEncryptionAlgorithm.Parameters = asn1.NullRawValue
+	}
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("encoding signed data: %w", err)
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER},
+	})
+}
+
+func (si signerInfo) issuedBy(cert *x509.Certificate) bool {
+	return bytes.Equal(si.IssuerAndSerialNumber.Issuer.FullBytes, cert.RawIssuer) &&
+		si.IssuerAndSerialNumber.SerialNumber.Cmp(cert.SerialNumber) == 0
+}
+
+func (si signerInfo) verify(content []byte, cert *x509.Certificate) error {
+	hash, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return err
+	}
+	signed := content
+	if len(si.AuthenticatedAttributes.FullBytes) > 0 {
+		h := hash.New()
+		h.Write(content)
+		if err := checkMessageDigest(si.AuthenticatedAttributes.Bytes, h.Sum(nil)); err != nil {
+			return err
+		}
+		// the signature covers the DER encoding of the attributes as a SET OF
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+	if err := checkEncryptionAlgorithm(si.DigestEncryptionAlgorithm.Algorithm, cert.PublicKey, hash); err != nil {
+		return err
+	}
+	algo, err := signatureAlgorithm(cert.PublicKey, hash)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(algo, signed, si.EncryptedDigest); err != nil {
+		return fmt.Errorf("verifying signature: %w", err)
+	}
+	return nil
+}
+
+func checkMessageDigest(rawAttributes, digest []byte) error {
+	for len(rawAttributes) > 0 {
+		var attr attribute
+		var err error
+		rawAttributes, err = asn1.Unmarshal(rawAttributes, &attr)
+		if err != nil {
+			return fmt.Errorf("parsing authenticated attributes: %w", err)
+		}
+		if !attr.Type.Equal(oidAttributeMessageDigest) {
+			continue
+		}
+		var messageDigest []byte
+		if _, err := asn1.Unmarshal(attr.Values.Bytes, &messageDigest); err != nil {
+			return fmt.Errorf("parsing message digest attribute: %w", err)
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			return errors.New("message digest does not match content")
+		}
+		return nil
+	}
+	return errors.New("authenticated attributes lack a message digest")
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidDigestSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidDigestSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidDigestSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+// checkEncryptionAlgorithm checks that the digest encryption algorithm of a signer info is known and
+// matches the key of the certificate and the digest algorithm.
+func checkEncryptionAlgorithm(oid asn1.ObjectIdentifier, pub crypto.PublicKey, hash crypto.Hash) error {
+	var keyType string
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		keyType = "rsa"
+	case *ecdsa.PublicKey:
+		keyType = "ecdsa"
+	case ed25519.PublicKey:
+		keyType = "ed25519"
+	}
+	for _, algorithm := range encryptionAlgorithms {
+		if !algorithm.oid.Equal(oid) {
+			continue
+		}
+		if algorithm.keyType != keyType {
+			return fmt.Errorf("signature algorithm %s does not match the %T of the certificate", oid, pub)
+		}
+		if algorithm.hash != 0 && algorithm.hash != hash {
+			return fmt.Errorf("signature algorithm %s does not match the digest algorithm %s", oid, hash)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature algorithm %s", oid)
+}
+
+func signatureAlgorithm(pub crypto.PublicKey, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported public key type %T with digest %s", pub, hash)
+}
@@ -0,0 +1,231 @@
+package pkcs7
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDetached(t *testing.T) {
+	content, err := os.ReadFile("testdata/content.txt")
+	require.NoError(t, err)
+	rsaCert := testCertificate(t, "testdata/rsa-cert.pem")
+	ecCert := testCertificate(t, "testdata/ec-cert.pem")
+
+	testCases := map[string]struct {
+		signature string
+		content   []byte
+		cert      *x509.Certificate
+		wantErr   bool
+	}{
+		"rsa without attributes": {
+			signature: "testdata/rsa-noattr.p7s",
+			content:   content,
+			cert:      rsaCert,
+		},
+		"ecdsa with attributes": {
+			signature: "testdata/ec-attr.p7s",
+			content:   content,
+			cert:      ecCert,
+		},
+		"rsa tampered content": {
+			signature: "testdata/rsa-noattr.p7s",
+			content:   append([]byte{'0'}, content[1:]...),
+			cert:      rsaCert,
+			wantErr:   true,
+		},
+		"ecdsa tampered content": {
+			signature: "testdata/ec-attr.p7s",
+			content:   content[1:],
+			cert:      ecCert,
+			wantErr:   true,
+		},
+		"wrong certificate": {
+			signature: "testdata/rsa-noattr.p7s",
+			content:   content,
+			cert:      ecCert,
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			der, err := os.ReadFile(tc.signature)
+			require.NoError(t, err)
+			sd, err := Parse(der)
+			require.NoError(t, err)
+			assert.Len(t, sd.Certificates, 1)
+
+			err = sd.VerifyDetached(tc.content, tc.cert)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse([]byte("not der"))
+	assert.Error(t, err)
+
+	der, err := os.ReadFile("testdata/rsa-noattr.p7s")
+	require.NoError(t, err)
+	_, err = Parse(append(der, 0))
+	assert.Error(t, err)
+}
+
+func testCertificate(t *testing.T, path string) *x509.Certificate {
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(raw)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestSignDetached(t *testing.T) {
+	content := []byte("2c9d3a245d76ef1ae0d199afc0a7332e00bfa1e4b99f0de65c20e9f0942beb26")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			cert := selfSignedCertificate(t, key)
+
+			der, err := SignDetached(content, cert, key)
+			require.NoError(err)
+			sd, err := Parse(der)
+			require.NoError(err)
+			require.Len(sd.Certificates, 1)
+			assert.Equal(cert.Raw, sd.Certificates[0].Raw)
+			assert.NoError(sd.VerifyDetached(content, cert))
+			assert.Error(sd.VerifyDetached(content[1:], cert))
+		})
+	}
+
+	_, err = SignDetached(content, selfSignedCertificate(t, rsaKey), ecKey)
+	assert.Error(t, err)
+}
+
+func TestVerifyEncryptionAlgorithm(t *testing.T) {
+	content := []byte("2c9d3a245d76ef1ae0d199afc0a7332e00bfa1e4b99f0de65c20e9f0942beb26")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cert := selfSignedCertificate(t, rsaKey)
+	der, err := SignDetached(content, cert, rsaKey)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		oid     asn1.ObjectIdentifier
+		wantErr string
+	}{
+		"rsa": {
+			oid: oidEncryptionRSA,
+		},
+		"rsa with sha256": {
+			oid: oidEncryptionRSASHA256,
+		},
+		"rsa with sha1": {
+			oid:     asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5},
+			wantErr: "unsupported signature algorithm 1.2.840.113549.1.1.5",
+		},
+		"rsa with other digest": {
+			oid:     oidEncryptionRSASHA384,
+			wantErr: "does not match the digest algorithm",
+		},
+		"ecdsa": {
+			oid:     oidEncryptionECDSASHA256,
+			wantErr: "does not match the *rsa.PublicKey",
+		},
+		"unknown": {
+			oid:     asn1.ObjectIdentifier{1, 2, 3, 4},
+			wantErr: "unsupported signature algorithm 1.2.3.4",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sd, err := Parse(der)
+			require.NoError(t, err)
+			sd.signers[0].DigestEncryptionAlgorithm.Algorithm = tc.oid
+			err = sd.VerifyDetached(content, cert)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestVerifyDigestAlgorithm(t *testing.T) {
+	content := []byte("2c9d3a245d76ef1ae0d199afc0a7332e00bfa1e4b99f0de65c20e9f0942beb26")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cert := selfSignedCertificate(t, rsaKey)
+	der, err := SignDetached(content, cert, rsaKey)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		oid     asn1.ObjectIdentifier
+		wantErr string
+	}{
+		"sha256": {
+			oid: oidDigestSHA256,
+		},
+		"sha1": {
+			oid:     asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26},
+			wantErr: "unsupported digest algorithm 1.3.14.3.2.26",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sd, err := Parse(der)
+			require.NoError(t, err)
+			sd.signers[0].DigestAlgorithm.Algorithm = tc.oid
+			err = sd.VerifyDetached(content, cert)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func selfSignedCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
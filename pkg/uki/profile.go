@@ -0,0 +1,121 @@
+package uki
+
+import (
+	"bufio"
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Section locates a PE section within the UKI file.
+type Section struct {
+	Name   string
+	Offset int64
+	Size   int64
+}
+
+// Profile is a profile of a multi-profile UKI. Sections preceding the first .profile section form
+// the base, which every profile inherits unless it carries a section of the same name itself.
+// UKIs without .profile sections have a single profile 0 consisting of the base.
+type Profile struct {
+	Index int
+	// ID and Title are read from the .profile section and empty for UKIs without profiles.
+	ID    string
+	Title string
+	// Sections are the effective sections of the profile, including the inherited base sections.
+	Sections []Section
+}
+
+// Section returns the effective section of the profile with the given name.
+func (p Profile) Section(name string) (Section, bool) {
+	for _, section := range p.Sections {
+		if section.Name == name {
+			return section, true
+		}
+	}
+	return Section{}, false
+}
+
+// String returns the index of the profile followed by its ID and title, if set.
+func (p Profile) String() string {
+	s := fmt.Sprintf("%d", p.Index)
+	if p.ID != "" {
+		s += " " + p.ID
+	}
+	if p.Title != "" {
+		s += fmt.Sprintf(" (%s)", p.Title)
+	}
+	return s
+}
+
+// Profiles returns the profiles of the UKI.
+func Profiles(r io.ReaderAt) ([]Profile, error) {
+	file, err := pe.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	var base []Section
+	var profiles []Profile
+	for _, s := range file.Sections {
+		section := Section{Name: s.Name, Offset: int64(s.Offset), Size: int64(s.VirtualSize)}
+		if section.Name == ".profile" {
+			content := make([]byte, min(section.Size, int64(s.Size)))
+			if _, err := s.ReadAt(content, 0); err != nil {
+				return nil, fmt.Errorf("reading .profile section %d: %w", len(profiles), err)
+			}
+			fields := parseOSRelease(content)
+			profiles = append(profiles, Profile{Index: len(profiles), ID: fields["ID"], Title: fields["TITLE"]})
+			continue
+		}
+		if len(profiles) == 0 {
+			base = append(base, section)
+			continue
+		}
+		current := &profiles[len(profiles)-1]
+		current.Sections = append(current.Sections, section)
+	}
+	if len(profiles) == 0 {
+		return []Profile{{Sections: base}}, nil
+	}
+	for i := range profiles {
+		for _, section := range base {
+			if _, ok := profiles[i].Section(section.Name); !ok {
+				profiles[i].Sections = append(profiles[i].Sections, section)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// FindProfile returns the profile with the given index or ID.
+func FindProfile(profiles []Profile, profile string) (Profile, error) {
+	for _, p := range profiles {
+		if p.ID == profile || fmt.Sprintf("%d", p.Index) == profile {
+			return p, nil
+		}
+	}
+	return Profile{}, fmt.Errorf("profile %q not found", profile)
+}
+
+// parseOSRelease parses KEY=value lines in os-release format, removing quotes around values.
+func parseOSRelease(content []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(content, "\x00")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		fields[key] = value
+	}
+	return fields
+}
@@ -0,0 +1,65 @@
+package uki
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/malt3/ddi-tool/pkg/uki/ukitest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	testCases := map[string]struct {
+		sections []ukitest.Section
+		want     []string
+		// cmdlines are the contents of the effective .cmdline section per profile
+		cmdlines []string
+	}{
+		"no profiles": {
+			sections: []ukitest.Section{
+				{Name: ".cmdline", Data: []byte("base")},
+				{Name: ".linux", Data: []byte("kernel")},
+			},
+			want:     []string{"0"},
+			cmdlines: []string{"base"},
+		},
+		"profiles inherit base": {
+			sections: []ukitest.Section{
+				{Name: ".cmdline", Data: []byte("base")},
+				{Name: ".linux", Data: []byte("kernel")},
+				{Name: ".profile", Data: []byte("ID=default\nTITLE=\"Default\"\n")},
+				{Name: ".profile", Data: []byte("ID=factory-reset\nTITLE='Factory Reset'\n")},
+				{Name: ".cmdline", Data: []byte("reset")},
+				{Name: ".profile", Data: []byte("# no id\n")},
+			},
+			want:     []string{"0 default (Default)", "1 factory-reset (Factory Reset)", "2"},
+			cmdlines: []string{"base", "reset", "base"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			file := ukitest.Build(ukitest.MachineAMD64, tc.sections...)
+			profiles, err := Profiles(bytes.NewReader(file))
+			require.NoError(err)
+			require.Len(profiles, len(tc.want))
+			for i, profile := range profiles {
+				assert.Equal(tc.want[i], profile.String())
+				section, ok := profile.Section(".cmdline")
+				require.True(ok)
+				assert.Equal(tc.cmdlines[i], string(file[section.Offset:section.Offset+section.Size]))
+				_, ok = profile.Section(".linux")
+				assert.True(ok)
+			}
+
+			_, err = FindProfile(profiles, "factory-reset")
+			assert.Equal(len(profiles) > 1, err == nil)
+			_, err = FindProfile(profiles, "0")
+			assert.NoError(err)
+		})
+	}
+}
@@ -3,7 +3,10 @@ package uki
 import (
 	"debug/pe"
 	"errors"
+	"fmt"
 	"io"
+
+	"github.com/malt3/ddi-tool/pkg/gpt"
 )
 
 func SectionBounds(r io.ReaderAt, name string) (int64, int64, error) {
@@ -17,3 +20,40 @@ func SectionBounds(r io.ReaderAt, name string) (int64, int64, error) {
 	}
 	return int64(section.Offset), int64(section.VirtualSize), nil
 }
+
+// IsUKI reports whether r is a PE file with the sections of a unified kernel image.
+// PE files without a .linux section (boot loaders, addons) are no UKIs.
+func IsUKI(r io.ReaderAt) bool {
+	file, err := pe.NewFile(r)
+	if err != nil {
+		return false
+	}
+	return file.Section(".linux") != nil
+}
+
+// machineArchs maps PE machine types to the architecture names of the Discoverable Partitions Specification.
+var machineArchs = map[uint16]gpt.Arch{
+	pe.IMAGE_FILE_MACHINE_I386:        gpt.ArchX86,
+	pe.IMAGE_FILE_MACHINE_AMD64:       gpt.ArchX86_64,
+	pe.IMAGE_FILE_MACHINE_IA64:        gpt.ArchIA64,
+	pe.IMAGE_FILE_MACHINE_ARM:         gpt.ArchARM,
+	pe.IMAGE_FILE_MACHINE_ARMNT:       gpt.ArchARM,
+	pe.IMAGE_FILE_MACHINE_THUMB:       gpt.ArchARM,
+	pe.IMAGE_FILE_MACHINE_ARM64:       gpt.ArchARM64,
+	pe.IMAGE_FILE_MACHINE_RISCV32:     gpt.ArchRISCV32,
+	pe.IMAGE_FILE_MACHINE_RISCV64:     gpt.ArchRISCV64,
+	pe.IMAGE_FILE_MACHINE_LOONGARCH64: gpt.ArchLoongArch64,
+}
+
+// Arch returns the architecture of the PE file from the Machine field of its COFF header.
+func Arch(r io.ReaderAt) (gpt.Arch, error) {
+	file, err := pe.NewFile(r)
+	if err != nil {
+		return "", err
+	}
+	arch, ok := machineArchs[file.Machine]
+	if !ok {
+		return "", fmt.Errorf("unknown PE machine type 0x%x", file.Machine)
+	}
+	return arch, nil
+}
@@ -0,0 +1,65 @@
+// Package ukitest builds minimal PE files with arbitrary sections for tests.
+package ukitest
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// MachineAMD64 and the other constants are the PE machine types of common architectures.
+	MachineAMD64   = 0x8664
+	MachineARM64   = 0xaa64
+	MachineI386    = 0x14c
+	MachineRISCV64 = 0x5064
+
+	peOffset   = 0x40
+	fileAlign  = 0x200
+	headerSize = 24
+)
+
+// Section is a PE section. VirtualSize defaults to the size of Data.
+type Section struct {
+	Name        string
+	Data        []byte
+	VirtualSize uint32
+}
+
+// Build returns a PE file for the machine containing the sections in the given order.
+// Section names may repeat, like in multi-profile UKIs.
+func Build(machine uint16, sections ...Section) []byte {
+	headersEnd := peOffset + headerSize + 40*len(sections)
+	offset := align(headersEnd)
+	out := make([]byte, offset)
+	copy(out[0:2], "MZ")
+	binary.LittleEndian.PutUint32(out[0x3C:], peOffset)
+	copy(out[peOffset:], "PE\x00\x00")
+	coff := out[peOffset+4:]
+	binary.LittleEndian.PutUint16(coff[0:2], machine)
+	binary.LittleEndian.PutUint16(coff[2:4], uint16(len(sections)))
+	binary.LittleEndian.PutUint16(coff[18:20], 0x0202) // executable, debug stripped
+
+	virtualAddress := uint32(0x1000)
+	for i, section := range sections {
+		header := out[peOffset+headerSize+40*i:]
+		copy(header[0:8], section.Name)
+		virtualSize := section.VirtualSize
+		if virtualSize == 0 {
+			virtualSize = uint32(len(section.Data))
+		}
+		rawSize := align(len(section.Data))
+		binary.LittleEndian.PutUint32(header[8:12], virtualSize)
+		binary.LittleEndian.PutUint32(header[12:16], virtualAddress)
+		binary.LittleEndian.PutUint32(header[16:20], uint32(rawSize))
+		binary.LittleEndian.PutUint32(header[20:24], uint32(len(out)))
+		binary.LittleEndian.PutUint32(header[36:40], 0x40000040) // initialized data, readable
+		data := make([]byte, rawSize)
+		copy(data, section.Data)
+		out = append(out, data...)
+		virtualAddress += max((virtualSize+0xFFF)&^0xFFF, 0x1000)
+	}
+	return out
+}
+
+func align(n int) int {
+	return (n + fileAlign - 1) &^ (fileAlign - 1)
+}
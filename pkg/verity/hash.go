@@ -0,0 +1,299 @@
+package verity
+
+import (
+	"context"
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+const defaultWindowSize = 8 << 20
+
+// Params describes how a dm-verity hash tree is built.
+type Params struct {
+	// HashType is 1 for the normal format and 0 for the original Chrome OS format.
+	HashType      uint32
+	Algorithm     string
+	DataBlockSize int64
+	HashBlockSize int64
+	Salt          []byte
+}
+
+// ProgressFunc is called with the number of data bytes hashed so far and the total number of data bytes.
+type ProgressFunc func(done, total int64)
+
+// Hasher computes dm-verity root hashes.
+// Leaf blocks are hashed concurrently while the upper levels of the tree are built incrementally,
+// so only a single partial hash block per level is kept in memory.
+type Hasher struct {
+	Params Params
+	// Workers is the number of goroutines hashing data blocks (defaults to GOMAXPROCS).
+	Workers int
+	// WindowSize is the size of a single ReadAt on the data (defaults to 8 MiB).
+	// It is rounded down to a multiple of the data block size.
+	WindowSize int64
+	// Progress is called after every window (optional).
+	Progress ProgressFunc
+}
+
+// RootHash computes the root hash over dataSize bytes of data starting at offset.
+func (h *Hasher) RootHash(ctx context.Context, r io.ReaderAt, offset, dataSize int64) ([]byte, error) {
+	hashFn, err := hashFunc(h.Params.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Params.validate(hashFn.Size()); err != nil {
+		return nil, err
+	}
+	if dataSize%h.Params.DataBlockSize != 0 {
+		return nil, fmt.Errorf("data size %d is not a multiple of the data block size %d", dataSize, h.Params.DataBlockSize)
+	}
+	dataBlocks := dataSize / h.Params.DataBlockSize
+	if dataBlocks == 0 {
+		return nil, errors.New("no data blocks")
+	}
+
+	windowSize := h.WindowSize
+	if windowSize <= 0 {
+		windowSize = defaultWindowSize
+	}
+	windowSize = max(windowSize-windowSize%h.Params.DataBlockSize, h.Params.DataBlockSize)
+	workers := h.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	windows := (dataSize + windowSize - 1) / windowSize
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// inFlight bounds the number of windows whose digests are waiting to be consumed in order.
+	inFlight := make(chan struct{}, 2*workers)
+	indices := make(chan int64)
+	results := make(chan windowResult, 2*workers)
+
+	go func() {
+		defer close(indices)
+		for i := int64(0); i < windows; i++ {
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, windowSize)
+			hasher := hashFn.New()
+			for index := range indices {
+				start := index * windowSize
+				size := min(windowSize, dataSize-start)
+				digests, err := h.hashWindow(hasher, r, buf[:size], offset+start)
+				select {
+				case results <- windowResult{index: index, size: size, digests: digests, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	tree := newTreeBuilder(hashFn, h.Params, dataBlocks)
+	pending := make(map[int64]windowResult)
+	var next, done int64
+	for next < windows {
+		var result windowResult
+		var ok bool
+		select {
+		case result, ok = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !ok {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("hash workers exited early")
+		}
+		if result.err != nil {
+			return nil, fmt.Errorf("hashing data at offset %d: %w", offset+result.index*windowSize, result.err)
+		}
+		pending[result.index] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			digestSize := hashFn.Size()
+			for i := 0; i+digestSize <= len(result.digests); i += digestSize {
+				tree.add(0, result.digests[i:i+digestSize])
+			}
+			<-inFlight
+			next++
+			done += result.size
+			if h.Progress != nil {
+				h.Progress(done, dataSize)
+			}
+		}
+	}
+	return tree.finish(), nil
+}
+
+func (h *Hasher) hashWindow(hasher hash.Hash, r io.ReaderAt, buf []byte, off int64) ([]byte, error) {
+	n, err := r.ReadAt(buf, off)
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(buf)) {
+		return nil, err
+	}
+	blockSize := h.Params.DataBlockSize
+	digests := make([]byte, 0, int64(len(buf))/blockSize*int64(hasher.Size()))
+	for start := int64(0); start < int64(len(buf)); start += blockSize {
+		digests = h.Params.sum(hasher, digests, buf[start:start+blockSize])
+	}
+	return digests, nil
+}
+
+type windowResult struct {
+	index   int64
+	size    int64
+	digests []byte
+	err     error
+}
+
+// treeBuilder folds the digests of one level into hash blocks of the next level.
+// Level 0 receives the digests of the data blocks, the digest of the single block
+// of the top level is the root hash.
+type treeBuilder struct {
+	hasher    hash.Hash
+	params    Params
+	entrySize int
+	perBlock  int
+	levels    int
+	blocks    [][]byte
+	filled    []int
+	root      []byte
+}
+
+func newTreeBuilder(hashFn crypto.Hash, params Params, dataBlocks int64) *treeBuilder {
+	levels := treeLevels(params, hashFn.Size(), dataBlocks)
+	b := &treeBuilder{
+		hasher:    hashFn.New(),
+		params:    params,
+		entrySize: params.entrySize(hashFn.Size()),
+		perBlock:  1 << perBlockBits(params, hashFn.Size()),
+		levels:    levels,
+		blocks:    make([][]byte, levels),
+		filled:    make([]int, levels),
+	}
+	for i := range b.blocks {
+		b.blocks[i] = make([]byte, params.HashBlockSize)
+	}
+	return b
+}
+
+func (b *treeBuilder) add(level int, digest []byte) {
+	if level == b.levels {
+		b.root = append([]byte(nil), digest...)
+		return
+	}
+	copy(b.blocks[level][b.filled[level]*b.entrySize:], digest)
+	b.filled[level]++
+	if b.filled[level] == b.perBlock {
+		b.flush(level)
+	}
+}
+
+func (b *treeBuilder) flush(level int) {
+	digest := b.params.sum(b.hasher, nil, b.blocks[level])
+	clear(b.blocks[level])
+	b.filled[level] = 0
+	b.add(level+1, digest)
+}
+
+func (b *treeBuilder) finish() []byte {
+	for level := 0; level < b.levels; level++ {
+		if b.filled[level] > 0 {
+			b.flush(level)
+		}
+	}
+	return b.root
+}
+
+func (p Params) validate(digestSize int) error {
+	if p.HashType > 1 {
+		return fmt.Errorf("unsupported hash type %d", p.HashType)
+	}
+	for _, size := range []int64{p.DataBlockSize, p.HashBlockSize} {
+		if size < 512 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid block size %d", size)
+		}
+	}
+	if int64(p.entrySize(digestSize)) > p.HashBlockSize {
+		return errors.New("digest does not fit into hash block")
+	}
+	return nil
+}
+
+// entrySize is the space a single digest occupies in a hash block.
+func (p Params) entrySize(digestSize int) int {
+	if p.HashType == 0 {
+		return digestSize
+	}
+	return 1 << bits.Len(uint(digestSize-1))
+}
+
+// sum appends the salted digest of block to dst.
+func (p Params) sum(hasher hash.Hash, dst, block []byte) []byte {
+	hasher.Reset()
+	if p.HashType == 1 {
+		hasher.Write(p.Salt)
+		hasher.Write(block)
+	} else {
+		hasher.Write(block)
+		hasher.Write(p.Salt)
+	}
+	return hasher.Sum(dst)
+}
+
+func hashFunc(algorithm string) (crypto.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return crypto.SHA1, nil
+	case "sha256":
+		return crypto.SHA256, nil
+	case "sha512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+}
+
+// DigestSize returns the size of a digest of the hash algorithm.
+func DigestSize(algorithm string) (int, error) {
+	hashFn, err := hashFunc(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	return hashFn.Size(), nil
+}
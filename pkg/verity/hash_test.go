@@ -0,0 +1,172 @@
+package verity
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootHash(t *testing.T) {
+	salt := bytes.Repeat([]byte{0xab}, 32)
+	testCases := map[string]struct {
+		params     Params
+		dataBlocks int
+		workers    int
+		windowSize int64
+	}{
+		"single block": {
+			params:     Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 4096, HashBlockSize: 4096, Salt: salt},
+			dataBlocks: 1,
+		},
+		"one full hash block": {
+			params:     Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512, Salt: salt},
+			dataBlocks: 16,
+		},
+		"three levels": {
+			params:     Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512, Salt: salt},
+			dataBlocks: 16*16 + 3,
+			workers:    3,
+			windowSize: 3 * 512,
+		},
+		"unaligned window": {
+			params:     Params{HashType: 1, Algorithm: "sha512", DataBlockSize: 1024, HashBlockSize: 4096, Salt: salt},
+			dataBlocks: 1000,
+			workers:    7,
+			windowSize: 5000,
+		},
+		"chrome os format": {
+			params:     Params{HashType: 0, Algorithm: "sha1", DataBlockSize: 512, HashBlockSize: 512, Salt: salt[:7]},
+			dataBlocks: 555,
+			workers:    2,
+			windowSize: 4096,
+		},
+		"no salt": {
+			params:     Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 4096, HashBlockSize: 4096},
+			dataBlocks: 300,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			data := make([]byte, 4096+tc.dataBlocks*int(tc.params.DataBlockSize))
+			rand.New(rand.NewSource(int64(tc.dataBlocks))).Read(data)
+
+			var lastDone, lastTotal int64
+			hasher := &Hasher{
+				Params:     tc.params,
+				Workers:    tc.workers,
+				WindowSize: tc.windowSize,
+				Progress: func(done, total int64) {
+					assert.Greater(done, lastDone)
+					lastDone, lastTotal = done, total
+				},
+			}
+			dataSize := int64(tc.dataBlocks) * tc.params.DataBlockSize
+			root, err := hasher.RootHash(context.Background(), bytes.NewReader(data), 4096, dataSize)
+			require.NoError(err)
+			assert.Equal(naiveRootHash(t, tc.params, data[4096:]), root)
+			assert.Equal(dataSize, lastDone)
+			assert.Equal(dataSize, lastTotal)
+		})
+	}
+}
+
+// TestRootHashKnownVector checks the root hash that systemd-repart 252 (libcryptsetup) computed for a
+// 10 MiB data partition: 1 MiB of a pattern followed by zeros, hash_type 1, sha256, 512 byte blocks.
+func TestRootHashKnownVector(t *testing.T) {
+	require := require.New(t)
+
+	data := make([]byte, 10<<20)
+	for i := range data[:1<<20] {
+		data[i] = byte((i/512*7 + i%512) % 251)
+	}
+	salt, err := hex.DecodeString("ab5bf3a77b84c9f77514d2f0d07f441a45341c147dff663845961af449d93d2b")
+	require.NoError(err)
+	hasher := &Hasher{
+		Params:     Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512, Salt: salt},
+		Workers:    4,
+		WindowSize: 64 << 10,
+	}
+	root, err := hasher.RootHash(context.Background(), bytes.NewReader(data), 0, int64(len(data)))
+	require.NoError(err)
+	assert.Equal(t, "77125d77fc7687da91055a9186e521f77538ccdf0488ed4d6b3b6d2bb6ef6142", hex.EncodeToString(root))
+}
+
+func TestRootHashCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hasher := &Hasher{
+		Params: Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512},
+	}
+	_, err := hasher.RootHash(ctx, bytes.NewReader(make([]byte, 1<<20)), 0, 1<<20)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRootHashErrors(t *testing.T) {
+	data := bytes.NewReader(make([]byte, 8192))
+	testCases := map[string]struct {
+		params Params
+		size   int64
+	}{
+		"unknown algorithm": {
+			params: Params{HashType: 1, Algorithm: "md5", DataBlockSize: 512, HashBlockSize: 512},
+			size:   512,
+		},
+		"unaligned size": {
+			params: Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512},
+			size:   513,
+		},
+		"invalid block size": {
+			params: Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 1000, HashBlockSize: 512},
+			size:   1000,
+		},
+		"short read": {
+			params: Params{HashType: 1, Algorithm: "sha256", DataBlockSize: 512, HashBlockSize: 512},
+			size:   16384,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			hasher := &Hasher{Params: tc.params}
+			_, err := hasher.RootHash(context.Background(), data, 0, tc.size)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// naiveRootHash builds the complete tree level by level.
+func naiveRootHash(t *testing.T, params Params, data []byte) []byte {
+	hashFn, err := hashFunc(params.Algorithm)
+	require.NoError(t, err)
+	hasher := hashFn.New()
+	entrySize := params.entrySize(hashFn.Size())
+	perBlock := 1
+	for perBlock*2*entrySize <= int(params.HashBlockSize) {
+		perBlock *= 2
+	}
+
+	var digests [][]byte
+	for off := 0; off < len(data); off += int(params.DataBlockSize) {
+		digests = append(digests, params.sum(hasher, nil, data[off:off+int(params.DataBlockSize)]))
+	}
+	for len(digests) > 1 {
+		var next [][]byte
+		for start := 0; start < len(digests); start += perBlock {
+			block := make([]byte, params.HashBlockSize)
+			for i, digest := range digests[start:min(start+perBlock, len(digests))] {
+				copy(block[i*entrySize:], digest)
+			}
+			next = append(next, params.sum(hasher, nil, block))
+		}
+		digests = next
+	}
+	return digests[0]
+}
@@ -0,0 +1,90 @@
+package verity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/malt3/ddi-tool/pkg/pkcs7"
+)
+
+// Signature is the content of a root-verity-sig or usr-verity-sig partition.
+type Signature struct {
+	RootHash               string `json:"rootHash"`
+	CertificateFingerprint string `json:"certificateFingerprint,omitempty"`
+	// Signature is a detached PKCS #7 signature over the hex encoded root hash.
+	Signature []byte `json:"signature"`
+}
+
+// ReadSignature reads the NUL padded JSON object of a verity signature partition.
+func ReadSignature(r io.ReaderAt, offset, size int64) (*Signature, error) {
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("reading verity signature partition: %w", err)
+	}
+	buf = bytes.TrimRight(buf, "\x00")
+	if len(buf) == 0 {
+		return nil, errors.New("verity signature partition is empty")
+	}
+	var sig Signature
+	if err := json.Unmarshal(buf, &sig); err != nil {
+		return nil, fmt.Errorf("decoding verity signature: %w", err)
+	}
+	if _, err := hex.DecodeString(sig.RootHash); err != nil || len(sig.RootHash) == 0 {
+		return nil, fmt.Errorf("verity signature has invalid root hash %q", sig.RootHash)
+	}
+	return &sig, nil
+}
+
+// Sign creates the verity signature for a root hash.
+func Sign(rootHash []byte, cert *x509.Certificate, signer crypto.Signer) (*Signature, error) {
+	encodedRootHash := hex.EncodeToString(rootHash)
+	signature, err := pkcs7.SignDetached([]byte(encodedRootHash), cert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		RootHash:               encodedRootHash,
+		CertificateFingerprint: CertificateFingerprint(cert),
+		Signature:              signature,
+	}, nil
+}
+
+// MarshalPadded encodes the signature as JSON padded with NUL bytes to size.
+func (s *Signature) MarshalPadded(size int64) ([]byte, error) {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > size {
+		return nil, fmt.Errorf("verity signature needs %d bytes, but partition is only %d bytes", len(content), size)
+	}
+	padded := make([]byte, size)
+	copy(padded, content)
+	return padded, nil
+}
+
+// Verify checks the certificate fingerprint and the PKCS #7 signature over the root hash.
+func (s *Signature) Verify(cert *x509.Certificate) error {
+	if s.CertificateFingerprint != "" && !strings.EqualFold(s.CertificateFingerprint, CertificateFingerprint(cert)) {
+		return fmt.Errorf("certificate fingerprint %s does not match certificate %s", s.CertificateFingerprint, CertificateFingerprint(cert))
+	}
+	signedData, err := pkcs7.Parse(s.Signature)
+	if err != nil {
+		return fmt.Errorf("parsing signature: %w", err)
+	}
+	return signedData.VerifyDetached([]byte(strings.ToLower(s.RootHash)), cert)
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 digest of the DER encoded certificate.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,59 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "verity"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(err)
+
+	rootHash := bytes.Repeat([]byte{0x42}, 32)
+	sig, err := Sign(rootHash, cert, key)
+	require.NoError(err)
+
+	_, err = sig.MarshalPadded(64)
+	assert.Error(err)
+
+	partition, err := sig.MarshalPadded(16384)
+	require.NoError(err)
+	assert.Len(partition, 16384)
+	assert.Equal(byte(0), partition[len(partition)-1])
+
+	image := append(make([]byte, 512), partition...)
+	read, err := ReadSignature(bytes.NewReader(image), 512, int64(len(partition)))
+	require.NoError(err)
+	assert.Equal(sig.RootHash, read.RootHash)
+	assert.Equal(CertificateFingerprint(cert), read.CertificateFingerprint)
+	assert.NoError(read.Verify(cert))
+
+	read.RootHash = "00" + read.RootHash[2:]
+	assert.Error(read.Verify(cert))
+
+	_, err = ReadSignature(bytes.NewReader(make([]byte, 1024)), 0, 1024)
+	assert.Error(err)
+}
@@ -0,0 +1,78 @@
+package verity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	superblockSignature = "verity\x00\x00"
+	superblockSize      = 512
+	maxSaltSize         = 256
+)
+
+// Superblock is the on-disk header of a dm-verity hash partition as written by veritysetup and systemd-repart.
+type Superblock struct {
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     string
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	Salt          []byte
+}
+
+// ReadSuperblock reads the superblock at the given offset of r.
+func ReadSuperblock(r io.ReaderAt, offset int64) (*Superblock, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("reading verity superblock: %w", err)
+	}
+	if string(buf[0:8]) != superblockSignature {
+		return nil, errors.New("invalid verity superblock signature")
+	}
+	sb := &Superblock{
+		Version:       binary.LittleEndian.Uint32(buf[8:12]),
+		HashType:      binary.LittleEndian.Uint32(buf[12:16]),
+		Algorithm:     string(bytes.TrimRight(buf[32:64], "\x00")),
+		DataBlockSize: binary.LittleEndian.Uint32(buf[64:68]),
+		HashBlockSize: binary.LittleEndian.Uint32(buf[68:72]),
+		DataBlocks:    binary.LittleEndian.Uint64(buf[72:80]),
+	}
+	copy(sb.UUID[:], buf[16:32])
+	if sb.Version != 1 {
+		return nil, fmt.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	saltSize := int(binary.LittleEndian.Uint16(buf[80:82]))
+	if saltSize > maxSaltSize {
+		return nil, fmt.Errorf("invalid verity salt size %d", saltSize)
+	}
+	sb.Salt = append([]byte(nil), buf[88:88+saltSize]...)
+	return sb, nil
+}
+
+// Params returns the hash tree parameters described by the superblock.
+func (s *Superblock) Params() Params {
+	return Params{
+		HashType:      s.HashType,
+		Algorithm:     s.Algorithm,
+		DataBlockSize: int64(s.DataBlockSize),
+		HashBlockSize: int64(s.HashBlockSize),
+		Salt:          s.Salt,
+	}
+}
+
+// DataSize is the number of bytes of the data device covered by the hash tree.
+func (s *Superblock) DataSize() int64 {
+	return int64(s.DataBlocks) * int64(s.DataBlockSize)
+}
+
+// UUIDString returns the UUID of the superblock in its canonical form.
+func (s *Superblock) UUIDString() string {
+	u := s.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,61 @@
+package verity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSuperblock(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	salt := bytes.Repeat([]byte{0x5a}, 32)
+	raw := testSuperblock(512, 512, 20480, salt)
+	sb, err := ReadSuperblock(bytes.NewReader(append(make([]byte, 1024), raw...)), 1024)
+	require.NoError(err)
+	assert.Equal(uint32(1), sb.Version)
+	assert.Equal(uint32(1), sb.HashType)
+	assert.Equal("sha256", sb.Algorithm)
+	assert.Equal(uint32(512), sb.DataBlockSize)
+	assert.Equal(uint32(512), sb.HashBlockSize)
+	assert.Equal(uint64(20480), sb.DataBlocks)
+	assert.Equal(salt, sb.Salt)
+	assert.Equal("c043a8be-3b61-46e1-9e40-979d4d7831e4", sb.UUIDString())
+	assert.Equal(int64(10485760), sb.DataSize())
+	assert.Equal(int64(512), sb.HashAreaOffset())
+
+	// 20480 data blocks with 16 hashes per block need 1280 + 80 + 5 + 1 hash blocks
+	treeSize, err := sb.TreeSize()
+	require.NoError(err)
+	assert.Equal(int64(512+1366*512), treeSize)
+
+	sb, err = ReadSuperblock(bytes.NewReader(testSuperblock(4096, 4096, 1000, nil)), 0)
+	require.NoError(err)
+	assert.Equal(int64(4096), sb.HashAreaOffset())
+	treeSize, err = sb.TreeSize()
+	require.NoError(err)
+	assert.Equal(int64(4096+8*4096+4096), treeSize)
+
+	raw[0] = 'V'
+	_, err = ReadSuperblock(bytes.NewReader(raw), 0)
+	assert.Error(err)
+}
+
+func testSuperblock(dataBlockSize, hashBlockSize uint32, dataBlocks uint64, salt []byte) []byte {
+	raw := make([]byte, superblockSize)
+	copy(raw, superblockSignature)
+	binary.LittleEndian.PutUint32(raw[8:12], 1)
+	binary.LittleEndian.PutUint32(raw[12:16], 1)
+	copy(raw[16:32], []byte{0xc0, 0x43, 0xa8, 0xbe, 0x3b, 0x61, 0x46, 0xe1, 0x9e, 0x40, 0x97, 0x9d, 0x4d, 0x78, 0x31, 0xe4})
+	copy(raw[32:64], "sha256")
+	binary.LittleEndian.PutUint32(raw[64:68], dataBlockSize)
+	binary.LittleEndian.PutUint32(raw[68:72], hashBlockSize)
+	binary.LittleEndian.PutUint64(raw[72:80], dataBlocks)
+	binary.LittleEndian.PutUint16(raw[80:82], uint16(len(salt)))
+	copy(raw[88:], salt)
+	return raw
+}
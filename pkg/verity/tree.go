@@ -0,0 +1,69 @@
+package verity
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// HashAreaOffset is the offset of the hash tree relative to the start of the hash partition.
+func (s *Superblock) HashAreaOffset() int64 {
+	hashBlockSize := int64(s.HashBlockSize)
+	return (superblockSize + hashBlockSize - 1) / hashBlockSize * hashBlockSize
+}
+
+// StoredRootHash computes the root hash from the top level block of the hash tree
+// stored in the hash partition at offset. The data itself is not read, so this only
+// tells which root hash the stored tree belongs to.
+func StoredRootHash(r io.ReaderAt, offset int64, sb *Superblock) ([]byte, error) {
+	params := sb.Params()
+	hashFn, err := hashFunc(params.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := params.validate(hashFn.Size()); err != nil {
+		return nil, err
+	}
+	if treeLevels(params, hashFn.Size(), int64(sb.DataBlocks)) == 0 {
+		return nil, errors.New("hash tree of a single data block has no hash blocks")
+	}
+	top := make([]byte, params.HashBlockSize)
+	if _, err := r.ReadAt(top, offset+sb.HashAreaOffset()); err != nil {
+		return nil, fmt.Errorf("reading top level hash block: %w", err)
+	}
+	return params.sum(hashFn.New(), nil, top), nil
+}
+
+// treeLevels returns the number of hash block levels needed for dataBlocks.
+func treeLevels(params Params, digestSize int, dataBlocks int64) int {
+	perBlockBits := perBlockBits(params, digestSize)
+	levels := 0
+	for perBlockBits*levels < 64 && uint64(dataBlocks-1)>>(perBlockBits*levels) != 0 {
+		levels++
+	}
+	return levels
+}
+
+func perBlockBits(params Params, digestSize int) int {
+	return bits.Len64(uint64(params.HashBlockSize)/uint64(params.entrySize(digestSize))) - 1
+}
+
+// TreeSize returns the number of bytes the superblock and the hash tree occupy in the hash partition.
+func (s *Superblock) TreeSize() (int64, error) {
+	params := s.Params()
+	hashFn, err := hashFunc(params.Algorithm)
+	if err != nil {
+		return 0, err
+	}
+	if err := params.validate(hashFn.Size()); err != nil {
+		return 0, err
+	}
+	perBlockBits := perBlockBits(params, hashFn.Size())
+	var hashBlocks int64
+	for level := 0; level < treeLevels(params, hashFn.Size(), int64(s.DataBlocks)); level++ {
+		shift := uint((level + 1) * perBlockBits)
+		hashBlocks += int64((s.DataBlocks + (1 << shift) - 1) >> shift)
+	}
+	return s.HashAreaOffset() + hashBlocks*params.HashBlockSize, nil
+}